@@ -0,0 +1,449 @@
+package acme
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LetsEncrypt is the production directory of Let's Encrypt
+const LetsEncrypt = "https://acme-v02.api.letsencrypt.org/directory"
+
+// RenewBefore is how long before expiry a certificate is replaced
+const RenewBefore = 30 * 24 * time.Hour
+
+// CheckInterval is how often the certificate's expiry is checked
+const CheckInterval = 12 * time.Hour
+
+// Manager obtains and renews a certificate for its hosts (RFC 8555, answering http-01 challenges)
+type Manager struct {
+	Hosts     []string
+	CacheDir  string
+	Directory string
+	Email     string
+	Logger    chan string
+	lock      sync.Mutex
+	cert      *tls.Certificate
+	tokens    map[string]string
+	client    http.Client
+	key       *ecdsa.PrivateKey
+	kid       string
+	nonce     string
+	endpoints struct {
+		NewNonce   string `json:"newNonce"`
+		NewAccount string `json:"newAccount"`
+		NewOrder   string `json:"newOrder"`
+	}
+}
+
+// Send a line to the logger (if there is one)
+func (ctx *Manager) log(line string) {
+	if ctx.Logger != nil {
+		ctx.Logger <- line
+	}
+}
+
+// Start loads the cached certificate (obtaining one if needed) and keeps it renewed
+func (ctx *Manager) Start() error {
+	if len(ctx.Hosts) == 0 {
+		return errors.New("no hosts to obtain a certificate for")
+	}
+	if len(ctx.Directory) == 0 {
+		ctx.Directory = LetsEncrypt
+	}
+	ctx.client.Timeout = time.Minute
+	err := os.MkdirAll(ctx.CacheDir, 0700)
+	if err != nil {
+		return err
+	}
+	ctx.loadCertificate()
+	if ctx.renewalDue() {
+		err = ctx.obtain()
+		if err != nil {
+			return err
+		}
+	}
+	go func() {
+		for {
+			time.Sleep(CheckInterval)
+			if !ctx.renewalDue() {
+				continue
+			}
+			err := ctx.obtain()
+			if err != nil {
+				ctx.log(fmt.Sprintf(" [!] Certificate renewal failed: %s\n", err.Error()))
+			}
+		}
+	}()
+	return nil
+}
+
+// GetCertificate for tls.Config, returning the current certificate
+func (ctx *Manager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	if ctx.cert == nil {
+		return nil, errors.New("no certificate available")
+	}
+	return ctx.cert, nil
+}
+
+// ServeHTTP answers http-01 challenges (everything else is not found)
+func (ctx *Manager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.URL.Path, "/.well-known/acme-challenge/")
+	ctx.lock.Lock()
+	answer, ok := ctx.tokens[token]
+	ctx.lock.Unlock()
+	if !ok || token == r.URL.Path {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(answer))
+}
+
+// Whether the certificate is missing, for other hosts, or close to expiring
+func (ctx *Manager) renewalDue() bool {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	if ctx.cert == nil || ctx.cert.Leaf == nil {
+		return true
+	}
+	for _, host := range ctx.Hosts {
+		if ctx.cert.Leaf.VerifyHostname(host) != nil {
+			return true
+		}
+	}
+	return time.Until(ctx.cert.Leaf.NotAfter) < RenewBefore
+}
+
+// Load the certificate from the cache directory (missing files are not an error)
+func (ctx *Manager) loadCertificate() {
+	cert, err := tls.LoadX509KeyPair(filepath.Join(ctx.CacheDir, "cert.pem"), filepath.Join(ctx.CacheDir, "key.pem"))
+	if err != nil {
+		return
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return
+	}
+	ctx.lock.Lock()
+	ctx.cert = &cert
+	ctx.lock.Unlock()
+}
+
+// Load the account key from the cache directory, creating it the first time
+func (ctx *Manager) accountKey() error {
+	file := filepath.Join(ctx.CacheDir, "account.pem")
+	data, err := os.ReadFile(file)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return fmt.Errorf("invalid account key: %s", file)
+		}
+		ctx.key, err = x509.ParseECPrivateKey(block.Bytes)
+		return err
+	}
+	ctx.key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	der, err := x509.MarshalECPrivateKey(ctx.key)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+}
+
+// Base64url without padding, as JWS requires
+func encode(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// JSON web key of the account (members in the order the thumbprint requires)
+func (ctx *Manager) jwk() string {
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	ctx.key.X.FillBytes(x)
+	ctx.key.Y.FillBytes(y)
+	return fmt.Sprintf(`{"crv":"P-256","kty":"EC","x":"%s","y":"%s"}`, encode(x), encode(y))
+}
+
+// Key authorization for a challenge token (RFC 8555 section 8.1)
+func (ctx *Manager) keyAuthorization(token string) string {
+	thumbprint := sha256.Sum256([]byte(ctx.jwk()))
+	return token + "." + encode(thumbprint[:])
+}
+
+// POST a JWS signed request (a nil payload is a POST-as-GET), retrying once on a bad nonce
+func (ctx *Manager) post(url string, payload interface{}) (*http.Response, []byte, error) {
+	for attempt := 0; ; attempt++ {
+		if len(ctx.nonce) == 0 {
+			resp, err := ctx.client.Head(ctx.endpoints.NewNonce)
+			if err != nil {
+				return nil, nil, err
+			}
+			resp.Body.Close()
+			ctx.nonce = resp.Header.Get("Replay-Nonce")
+		}
+		protected := fmt.Sprintf(`{"alg":"ES256","nonce":"%s","url":"%s",`, ctx.nonce, url)
+		if len(ctx.kid) > 0 {
+			protected += fmt.Sprintf(`"kid":"%s"}`, ctx.kid)
+		} else {
+			protected += `"jwk":` + ctx.jwk() + `}`
+		}
+		body := ""
+		if payload != nil {
+			data, err := json.Marshal(payload)
+			if err != nil {
+				return nil, nil, err
+			}
+			body = encode(data)
+		}
+		signed := encode([]byte(protected)) + "." + body
+		digest := sha256.Sum256([]byte(signed))
+		r, s, err := ecdsa.Sign(rand.Reader, ctx.key, digest[:])
+		if err != nil {
+			return nil, nil, err
+		}
+		signature := make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+		request, _ := json.Marshal(map[string]string{"protected": encode([]byte(protected)), "payload": body, "signature": encode(signature)})
+		resp, err := ctx.client.Post(url, "application/jose+json", bytes.NewReader(request))
+		if err != nil {
+			return nil, nil, err
+		}
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		ctx.nonce = resp.Header.Get("Replay-Nonce")
+		if err != nil {
+			return nil, nil, err
+		}
+		if resp.StatusCode >= 400 {
+			if attempt == 0 && bytes.Contains(data, []byte("urn:ietf:params:acme:error:badNonce")) {
+				continue
+			}
+			return resp, data, fmt.Errorf("%s: status %d (%s)", url, resp.StatusCode, strings.TrimSpace(string(data)))
+		}
+		return resp, data, nil
+	}
+}
+
+// Order status and its links
+type order struct {
+	Status         string   `json:"status"`
+	Authorizations []string `json:"authorizations"`
+	Finalize       string   `json:"finalize"`
+	Certificate    string   `json:"certificate"`
+}
+
+// Authorization of one identifier
+type authorization struct {
+	Status     string `json:"status"`
+	Identifier struct {
+		Value string `json:"value"`
+	} `json:"identifier"`
+	Challenges []struct {
+		Type  string `json:"type"`
+		URL   string `json:"url"`
+		Token string `json:"token"`
+	} `json:"challenges"`
+}
+
+// POST-as-GET a resource until its status is no longer pending or processing
+func (ctx *Manager) poll(url string, status interface{ current() string }) error {
+	deadline := time.Now().Add(2 * time.Minute)
+	for {
+		_, data, err := ctx.post(url, nil)
+		if err != nil {
+			return err
+		}
+		err = json.Unmarshal(data, status)
+		if err != nil {
+			return err
+		}
+		if current := status.current(); current != "pending" && current != "processing" {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for: %s", url)
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+func (status *order) current() string {
+	return status.Status
+}
+
+func (status *authorization) current() string {
+	return status.Status
+}
+
+// Obtain a new certificate for the hosts and store it in the cache directory
+func (ctx *Manager) obtain() error {
+	ctx.log(fmt.Sprintf(" [*] Obtaining a certificate for: %s\n", strings.Join(ctx.Hosts, ", ")))
+	if ctx.key == nil {
+		err := ctx.accountKey()
+		if err != nil {
+			return err
+		}
+	}
+	resp, err := ctx.client.Get(ctx.Directory)
+	if err != nil {
+		return err
+	}
+	err = json.NewDecoder(resp.Body).Decode(&ctx.endpoints)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	// Register (or find) the account
+	if len(ctx.kid) == 0 {
+		account := map[string]interface{}{"termsOfServiceAgreed": true}
+		if len(ctx.Email) > 0 {
+			account["contact"] = []string{"mailto:" + ctx.Email}
+		}
+		resp, _, err = ctx.post(ctx.endpoints.NewAccount, account)
+		if err != nil {
+			return err
+		}
+		ctx.kid = resp.Header.Get("Location")
+	}
+
+	// Order a certificate for every host
+	var identifiers []map[string]string
+	for _, host := range ctx.Hosts {
+		identifiers = append(identifiers, map[string]string{"type": "dns", "value": host})
+	}
+	resp, data, err := ctx.post(ctx.endpoints.NewOrder, map[string]interface{}{"identifiers": identifiers})
+	if err != nil {
+		return err
+	}
+	orderURL := resp.Header.Get("Location")
+	var status order
+	err = json.Unmarshal(data, &status)
+	if err != nil {
+		return err
+	}
+
+	// Answer a http-01 challenge for each identifier not yet authorized
+	for _, url := range status.Authorizations {
+		var authz authorization
+		_, data, err = ctx.post(url, nil)
+		if err == nil {
+			err = json.Unmarshal(data, &authz)
+		}
+		if err != nil {
+			return err
+		}
+		if authz.Status == "valid" {
+			continue
+		}
+		challenge := -1
+		for i := range authz.Challenges {
+			if authz.Challenges[i].Type == "http-01" {
+				challenge = i
+			}
+		}
+		if challenge < 0 {
+			return fmt.Errorf("no http-01 challenge offered for: %s", authz.Identifier.Value)
+		}
+		token := authz.Challenges[challenge].Token
+		ctx.lock.Lock()
+		if ctx.tokens == nil {
+			ctx.tokens = make(map[string]string)
+		}
+		ctx.tokens[token] = ctx.keyAuthorization(token)
+		ctx.lock.Unlock()
+		_, _, err = ctx.post(authz.Challenges[challenge].URL, struct{}{})
+		if err == nil {
+			err = ctx.poll(url, &authz)
+		}
+		ctx.lock.Lock()
+		delete(ctx.tokens, token)
+		ctx.lock.Unlock()
+		if err != nil {
+			return err
+		}
+		if authz.Status != "valid" {
+			return fmt.Errorf("authorization %s for: %s", authz.Status, authz.Identifier.Value)
+		}
+	}
+
+	// Finalize with a request for a new key
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: ctx.Hosts[0]}, DNSNames: ctx.Hosts}, key)
+	if err != nil {
+		return err
+	}
+	_, data, err = ctx.post(status.Finalize, map[string]string{"csr": encode(csr)})
+	if err == nil {
+		err = json.Unmarshal(data, &status)
+	}
+	if err == nil && status.Status != "valid" {
+		err = ctx.poll(orderURL, &status)
+	}
+	if err != nil {
+		return err
+	}
+	if status.Status != "valid" {
+		return fmt.Errorf("order %s for: %s", status.Status, strings.Join(ctx.Hosts, ", "))
+	}
+	_, chain, err := ctx.post(status.Certificate, nil)
+	if err != nil {
+		return err
+	}
+	return ctx.store(chain, key)
+}
+
+// Save a certificate chain and its key, then start using them
+func (ctx *Manager) store(chain []byte, key *ecdsa.PrivateKey) error {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	cert, err := tls.X509KeyPair(chain, keyPEM)
+	if err != nil {
+		return err
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(filepath.Join(ctx.CacheDir, "key.pem"), keyPEM, 0600)
+	if err == nil {
+		err = os.WriteFile(filepath.Join(ctx.CacheDir, "cert.pem"), chain, 0600)
+	}
+	if err != nil {
+		return err
+	}
+	ctx.lock.Lock()
+	ctx.cert = &cert
+	ctx.lock.Unlock()
+	ctx.log(fmt.Sprintf(" [+] Obtained a certificate for %s (expires %s)\n", strings.Join(ctx.Hosts, ", "), cert.Leaf.NotAfter.Format(time.RFC3339)))
+	return nil
+}
@@ -0,0 +1,220 @@
+package api
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"proxy/socks5"
+	"time"
+)
+
+// KillReport returned after closing sessions
+type KillReport struct {
+	Killed   int                  `json:"killed"`
+	Sessions []socks5.SessionInfo `json:"sessions"`
+}
+
+// PoolEntry describing an outbound proxy (without its password)
+type PoolEntry struct {
+	Listener string             `json:"listener,omitempty"`
+	Tenant   string             `json:"tenant,omitempty"`
+	Type     string             `json:"type,omitempty"`
+	Host     string             `json:"host"`
+	Port     int                `json:"port"`
+	UseTLS   bool               `json:"usetls"`
+	Username string             `json:"username,omitempty"`
+	Country  string             `json:"country,omitempty"`
+	Tag      string             `json:"tag,omitempty"`
+	Status   socks5.ProxyStatus `json:"status"`
+}
+
+// Wrap a handler so it requires the admin token
+func (ctx *Server) admin(handler http.HandlerFunc) http.HandlerFunc {
+	return ctx.authorize(handler, false)
+}
+
+// Wrap a handler so observers may use it too, though only to read
+func (ctx *Server) observe(handler http.HandlerFunc) http.HandlerFunc {
+	return ctx.authorize(handler, true)
+}
+
+// Check the bearer token, letting the observer token through only to read from handlers that allow it
+func (ctx *Server) authorize(handler http.HandlerFunc, observers bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(ctx.Token) == 0 && len(ctx.ObserverToken) == 0 {
+			http.Error(w, "admin API disabled", http.StatusForbidden)
+			return
+		}
+		header := []byte(r.Header.Get("Authorization"))
+		if len(ctx.Token) > 0 && subtle.ConstantTimeCompare(header, []byte("Bearer "+ctx.Token)) == 1 {
+			handler(w, r)
+			return
+		}
+		if len(ctx.ObserverToken) > 0 && subtle.ConstantTimeCompare(header, []byte("Bearer "+ctx.ObserverToken)) == 1 {
+			// Observers can never change state or close sessions, whatever the handler would do
+			if !observers || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+				http.Error(w, "read-only observer", http.StatusForbidden)
+				return
+			}
+			handler(w, r)
+			return
+		}
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	}
+}
+
+// Listeners selected by the tenant parameter (all of them without it)
+func (ctx *Server) selected(r *http.Request) []*socks5.Context {
+	tenant := r.URL.Query().Get("tenant")
+	if len(tenant) == 0 {
+		return ctx.Contexts
+	}
+	var contexts []*socks5.Context
+	for _, server := range ctx.Contexts {
+		if server.TenantName() == tenant {
+			contexts = append(contexts, server)
+		}
+	}
+	return contexts
+}
+
+// Build a session query from the request parameters
+func parseQuery(r *http.Request) (socks5.SessionQuery, error) {
+	values := r.URL.Query()
+	query := socks5.SessionQuery{
+		Client:      values.Get("client"),
+		Destination: values.Get("destination"),
+		Upstream:    values.Get("upstream"),
+	}
+	if len(values.Get("minage")) > 0 {
+		age, err := time.ParseDuration(values.Get("minage"))
+		if err != nil {
+			return query, fmt.Errorf("invalid minage: %s", values.Get("minage"))
+		}
+		query.MinAge = age
+	}
+	return query, nil
+}
+
+// List active sessions matching the query
+func (ctx *Server) handleSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query, err := parseQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sessions := []socks5.SessionInfo{}
+	for _, server := range ctx.selected(r) {
+		for _, client := range server.FindSessions(query) {
+			sessions = append(sessions, client.Info())
+		}
+	}
+	writeJSON(w, sessions)
+}
+
+// Close all active sessions matching the query
+func (ctx *Server) handleKill(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query, err := parseQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	report := KillReport{Sessions: []socks5.SessionInfo{}}
+	for _, server := range ctx.selected(r) {
+		for _, client := range server.FindSessions(query) {
+			report.Sessions = append(report.Sessions, client.Info())
+			client.Close()
+			report.Killed++
+		}
+	}
+	if report.Killed > 0 {
+		ctx.log(fmt.Sprintf(" [*] Admin closed %d sessions (%s)\n", report.Killed, r.URL.RawQuery))
+	}
+	writeJSON(w, report)
+}
+
+// Report error counts per class
+func (ctx *Server) handleErrors(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	counts := make(map[string]uint64)
+	for _, server := range ctx.selected(r) {
+		for class, count := range server.ErrorCounts() {
+			counts[class] += count
+		}
+	}
+	writeJSON(w, counts)
+}
+
+// List the outbound proxies and their status
+func (ctx *Server) handlePool(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	entries := []PoolEntry{}
+	for _, server := range ctx.selected(r) {
+		for _, proxy := range server.Proxies.List() {
+			entries = append(entries, PoolEntry{
+				Listener: server.Name,
+				Tenant:   server.TenantName(),
+				Type:     proxy.Type,
+				Host:     proxy.Host,
+				Port:     proxy.Port,
+				UseTLS:   proxy.UseTLS,
+				Country:  proxy.Country,
+				Tag:      proxy.Tag,
+				Username: proxy.Username,
+				Status:   server.Proxies.Status(proxy),
+			})
+		}
+	}
+	writeJSON(w, entries)
+}
+
+// Trace the negotiation of the next connection from a client IP
+func (ctx *Server) handleTrace(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	client := net.ParseIP(r.URL.Query().Get("client"))
+	if client == nil {
+		http.Error(w, "invalid client", http.StatusBadRequest)
+		return
+	}
+	for _, server := range ctx.selected(r) {
+		server.TraceNext(client.String())
+	}
+	ctx.log(fmt.Sprintf(" [*] Admin armed a trace for the next connection from: %s\n", client.String()))
+	writeJSON(w, map[string]string{"client": client.String()})
+}
+
+// List the tenants with their labels and use of their limits
+func (ctx *Server) handleTenants(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	tenants := []socks5.TenantStatus{}
+	seen := make(map[*socks5.Tenant]bool)
+	for _, server := range ctx.Contexts {
+		if server.Tenant == nil || seen[server.Tenant] {
+			continue
+		}
+		seen[server.Tenant] = true
+		tenants = append(tenants, server.Tenant.Status())
+	}
+	writeJSON(w, tenants)
+}
@@ -0,0 +1,248 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"proxy/failover"
+	"proxy/socks5"
+	"sync"
+	"time"
+)
+
+// Server for the HTTP API
+type Server struct {
+	Contexts         []*socks5.Context
+	ListenAddress    string
+	Token            string
+	ObserverToken    string
+	Journal          string
+	Metrics          http.Handler
+	UpdateBlacklists func() UpdateReport
+	Failover         *failover.Pair
+	Events           *EventStream
+	journalLock      sync.Mutex
+	mux              *http.ServeMux
+}
+
+// UsageReport returned by the self-service endpoint
+type UsageReport struct {
+	User     string               `json:"user"`
+	Usage    socks5.Usage         `json:"usage"`
+	Sessions []socks5.SessionInfo `json:"sessions"`
+}
+
+// Listen for API requests
+func (ctx *Server) Listen() error {
+	ctx.mux = http.NewServeMux()
+	ctx.mux.HandleFunc("/usage", ctx.handleUsage)
+	ctx.mux.HandleFunc("/preference", ctx.handlePreference)
+	ctx.mux.HandleFunc("/token", ctx.handleToken)
+	ctx.mux.HandleFunc("/admin/sessions", ctx.observe(ctx.handleSessions))
+	ctx.mux.HandleFunc("/admin/sessions/kill", ctx.admin(ctx.handleKill))
+	ctx.mux.HandleFunc("/admin/errors", ctx.observe(ctx.handleErrors))
+	ctx.mux.HandleFunc("/admin/resources", ctx.observe(ctx.handleResources))
+	ctx.mux.HandleFunc("/admin/pool", ctx.observe(ctx.handlePool))
+	ctx.mux.HandleFunc("/admin/pool/proxies", ctx.admin(ctx.handlePoolProxies))
+	ctx.mux.HandleFunc("/admin/trace", ctx.admin(ctx.handleTrace))
+	ctx.mux.HandleFunc("/admin/tunables", ctx.observe(ctx.handleTunables))
+	ctx.mux.HandleFunc("/admin/tenants", ctx.observe(ctx.handleTenants))
+	ctx.mux.HandleFunc("/admin/filter", ctx.observe(ctx.handleFilter))
+	ctx.mux.HandleFunc("/admin/filter/import", ctx.admin(ctx.handleFilterImport))
+	ctx.mux.HandleFunc("/admin/blacklist/update", ctx.admin(ctx.handleBlacklistUpdate))
+	ctx.mux.HandleFunc("/admin/blacklist/rollback", ctx.admin(ctx.handleBlacklistRollback))
+	if ctx.Events != nil {
+		ctx.mux.HandleFunc("/admin/events", ctx.observe(ctx.handleEvents))
+	}
+	if ctx.Failover != nil {
+		ctx.mux.HandleFunc("/admin/failover", ctx.observe(ctx.handleFailover))
+		ctx.mux.HandleFunc("/admin/failover/blacklist", ctx.observe(ctx.handleFailoverBlacklist))
+	}
+	if ctx.Metrics != nil {
+		ctx.mux.HandleFunc("/metrics", ctx.observe(ctx.Metrics.ServeHTTP))
+	}
+	listener, err := net.Listen("tcp", ctx.ListenAddress)
+	if err != nil {
+		return err
+	}
+	ctx.log(fmt.Sprintf(" [*] API bound to: %s\n", ctx.ListenAddress))
+	return http.Serve(listener, ctx.mux)
+}
+
+// Send a line to the shared logger
+func (ctx *Server) log(line string) {
+	if len(ctx.Contexts) > 0 && ctx.Contexts[0].Logger != nil {
+		ctx.Contexts[0].Logger <- line
+	}
+}
+
+// Determine which user is making a request and the listeners they may see (by their proxy credentials, or their address without them)
+func (ctx *Server) identify(r *http.Request) (string, []*socks5.Context, bool) {
+	if username, password, ok := r.BasicAuth(); ok {
+		// Only listeners accepting the credentials, so tenants never see each other's users
+		var contexts []*socks5.Context
+		for _, server := range ctx.Contexts {
+			if server.Credentials.Check(username, password) {
+				contexts = append(contexts, server)
+			}
+		}
+		return username, contexts, len(contexts) > 0
+	}
+	for _, server := range ctx.Contexts {
+		if server.Credentials.Required() || server.GSSAPI != nil {
+			// Usage is tracked by username, so an address says nothing
+			return "", nil, false
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return "", nil, false
+	}
+	return host, ctx.Contexts, true
+}
+
+// Write a value as a JSON response
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	data, err := json.MarshalIndent(value, "", " ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// Self-service endpoint returning the caller's own usage and active sessions
+func (ctx *Server) handleUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, contexts, ok := ctx.identify(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="proxy"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	report := UsageReport{User: user, Sessions: []socks5.SessionInfo{}}
+	for _, server := range contexts {
+		usage, sessions := server.UserUsage(user)
+		report.Usage.Connections += usage.Connections
+		report.Usage.Sent += usage.Sent
+		report.Usage.Received += usage.Received
+		report.Sessions = append(report.Sessions, sessions...)
+	}
+	writeJSON(w, report)
+}
+
+// PreferenceReport returned by the self-service preference endpoint
+type PreferenceReport struct {
+	User string `json:"user"`
+	Exit string `json:"exit"`
+}
+
+// Show (GET) or change (POST with exit, empty to clear) the caller's preferred exit country or tag
+func (ctx *Server) handlePreference(w http.ResponseWriter, r *http.Request) {
+	user, contexts, ok := ctx.identify(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="proxy"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		exit := r.URL.Query().Get("exit")
+		if len(exit) > 64 {
+			http.Error(w, "exit too long", http.StatusBadRequest)
+			return
+		}
+		for _, server := range contexts {
+			server.SetExitPreference(user, exit)
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	report := PreferenceReport{User: user}
+	if len(contexts) > 0 {
+		report.Exit = contexts[0].ExitPreference(user)
+	}
+	writeJSON(w, report)
+}
+
+// TokenReport returned when a session token is issued
+type TokenReport struct {
+	User    string    `json:"user"`
+	Token   string    `json:"token,omitempty"`
+	Expires time.Time `json:"expires,omitzero"`
+	Revoked int       `json:"revoked,omitempty"`
+}
+
+// Issue (POST) a short-lived token the caller can use as their proxy password, or revoke (DELETE) their tokens
+func (ctx *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+	user, contexts, ok := ctx.identify(r)
+	if _, _, basic := r.BasicAuth(); !ok || !basic {
+		// Tokens stand in for a password, so only a password gets one
+		w.Header().Set("WWW-Authenticate", `Basic realm="proxy"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	report := TokenReport{User: user}
+	switch r.Method {
+	case http.MethodPost:
+		token, err := socks5.NewSessionToken()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, server := range contexts {
+			if expires, accepted := server.AcceptToken(user, token); accepted {
+				report.Token = token
+				if report.Expires.IsZero() || expires.Before(report.Expires) {
+					report.Expires = expires
+				}
+			}
+		}
+		if len(report.Token) == 0 {
+			http.Error(w, "session tokens disabled", http.StatusNotFound)
+			return
+		}
+		ctx.log(fmt.Sprintf(" [+] Issued a session token to %s (expires %s)\n", user, report.Expires.Format(time.RFC3339)))
+	case http.MethodDelete:
+		for _, server := range contexts {
+			report.Revoked += server.RevokeTokens(user)
+		}
+		ctx.log(fmt.Sprintf(" [-] Revoked %d session tokens of %s\n", report.Revoked, user))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, report)
+}
+
+// State of this instance for its failover peer
+func (ctx *Server) handleFailover(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, ctx.Failover.State())
+}
+
+// List a listener's blacklist entries, for the failover peer to take over
+func (ctx *Server) handleFailoverBlacklist(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	listener := r.URL.Query().Get("listener")
+	for _, server := range ctx.Contexts {
+		if server.ListenAddress == listener {
+			writeJSON(w, server.FilterEntries())
+			return
+		}
+	}
+	http.Error(w, "unknown listener", http.StatusNotFound)
+}
@@ -0,0 +1,83 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// SourceSummary of downloading one blacklist source
+type SourceSummary struct {
+	Source string `json:"source"`
+	Count  int    `json:"count"`
+	Error  string `json:"error,omitempty"`
+}
+
+// UpdateReport returned after refreshing the blacklist sources
+type UpdateReport struct {
+	Sources  []SourceSummary `json:"sources"`
+	Duration string          `json:"duration"`
+	Errors   int             `json:"errors"`
+}
+
+// Refresh every configured blacklist source now (POST), instead of waiting for its schedule
+func (ctx *Server) handleBlacklistUpdate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if ctx.UpdateBlacklists == nil {
+		http.Error(w, "no blacklist sources", http.StatusNotFound)
+		return
+	}
+	report := ctx.UpdateBlacklists()
+	ctx.journal(JournalEntry{Time: time.Now(), Source: r.RemoteAddr, Name: "blacklist_update", New: fmt.Sprintf("%d sources, %d errors", len(report.Sources), report.Errors)})
+	writeJSON(w, report)
+}
+
+// RollbackSummary of restoring one listener's blacklist from its newest backup
+type RollbackSummary struct {
+	Listener string `json:"listener"`
+	File     string `json:"file"`
+	Backup   string `json:"backup,omitempty"`
+	Count    int    `json:"count"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Restore the blacklists (POST, optionally only a listener's) from their newest backups and reload them
+func (ctx *Server) handleBlacklistRollback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	listener := r.URL.Query().Get("listener")
+	summaries := []RollbackSummary{}
+	// Listeners can share a file, which must only go back one step
+	restored := make(map[string]string)
+	for _, server := range ctx.selected(r) {
+		if len(listener) > 0 && listener != server.Name {
+			continue
+		}
+		summary := RollbackSummary{Listener: server.Name, File: server.FilterFile()}
+		if backup, ok := restored[summary.File]; ok && len(summary.File) > 0 {
+			summary.Backup = backup
+			summary.Count = server.ReloadFilter()
+		} else {
+			var err error
+			summary.Backup, summary.Count, err = server.RollbackFilter()
+			if err != nil {
+				summary.Error = err.Error()
+			} else {
+				restored[summary.File] = summary.Backup
+				ctx.journal(JournalEntry{Time: time.Now(), Source: r.RemoteAddr, Listener: server.Name, Name: "blacklist_rollback", New: fmt.Sprintf("%s (%d entries)", summary.Backup, summary.Count)})
+				ctx.log(fmt.Sprintf(" [*] Admin rolled back blacklist %s to %s (%d entries)\n", summary.File, summary.Backup, summary.Count))
+			}
+		}
+		summaries = append(summaries, summary)
+	}
+	if len(summaries) == 0 {
+		http.Error(w, "unknown listener", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, summaries)
+}
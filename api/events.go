@@ -0,0 +1,92 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"proxy/socks5"
+	"sync"
+)
+
+// EventBuffer is how many events a slow stream client may fall behind before events are dropped for it
+const EventBuffer = 256
+
+// EventStream passes session events on to clients of the event stream
+type EventStream struct {
+	lock        sync.Mutex
+	subscribers map[chan socks5.Event]bool
+}
+
+// HandleEvent sends an event to every subscriber without waiting for any of them
+func (ctx *EventStream) HandleEvent(event socks5.Event) {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	for subscriber := range ctx.subscribers {
+		select {
+		case subscriber <- event:
+		default:
+			// The client isn't keeping up, it misses this one
+		}
+	}
+}
+
+// Start receiving events
+func (ctx *EventStream) subscribe() chan socks5.Event {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	if ctx.subscribers == nil {
+		ctx.subscribers = make(map[chan socks5.Event]bool)
+	}
+	subscriber := make(chan socks5.Event, EventBuffer)
+	ctx.subscribers[subscriber] = true
+	return subscriber
+}
+
+// Stop receiving events
+func (ctx *EventStream) unsubscribe(subscriber chan socks5.Event) {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	delete(ctx.subscribers, subscriber)
+}
+
+// Stream session events as they happen (server-sent events, optionally only of one type)
+func (ctx *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	eventType := r.URL.Query().Get("type")
+	subscriber := ctx.Events.subscribe()
+	defer ctx.Events.unsubscribe(subscriber)
+	ctx.log(fmt.Sprintf(" [*] Event stream attached: %s\n", r.RemoteAddr))
+	defer ctx.log(fmt.Sprintf(" [*] Event stream detached: %s\n", r.RemoteAddr))
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event := <-subscriber:
+			if len(eventType) > 0 && event.Type != eventType {
+				continue
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
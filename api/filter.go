@@ -0,0 +1,236 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"proxy/filter"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FilterEntry describing a blacklist entry of a listener
+type FilterEntry struct {
+	Listener string             `json:"listener,omitempty"`
+	Tenant   string             `json:"tenant,omitempty"`
+	Entry    filter.DomainEntry `json:"entry"`
+}
+
+// List blacklist entries (GET), add one (POST with name, and optionally category, ttl and listener) or remove one (DELETE with name, and optionally listener)
+func (ctx *Server) handleFilter(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		entries := []FilterEntry{}
+		for _, server := range ctx.selected(r) {
+			for _, entry := range server.FilterEntries() {
+				entries = append(entries, FilterEntry{Listener: server.Name, Tenant: server.TenantName(), Entry: entry})
+			}
+		}
+		writeJSON(w, entries)
+	case http.MethodPost:
+		values := r.URL.Query()
+		entry := filter.DomainEntry{Name: strings.ToLower(values.Get("name")), Category: values.Get("category"), Source: "admin"}
+		if len(entry.Name) == 0 {
+			http.Error(w, "missing name", http.StatusBadRequest)
+			return
+		}
+		// Temporary blocks remove themselves once the TTL has passed
+		if len(values.Get("ttl")) > 0 {
+			ttl, err := time.ParseDuration(values.Get("ttl"))
+			if err != nil || ttl <= 0 {
+				http.Error(w, fmt.Sprintf("invalid ttl: %s", values.Get("ttl")), http.StatusBadRequest)
+				return
+			}
+			entry.Expires = time.Now().Add(ttl)
+		}
+		listener := values.Get("listener")
+		var changes []JournalEntry
+		for _, server := range ctx.selected(r) {
+			if len(listener) > 0 && listener != server.Name {
+				continue
+			}
+			server.UpdateFilter([]filter.DomainEntry{entry})
+			change := JournalEntry{Time: time.Now(), Source: r.RemoteAddr, Listener: server.Name, Name: "blacklist", New: entry.Name}
+			if !entry.Expires.IsZero() {
+				change.New += " (expires " + entry.Expires.Format(time.RFC3339) + ")"
+			}
+			ctx.journal(change)
+			changes = append(changes, change)
+		}
+		if len(changes) == 0 {
+			http.Error(w, "unknown listener", http.StatusNotFound)
+			return
+		}
+		ctx.log(fmt.Sprintf(" [*] Admin added %s to %d blacklists\n", entry.Name, len(changes)))
+		writeJSON(w, changes)
+	case http.MethodDelete:
+		values := r.URL.Query()
+		name := strings.ToLower(values.Get("name"))
+		if len(name) == 0 {
+			http.Error(w, "missing name", http.StatusBadRequest)
+			return
+		}
+		listener := values.Get("listener")
+		changes := []JournalEntry{}
+		for _, server := range ctx.selected(r) {
+			if len(listener) > 0 && listener != server.Name {
+				continue
+			}
+			if server.RemoveFilter([]string{name}) == 0 {
+				continue
+			}
+			change := JournalEntry{Time: time.Now(), Source: r.RemoteAddr, Listener: server.Name, Name: "blacklist", Old: name}
+			ctx.journal(change)
+			changes = append(changes, change)
+		}
+		if len(changes) == 0 {
+			http.Error(w, "no such entry", http.StatusNotFound)
+			return
+		}
+		ctx.log(fmt.Sprintf(" [*] Admin removed %s from %d blacklists\n", name, len(changes)))
+		writeJSON(w, changes)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// ImportLimit is the largest batch accepted by the import endpoint, after decompression
+const ImportLimit = 64 << 20
+
+// ImportReport describing what a batch did (or would do, on a dry run) to a listener's blacklist
+type ImportReport struct {
+	Listener string `json:"listener,omitempty"`
+	Tenant   string `json:"tenant,omitempty"`
+	DryRun   bool   `json:"dry_run"`
+	Invalid  int    `json:"invalid"`
+	filter.MergeResult
+}
+
+// Import a batch of blacklist entries (POST a JSON array of names or entries, or a list in format, optionally gzipped) tagged with source, and optionally category, ttl, listener and dry_run
+func (ctx *Server) handleFilterImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	values := r.URL.Query()
+	source := values.Get("source")
+	if len(source) == 0 {
+		source = "admin"
+	}
+	var expires time.Time
+	if len(values.Get("ttl")) > 0 {
+		ttl, err := time.ParseDuration(values.Get("ttl"))
+		if err != nil || ttl <= 0 {
+			http.Error(w, fmt.Sprintf("invalid ttl: %s", values.Get("ttl")), http.StatusBadRequest)
+			return
+		}
+		expires = time.Now().Add(ttl)
+	}
+	dryRun, _ := strconv.ParseBool(values.Get("dry_run"))
+
+	body, err := readBatch(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var entries []filter.DomainEntry
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		entries, err = parseBatch(body)
+	} else {
+		format := values.Get("format")
+		if len(format) == 0 {
+			format = "domains"
+		}
+		entries, _, err = filter.ParseList(body, format)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var valid []filter.DomainEntry
+	invalid := 0
+	for _, entry := range entries {
+		entry.Name = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(entry.Name)), ".")
+		if len(entry.Name) == 0 || len(entry.Name) > 253 || strings.ContainsAny(entry.Name, " /:*?#@") {
+			invalid++
+			continue
+		}
+		entry.Hits = 0
+		entry.Source = source
+		if len(entry.Category) == 0 {
+			entry.Category = values.Get("category")
+		}
+		if !expires.IsZero() {
+			entry.Expires = expires
+		}
+		valid = append(valid, entry)
+	}
+
+	listener := values.Get("listener")
+	reports := []ImportReport{}
+	for _, server := range ctx.selected(r) {
+		if len(listener) > 0 && listener != server.Name {
+			continue
+		}
+		result := server.ImportFilter(valid, dryRun)
+		reports = append(reports, ImportReport{Listener: server.Name, Tenant: server.TenantName(), DryRun: dryRun, Invalid: invalid, MergeResult: result})
+		if !dryRun {
+			ctx.journal(JournalEntry{Time: time.Now(), Source: r.RemoteAddr, Listener: server.Name, Name: "blacklist", New: fmt.Sprintf("%d entries from %s", result.Added, source)})
+		}
+	}
+	if len(reports) == 0 {
+		http.Error(w, "unknown listener", http.StatusNotFound)
+		return
+	}
+	if !dryRun {
+		ctx.log(fmt.Sprintf(" [*] Admin imported %d entries from %s into %d blacklists\n", len(valid), source, len(reports)))
+	}
+	writeJSON(w, reports)
+}
+
+// Read an import body, decompressing it when it is gzipped
+func readBatch(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	reader := bufio.NewReader(http.MaxBytesReader(w, r.Body, ImportLimit))
+	// Clients don't always say the body is compressed, so look for the gzip magic number too
+	magic, _ := reader.Peek(2)
+	var input io.Reader = reader
+	if r.Header.Get("Content-Encoding") == "gzip" || bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		decompressed, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+		defer decompressed.Close()
+		input = decompressed
+	}
+	body, err := io.ReadAll(io.LimitReader(input, ImportLimit+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > ImportLimit {
+		return nil, fmt.Errorf("batch larger than %d bytes", ImportLimit)
+	}
+	return body, nil
+}
+
+// Parse a JSON batch, an array of names or of entries with a name and category
+func parseBatch(body []byte) ([]filter.DomainEntry, error) {
+	var names []string
+	if json.Unmarshal(body, &names) == nil {
+		entries := make([]filter.DomainEntry, len(names))
+		for i, name := range names {
+			entries[i].Name = name
+		}
+		return entries, nil
+	}
+	var entries []filter.DomainEntry
+	err := json.Unmarshal(body, &entries)
+	if err != nil {
+		return nil, fmt.Errorf("invalid batch: %s", err.Error())
+	}
+	return entries, nil
+}
@@ -0,0 +1,57 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"proxy/socks5"
+	"time"
+)
+
+// PoolChange describing what adding or removing outbound proxies did to a listener's pool
+type PoolChange struct {
+	Listener string `json:"listener,omitempty"`
+	Tenant   string `json:"tenant,omitempty"`
+	Added    int    `json:"added"`
+	Removed  int    `json:"removed"`
+	Total    int    `json:"total"`
+}
+
+// Add outbound proxies (POST a JSON array of entries as in the proxies file) or remove them (DELETE an array of host and port), optionally only on a listener, until the next reload
+func (ctx *Server) handlePoolProxies(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var hosts []socks5.ProxyInfo
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, ImportLimit)).Decode(&hosts)
+	if err != nil || len(hosts) == 0 {
+		http.Error(w, "expected a JSON array of outbound proxies", http.StatusBadRequest)
+		return
+	}
+	listener := r.URL.Query().Get("listener")
+	changes := []PoolChange{}
+	for _, server := range ctx.selected(r) {
+		if len(listener) > 0 && listener != server.Name {
+			continue
+		}
+		change := PoolChange{Listener: server.Name, Tenant: server.TenantName()}
+		if r.Method == http.MethodPost {
+			change.Added, err = server.AddProxies(hosts)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		} else {
+			change.Removed = len(server.RemoveProxies(hosts))
+		}
+		change.Total = len(server.Proxies.List())
+		changes = append(changes, change)
+		ctx.journal(JournalEntry{Time: time.Now(), Source: r.RemoteAddr, Listener: server.Name, Name: "pool", New: fmt.Sprintf("%d added, %d removed (%d outbound proxies)", change.Added, change.Removed, change.Total)})
+	}
+	if len(changes) == 0 {
+		http.Error(w, "unknown listener", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, changes)
+}
@@ -0,0 +1,88 @@
+package api
+
+import (
+	"net/http"
+	"proxy/socks5"
+	"sort"
+	"strconv"
+)
+
+// ResourceUsage of the active sessions of one client address (or user)
+type ResourceUsage struct {
+	Name        string `json:"name"`
+	Sessions    int    `json:"sessions"`
+	Memory      int64  `json:"memory"`
+	Descriptors int    `json:"descriptors"`
+}
+
+// ResourceReport of the process and what its active sessions hold
+type ResourceReport struct {
+	Process     socks5.ProcessResources `json:"process"`
+	Sessions    int                     `json:"sessions"`
+	Memory      int64                   `json:"memory"`
+	Descriptors int                     `json:"descriptors"`
+	Clients     []ResourceUsage         `json:"clients"`
+}
+
+// Report the buffers and descriptors active sessions hold per client address (or per user with by=user), the heaviest first
+func (ctx *Server) handleResources(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	values := r.URL.Query()
+	by := values.Get("by")
+	if by != "" && by != "client" && by != "user" {
+		http.Error(w, "by must be client or user", http.StatusBadRequest)
+		return
+	}
+	top := 0
+	if len(values.Get("top")) > 0 {
+		var err error
+		top, err = strconv.Atoi(values.Get("top"))
+		if err != nil || top < 0 {
+			http.Error(w, "invalid top", http.StatusBadRequest)
+			return
+		}
+	}
+
+	report := ResourceReport{Process: socks5.Process(), Clients: []ResourceUsage{}}
+	clients := make(map[string]*ResourceUsage)
+	for _, server := range ctx.selected(r) {
+		for _, client := range server.Sessions() {
+			name := client.Client.Host
+			if by == "user" {
+				name = client.Identity()
+			}
+			usage, ok := clients[name]
+			if !ok {
+				usage = &ResourceUsage{Name: name}
+				clients[name] = usage
+			}
+			resources := client.Resources()
+			usage.Sessions++
+			usage.Memory += resources.Memory
+			usage.Descriptors += resources.Descriptors
+			report.Sessions++
+			report.Memory += resources.Memory
+			report.Descriptors += resources.Descriptors
+		}
+	}
+	for _, usage := range clients {
+		report.Clients = append(report.Clients, *usage)
+	}
+	sort.Slice(report.Clients, func(i, j int) bool {
+		a, b := report.Clients[i], report.Clients[j]
+		if a.Memory != b.Memory {
+			return a.Memory > b.Memory
+		}
+		if a.Descriptors != b.Descriptors {
+			return a.Descriptors > b.Descriptors
+		}
+		return a.Name < b.Name
+	})
+	if top > 0 && len(report.Clients) > top {
+		report.Clients = report.Clients[:top]
+	}
+	writeJSON(w, report)
+}
@@ -0,0 +1,72 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"proxy/socks5"
+	"time"
+)
+
+// JournalEntry records a runtime change made through the admin API
+type JournalEntry struct {
+	Time     time.Time `json:"time"`
+	Source   string    `json:"source"`
+	Listener string    `json:"listener,omitempty"`
+	Name     string    `json:"name"`
+	Old      string    `json:"old"`
+	New      string    `json:"new"`
+}
+
+// Append an entry to the journal file (one JSON object per line)
+func (ctx *Server) journal(entry JournalEntry) {
+	if len(ctx.Journal) == 0 {
+		return
+	}
+	ctx.journalLock.Lock()
+	defer ctx.journalLock.Unlock()
+	output, err := os.OpenFile(ctx.Journal, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		ctx.log(" [!] Failed to write journal: " + err.Error() + "\n")
+		return
+	}
+	defer output.Close()
+	data, _ := json.Marshal(entry)
+	output.Write(append(data, '\n'))
+}
+
+// List runtime limits (GET) or change one (POST with name, value and optionally listener)
+func (ctx *Server) handleTunables(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		list := []socks5.Tunable{}
+		for _, server := range ctx.Contexts {
+			list = append(list, server.Tunables()...)
+		}
+		writeJSON(w, list)
+	case http.MethodPost:
+		values := r.URL.Query()
+		listener := values.Get("listener")
+		var changes []JournalEntry
+		for _, server := range ctx.Contexts {
+			if len(listener) > 0 && listener != server.Name {
+				continue
+			}
+			old, err := server.SetTunable(values.Get("name"), values.Get("value"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			entry := JournalEntry{Time: time.Now(), Source: r.RemoteAddr, Listener: server.Name, Name: values.Get("name"), Old: old, New: values.Get("value")}
+			ctx.journal(entry)
+			changes = append(changes, entry)
+		}
+		if len(changes) == 0 {
+			http.Error(w, "unknown listener", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, changes)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
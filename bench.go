@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"proxy/filter"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Build a representative workload from the filter: exact hits, subdomain hits and misses
+func benchWorkload(ctx *filter.Filter, size int) []string {
+	var hosts []string
+	for i := 0; len(hosts) < size; i++ {
+		switch {
+		case len(ctx.Domains) == 0 || i%3 == 2:
+			hosts = append(hosts, "host"+strconv.Itoa(i)+".example.invalid")
+		case i%3 == 0:
+			hosts = append(hosts, ctx.Domains[i%len(ctx.Domains)].Name)
+		default:
+			hosts = append(hosts, "www."+ctx.Domains[i%len(ctx.Domains)].Name)
+		}
+	}
+	return hosts
+}
+
+// Read a list of hostnames (one per line) to use as the workload
+func benchHosts(file string) ([]string, error) {
+	input, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer input.Close()
+	var hosts []string
+	scanner := bufio.NewScanner(input)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) > 0 && line[0] != '#' {
+			hosts = append(hosts, line)
+		}
+	}
+	return hosts, scanner.Err()
+}
+
+// Measure filter load time, memory use, and match throughput
+func filterBench(args []string) {
+	flags := flag.NewFlagSet("filter bench", flag.ExitOnError)
+	blacklistPtr := flags.String("blacklist", "blacklist.json", "Blacklist file to use (JSON formatted).")
+	hostsPtr := flags.String("hosts", "", "File with hostnames to look up (generated from the blacklist if empty).")
+	countPtr := flags.Int("n", 100000, "Number of lookups to perform.")
+	flags.Parse(args)
+
+	var before, after runtime.MemStats
+	var domainFilter filter.Filter
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+	if !domainFilter.LoadFile(*blacklistPtr) {
+		fmt.Printf(" [!] Failed to load blacklist: %s\n", *blacklistPtr)
+		return
+	}
+	loadTime := time.Since(start)
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+
+	hosts := benchWorkload(&domainFilter, 1000)
+	if len(*hostsPtr) > 0 {
+		var err error
+		hosts, err = benchHosts(*hostsPtr)
+		if err != nil || len(hosts) == 0 {
+			fmt.Printf(" [!] Failed to load hosts: %s\n", *hostsPtr)
+			return
+		}
+	}
+
+	matched := 0
+	start = time.Now()
+	for i := 0; i < *countPtr; i++ {
+		if domainFilter.Matches(hosts[i%len(hosts)]) {
+			matched++
+		}
+	}
+	elapsed := time.Since(start)
+
+	fmt.Printf(" [*] Implementation: linear\n")
+	fmt.Printf(" [*] Domains: %d (loaded in %v)\n", len(domainFilter.Domains), loadTime.Round(time.Millisecond))
+	fmt.Printf(" [*] Heap: %.1f MiB\n", float64(int64(after.HeapAlloc)-int64(before.HeapAlloc))/(1024*1024))
+	if *countPtr > 0 && elapsed > 0 {
+		fmt.Printf(" [*] Lookups: %d in %v (%v/lookup, %.0f lookups/s, %d matched)\n", *countPtr, elapsed.Round(time.Millisecond), elapsed/time.Duration(*countPtr), float64(*countPtr)/elapsed.Seconds(), matched)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"proxy/api"
+	"proxy/filter"
+	"time"
+)
+
+// Ask a running instance to refresh its blacklist sources now and print the summary
+func blacklistUpdate(args []string) {
+	flags := flag.NewFlagSet("blacklist update", flag.ExitOnError)
+	apiPtr := flags.String("api", "127.0.0.1:8080", "Address of the running instance's HTTP API.")
+	tokenPtr := flags.String("apitoken", "", "Bearer token for the admin API.")
+	timeoutPtr := flags.Duration("timeout", 5*time.Minute, "How long to wait for the sources to download.")
+	flags.Parse(args)
+
+	request, err := http.NewRequest(http.MethodPost, "http://"+*apiPtr+"/admin/blacklist/update", nil)
+	if err != nil {
+		fmt.Printf(" [!] %s\n", err.Error())
+		return
+	}
+	request.Header.Set("Authorization", "Bearer "+*tokenPtr)
+	client := http.Client{Timeout: *timeoutPtr}
+	resp, err := client.Do(request)
+	if err != nil {
+		fmt.Printf(" [!] Unable to reach the API: %s\n", err.Error())
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fmt.Printf(" [!] Update failed: %s\n", resp.Status)
+		return
+	}
+	var report api.UpdateReport
+	err = json.NewDecoder(resp.Body).Decode(&report)
+	if err != nil {
+		fmt.Printf(" [!] Invalid response: %s\n", err.Error())
+		return
+	}
+	for _, summary := range report.Sources {
+		if len(summary.Error) > 0 {
+			fmt.Printf(" [!] Error loading blacklist: \"%s\" (%s)\n", summary.Source, summary.Error)
+		} else {
+			fmt.Printf(" [+] Loaded %d domains from: \"%s\"\n", summary.Count, summary.Source)
+		}
+	}
+	fmt.Printf(" [*] Updated %d sources in %s (%d errors)\n", len(report.Sources), report.Duration, report.Errors)
+}
+
+// Restore blacklists from their newest backups, through a running instance so it reloads them, or directly in a file that no instance is using
+func blacklistRollback(args []string) {
+	flags := flag.NewFlagSet("blacklist rollback", flag.ExitOnError)
+	apiPtr := flags.String("api", "127.0.0.1:8080", "Address of the running instance's HTTP API.")
+	tokenPtr := flags.String("apitoken", "", "Bearer token for the admin API.")
+	listenerPtr := flags.String("listener", "", "Only roll back this listener's blacklist (all of them if empty).")
+	filePtr := flags.String("file", "", "Roll back this blacklist file directly instead (only while no instance is using it).")
+	flags.Parse(args)
+
+	if len(*filePtr) > 0 {
+		backup, err := filter.Rollback(*filePtr)
+		if err != nil {
+			fmt.Printf(" [!] %s\n", err.Error())
+			return
+		}
+		fmt.Printf(" [+] Restored %s from: %s (%d older backups left)\n", *filePtr, backup, len(filter.Backups(*filePtr)))
+		return
+	}
+
+	request, err := http.NewRequest(http.MethodPost, "http://"+*apiPtr+"/admin/blacklist/rollback?listener="+url.QueryEscape(*listenerPtr), nil)
+	if err != nil {
+		fmt.Printf(" [!] %s\n", err.Error())
+		return
+	}
+	request.Header.Set("Authorization", "Bearer "+*tokenPtr)
+	client := http.Client{Timeout: time.Minute}
+	resp, err := client.Do(request)
+	if err != nil {
+		fmt.Printf(" [!] Unable to reach the API: %s\n", err.Error())
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fmt.Printf(" [!] Rollback failed: %s\n", resp.Status)
+		return
+	}
+	var summaries []api.RollbackSummary
+	err = json.NewDecoder(resp.Body).Decode(&summaries)
+	if err != nil {
+		fmt.Printf(" [!] Invalid response: %s\n", err.Error())
+		return
+	}
+	for _, summary := range summaries {
+		if len(summary.Error) > 0 {
+			fmt.Printf(" [!] Unable to roll back %s: %s\n", summary.File, summary.Error)
+		} else {
+			fmt.Printf(" [+] Restored %s from: %s (%d domains)\n", summary.File, summary.Backup, summary.Count)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package config
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// Listener with its own policy (empty fields fall back to the command line settings)
+type Listener struct {
+	Name            string   `json:"name"`
+	Address         string   `json:"address"`
+	Addresses       []string `json:"addresses"`
+	Blacklist       string   `json:"blacklist"`
+	Proxies         string   `json:"proxies"`
+	Schedule        string   `json:"schedule"`
+	Interim         string   `json:"interim"`
+	MaxConnections  int      `json:"max_connections"`
+	VerifyUpstream  bool     `json:"verify_upstream"`
+	Destinations    string   `json:"destination_limits"`
+	Credentials     string   `json:"credentials"`
+	GSSAPI          string   `json:"gssapi"`
+	Socks6          bool     `json:"socks6"`
+	HTTPConnect     bool     `json:"http_connect"`
+	HTTPOnly        bool     `json:"http_only"`
+	WebSocket       string   `json:"websocket"`
+	Transparent     bool     `json:"transparent"`
+	TProxy          bool     `json:"tproxy"`
+	PreserveSource  bool     `json:"preserve_source"`
+	DNSIntercept    string   `json:"dns_intercept"`
+	DNSResolver     string   `json:"dns_resolver"`
+	DropUnsupported bool     `json:"drop_unsupported"`
+	PAC             bool     `json:"pac"`
+	PACBypass       []string `json:"pac_bypass"`
+	Bypass          []string `json:"bypass"`
+	FastOpen        bool     `json:"fastopen"`
+	MSS             string   `json:"mss"`
+	Aliases         string   `json:"aliases"`
+	Policy          string   `json:"policy"`
+	Routes          string   `json:"routes"`
+	Strategy        string   `json:"strategy"`
+	Origins         string   `json:"origins"`
+	TLSCert         string   `json:"tls_cert"`
+	TLSKey          string   `json:"tls_key"`
+	TLSClientCA     string   `json:"tls_client_ca"`
+	TLSMinVersion   string   `json:"tls_min_version"`
+	TLSCiphers      string   `json:"tls_ciphers"`
+	TLSNoResumption bool     `json:"tls_no_resumption"`
+	TLSTickets      string   `json:"tls_ticket_rotation"`
+	AllowOpen       bool     `json:"allow_open"`
+	Tenant          string   `json:"-"`
+}
+
+// Tenant with its own listeners and policy, isolated from the rest of the process
+type Tenant struct {
+	Name           string            `json:"name"`
+	Labels         map[string]string `json:"labels"`
+	MaxConnections int               `json:"max_connections"`
+	QuotaBytes     uint64            `json:"quota_bytes"`
+	Blacklist      string            `json:"blacklist"`
+	Proxies        string            `json:"proxies"`
+	Schedule       string            `json:"schedule"`
+	Destinations   string            `json:"destination_limits"`
+	Credentials    string            `json:"credentials"`
+	Listeners      []Listener        `json:"listeners"`
+}
+
+// TenantListeners returns the tenant's listeners with the tenant's policy filled in
+func (ctx *Tenant) TenantListeners() []Listener {
+	var listeners []Listener
+	for _, listener := range ctx.Listeners {
+		listener.Tenant = ctx.Name
+		if len(listener.Name) == 0 {
+			listener.Name = ctx.Name
+		}
+		if len(listener.Blacklist) == 0 {
+			listener.Blacklist = ctx.Blacklist
+		}
+		if len(listener.Blacklist) == 0 {
+			// Tenants never share a filter profile
+			listener.Blacklist = "blacklist-" + ctx.Name + ".json"
+		}
+		if len(listener.Proxies) == 0 {
+			listener.Proxies = ctx.Proxies
+		}
+		if len(listener.Schedule) == 0 {
+			listener.Schedule = ctx.Schedule
+		}
+		if len(listener.Destinations) == 0 {
+			listener.Destinations = ctx.Destinations
+		}
+		if len(listener.Credentials) == 0 {
+			listener.Credentials = ctx.Credentials
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners
+}
+
+// Source of domains imported into the blacklists
+type Source struct {
+	Name     string `json:"name"`
+	URL      string `json:"url"`
+	Enabled  *bool  `json:"enabled"`
+	Format   string `json:"format"`
+	Category string `json:"category"`
+	Refresh  string `json:"refresh"`
+	TTL      string `json:"ttl"`
+}
+
+// Active reports whether the source should be used (sources are enabled unless turned off)
+func (ctx *Source) Active() bool {
+	return ctx.Enabled == nil || *ctx.Enabled
+}
+
+// RefreshInterval for downloading the source again while running (0 only downloads at startup)
+func (ctx *Source) RefreshInterval() time.Duration {
+	interval, err := time.ParseDuration(ctx.Refresh)
+	if err != nil {
+		return 0
+	}
+	return interval
+}
+
+// EntryTTL for the source's entries, after which they expire unless downloaded again (0 keeps them)
+func (ctx *Source) EntryTTL() time.Duration {
+	ttl, err := time.ParseDuration(ctx.TTL)
+	if err != nil {
+		return 0
+	}
+	return ttl
+}
+
+// DefaultSources used when no other sources are configured
+var DefaultSources = []Source{
+	{Name: "mvps", URL: "https://winhelp2002.mvps.org/hosts.txt", Format: "hosts", Category: "ads"},
+}
+
+// Config file contents
+type Config struct {
+	Listeners      []Listener `json:"listeners"`
+	Sources        []Source   `json:"sources"`
+	Tenants        []Tenant   `json:"tenants"`
+	OpenProxyGuard bool       `json:"open_proxy_guard"`
+}
+
+// AllListeners returns the shared listeners followed by every tenant's
+func (ctx *Config) AllListeners() []Listener {
+	listeners := append([]Listener{}, ctx.Listeners...)
+	for _, tenant := range ctx.Tenants {
+		listeners = append(listeners, tenant.TenantListeners()...)
+	}
+	return listeners
+}
+
+// LoadFile retrieves the configuration from a file
+func (ctx *Config) LoadFile(file string) bool {
+	input, err := os.Open(file)
+	if err != nil {
+		return false
+	}
+	defer input.Close()
+	finfo, err := input.Stat()
+	if err != nil {
+		return false
+	}
+	data := make([]byte, finfo.Size())
+	_, err = input.Read(data)
+	if err != nil {
+		return false
+	}
+	err = json.Unmarshal(data, ctx)
+	if err != nil {
+		return false
+	}
+	for _, listener := range ctx.Listeners {
+		if len(listener.Address) == 0 {
+			return false
+		}
+	}
+	tenants := make(map[string]bool)
+	for _, tenant := range ctx.Tenants {
+		if len(tenant.Name) == 0 || tenants[tenant.Name] || len(tenant.Listeners) == 0 {
+			return false
+		}
+		tenants[tenant.Name] = true
+		for _, listener := range tenant.Listeners {
+			if len(listener.Address) == 0 {
+				return false
+			}
+		}
+	}
+	for _, source := range ctx.Sources {
+		if len(source.URL) == 0 {
+			return false
+		}
+		switch source.Format {
+		case "", "hosts", "domains", "adblock":
+		default:
+			return false
+		}
+		if len(source.Refresh) > 0 && source.RefreshInterval() <= 0 {
+			return false
+		}
+		if len(source.TTL) > 0 && source.EntryTTL() <= 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,131 @@
+package control
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"os/signal"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Commands understood by the server
+const (
+	Exit   = "exit"
+	Reload = "reload"
+	Dump   = "dump"
+)
+
+// SIGUSR1 differs between platforms and does not exist on Windows
+func usr1() (os.Signal, bool) {
+	switch runtime.GOOS {
+	case "linux":
+		return syscall.Signal(0xa), true
+	case "darwin", "freebsd", "netbsd", "openbsd", "dragonfly":
+		return syscall.Signal(0x1e), true
+	}
+	return nil, false
+}
+
+// Signal to command mapping for the current platform
+func signalCommands() map[os.Signal]string {
+	// Windows delivers ctrl-c as os.Interrupt and console close or shutdown as SIGTERM
+	commands := map[os.Signal]string{
+		os.Interrupt:    Exit,
+		syscall.SIGTERM: Exit,
+	}
+	if runtime.GOOS != "windows" {
+		commands[syscall.SIGHUP] = Reload
+		if sig, ok := usr1(); ok {
+			commands[sig] = Dump
+		}
+	}
+	return commands
+}
+
+// Signals relays OS signals to the commands channel
+func Signals(commands chan<- string) {
+	mapping := signalCommands()
+	var signals []os.Signal
+	for sig := range mapping {
+		signals = append(signals, sig)
+	}
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, signals...)
+	for received := range c {
+		commands <- mapping[received]
+	}
+}
+
+// Network to use for a control address (paths are Unix sockets, which Windows 10 also supports)
+func network(address string) string {
+	if strings.ContainsAny(address, "/\\") {
+		return "unix"
+	}
+	return "tcp"
+}
+
+// Listen serves line based commands ("exit", "reload", "dump") on a control socket
+func Listen(address string, commands chan<- string) error {
+	kind := network(address)
+	if kind == "unix" {
+		// Remove a socket left behind by a previous run
+		os.Remove(address)
+	}
+	listener, err := net.Listen(kind, address)
+	if err != nil {
+		return err
+	}
+	for {
+		connection, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go serve(connection, commands)
+	}
+}
+
+// Read commands from a control connection
+func serve(connection net.Conn, commands chan<- string) {
+	defer connection.Close()
+	scanner := bufio.NewScanner(connection)
+	for scanner.Scan() {
+		command := strings.ToLower(strings.TrimSpace(scanner.Text()))
+		switch command {
+		case Exit, Reload, Dump:
+			commands <- command
+			connection.Write([]byte("ok\n"))
+		case "":
+		default:
+			connection.Write([]byte("unknown command\n"))
+		}
+	}
+}
+
+// Send a command to a running instance's control socket and return its reply
+func Send(address string, command string) (string, error) {
+	connection, err := net.DialTimeout(network(address), address, 5*time.Second)
+	if err != nil {
+		return "", err
+	}
+	defer connection.Close()
+	connection.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = connection.Write([]byte(command + "\n"))
+	if err != nil {
+		return "", err
+	}
+	reply, err := bufio.NewReader(connection).ReadString('\n')
+	return strings.TrimSpace(reply), err
+}
+
+// Running reports whether something is accepting connections on a control address
+func Running(address string) bool {
+	connection, err := net.DialTimeout(network(address), address, time.Second)
+	if err != nil {
+		return false
+	}
+	connection.Close()
+	return true
+}
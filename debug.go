@@ -0,0 +1,106 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"proxy/filter"
+	"proxy/policy"
+	"proxy/socks5"
+	"strconv"
+	"strings"
+)
+
+// Run a destination through the same policy a client request gets, printing each decision ("resolve" stops before connecting)
+func debugRequest(command string, args []string) {
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	blacklistPtr := flags.String("blacklist", "blacklist.json", "Blacklist file to use (JSON formatted).")
+	proxiesPtr := flags.String("proxies", "", "A JSON formatted file containing outbound proxies to use.")
+	credentialsPtr := flags.String("credentials", "", "A JSON formatted file of users, for their preferred exits.")
+	schedulePtr := flags.String("schedule", "", "A JSON formatted file containing allowed time windows per user.")
+	userPtr := flags.String("user", "", "User to make the request as (the client address is used without one).")
+	aliasesPtr := flags.String("aliases", "", "A JSON formatted file of host aliases.")
+	policyPtr := flags.String("policy", "", "A JSON formatted file of policy rules.")
+	routesPtr := flags.String("routes", "", "A JSON formatted file of routes.")
+	bypassPtr := flags.String("bypass", "", "Destinations (comma separated) always connected directly.")
+	reachHintsPtr := flags.Bool("reachhints", false, "Prefer the address family that is reachable for direct connections.")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		fmt.Printf(" [!] Usage: proxy %s [flags] <%s>\n", command, map[string]string{"resolve": "host", "dial": "host:port"}[command])
+		return
+	}
+
+	host, port := flags.Arg(0), 0
+	if command == "dial" {
+		var portText string
+		var err error
+		host, portText, err = net.SplitHostPort(flags.Arg(0))
+		if err == nil {
+			port, err = strconv.Atoi(portText)
+		}
+		if err != nil || port <= 0 || port > 0xFFFF {
+			fmt.Printf(" [!] Invalid destination: %s\n", flags.Arg(0))
+			return
+		}
+	}
+
+	var ctx socks5.Context
+	ctx.ReachabilityHints = *reachHintsPtr
+	var domainFilter filter.Filter
+	if !domainFilter.LoadFile(*blacklistPtr) {
+		fmt.Printf(" [!] Failed to load blacklist: %s\n", *blacklistPtr)
+	}
+	ctx.SetFilter(domainFilter)
+	if len(*proxiesPtr) > 0 && !ctx.Proxies.LoadFile(*proxiesPtr) {
+		fmt.Printf(" [!] Failed to load proxies from: %s\n", *proxiesPtr)
+		return
+	}
+	if len(*credentialsPtr) > 0 && !ctx.Credentials.LoadFile(*credentialsPtr) {
+		fmt.Printf(" [!] Failed to load credentials from: %s\n", *credentialsPtr)
+		return
+	}
+	if len(*schedulePtr) > 0 && !ctx.Schedule.LoadFile(*schedulePtr) {
+		fmt.Printf(" [!] Failed to load schedule from: %s\n", *schedulePtr)
+		return
+	}
+	if len(*aliasesPtr) > 0 {
+		aliases := &socks5.HostAliases{}
+		if !aliases.LoadFile(*aliasesPtr) {
+			fmt.Printf(" [!] Failed to load host aliases from: %s\n", *aliasesPtr)
+			return
+		}
+		ctx.Rewriter = aliases
+	}
+	if len(*policyPtr) > 0 {
+		rules := &policy.Policy{}
+		if !rules.LoadFile(*policyPtr) {
+			fmt.Printf(" [!] Failed to load policy from: %s\n", *policyPtr)
+			return
+		}
+		ctx.Policy = rules
+	}
+	if len(*bypassPtr) > 0 {
+		bypass, err := socks5.ParseBypass(strings.Split(*bypassPtr, ","))
+		if err != nil {
+			fmt.Printf(" [!] %s\n", err.Error())
+			return
+		}
+		ctx.Bypass = bypass
+	}
+	if len(*routesPtr) > 0 {
+		routes := &socks5.RoutingTable{}
+		if !routes.LoadFile(*routesPtr) {
+			fmt.Printf(" [!] Failed to load routes from: %s\n", *routesPtr)
+			return
+		}
+		ctx.Routes = routes
+	}
+
+	for _, step := range ctx.Diagnose(host, port, *userPtr, command == "dial") {
+		marker := "[+]"
+		if step.Failed {
+			marker = "[!]"
+		}
+		fmt.Printf(" %s %-11s %s\n", marker, step.Step+":", step.Detail)
+	}
+}
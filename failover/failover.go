@@ -0,0 +1,272 @@
+package failover
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"proxy/filter"
+	"proxy/socks5"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HookTimeout is how long the hook may take to move traffic (a DNS update, or a VRRP priority change)
+const HookTimeout = 30 * time.Second
+
+// BlacklistTimeout is how long fetching a blacklist from the peer may take
+const BlacklistTimeout = time.Minute
+
+// Pair of instances, one active and one warm standby, watching each other through their APIs
+type Pair struct {
+	Peer      string            `json:"peer"`
+	Token     string            `json:"token"`
+	Priority  int               `json:"priority"`
+	Interval  string            `json:"interval"`
+	DeadAfter int               `json:"dead_after"`
+	Hook      string            `json:"hook"`
+	Contexts  []*socks5.Context `json:"-"`
+	Logger    chan string       `json:"-"`
+	started   time.Time
+	active    bool
+	decided   bool
+	misses    int
+	lock      sync.Mutex
+	client    http.Client
+	synced    map[string]uint64
+	restarted time.Time
+	syncing   int32
+}
+
+// State of an instance as seen by its peer, with what a standby needs to take over (transfer quotas and quarantined proxies)
+type State struct {
+	Priority    int                            `json:"priority"`
+	Started     time.Time                      `json:"started"`
+	Active      bool                           `json:"active"`
+	Tenants     map[string]uint64              `json:"tenants,omitempty"`
+	Quarantines map[string][]socks5.Quarantine `json:"quarantines,omitempty"`
+	Blacklists  map[string]uint64              `json:"blacklists,omitempty"`
+}
+
+// LoadFile retrieves the pairing settings from a file
+func (ctx *Pair) LoadFile(file string) bool {
+	input, err := os.Open(file)
+	if err != nil {
+		return false
+	}
+	defer input.Close()
+	finfo, err := input.Stat()
+	if err != nil {
+		return false
+	}
+	data := make([]byte, finfo.Size())
+	_, err = input.Read(data)
+	if err != nil {
+		return false
+	}
+	err = json.Unmarshal(data, ctx)
+	if err != nil {
+		return false
+	}
+	if len(ctx.Peer) == 0 || ctx.CheckInterval() <= 0 || ctx.DeadAfter < 0 {
+		return false
+	}
+	if !strings.Contains(ctx.Peer, "://") {
+		ctx.Peer = "http://" + ctx.Peer
+	}
+	if ctx.DeadAfter == 0 {
+		ctx.DeadAfter = 3
+	}
+	ctx.started = time.Now()
+	return true
+}
+
+// CheckInterval between polls of the peer (2 seconds unless configured)
+func (ctx *Pair) CheckInterval() time.Duration {
+	if len(ctx.Interval) == 0 {
+		return 2 * time.Second
+	}
+	interval, err := time.ParseDuration(ctx.Interval)
+	if err != nil {
+		return 0
+	}
+	return interval
+}
+
+// Active reports whether this instance is the one clients should use
+func (ctx *Pair) Active() bool {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	return ctx.active
+}
+
+// State returns a snapshot of this instance for its peer
+func (ctx *Pair) State() State {
+	state := State{Priority: ctx.Priority, Started: ctx.started, Active: ctx.Active(), Tenants: make(map[string]uint64), Quarantines: make(map[string][]socks5.Quarantine), Blacklists: make(map[string]uint64)}
+	for _, server := range ctx.Contexts {
+		state.Blacklists[server.ListenAddress] = server.FilterGeneration()
+		if server.Tenant != nil {
+			state.Tenants[server.Tenant.Name] = server.Tenant.Status().Transferred
+		}
+		if quarantines := server.Proxies.Quarantines(); len(quarantines) > 0 {
+			state.Quarantines[server.ListenAddress] = quarantines
+		}
+	}
+	return state
+}
+
+// Run watches the peer, taking over when it stops answering and handing back when it outranks this instance
+func (ctx *Pair) Run() {
+	ctx.client.Timeout = ctx.CheckInterval()
+	for {
+		peer, err := ctx.poll()
+		if err != nil {
+			ctx.misses++
+			if ctx.misses == ctx.DeadAfter {
+				ctx.log(fmt.Sprintf(" [!] Failover peer is not answering: %s\n", err.Error()))
+			}
+			if ctx.misses >= ctx.DeadAfter {
+				ctx.promote(true, "peer unreachable")
+			}
+		} else {
+			if ctx.misses >= ctx.DeadAfter {
+				ctx.log(fmt.Sprintf(" [+] Failover peer is back: %s\n", ctx.Peer))
+			}
+			ctx.misses = 0
+			ctx.sync(peer)
+			// The higher priority wins, then the longer running instance, so both agree without talking it over
+			outranked := peer.Priority > ctx.Priority || (peer.Priority == ctx.Priority && peer.Started.Before(ctx.started))
+			if outranked {
+				ctx.promote(false, fmt.Sprintf("peer has priority %d", peer.Priority))
+			} else {
+				ctx.promote(true, fmt.Sprintf("outranks peer with priority %d", peer.Priority))
+			}
+			// Fetching blacklists can take a while, so it must not hold up watching the peer (one fetch at a time)
+			if peer.Active && !ctx.Active() && atomic.CompareAndSwapInt32(&ctx.syncing, 0, 1) {
+				go func(peer State) {
+					defer atomic.StoreInt32(&ctx.syncing, 0)
+					ctx.syncBlacklists(peer)
+				}(peer)
+			}
+		}
+		time.Sleep(ctx.CheckInterval())
+	}
+}
+
+// Fetch the peer's state from its API
+func (ctx *Pair) poll() (State, error) {
+	var state State
+	request, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(ctx.Peer, "/")+"/admin/failover", nil)
+	if err != nil {
+		return state, err
+	}
+	request.Header.Set("Authorization", "Bearer "+ctx.Token)
+	response, err := ctx.client.Do(request)
+	if err != nil {
+		return state, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return state, fmt.Errorf("%s from: %s", response.Status, ctx.Peer)
+	}
+	err = json.NewDecoder(response.Body).Decode(&state)
+	return state, err
+}
+
+// Take over the peer's transfer counts and quarantines, so limits hold after a failover
+func (ctx *Pair) sync(peer State) {
+	for _, server := range ctx.Contexts {
+		if server.Tenant != nil {
+			if bytes, ok := peer.Tenants[server.Tenant.Name]; ok {
+				server.Tenant.SyncTransferred(bytes)
+			}
+		}
+		for _, quarantine := range peer.Quarantines[server.ListenAddress] {
+			if server.Proxies.SyncQuarantine(quarantine) {
+				ctx.log(fmt.Sprintf(" [*] Quarantined %s:%d until %s (from failover peer)\n", quarantine.Host, quarantine.Port, quarantine.Until.Format(time.RFC3339)))
+			}
+		}
+	}
+}
+
+// Take over the active peer's blacklists whenever they change, so only it downloads from the sources and both block the same
+func (ctx *Pair) syncBlacklists(peer State) {
+	if ctx.synced == nil || !peer.Started.Equal(ctx.restarted) {
+		// A restarted peer counts its changes from zero again
+		ctx.synced = make(map[string]uint64)
+		ctx.restarted = peer.Started
+	}
+	for _, server := range ctx.Contexts {
+		generation, ok := peer.Blacklists[server.ListenAddress]
+		if synced, done := ctx.synced[server.ListenAddress]; !ok || (done && synced == generation) {
+			continue
+		}
+		entries, err := ctx.fetchBlacklist(server.ListenAddress)
+		if err != nil {
+			ctx.log(fmt.Sprintf(" [!] Failed to fetch blacklist from failover peer: %s (%s)\n", server.ListenAddress, err.Error()))
+			continue
+		}
+		server.SyncFilter(entries)
+		ctx.synced[server.ListenAddress] = generation
+		ctx.log(fmt.Sprintf(" [*] Blacklist of %s synced from failover peer: %d entries\n", server.ListenAddress, len(entries)))
+	}
+}
+
+// Fetch a listener's blacklist entries from the peer's API
+func (ctx *Pair) fetchBlacklist(listener string) ([]filter.DomainEntry, error) {
+	request, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(ctx.Peer, "/")+"/admin/failover/blacklist?listener="+url.QueryEscape(listener), nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Authorization", "Bearer "+ctx.Token)
+	client := http.Client{Timeout: BlacklistTimeout}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s from: %s", response.Status, ctx.Peer)
+	}
+	var entries []filter.DomainEntry
+	err = json.NewDecoder(response.Body).Decode(&entries)
+	return entries, err
+}
+
+// Change role (or take the first one), running the hook so traffic follows
+func (ctx *Pair) promote(active bool, reason string) {
+	ctx.lock.Lock()
+	changed := !ctx.decided || ctx.active != active
+	ctx.active = active
+	ctx.decided = true
+	ctx.lock.Unlock()
+	if !changed {
+		return
+	}
+	role := "standby"
+	if active {
+		role = "active"
+	}
+	ctx.log(fmt.Sprintf(" [*] Failover: now %s (%s)\n", role, reason))
+	if len(ctx.Hook) == 0 {
+		return
+	}
+	hook, cancel := context.WithTimeout(context.Background(), HookTimeout)
+	defer cancel()
+	output, err := exec.CommandContext(hook, ctx.Hook, role).CombinedOutput()
+	if err != nil {
+		ctx.log(fmt.Sprintf(" [!] Failover hook failed (%s): %s %s\n", err.Error(), ctx.Hook, strings.TrimSpace(string(output))))
+	}
+}
+
+// Send a line to the shared logger
+func (ctx *Pair) log(line string) {
+	if ctx.Logger != nil {
+		ctx.Logger <- line
+	}
+}
@@ -0,0 +1,62 @@
+package filter
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// BackupLayout timestamps the backups of a filter file (so sorting their names sorts them by age)
+const BackupLayout = "20060102-150405.000"
+
+// Backup copies a filter file aside before it is overwritten, keeping only the newest count copies
+func Backup(file string, count int) error {
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		// Nothing to lose yet
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(file+"."+time.Now().UTC().Format(BackupLayout), data, 0644)
+	if err != nil {
+		return err
+	}
+	backups := Backups(file)
+	for len(backups) > count {
+		os.Remove(backups[len(backups)-1])
+		backups = backups[:len(backups)-1]
+	}
+	return nil
+}
+
+// Backups of a filter file, newest first
+func Backups(file string) []string {
+	matches, _ := filepath.Glob(file + ".*")
+	var backups []string
+	for _, match := range matches {
+		if _, err := time.Parse(BackupLayout, strings.TrimPrefix(match, file+".")); err == nil {
+			backups = append(backups, match)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+	return backups
+}
+
+// Rollback replaces a filter file with its newest backup, which is used up so rolling back again goes further back (returning the backup's name)
+func Rollback(file string) (string, error) {
+	backups := Backups(file)
+	if len(backups) == 0 {
+		return "", fmt.Errorf("no backups of: %s", file)
+	}
+	// A backup that would not load is no better than the current file
+	var restored Filter
+	if !restored.LoadFile(backups[0]) {
+		return "", fmt.Errorf("invalid backup: %s", backups[0])
+	}
+	return backups[0], os.Rename(backups[0], file)
+}
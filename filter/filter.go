@@ -2,16 +2,28 @@ package filter
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // DomainEntry for tracking each domain, rules, and hit count
 type DomainEntry struct {
-	Name string `json:"name"`
-	Hits int    `json:"hits"`
+	Name     string    `json:"name"`
+	Hits     int64     `json:"hits"`
+	Category string    `json:"category,omitempty"`
+	Source   string    `json:"source,omitempty"`
+	Expires  time.Time `json:"expires,omitzero"`
+}
+
+// Expired reports whether a temporary entry has passed its expiry time
+func (entry *DomainEntry) Expired(now time.Time) bool {
+	return !entry.Expires.IsZero() && now.After(entry.Expires)
 }
 
 // Matches a string against a domain name
@@ -37,17 +49,47 @@ func (entry *DomainEntry) Matches(item string) bool {
 type Filter struct {
 	Domains  []DomainEntry
 	FileName string
+	Backups  int // Copies of the file kept from before each save that changes it (0 keeps none)
 }
 
 // Matches a string against all domain names in the filter
 func (ctx *Filter) Matches(item string) bool {
-	for i, domainEntry := range ctx.Domains {
-		if domainEntry.Matches(strings.ToLower(item)) {
-			ctx.Domains[i].Hits++
-			return true
+	_, ok := ctx.Match(item)
+	return ok
+}
+
+// Match returns the domain entry that matched a string
+func (ctx *Filter) Match(item string) (string, bool) {
+	explanation, ok := ctx.Explain(item)
+	return explanation.Rule, ok
+}
+
+// Explanation of why a string matched the filter
+type Explanation struct {
+	Item     string    `json:"item"`
+	Rule     string    `json:"rule"`
+	Source   string    `json:"source,omitempty"`
+	Category string    `json:"category,omitempty"`
+	Expires  time.Time `json:"expires,omitzero"`
+}
+
+// Explain returns the rule that matched a string, with the list it came from
+func (ctx *Filter) Explain(item string) (Explanation, bool) {
+	now := time.Now()
+	// Entries are taken by reference and counted atomically, so matches can run concurrently
+	for i := range ctx.Domains {
+		domainEntry := &ctx.Domains[i]
+		if domainEntry.Matches(strings.ToLower(item)) && !domainEntry.Expired(now) {
+			atomic.AddInt64(&domainEntry.Hits, 1)
+			explanation := Explanation{Item: item, Rule: domainEntry.Name, Source: domainEntry.Source, Category: domainEntry.Category, Expires: domainEntry.Expires}
+			if len(explanation.Source) == 0 {
+				// Entries saved before sources were recorded came from the filter's own file
+				explanation.Source = ctx.FileName
+			}
+			return explanation, true
 		}
 	}
-	return false
+	return Explanation{}, false
 }
 
 // LoadFile retrieves a domain list from a file
@@ -126,7 +168,7 @@ func (ctx *Filter) LoadListFile(file string) (bool, int) {
 		if len(elements) > 1 {
 			line = elements[len(elements)-1]
 		}
-		ctx.Domains = append(ctx.Domains, DomainEntry{line, 0})
+		ctx.Domains = append(ctx.Domains, DomainEntry{Name: line, Source: file})
 	}
 	ctx.deduplicate()
 	return true, count
@@ -138,6 +180,13 @@ func (ctx *Filter) SaveFile(file string) bool {
 	if err != nil {
 		return false
 	}
+	if ctx.Backups > 0 {
+		// Hit counts change on every save, only a change to the entries is worth a backup
+		var previous []DomainEntry
+		if data, err := os.ReadFile(file); err != nil || json.Unmarshal(data, &previous) != nil || !sameEntries(previous, ctx.Domains) {
+			Backup(file, ctx.Backups)
+		}
+	}
 	output, err := os.Create(file)
 	if err != nil {
 		return false
@@ -149,6 +198,27 @@ func (ctx *Filter) SaveFile(file string) bool {
 	return true
 }
 
+// Whether two lists hold the same entries, in any order and whatever their hit counts
+func sameEntries(a []DomainEntry, b []DomainEntry) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	key := func(entry DomainEntry) string {
+		return strings.Join([]string{entry.Name, entry.Category, entry.Source, entry.Expires.UTC().Format(time.RFC3339Nano)}, "\x00")
+	}
+	counts := make(map[string]int)
+	for _, entry := range a {
+		counts[key(entry)]++
+	}
+	for _, entry := range b {
+		counts[key(entry)]--
+		if counts[key(entry)] < 0 {
+			return false
+		}
+	}
+	return true
+}
+
 // Save data to the same file it was loaded from (if available)
 func (ctx *Filter) Save() {
 	if len(ctx.FileName) > 0 {
@@ -158,19 +228,212 @@ func (ctx *Filter) Save() {
 
 // LoadHTTP retrieves a domain list from a URL
 func (ctx *Filter) LoadHTTP(url string) (bool, int) {
-	resp, err := http.Get(url)
-	temp := ""
-	count := 0
-	skip := false
-	var list []string
+	entries, count, err := FetchSource(Source{URL: url}, 0)
 	if err != nil {
 		return false, count
 	}
+	ctx.Domains = append(ctx.Domains, entries...)
+	ctx.deduplicate()
+	return true, count
+}
+
+// Source of a domain list and how to read it
+type Source struct {
+	Name     string // Recorded on every entry imported from the source (the URL without one)
+	URL      string
+	Format   string        // "hosts" (the default), "domains" or "adblock"
+	Category string        // Recorded on every entry imported from the source
+	TTL      time.Duration // Imported entries expire after this long unless imported again (0 keeps them)
+}
+
+// SourceResult of loading a single domain list
+type SourceResult struct {
+	Source string
+	Count  int
+	Err    error
+}
+
+// LoadHTTPAll retrieves several hosts style domain lists concurrently and merges the ones that succeed
+func (ctx *Filter) LoadHTTPAll(urls []string, timeout time.Duration) []SourceResult {
+	var sources []Source
+	for _, url := range urls {
+		sources = append(sources, Source{URL: url})
+	}
+	return ctx.LoadSources(sources, timeout)
+}
+
+// LoadSources retrieves several domain lists concurrently and merges the ones that succeed
+func (ctx *Filter) LoadSources(sources []Source, timeout time.Duration) []SourceResult {
+	results := make([]SourceResult, len(sources))
+	lists := make([][]DomainEntry, len(sources))
+	var wait sync.WaitGroup
+	for i, source := range sources {
+		wait.Add(1)
+		go func(i int, source Source) {
+			defer wait.Done()
+			results[i].Source = source.URL
+			lists[i], results[i].Count, results[i].Err = FetchSource(source, timeout)
+		}(i, source)
+	}
+	wait.Wait()
+	for _, list := range lists {
+		ctx.Domains = append(ctx.Domains, list...)
+	}
+	ctx.deduplicate()
+	return results
+}
+
+// Add entries to the filter, dropping duplicates
+func (ctx *Filter) Add(entries []DomainEntry) {
+	ctx.Domains = append(ctx.Domains, entries...)
+	ctx.deduplicate()
+}
+
+// MergeResult describes what adding a batch of entries did to a filter
+type MergeResult struct {
+	Received   int `json:"received"`
+	Added      int `json:"added"`
+	Duplicates int `json:"duplicates"`
+	Superseded int `json:"superseded"`
+	Total      int `json:"total"`
+}
+
+// Merge a batch of entries as Add does, only reporting the result on a dry run
+func (ctx *Filter) Merge(entries []DomainEntry, dryRun bool) MergeResult {
+	before := make(map[string]bool)
+	for _, domainEntry := range ctx.Domains {
+		before[domainEntry.Name] = true
+	}
+	merged := Filter{Domains: append(append([]DomainEntry(nil), ctx.Domains...), entries...)}
+	merged.deduplicate()
+	result := MergeResult{Received: len(entries), Total: len(merged.Domains)}
+	after := make(map[string]bool)
+	for _, domainEntry := range merged.Domains {
+		after[domainEntry.Name] = true
+		if !before[domainEntry.Name] {
+			result.Added++
+		}
+	}
+	// Existing entries covered by a broader new one, for at least as long, are dropped (as deduplicate does)
+	for name := range before {
+		if !after[name] {
+			result.Superseded++
+		}
+	}
+	result.Duplicates = result.Received - result.Added
+	if !dryRun {
+		ctx.Domains = merged.Domains
+	}
+	return result
+}
+
+// Remove entries by name, returning how many were removed
+func (ctx *Filter) Remove(names []string) int {
+	drop := make(map[string]bool)
+	for _, name := range names {
+		drop[strings.ToLower(name)] = true
+	}
+	var kept []DomainEntry
+	for _, domainEntry := range ctx.Domains {
+		if !drop[domainEntry.Name] {
+			kept = append(kept, domainEntry)
+		}
+	}
+	removed := len(ctx.Domains) - len(kept)
+	if removed > 0 {
+		ctx.Domains = kept
+	}
+	return removed
+}
+
+// Replace all entries, keeping the hit counts of names that stay in the filter
+func (ctx *Filter) Replace(entries []DomainEntry) {
+	hits := make(map[string]int64)
+	for _, domainEntry := range ctx.Domains {
+		hits[domainEntry.Name] = domainEntry.Hits
+	}
+	domains := make([]DomainEntry, len(entries))
+	for i, domainEntry := range entries {
+		if domainEntry.Hits == 0 {
+			domainEntry.Hits = hits[domainEntry.Name]
+		}
+		domains[i] = domainEntry
+	}
+	ctx.Domains = domains
+	ctx.deduplicate()
+}
+
+// Expire removes entries past their expiry time, returning how many were removed
+func (ctx *Filter) Expire(now time.Time) int {
+	var kept []DomainEntry
+	for _, domainEntry := range ctx.Domains {
+		if !domainEntry.Expired(now) {
+			kept = append(kept, domainEntry)
+		}
+	}
+	removed := len(ctx.Domains) - len(kept)
+	if removed > 0 {
+		ctx.Domains = kept
+	}
+	return removed
+}
+
+// FetchSource downloads a domain list and parses it according to its format
+func FetchSource(source Source, timeout time.Duration) ([]DomainEntry, int, error) {
+	client := http.Client{Timeout: timeout}
+	resp, err := client.Get(source.URL)
+	if err != nil {
+		return nil, 0, err
+	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("status %d", resp.StatusCode)
+	}
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return false, count
+		return nil, 0, err
+	}
+	entries, count, err := ParseList(body, source.Format)
+	if err != nil {
+		return nil, 0, err
+	}
+	name := source.Name
+	if len(name) == 0 {
+		name = source.URL
+	}
+	for i := range entries {
+		entries[i].Category = source.Category
+		entries[i].Source = name
+		if source.TTL > 0 {
+			entries[i].Expires = time.Now().Add(source.TTL)
+		}
+	}
+	return entries, count, nil
+}
+
+// ParseList parses a domain list in a format ("hosts", the default, "domains" or "adblock"), returning the entries and the lines read
+func ParseList(body []byte, format string) ([]DomainEntry, int, error) {
+	switch format {
+	case "", "hosts":
+		entries, count := parseHosts(body)
+		return entries, count, nil
+	case "domains":
+		entries, count := parseDomains(body)
+		return entries, count, nil
+	case "adblock":
+		entries, count := parseAdblock(body)
+		return entries, count, nil
 	}
+	return nil, 0, fmt.Errorf("unknown list format: %s", format)
+}
+
+// Parse a hosts style domain list
+func parseHosts(body []byte) ([]DomainEntry, int) {
+	temp := ""
+	count := 0
+	skip := false
+	var list []string
+	var entries []DomainEntry
 	// Parse the result for lines of text
 	for _, char := range body {
 		if char == '#' {
@@ -195,8 +458,8 @@ func (ctx *Filter) LoadHTTP(url string) (bool, int) {
 		if char == '\t' {
 			char = ' '
 		}
-		if char == ' ' && temp[len(temp)-1] == ' ' {
-			// Avoid adding duplicate spaces
+		if char == ' ' && (len(temp) == 0 || temp[len(temp)-1] == ' ') {
+			// Avoid adding leading or duplicate spaces
 			continue
 		}
 		temp += string(char)
@@ -218,22 +481,80 @@ func (ctx *Filter) LoadHTTP(url string) (bool, int) {
 		if len(elements) == 2 {
 			line = elements[len(elements)-1]
 		}
-		ctx.Domains = append(ctx.Domains, DomainEntry{line, 0})
+		entries = append(entries, DomainEntry{Name: line})
 	}
-	ctx.deduplicate()
-	return true, count
+	return entries, count
 }
 
+// Parse a list with one domain per line (anything after the first field is ignored)
+func parseDomains(body []byte) ([]DomainEntry, int) {
+	var entries []DomainEntry
+	count := 0
+	for _, line := range strings.Split(string(body), "\n") {
+		fields := strings.Fields(strings.ToLower(line))
+		if len(fields) == 0 {
+			continue
+		}
+		count++
+		if fields[0][0] == '#' {
+			continue
+		}
+		entries = append(entries, DomainEntry{Name: fields[0]})
+	}
+	return entries, count
+}
+
+// Parse the domain blocking rules ("||example.com^") of an adblock style list
+func parseAdblock(body []byte) ([]DomainEntry, int) {
+	var entries []DomainEntry
+	count := 0
+	for _, line := range strings.Split(string(body), "\n") {
+		line = strings.ToLower(strings.TrimSpace(line))
+		if len(line) == 0 {
+			continue
+		}
+		count++
+		// Comments, exceptions, cosmetic and path rules don't map to domains
+		if !strings.HasPrefix(line, "||") || !strings.HasSuffix(line, "^") {
+			continue
+		}
+		domain := line[2 : len(line)-1]
+		if len(domain) == 0 || strings.ContainsAny(domain, "/*^$") {
+			continue
+		}
+		entries = append(entries, DomainEntry{Name: domain})
+	}
+	return entries, count
+}
+
+// Drop entries another one covers for at least as long, so an expiring entry never takes a permanent block with it
 func (ctx *Filter) deduplicate() {
+	// The later of two entries for a name wins, keeping the later expiry
+	var unique []DomainEntry
+	index := make(map[string]int)
+	for _, domainEntry := range ctx.Domains {
+		i, ok := index[domainEntry.Name]
+		if !ok {
+			index[domainEntry.Name] = len(unique)
+			unique = append(unique, domainEntry)
+			continue
+		}
+		earlier := unique[i]
+		// Attempt to preserve hit counts
+		if domainEntry.Hits == 0 {
+			domainEntry.Hits = earlier.Hits
+		}
+		if outlasts(earlier.Expires, domainEntry.Expires) {
+			domainEntry.Expires = earlier.Expires
+		}
+		unique[i] = domainEntry
+	}
+	// A broader entry (a parent domain) supersedes narrower ones, unless they outlast it
 	var newlist []DomainEntry
-	for i, domainEntry := range ctx.Domains[:len(ctx.Domains)] {
+	for _, domainEntry := range unique {
 		add := true
-		for _, domainEntryCompare := range ctx.Domains[i+1:] {
-			if domainEntry.Matches(domainEntryCompare.Name) {
-				// Attempt to preserve hit counts
-				if domainEntryCompare.Hits == 0 {
-					domainEntryCompare.Hits = domainEntry.Hits
-				}
+		for _, domainEntryCompare := range unique {
+			if domainEntryCompare.Name != domainEntry.Name && domainEntryCompare.Matches(domainEntry.Name) && outlasts(domainEntryCompare.Expires, domainEntry.Expires) {
 				add = false
 				break
 			}
@@ -244,3 +565,8 @@ func (ctx *Filter) deduplicate() {
 	}
 	ctx.Domains = newlist
 }
+
+// Whether an expiry lasts at least as long as another (zero never expires)
+func outlasts(expires time.Time, other time.Time) bool {
+	return expires.IsZero() || (!other.IsZero() && !expires.Before(other))
+}
@@ -0,0 +1,35 @@
+package filter
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeduplicateKeepsPermanentEntries(t *testing.T) {
+	expires := time.Now().Add(time.Hour)
+	ctx := Filter{Domains: []DomainEntry{{Name: "example.com"}, {Name: "www.example.com"}}}
+	ctx.Add([]DomainEntry{{Name: "example.com", Expires: expires}, {Name: "example.com", Expires: expires}})
+	ctx.Add([]DomainEntry{{Name: "www.example.com", Expires: expires}})
+	if len(ctx.Domains) != 1 || ctx.Domains[0].Name != "example.com" || !ctx.Domains[0].Expires.IsZero() {
+		t.Fatalf("expected only a permanent example.com, got %+v", ctx.Domains)
+	}
+
+	// A temporary parent leaves the permanent narrower entry in place
+	ctx = Filter{Domains: []DomainEntry{{Name: "www.example.com"}}}
+	ctx.Add([]DomainEntry{{Name: "example.com", Expires: expires}})
+	if len(ctx.Domains) != 2 {
+		t.Fatalf("expected both entries, got %+v", ctx.Domains)
+	}
+	ctx.Expire(expires.Add(time.Second))
+	if !ctx.Matches("www.example.com") || ctx.Matches("mail.example.com") {
+		t.Fatalf("expected only www.example.com blocked after expiry, got %+v", ctx.Domains)
+	}
+
+	// Two temporary entries keep the later expiry
+	later := expires.Add(time.Hour)
+	ctx = Filter{Domains: []DomainEntry{{Name: "example.com", Expires: later}, {Name: "www.example.com", Expires: expires}}}
+	ctx.Add([]DomainEntry{{Name: "example.com", Expires: expires}})
+	if len(ctx.Domains) != 1 || !ctx.Domains[0].Expires.Equal(later) {
+		t.Fatalf("expected example.com until %s, got %+v", later, ctx.Domains)
+	}
+}
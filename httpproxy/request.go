@@ -0,0 +1,206 @@
+package httpproxy
+
+import (
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Limits applied while reading a request head
+const (
+	MaxLineLength  = 8192
+	MaxHeaderCount = 100
+)
+
+// Header line of a request
+type Header struct {
+	Name  string
+	Value string
+}
+
+// Request head of an HTTP proxy request
+type Request struct {
+	Method        string
+	Target        string
+	Version       string
+	Headers       []Header
+	ContentLength int64
+	Chunked       bool
+}
+
+// Get returns the value of the first header with the given name
+func (req *Request) Get(name string) string {
+	for _, header := range req.Headers {
+		if strings.EqualFold(header.Name, name) {
+			return header.Value
+		}
+	}
+	return ""
+}
+
+// Count the headers with the given name
+func (req *Request) count(name string) int {
+	count := 0
+	for _, header := range req.Headers {
+		if strings.EqualFold(header.Name, name) {
+			count++
+		}
+	}
+	return count
+}
+
+// Check a string against the token characters from RFC 7230
+func isToken(s string) bool {
+	if len(s) == 0 {
+		return false
+	}
+	for _, c := range []byte(s) {
+		if c <= ' ' || c >= 0x7F || strings.IndexByte("\"(),/:;<=>?@[\\]{}", c) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Read a single CRLF terminated line, rejecting bare LF and oversized lines
+func readLine(reader *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		data, err := reader.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if data == '\n' {
+			if len(line) == 0 || line[len(line)-1] != '\r' {
+				return "", fmt.Errorf("line not terminated by CRLF")
+			}
+			return string(line[:len(line)-1]), nil
+		}
+		line = append(line, data)
+		if len(line) > MaxLineLength {
+			return "", fmt.Errorf("line too long")
+		}
+	}
+}
+
+// ReadRequest strictly parses a request head so ambiguous requests never reach a backend
+func ReadRequest(reader *bufio.Reader) (*Request, error) {
+	line, err := readLine(reader)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Split(line, " ")
+	if len(parts) != 3 || !isToken(parts[0]) || len(parts[1]) == 0 {
+		return nil, fmt.Errorf("malformed request line")
+	}
+	req := &Request{Method: parts[0], Target: parts[1], Version: parts[2], ContentLength: -1}
+	if req.Version != "HTTP/1.1" && req.Version != "HTTP/1.0" {
+		return nil, fmt.Errorf("unsupported version: %s", req.Version)
+	}
+	req.Headers, err = readHeaders(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	// Message framing must be unambiguous
+	if req.count("Content-Length") > 1 {
+		return nil, fmt.Errorf("multiple Content-Length headers")
+	}
+	if req.count("Content-Length") == 1 {
+		value := req.Get("Content-Length")
+		if strings.Trim(value, "0123456789") != "" {
+			return nil, fmt.Errorf("invalid Content-Length: %s", value)
+		}
+		req.ContentLength, err = strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Content-Length: %s", value)
+		}
+	}
+	if req.count("Transfer-Encoding") > 0 {
+		if req.count("Transfer-Encoding") > 1 || req.ContentLength >= 0 {
+			return nil, fmt.Errorf("conflicting Transfer-Encoding")
+		}
+		if req.Version == "HTTP/1.0" || !strings.EqualFold(req.Get("Transfer-Encoding"), "chunked") {
+			return nil, fmt.Errorf("unsupported Transfer-Encoding: %s", req.Get("Transfer-Encoding"))
+		}
+		req.Chunked = true
+	}
+	if req.count("Host") > 1 || (req.Version == "HTTP/1.1" && req.count("Host") == 0) {
+		return nil, fmt.Errorf("missing or duplicate Host header")
+	}
+	return req, nil
+}
+
+// Read header lines up to the blank line ending a message head
+func readHeaders(reader *bufio.Reader) ([]Header, error) {
+	var headers []Header
+	for {
+		line, err := readLine(reader)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 {
+			return headers, nil
+		}
+		// Obsolete line folding is a classic smuggling vector
+		if line[0] == ' ' || line[0] == '\t' {
+			return nil, fmt.Errorf("folded header")
+		}
+		colon := strings.IndexByte(line, ':')
+		if colon < 0 || !isToken(line[:colon]) {
+			return nil, fmt.Errorf("malformed header")
+		}
+		value := strings.Trim(line[colon+1:], " \t")
+		for _, c := range []byte(value) {
+			if (c < ' ' && c != '\t') || c == 0x7F {
+				return nil, fmt.Errorf("invalid character in header: %s", line[:colon])
+			}
+		}
+		headers = append(headers, Header{Name: line[:colon], Value: value})
+		if len(headers) > MaxHeaderCount {
+			return nil, fmt.Errorf("too many headers")
+		}
+	}
+}
+
+// Response head from an upstream HTTP proxy
+type Response struct {
+	Version string
+	Status  int
+	Reason  string
+	Headers []Header
+}
+
+// Get returns the value of the first header with the given name
+func (resp *Response) Get(name string) string {
+	for _, header := range resp.Headers {
+		if strings.EqualFold(header.Name, name) {
+			return header.Value
+		}
+	}
+	return ""
+}
+
+// ReadResponse parses a response head (the body, if any, is left in the reader)
+func ReadResponse(reader *bufio.Reader) (*Response, error) {
+	line, err := readLine(reader)
+	if err != nil {
+		return nil, err
+	}
+	version, rest, _ := strings.Cut(line, " ")
+	code, reason, _ := strings.Cut(rest, " ")
+	resp := &Response{Version: version, Reason: reason}
+	if resp.Version != "HTTP/1.1" && resp.Version != "HTTP/1.0" {
+		return nil, fmt.Errorf("unsupported version: %s", resp.Version)
+	}
+	if len(code) != 3 || strings.Trim(code, "0123456789") != "" {
+		return nil, fmt.Errorf("malformed status line")
+	}
+	resp.Status, _ = strconv.Atoi(code)
+	resp.Headers, err = readHeaders(reader)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
@@ -0,0 +1,236 @@
+package metrics
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Labels attached to a measurement
+type Labels map[string]string
+
+// Metrics receives measurements from the server (implementations must not block)
+type Metrics interface {
+	// Counter adds to a running total
+	Counter(name string, value int64, labels Labels)
+	// Gauge sets a value that can go up and down
+	Gauge(name string, value float64, labels Labels)
+	// Histogram records an observation (durations are in seconds)
+	Histogram(name string, value float64, labels Labels)
+}
+
+// Noop discards all measurements
+type Noop struct{}
+
+// Counter is ignored
+func (Noop) Counter(name string, value int64, labels Labels) {}
+
+// Gauge is ignored
+func (Noop) Gauge(name string, value float64, labels Labels) {}
+
+// Histogram is ignored
+func (Noop) Histogram(name string, value float64, labels Labels) {}
+
+// Multi passes measurements to several implementations
+type Multi []Metrics
+
+// Counter for every implementation
+func (ctx Multi) Counter(name string, value int64, labels Labels) {
+	for _, metrics := range ctx {
+		metrics.Counter(name, value, labels)
+	}
+}
+
+// Gauge for every implementation
+func (ctx Multi) Gauge(name string, value float64, labels Labels) {
+	for _, metrics := range ctx {
+		metrics.Gauge(name, value, labels)
+	}
+}
+
+// Histogram for every implementation
+func (ctx Multi) Histogram(name string, value float64, labels Labels) {
+	for _, metrics := range ctx {
+		metrics.Histogram(name, value, labels)
+	}
+}
+
+// Join the label pairs in a stable order
+func (labels Labels) format(separator string, pair func(key string, value string) string) string {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, key := range keys {
+		pairs = append(pairs, pair(key, labels[key]))
+	}
+	return strings.Join(pairs, separator)
+}
+
+// Buckets for Prometheus histograms (seconds)
+var Buckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+
+type series struct {
+	labels  Labels
+	value   float64
+	buckets []uint64
+	count   uint64
+}
+
+type family struct {
+	kind   string
+	series map[string]*series
+}
+
+// Prometheus keeps measurements in memory and serves them in the text exposition format
+type Prometheus struct {
+	Prefix   string
+	lock     sync.Mutex
+	families map[string]*family
+}
+
+// Find or create a series (caller holds the lock)
+func (ctx *Prometheus) series(kind string, name string, labels Labels) *series {
+	if ctx.families == nil {
+		ctx.families = make(map[string]*family)
+	}
+	name = ctx.Prefix + name
+	metric, ok := ctx.families[name]
+	if !ok {
+		metric = &family{kind: kind, series: make(map[string]*series)}
+		ctx.families[name] = metric
+	}
+	key := labels.format(",", func(key string, value string) string { return key + "=" + value })
+	entry, ok := metric.series[key]
+	if !ok {
+		entry = &series{labels: labels}
+		if kind == "histogram" {
+			entry.buckets = make([]uint64, len(Buckets))
+		}
+		metric.series[key] = entry
+	}
+	return entry
+}
+
+// Counter adds to a running total
+func (ctx *Prometheus) Counter(name string, value int64, labels Labels) {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	ctx.series("counter", name, labels).value += float64(value)
+}
+
+// Gauge sets a value
+func (ctx *Prometheus) Gauge(name string, value float64, labels Labels) {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	ctx.series("gauge", name, labels).value = value
+}
+
+// Histogram records an observation in the buckets
+func (ctx *Prometheus) Histogram(name string, value float64, labels Labels) {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	entry := ctx.series("histogram", name, labels)
+	for i, bound := range Buckets {
+		if value <= bound {
+			entry.buckets[i]++
+		}
+	}
+	entry.value += value
+	entry.count++
+}
+
+// Format label pairs for the exposition format, with an optional extra pair
+func exposition(labels Labels, extra ...string) string {
+	all := Labels{}
+	for key, value := range labels {
+		all[key] = value
+	}
+	if len(extra) == 2 {
+		all[extra[0]] = extra[1]
+	}
+	if len(all) == 0 {
+		return ""
+	}
+	return "{" + all.format(",", func(key string, value string) string { return key + "=" + strconv.Quote(value) }) + "}"
+}
+
+// ServeHTTP writes all measurements in the text exposition format
+func (ctx *Prometheus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	names := make([]string, 0, len(ctx.families))
+	for name := range ctx.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, name := range names {
+		metric := ctx.families[name]
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, metric.kind)
+		keys := make([]string, 0, len(metric.series))
+		for key := range metric.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			entry := metric.series[key]
+			if metric.kind != "histogram" {
+				fmt.Fprintf(w, "%s%s %v\n", name, exposition(entry.labels), entry.value)
+				continue
+			}
+			for i, bound := range Buckets {
+				fmt.Fprintf(w, "%s_bucket%s %d\n", name, exposition(entry.labels, "le", strconv.FormatFloat(bound, 'g', -1, 64)), entry.buckets[i])
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", name, exposition(entry.labels, "le", "+Inf"), entry.count)
+			fmt.Fprintf(w, "%s_sum%s %v\n", name, exposition(entry.labels), entry.value)
+			fmt.Fprintf(w, "%s_count%s %d\n", name, exposition(entry.labels), entry.count)
+		}
+	}
+}
+
+// StatsD sends measurements over UDP (labels are sent as DogStatsD style tags)
+type StatsD struct {
+	Prefix     string
+	connection net.Conn
+}
+
+// NewStatsD creates a client for a StatsD server
+func NewStatsD(address string, prefix string) (*StatsD, error) {
+	connection, err := net.DialTimeout("udp", address, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return &StatsD{Prefix: prefix, connection: connection}, nil
+}
+
+// Send one measurement (losses are acceptable, so errors are ignored)
+func (ctx *StatsD) send(name string, value string, kind string, labels Labels) {
+	line := ctx.Prefix + name + ":" + value + "|" + kind
+	if len(labels) > 0 {
+		line += "|#" + labels.format(",", func(key string, value string) string { return key + ":" + value })
+	}
+	ctx.connection.Write([]byte(line))
+}
+
+// Counter adds to a running total
+func (ctx *StatsD) Counter(name string, value int64, labels Labels) {
+	ctx.send(name, strconv.FormatInt(value, 10), "c", labels)
+}
+
+// Gauge sets a value
+func (ctx *StatsD) Gauge(name string, value float64, labels Labels) {
+	ctx.send(name, strconv.FormatFloat(value, 'g', -1, 64), "g", labels)
+}
+
+// Histogram records a duration as a timer in milliseconds
+func (ctx *StatsD) Histogram(name string, value float64, labels Labels) {
+	ctx.send(name, strconv.FormatFloat(value*1000, 'f', 3, 64), "ms", labels)
+}
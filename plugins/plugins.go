@@ -0,0 +1,95 @@
+package plugins
+
+import (
+	"fmt"
+	"path/filepath"
+	"plugin"
+	"proxy/socks5"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Handlers registered at build time or loaded from plugins, by name
+var (
+	registry     = make(map[string]socks5.EventHandler)
+	registryLock sync.Mutex
+)
+
+// Register a handler for connection events (call from init in a file built into the proxy)
+func Register(name string, handler socks5.EventHandler) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	if _, ok := registry[name]; ok {
+		panic("plugins: handler registered twice: " + name)
+	}
+	registry[name] = handler
+}
+
+// Load a Go plugin (built with -buildmode=plugin) exporting a Handler variable or function,
+// registered under the file's name
+func Load(file string) (string, error) {
+	library, err := plugin.Open(file)
+	if err != nil {
+		return "", err
+	}
+	symbol, err := library.Lookup("Handler")
+	if err != nil {
+		return "", err
+	}
+	var handler socks5.EventHandler
+	switch value := symbol.(type) {
+	case *socks5.EventHandler:
+		// var Handler socks5.EventHandler = ...
+		handler = *value
+	case func(socks5.Event):
+		// func Handler(event socks5.Event)
+		handler = Func(value)
+	case socks5.EventHandler:
+		// var Handler auditor, where *auditor has a HandleEvent method
+		handler = value
+	}
+	if handler == nil {
+		return "", fmt.Errorf("plugin %s: Handler is not an event handler (%T)", file, symbol)
+	}
+	name := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	if _, ok := registry[name]; ok {
+		return "", fmt.Errorf("plugin %s: handler already registered: %s", file, name)
+	}
+	registry[name] = handler
+	return name, nil
+}
+
+// Names of the registered handlers, sorted
+func Names() []string {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Handlers registered, in name order
+func Handlers() []socks5.EventHandler {
+	names := Names()
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	handlers := make([]socks5.EventHandler, 0, len(names))
+	for _, name := range names {
+		handlers = append(handlers, registry[name])
+	}
+	return handlers
+}
+
+// Func adapts a function to an event handler
+type Func func(event socks5.Event)
+
+// HandleEvent passes the event to the function
+func (handler Func) HandleEvent(event socks5.Event) {
+	handler(event)
+}
@@ -0,0 +1,496 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Actions a rule can take
+const (
+	Allow = "allow"
+	Deny  = "deny"
+	Route = "route"
+)
+
+// Direct is the route that skips the outbound proxies
+const Direct = "direct"
+
+// Attributes of a connection that rules can test
+type Attributes struct {
+	Client   string
+	User     string
+	Host     string
+	Port     int
+	Command  string
+	Origin   string
+	Tenant   string
+	Listener string
+	Time     time.Time
+}
+
+// Rule applying an action to the connections its condition matches
+type Rule struct {
+	Name   string `json:"name"`
+	When   string `json:"when"`
+	Action string `json:"action"`
+	Route  string `json:"route"`
+	cond   node
+}
+
+// Decision made by the first matching rule
+type Decision struct {
+	Rule   string
+	Action string
+	Route  string
+}
+
+// Policy evaluated for every connection, in rule order
+type Policy struct {
+	Rules []Rule `json:"rules"`
+}
+
+// LoadFile retrieves the policy from a file, compiling every rule
+func (ctx *Policy) LoadFile(file string) bool {
+	input, err := os.Open(file)
+	if err != nil {
+		return false
+	}
+	defer input.Close()
+	finfo, err := input.Stat()
+	if err != nil {
+		return false
+	}
+	data := make([]byte, finfo.Size())
+	_, err = input.Read(data)
+	if err != nil {
+		return false
+	}
+	var policy Policy
+	err = json.Unmarshal(data, &policy)
+	if err != nil {
+		return false
+	}
+	for i := range policy.Rules {
+		if policy.Rules[i].compile() != nil {
+			return false
+		}
+	}
+	ctx.Rules = policy.Rules
+	return true
+}
+
+// Compile a rule's condition and check its action (an empty condition matches everything)
+func (rule *Rule) compile() error {
+	switch rule.Action {
+	case Allow, Deny:
+	case Route:
+		if len(rule.Route) == 0 {
+			return fmt.Errorf("route rule without a route: %s", rule.Name)
+		}
+	default:
+		return fmt.Errorf("unknown action %q: %s", rule.Action, rule.Name)
+	}
+	if len(strings.TrimSpace(rule.When)) == 0 {
+		rule.cond = literal{true}
+		return nil
+	}
+	cond, err := parseCondition(rule.When)
+	if err != nil {
+		return fmt.Errorf("%s: %s", rule.Name, err.Error())
+	}
+	rule.cond = cond
+	return nil
+}
+
+// Evaluate returns the decision of the first rule matching a connection (false when none does)
+func (ctx *Policy) Evaluate(attributes Attributes) (Decision, bool) {
+	for _, rule := range ctx.Rules {
+		if rule.cond == nil {
+			continue
+		}
+		matched, err := test(rule.cond, attributes)
+		if err == nil && matched {
+			name := rule.Name
+			if len(name) == 0 {
+				name = rule.When
+			}
+			return Decision{Rule: name, Action: rule.Action, Route: rule.Route}, true
+		}
+	}
+	return Decision{}, false
+}
+
+// Parse a condition, checking its types against a connection with every attribute empty
+func parseCondition(expression string) (node, error) {
+	parser := &parser{tokens: tokenize(expression)}
+	cond, err := parser.or()
+	if err == nil && parser.position < len(parser.tokens) {
+		err = fmt.Errorf("unexpected %q", parser.tokens[parser.position])
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Attributes always have the same types, so a type error shows up on any connection
+	err = verify(cond)
+	if err == nil {
+		_, err = test(cond, Attributes{})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return cond, nil
+}
+
+// Evaluate every part of a condition, including those && and || would skip
+func verify(cond node) error {
+	switch n := cond.(type) {
+	case logical:
+		_, err := test(n.left, Attributes{})
+		if err == nil {
+			_, err = test(n.right, Attributes{})
+		}
+		if err == nil {
+			err = verify(n.left)
+		}
+		if err == nil {
+			err = verify(n.right)
+		}
+		return err
+	case not:
+		return verify(n.operand)
+	case comparison:
+		err := verify(n.left)
+		if err == nil {
+			err = verify(n.right)
+		}
+		if err == nil {
+			_, err = n.eval(Attributes{})
+		}
+		return err
+	}
+	_, err := cond.eval(Attributes{})
+	return err
+}
+
+// Evaluate a condition that must be true or false
+func test(cond node, attributes Attributes) (bool, error) {
+	value, err := cond.eval(attributes)
+	if err != nil {
+		return false, err
+	}
+	result, ok := value.(bool)
+	if !ok {
+		return false, fmt.Errorf("condition is not true or false: %v", value)
+	}
+	return result, nil
+}
+
+// Part of a condition (values are strings, ints, bools or lists)
+type node interface {
+	eval(attributes Attributes) (interface{}, error)
+}
+
+type literal struct {
+	value interface{}
+}
+
+func (n literal) eval(attributes Attributes) (interface{}, error) {
+	return n.value, nil
+}
+
+type list []node
+
+func (n list) eval(attributes Attributes) (interface{}, error) {
+	values := make([]interface{}, len(n))
+	for i, item := range n {
+		value, err := item.eval(attributes)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+// Attribute of the connection, by name
+type variable string
+
+func (n variable) eval(attributes Attributes) (interface{}, error) {
+	switch n {
+	case "client":
+		return attributes.Client, nil
+	case "user":
+		return attributes.User, nil
+	case "host":
+		return strings.ToLower(attributes.Host), nil
+	case "port":
+		return attributes.Port, nil
+	case "command":
+		return attributes.Command, nil
+	case "origin":
+		return attributes.Origin, nil
+	case "tenant":
+		return attributes.Tenant, nil
+	case "listener":
+		return attributes.Listener, nil
+	case "hour":
+		return attributes.Time.Hour(), nil
+	case "minute":
+		return attributes.Time.Minute(), nil
+	case "weekday":
+		return strings.ToLower(attributes.Time.Weekday().String()[:3]), nil
+	}
+	return nil, fmt.Errorf("unknown attribute: %s", string(n))
+}
+
+type not struct {
+	operand node
+}
+
+func (n not) eval(attributes Attributes) (interface{}, error) {
+	value, err := test(n.operand, attributes)
+	return !value, err
+}
+
+// Short-circuiting && and ||
+type logical struct {
+	operator    string
+	left, right node
+}
+
+func (n logical) eval(attributes Attributes) (interface{}, error) {
+	left, err := test(n.left, attributes)
+	if err != nil {
+		return nil, err
+	}
+	if (n.operator == "&&") != left {
+		// false && ... or true || ...
+		return left, nil
+	}
+	return test(n.right, attributes)
+}
+
+type comparison struct {
+	operator    string
+	left, right node
+}
+
+func (n comparison) eval(attributes Attributes) (interface{}, error) {
+	left, err := n.left.eval(attributes)
+	if err != nil {
+		return nil, err
+	}
+	right, err := n.right.eval(attributes)
+	if err != nil {
+		return nil, err
+	}
+	switch n.operator {
+	case "==", "!=":
+		if fmt.Sprintf("%T", left) != fmt.Sprintf("%T", right) {
+			return nil, fmt.Errorf("comparing %v with %v", left, right)
+		}
+		return (fmt.Sprint(left) == fmt.Sprint(right)) == (n.operator == "=="), nil
+	case "<", "<=", ">", ">=":
+		a, ok := left.(int)
+		b, ok2 := right.(int)
+		if !ok || !ok2 {
+			return nil, fmt.Errorf("%s needs numbers: %v, %v", n.operator, left, right)
+		}
+		switch n.operator {
+		case "<":
+			return a < b, nil
+		case "<=":
+			return a <= b, nil
+		case ">":
+			return a > b, nil
+		}
+		return a >= b, nil
+	case "matches":
+		text, ok := left.(string)
+		pattern, ok2 := right.(string)
+		if !ok || !ok2 {
+			return nil, fmt.Errorf("matches needs strings: %v, %v", left, right)
+		}
+		matched, err := path.Match(strings.ToLower(pattern), strings.ToLower(text))
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern: %s", pattern)
+		}
+		return matched, nil
+	case "in":
+		if items, ok := right.([]interface{}); ok {
+			for _, item := range items {
+				if fmt.Sprintf("%T", item) == fmt.Sprintf("%T", left) && fmt.Sprint(item) == fmt.Sprint(left) {
+					return true, nil
+				}
+			}
+			return false, nil
+		}
+		// A network (CIDR) holding an address
+		text, ok := left.(string)
+		cidr, ok2 := right.(string)
+		_, network, err := net.ParseCIDR(cidr)
+		if !ok || !ok2 || err != nil {
+			return nil, fmt.Errorf("in needs a list or a network: %v", right)
+		}
+		// An address on a particular interface is still in the network
+		address, _, _ := strings.Cut(text, "%")
+		ip := net.ParseIP(address)
+		return ip != nil && network.Contains(ip), nil
+	}
+	return nil, fmt.Errorf("unknown operator: %s", n.operator)
+}
+
+// Split an expression into strings (kept quoted), numbers, names and operators
+func tokenize(expression string) []string {
+	var tokens []string
+	runes := []rune(expression)
+	for i := 0; i < len(runes); {
+		char := runes[i]
+		switch {
+		case unicode.IsSpace(char):
+			i++
+		case char == '"':
+			end := i + 1
+			for end < len(runes) && runes[end] != '"' {
+				if runes[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			tokens = append(tokens, string(runes[i:min(end+1, len(runes))]))
+			i = end + 1
+		case unicode.IsLetter(char) || unicode.IsDigit(char) || char == '_':
+			end := i
+			for end < len(runes) && (unicode.IsLetter(runes[end]) || unicode.IsDigit(runes[end]) || runes[end] == '_') {
+				end++
+			}
+			tokens = append(tokens, string(runes[i:end]))
+			i = end
+		case i+1 < len(runes) && strings.Contains("== != <= >= && ||", string(runes[i:i+2])):
+			tokens = append(tokens, string(runes[i:i+2]))
+			i += 2
+		default:
+			tokens = append(tokens, string(char))
+			i++
+		}
+	}
+	return tokens
+}
+
+// Recursive descent parser, from the loosest binding operator (||) to single values
+type parser struct {
+	tokens   []string
+	position int
+}
+
+// The next token, or nothing at the end
+func (ctx *parser) peek() string {
+	if ctx.position < len(ctx.tokens) {
+		return ctx.tokens[ctx.position]
+	}
+	return ""
+}
+
+func (ctx *parser) or() (node, error) {
+	left, err := ctx.and()
+	for err == nil && ctx.peek() == "||" {
+		ctx.position++
+		var right node
+		right, err = ctx.and()
+		left = logical{operator: "||", left: left, right: right}
+	}
+	return left, err
+}
+
+func (ctx *parser) and() (node, error) {
+	left, err := ctx.unary()
+	for err == nil && ctx.peek() == "&&" {
+		ctx.position++
+		var right node
+		right, err = ctx.unary()
+		left = logical{operator: "&&", left: left, right: right}
+	}
+	return left, err
+}
+
+func (ctx *parser) unary() (node, error) {
+	if ctx.peek() == "!" {
+		ctx.position++
+		operand, err := ctx.unary()
+		return not{operand}, err
+	}
+	return ctx.comparison()
+}
+
+func (ctx *parser) comparison() (node, error) {
+	left, err := ctx.value()
+	if err != nil {
+		return nil, err
+	}
+	switch operator := ctx.peek(); operator {
+	case "==", "!=", "<", "<=", ">", ">=", "matches", "in":
+		ctx.position++
+		right, err := ctx.value()
+		return comparison{operator: operator, left: left, right: right}, err
+	}
+	return left, nil
+}
+
+func (ctx *parser) value() (node, error) {
+	token := ctx.peek()
+	ctx.position++
+	switch {
+	case len(token) == 0:
+		return nil, fmt.Errorf("unexpected end of condition")
+	case token == "(":
+		inner, err := ctx.or()
+		if err != nil {
+			return nil, err
+		}
+		if ctx.peek() != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		ctx.position++
+		return inner, nil
+	case token == "[":
+		var items list
+		for ctx.peek() != "]" {
+			item, err := ctx.value()
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+			if ctx.peek() == "," {
+				ctx.position++
+			} else if ctx.peek() != "]" {
+				return nil, fmt.Errorf("missing ]")
+			}
+		}
+		ctx.position++
+		return items, nil
+	case token[0] == '"':
+		text, err := strconv.Unquote(token)
+		if err != nil {
+			return nil, fmt.Errorf("invalid string: %s", token)
+		}
+		return literal{text}, nil
+	case unicode.IsDigit(rune(token[0])):
+		number, err := strconv.Atoi(token)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number: %s", token)
+		}
+		return literal{number}, nil
+	case token == "true" || token == "false":
+		return literal{token == "true"}, nil
+	case unicode.IsLetter(rune(token[0])):
+		return variable(token), nil
+	}
+	return nil, fmt.Errorf("unexpected %q", token)
+}
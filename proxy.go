@@ -1,16 +1,188 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"fmt"
 	"net"
+	"net/http"
+	"os"
+	"proxy/acme"
+	"proxy/api"
+	"proxy/config"
+	"proxy/control"
+	"proxy/failover"
+	"proxy/filter"
+	"proxy/metrics"
+	"proxy/plugins"
+	"proxy/policy"
 	"proxy/socks5"
+	"proxy/webhook"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
-func logger(ctx socks5.Context) {
+// Command line arguments
+var (
+	addrPtr              = flag.String("addr", "", "The local IP to bind to.")
+	portPtr              = flag.Int("port", 3128, "The port to listen on.")
+	acceptWorkersPtr     = flag.Int("acceptworkers", 1, "Accept loops per listen address, sharing the port with SO_REUSEPORT (Linux only).")
+	listenPtr            = flag.String("listen", "", "Additional addresses (comma separated) to accept clients on, prefixed tls:// or tcp:// to choose whether they use TLS.")
+	hostPtr              = flag.String("host", "0.0.0.0", "Public address of the proxy (IP or hostname).")
+	reportDomainPtr      = flag.Bool("reportdomain", false, "Report -host in replies as a domain name instead of resolving it to an IP at startup.")
+	proxiesPtr           = flag.String("proxies", "", "A JSON formatted file containing outbound proxies to use.")
+	blacklistPtr         = flag.String("blacklist", "blacklist.json", "Blacklist file to use (JSON formatted).")
+	blacklistBackupsPtr  = flag.Int("blacklistbackups", 5, "Timestamped copies of the blacklist file kept from before each change (for \"blacklist rollback\", 0 keeps none).")
+	updatePtr            = flag.Bool("update", false, "Pull new blacklist info from the configured sources (the built-in ones if none).")
+	sourcesPtr           = flag.String("sources", "", "A JSON formatted file of blacklist sources (\"sources\" as in the -config file).")
+	updatefromfilePtr    = flag.String("updatefile", "", "File containing additional blacklist URLs to import.")
+	updatefromURLPtr     = flag.String("updateurl", "", "URL with additional blacklist URLs to import (comma separated for several).")
+	updateTimeoutPtr     = flag.Duration("updatetimeout", 30*time.Second, "Time limit for downloading each blacklist URL.")
+	schedulePtr          = flag.String("schedule", "", "A JSON formatted file containing allowed time windows per user.")
+	scheduleWarnPtr      = flag.Duration("schedulewarn", 5*time.Minute, "How long before a window ends to warn about closing sessions.")
+	drainPtr             = flag.Duration("draingrace", 0, "Grace period before closing tunnels through proxies removed on reload (0 keeps them open).")
+	interimPtr           = flag.String("interim", "", "Load the blacklist in the background, allowing or denying (\"allow\" or \"deny\") connections until it is ready.")
+	judgePtr             = flag.String("judge", "", "URL that echoes request headers, used to classify outbound proxy anonymity.")
+	minAnonymityPtr      = flag.String("minanonymity", "", "Minimum anonymity class (transparent, anonymous, elite) for outbound proxies (requires -judge).")
+	keepAlivePtr         = flag.Duration("keepalive", 0, "TCP keepalive period for client connections (0 uses the system default, negative disables).")
+	upstreamKeepAlivePtr = flag.Duration("upstreamkeepalive", 0, "TCP keepalive period for outbound connections (0 uses the system default, negative disables).")
+	apiPtr               = flag.String("api", "", "Address to serve the HTTP API on (disabled if empty).")
+	apiTokenPtr          = flag.String("apitoken", "", "Bearer token required for the admin API (admin API disabled if empty).")
+	observerTokenPtr     = flag.String("observertoken", "", "Bearer token for read-only access to the admin API and its event stream, for auditors (disabled if empty).")
+	journalPtr           = flag.String("journal", "", "File recording runtime changes made through the admin API.")
+	prometheusPtr        = flag.Bool("prometheus", false, "Serve Prometheus metrics at /metrics on the API (requires -api and -apitoken).")
+	statsdPtr            = flag.String("statsd", "", "Address of a StatsD server to send metrics to (disabled if empty).")
+	destLimitPtr         = flag.Int("destlimit", 0, "Simultaneous tunnels allowed per destination host (0 is unlimited).")
+	destLimitsPtr        = flag.String("destlimits", "", "A JSON formatted file with a default per-destination limit and per-host overrides.")
+	httpHintPtr          = flag.Bool("httphint", false, "Answer HTTP requests sent to the SOCKS port with an error page explaining the mistake.")
+	fastOpenPtr          = flag.Bool("fastopen", false, "Use TCP Fast Open on listeners and outbound proxy connections where the platform allows it.")
+	linkLocalZonePtr     = flag.String("linklocalzone", "", "Interface (zone) for IPv6 link-local destinations requested without one, such as eth0.")
+	reachHintsPtr        = flag.Bool("reachhints", false, "Learn from ICMP unreachable errors (and pings where permitted) which address family works, preferring it for direct connections.")
+	tlsCertPtr           = flag.String("tls-cert", "", "Certificate file (PEM) for accepting SOCKS clients over TLS (requires -tls-key).")
+	tlsKeyPtr            = flag.String("tls-key", "", "Private key file (PEM) for the -tls-cert certificate.")
+	acmeHostPtr          = flag.String("acme-host", "", "Host names (comma separated) to obtain a TLS listener certificate for automatically with ACME.")
+	acmeCachePtr         = flag.String("acme-cache", "acme", "Directory keeping the ACME account key and certificate.")
+	acmeEmailPtr         = flag.String("acme-email", "", "Contact address for the ACME account (optional).")
+	acmeDirectoryPtr     = flag.String("acme-directory", acme.LetsEncrypt, "ACME directory URL of the certificate authority.")
+	acmeHTTPPtr          = flag.String("acme-http", ":80", "Address answering ACME http-01 challenges (must be reachable on port 80 of every -acme-host).")
+	tlsMinVersionPtr     = flag.String("tls-min-version", "1.2", "Oldest TLS version (1.0, 1.1, 1.2 or 1.3) accepted from clients of a TLS listener.")
+	tlsCiphersPtr        = flag.String("tls-ciphers", "", "Cipher suites (comma separated Go names) a TLS listener allows below TLS 1.3 (Go's defaults if empty).")
+	tlsNoResumptionPtr   = flag.Bool("tls-no-resumption", false, "Turn off TLS session resumption, so every client connection does a full handshake.")
+	tlsTicketsPtr        = flag.Duration("tls-ticket-rotation", 0, "How often a TLS listener's session ticket key is replaced (0 leaves rotation to Go, once a day).")
+	tlsClientCAPtr       = flag.String("tls-client-ca", "", "CA certificates (PEM) client certificates must be signed by, naming the user (requires -tls-cert).")
+	originsPtr           = flag.String("origins", "", "A JSON formatted file classifying clients (LAN, VPN, ...) by the networks they connect from.")
+	aliasesPtr           = flag.String("aliases", "", "A JSON formatted file of host aliases, connecting requests for a host (or host:port) to another destination.")
+	policyPtr            = flag.String("policy", "", "A JSON formatted file of policy rules (conditions on client, user, destination and time) allowing, denying or routing each request.")
+	routesPtr            = flag.String("routes", "", "A JSON formatted file of routes sending destinations (domain suffix, network or port) through a specific outbound proxy, a group of them or direct.")
+	mssPtr               = flag.String("mss", "", "A JSON formatted file with TCP MSS clamping per route (destination or outbound proxy host, or network).")
+	strictPtr            = flag.Bool("strict", false, "Refuse SOCKS5 clients that depart from RFC 1928/1929 (data sent ahead of a reply, empty credentials, reserved bytes, empty or malformed domain names) instead of logging and allowing it.")
+	strictEgressPtr      = flag.Bool("strict-egress", false, "With outbound proxies configured, refuse requests that would fall back to a direct connection (no proxies loaded) instead of leaking them; direct routes and the bypass list still apply.")
+	dropUnsupportedPtr   = flag.Bool("dropunsupported", false, "Drop clients requesting unsupported commands instead of replying (for hostile networks).")
+	httpPortPtr          = flag.Int("httpport", 0, "Port for a dedicated HTTP proxy listener, tunneling CONNECT and forwarding plain http:// requests (disabled if 0).")
+	transparentPortPtr   = flag.Int("transparentport", 0, "Port for a transparent listener taking iptables REDIRECTed connections (Linux only, disabled if 0; only redirect forwarded traffic, or the proxy's own connections loop).")
+	tproxyPortPtr        = flag.Int("tproxyport", 0, "Port for a transparent listener taking iptables TPROXY flows (Linux only, needs CAP_NET_ADMIN, disabled if 0).")
+	preserveSourcePtr    = flag.Bool("preservesource", false, "Make direct connections for TPROXY flows from the client's own address (replies must be routed back through this host).")
+	dnsInterceptPtr      = flag.String("dnsintercept", "", "UDP address where the transparent listener answers redirected DNS queries, refusing blacklisted names.")
+	dnsResolverPtr       = flag.String("dnsresolver", "", "Resolver (host:port) for intercepted DNS queries (defaults to the first nameserver in /etc/resolv.conf).")
+	httpConnectPtr       = flag.Bool("httpconnect", false, "Accept HTTP proxy requests (CONNECT and plain http:// URIs) alongside SOCKS on the same port.")
+	websocketPtr         = flag.String("websocket", "", "Path (such as /socks) where SOCKS clients can connect tunneled over WebSocket, for networks that only pass HTTP(S) (disabled if empty).")
+	pacPtr               = flag.Bool("pac", false, "Serve a proxy auto-config file at /proxy.pac and /wpad.dat on the HTTP proxy ports.")
+	bypassPtr            = flag.String("bypass", "", "Destinations (comma separated domains, networks, addresses, \"private\" or \"<local>\") always connected directly, even with outbound proxies loaded.")
+	pacBypassPtr         = flag.String("pacbypass", "", "Domains and IPv4 networks (comma separated) the PAC file sends direct, instead of through the proxy.")
+	socks6Ptr            = flag.Bool("socks6", false, "Accept experimental SOCKS6 (draft 11) requests alongside SOCKS4 and SOCKS5.")
+	gssapiPtr            = flag.String("gssapi", "", "Name of a compiled in GSS-API mechanism clients must authenticate with (disabled if empty).")
+	sessionTokensPtr     = flag.Duration("sessiontokens", 0, "How long session tokens issued through the self-service API (/token) are accepted as SOCKS passwords (0 disables).")
+	credentialsPtr       = flag.String("credentials", "", "A JSON formatted file of usernames and passwords clients must authenticate with (no authentication if empty).")
+	statusPtr            = flag.String("status", "", "File to write a JSON status report to (listeners, pool, blacklist and versions), kept up to date.")
+	statusIntervalPtr    = flag.Duration("statusinterval", 30*time.Second, "How often the status file is rewritten.")
+	summaryPtr           = flag.String("summary", "", "File to write a JSON summary of the run (connections, bytes, blocks, destinations, outbound proxies) to on exit.")
+	summaryTopPtr        = flag.Int("summarytop", 10, "Destinations listed in the exit summary (0 lists all).")
+	failoverPtr          = flag.String("failover", "", "A JSON formatted file pairing this instance with a warm standby (peer API, priority and hook); only the active one downloads blacklists, the standby takes them over.")
+	pluginsPtr           = flag.String("plugins", "", "Go plugins (comma separated .so files exporting Handler) receiving connection events.")
+	webhooksPtr          = flag.String("webhooks", "", "A JSON formatted file containing webhooks for connection events.")
+	verifyPtr            = flag.Bool("verifyupstream", false, "Validate outbound proxy replies and quarantine proxies that fail (may trip on protocols where the server speaks first).")
+	quarantinePtr        = flag.Duration("quarantine", 10*time.Minute, "How long to skip an outbound proxy that failed validation.")
+	healthCheckPtr       = flag.Duration("healthcheck", 0, "How often to probe every outbound proxy, skipping those that fail until they recover (0 disables).")
+	healthFailuresPtr    = flag.Int("healthfailures", 2, "Health probes an outbound proxy must fail in a row to be marked down.")
+	strategyPtr          = flag.String("strategy", socks5.StrategyRandom, "How outbound proxies are chosen: random, round-robin, least-connections, fastest or rotate.")
+	rotateEveryPtr       = flag.Duration("rotateevery", 10*time.Minute, "How long the rotate strategy keeps using one outbound proxy before switching (0 for no time limit).")
+	rotateAfterPtr       = flag.Int("rotateafter", 0, "Connections the rotate strategy makes through one outbound proxy before switching (0 for no limit).")
+	upstreamRetriesPtr   = flag.Int("retries", 2, "Other outbound proxies to try when the chosen one fails, before reporting the failure (0 never retries).")
+	utilizationPtr       = flag.Duration("utilization", 0, "How often outbound proxy pool utilization (active tunnels, bandwidth cap saturation) is reported as events for scaling the pool (0 disables).")
+	affinityPtr          = flag.Duration("affinity", 0, "How long connections to a destination host keep using the outbound proxy it was last reached through, so sites see one exit address (0 disables).")
+	latencyProbePtr      = flag.Duration("latencyprobe", time.Minute, "How often outbound proxies without recent tunnels are probed to update their latency (fastest strategy, 0 disables).")
+	healthTargetPtr      = flag.String("healthtarget", "", "Destination (host:port) health probes connect to through each outbound proxy (only its greeting is checked if empty).")
+	authFailuresPtr      = flag.Int("authfailures", 3, "Times an outbound proxy may reject its credentials before it is skipped until the proxies are reloaded (0 never skips).")
+	controlPtr           = flag.String("control", "", "Address (host:port or socket path) accepting exit, reload and dump commands.")
+	takeoverPtr          = flag.Bool("takeover", false, "Ask an instance already running with the same -control address to exit, then take over its listeners.")
+	listenRetryPtr       = flag.Duration("listenretry", 0, "How long to keep retrying when a listen address is already in use.")
+	traceDirPtr          = flag.String("tracedir", "", "Directory for connection traces requested through the admin API (defaults to the system temp directory).")
+	shutdownGracePtr     = flag.Duration("shutdowngrace", 5*time.Second, "How long active sessions may continue after an exit request before they are closed.")
+	handshakeTimeoutPtr  = flag.Duration("handshaketimeout", 30*time.Second, "How long a client may take to send its complete request before being disconnected (0 disables).")
+	maxMethodsPtr        = flag.Int("maxmethods", 16, "Authentication methods a client may offer in its greeting (0 is unlimited).")
+	udpIdlePtr           = flag.Duration("udpidle", 2*time.Minute, "Close UDP associations with no traffic for this long (0 disables).")
+	configPtr            = flag.String("config", "", "A JSON formatted file defining listeners, each with its own policy (overrides -addr and -port).")
+)
+
+// Apply exit, reload and dump commands to every listener
+func dispatch(commands chan string, contexts []*socks5.Context, collector *summaryCollector) {
+	for command := range commands {
+		switch command {
+		case control.Exit:
+			fmt.Print("\r [!] Shutting down\n")
+			var wait sync.WaitGroup
+			for _, ctx := range contexts {
+				wait.Add(1)
+				go func(ctx *socks5.Context) {
+					defer wait.Done()
+					ctx.Shutdown(*shutdownGracePtr)
+				}(ctx)
+			}
+			wait.Wait()
+			for _, ctx := range contexts {
+				ctx.SaveFilter()
+			}
+			summary := collector.finish(*summaryTopPtr, contexts)
+			printSummary(summary)
+			if len(*summaryPtr) > 0 {
+				err := writeSummary(*summaryPtr, summary)
+				if err != nil {
+					fmt.Printf(" [!] Failed to write summary: %s\n", err.Error())
+				}
+			}
+			os.Exit(0)
+		case control.Reload:
+			for _, ctx := range contexts {
+				ctx.ReloadProxies()
+			}
+		case control.Dump:
+			for _, ctx := range contexts {
+				ctx.Dump()
+			}
+		}
+	}
+}
+
+// Ask a previous instance to exit through its control socket and wait for it to stop
+func takeover(address string, timeout time.Duration) bool {
+	_, err := control.Send(address, control.Exit)
+	if err != nil {
+		return false
+	}
+	fmt.Printf(" [*] Asked the running instance at %s to exit\n", address)
+	deadline := time.Now().Add(timeout)
+	for control.Running(address) && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	return true
+}
+
+func logger(logs chan string) {
 	for {
-		line, ok := <-ctx.Logger
+		line, ok := <-logs
 		if !ok {
 			return
 		}
@@ -18,95 +190,903 @@ func logger(ctx socks5.Context) {
 	}
 }
 
-func main() {
-	// Process command line arguments
-	addrPtr := flag.String("addr", "", "The local IP to bind to.")
-	portPtr := flag.Int("port", 3128, "The port to listen on.")
-	hostPtr := flag.String("host", "0.0.0.0", "Public address of the proxy (IP or hostname).")
-	proxiesPtr := flag.String("proxies", "", "A JSON formatted file containing outbound proxies to use.")
-	blacklistPtr := flag.String("blacklist", "blacklist.json", "Blacklist file to use (JSON formatted).")
-	updatePtr := flag.Bool("update", false, "Pull new blacklist info from built-in URLS.")
-	updatefromfilePtr := flag.String("updatefile", "", "File containing additional blacklist URLs to import.")
-	updatefromURLPtr := flag.String("updateurl", "", "URL with additional blacklist URLs to import.")
-	flag.Parse()
+// Download a blacklist source periodically and add its domains to every shared listener's filter (a failover standby leaves that to the active peer, and takes over its blacklists)
+func refresh(source config.Source, contexts []*socks5.Context, pair *failover.Pair, logs chan string) {
+	name := source.Name
+	if len(name) == 0 {
+		name = source.URL
+	}
+	for {
+		time.Sleep(source.RefreshInterval())
+		if pair != nil && !pair.Active() {
+			logs <- fmt.Sprintf(" [*] Leaving the blacklist refresh to the failover peer: \"%s\"\n", name)
+			continue
+		}
+		entries, _, err := filter.FetchSource(filter.Source{Name: source.Name, URL: source.URL, Format: source.Format, Category: source.Category, TTL: source.EntryTTL()}, *updateTimeoutPtr)
+		if err != nil {
+			logs <- fmt.Sprintf(" [!] Error refreshing blacklist: \"%s\" (%s)\n", name, err.Error())
+			continue
+		}
+		for _, ctx := range contexts {
+			// Tenants keep only the blacklist they configure themselves
+			if ctx.Tenant == nil {
+				ctx.UpdateFilter(entries)
+			}
+		}
+		logs <- fmt.Sprintf(" [+] Refreshed %d domains from: \"%s\"\n", len(entries), name)
+	}
+}
 
-	// Socks5 context
-	var Socks5Ctx socks5.Context
+// Download every active blacklist source now, adding the entries to all shared listeners
+func updateSources(sources []config.Source, contexts []*socks5.Context, logs chan string) api.UpdateReport {
+	start := time.Now()
+	report := api.UpdateReport{}
+	var active []config.Source
+	for _, source := range sources {
+		if source.Active() {
+			active = append(active, source)
+		}
+	}
+	report.Sources = make([]api.SourceSummary, len(active))
+	var wait sync.WaitGroup
+	for i, source := range active {
+		wait.Add(1)
+		go func(i int, source config.Source) {
+			defer wait.Done()
+			name := source.Name
+			if len(name) == 0 {
+				name = source.URL
+			}
+			report.Sources[i].Source = name
+			entries, _, err := filter.FetchSource(filter.Source{Name: source.Name, URL: source.URL, Format: source.Format, Category: source.Category, TTL: source.EntryTTL()}, *updateTimeoutPtr)
+			if err != nil {
+				report.Sources[i].Error = err.Error()
+				logs <- fmt.Sprintf(" [!] Error refreshing blacklist: \"%s\" (%s)\n", name, err.Error())
+				return
+			}
+			for _, ctx := range contexts {
+				if ctx.Tenant == nil {
+					ctx.UpdateFilter(entries)
+				}
+			}
+			report.Sources[i].Count = len(entries)
+			logs <- fmt.Sprintf(" [+] Refreshed %d domains from: \"%s\"\n", len(entries), name)
+		}(i, source)
+	}
+	wait.Wait()
+	for _, summary := range report.Sources {
+		if len(summary.Error) > 0 {
+			report.Errors++
+		}
+	}
+	report.Duration = time.Since(start).String()
+	return report
+}
 
-	// Determine which IP to use
+// Automatically managed certificate for TLS listeners without their own
+var certificates *acme.Manager
 
-	ips, err := net.LookupIP(*hostPtr)
-	if err != nil {
-		fmt.Printf(" [!] Unable to determine IP: %s\n", *hostPtr)
-		return
+// Prepare a context for a listener, falling back to the command line settings
+func setup(ctx *socks5.Context, listener config.Listener, externalLists []config.Source) bool {
+	var err error
+	// Tenants are isolated, so they only get the policy they configure themselves
+	if len(listener.Tenant) == 0 {
+		if len(listener.Proxies) == 0 {
+			listener.Proxies = *proxiesPtr
+		}
+		if len(listener.Blacklist) == 0 {
+			listener.Blacklist = *blacklistPtr
+		}
+		if len(listener.Schedule) == 0 {
+			listener.Schedule = *schedulePtr
+		}
+		if len(listener.Destinations) == 0 {
+			listener.Destinations = *destLimitsPtr
+		}
+		if len(listener.Credentials) == 0 {
+			listener.Credentials = *credentialsPtr
+		}
+		if len(listener.GSSAPI) == 0 {
+			listener.GSSAPI = *gssapiPtr
+		}
+		if len(listener.Interim) == 0 {
+			listener.Interim = *interimPtr
+		}
+		if len(listener.MSS) == 0 {
+			listener.MSS = *mssPtr
+		}
+		if len(listener.Aliases) == 0 {
+			listener.Aliases = *aliasesPtr
+		}
+		if len(listener.Policy) == 0 {
+			listener.Policy = *policyPtr
+		}
+		if len(listener.Routes) == 0 {
+			listener.Routes = *routesPtr
+		}
 	}
-	Socks5Ctx.ReportIP = ips[0] // Select the first IP returned
-	fmt.Printf(" [+] IP to report: %s\n", Socks5Ctx.ReportIP.String())
-
-	// Create a channel for logging
-	Socks5Ctx.Logger = make(chan string, 100)
+	if len(listener.Origins) == 0 {
+		listener.Origins = *originsPtr
+	}
+	if len(listener.TLSCert) == 0 && len(listener.TLSKey) == 0 {
+		listener.TLSCert = *tlsCertPtr
+		listener.TLSKey = *tlsKeyPtr
+	}
+	if len(listener.TLSClientCA) == 0 {
+		listener.TLSClientCA = *tlsClientCAPtr
+	}
+	if len(listener.TLSMinVersion) == 0 {
+		listener.TLSMinVersion = *tlsMinVersionPtr
+	}
+	if len(listener.TLSCiphers) == 0 {
+		listener.TLSCiphers = *tlsCiphersPtr
+	}
+	listener.TLSNoResumption = listener.TLSNoResumption || *tlsNoResumptionPtr
 
 	// Create a channel to transfer inbound connections
-	Socks5Ctx.ClientConnections = make(chan socks5.ClientCtx, 10)
+	ctx.ClientConnections = make(chan *socks5.ClientCtx, 10)
 
-	// Setup connection string
-	Socks5Ctx.ListenAddress = *addrPtr + ":" + strconv.Itoa(*portPtr)
+	ctx.Name = listener.Name
+	ctx.ListenAddress = listener.Address
+	ctx.ListenAddresses = listener.Addresses
+	ctx.MaxConnections = listener.MaxConnections
+	ctx.VerifyUpstream = *verifyPtr || listener.VerifyUpstream
+	ctx.QuarantineTime = *quarantinePtr
+	ctx.HealthInterval = *healthCheckPtr
+	ctx.HealthFailures = *healthFailuresPtr
+	ctx.HealthTarget = *healthTargetPtr
+	ctx.LatencyInterval = *latencyProbePtr
+	ctx.UsageInterval = *utilizationPtr
+	ctx.UpstreamRetries = *upstreamRetriesPtr
+	ctx.AuthFailureLimit = *authFailuresPtr
+	ctx.SessionTokenTTL = *sessionTokensPtr
+	ctx.ListenRetry = *listenRetryPtr
+	ctx.AcceptWorkers = *acceptWorkersPtr
+	ctx.TraceDir = *traceDirPtr
+	ctx.UDPIdleTimeout = *udpIdlePtr
+	ctx.HandshakeTimeout = *handshakeTimeoutPtr
+	ctx.MaxMethods = *maxMethodsPtr
+	ctx.HTTPHint = *httpHintPtr
+	ctx.ReachabilityHints = *reachHintsPtr
+	ctx.LinkLocalZone = *linkLocalZonePtr
+	ctx.Socks6 = *socks6Ptr || listener.Socks6
+	ctx.HTTPConnect = *httpConnectPtr || listener.HTTPConnect
+	ctx.HTTPOnly = listener.HTTPOnly
+	ctx.WebSocket = listener.WebSocket
+	if len(ctx.WebSocket) == 0 && !listener.Transparent && !listener.TProxy {
+		ctx.WebSocket = *websocketPtr
+	}
+	if len(ctx.WebSocket) > 0 && !strings.HasPrefix(ctx.WebSocket, "/") {
+		fmt.Printf(" [!] The WebSocket path must start with /: %s\n", ctx.WebSocket)
+		return false
+	}
+	ctx.Transparent = listener.Transparent || listener.TProxy
+	ctx.TProxy = listener.TProxy
+	ctx.PreserveSource = listener.TProxy && (*preserveSourcePtr || listener.PreserveSource)
+	if ctx.Transparent && (listener.HTTPOnly || listener.HTTPConnect || listener.Socks6 || len(listener.WebSocket) > 0) {
+		fmt.Printf(" [!] A transparent listener cannot also speak HTTP, WebSocket or SOCKS6: %s\n", listener.Address)
+		return false
+	}
+
+	// DNS interception covers devices that resolve names themselves before their connections are redirected
+	if ctx.Transparent {
+		ctx.DNSIntercept = listener.DNSIntercept
+		if len(ctx.DNSIntercept) == 0 {
+			ctx.DNSIntercept = *dnsInterceptPtr
+		}
+		ctx.DNSResolver = listener.DNSResolver
+		if len(ctx.DNSResolver) == 0 {
+			ctx.DNSResolver = *dnsResolverPtr
+		}
+		if len(ctx.DNSResolver) == 0 {
+			ctx.DNSResolver = socks5.SystemResolver()
+		}
+		if len(ctx.DNSIntercept) > 0 && len(ctx.DNSResolver) == 0 {
+			fmt.Printf(" [!] No resolver for intercepted DNS (-dnsresolver): %s\n", listener.Address)
+			return false
+		}
+	} else if len(listener.DNSIntercept) > 0 {
+		fmt.Printf(" [!] DNS is only intercepted by transparent listeners: %s\n", listener.Address)
+		return false
+	}
+	ctx.DropUnsupported = *dropUnsupportedPtr || listener.DropUnsupported
+	ctx.Strict = *strictPtr
+
+	// Proxy auto-config for clients of the HTTP proxy
+	ctx.PAC = listener.PAC || (*pacPtr && (ctx.HTTPConnect || ctx.HTTPOnly))
+	if ctx.PAC && !ctx.HTTPConnect && !ctx.HTTPOnly {
+		fmt.Printf(" [!] The PAC file is served on HTTP proxy ports (http_connect or http_only): %s\n", listener.Address)
+		return false
+	}
+	ctx.PACBypass = listener.PACBypass
+	if len(ctx.PACBypass) == 0 && len(*pacBypassPtr) > 0 {
+		ctx.PACBypass = strings.Split(*pacBypassPtr, ",")
+	}
+	if ctx.PAC {
+		err = socks5.CheckBypass(ctx.PACBypass)
+		if err != nil {
+			fmt.Printf(" [!] %s\n", err.Error())
+			return false
+		}
+		fmt.Printf(" [+] Serving a PAC file (%d bypass entries).\n", len(ctx.PACBypass))
+	}
+
+	// Destinations kept off the outbound proxies
+	bypass := listener.Bypass
+	if len(bypass) == 0 && len(*bypassPtr) > 0 {
+		bypass = strings.Split(*bypassPtr, ",")
+	}
+	ctx.Bypass, err = socks5.ParseBypass(bypass)
+	if err != nil {
+		fmt.Printf(" [!] %s\n", err.Error())
+		return false
+	}
+	if len(bypass) > 0 {
+		fmt.Printf(" [+] Bypassing the outbound proxies for %d destination entries.\n", len(bypass))
+	}
+
+	ctx.FastOpen = *fastOpenPtr || listener.FastOpen
+	if ctx.FastOpen {
+		client, server := socks5.FastOpenSupport()
+		fmt.Printf(" [*] TCP Fast Open: outbound %v, inbound %v\n", client, server)
+	}
 
 	// Load list of outbound proxies to cycle between
-	if len(*proxiesPtr) > 0 {
-		if Socks5Ctx.Proxies.LoadFile(*proxiesPtr) {
-			fmt.Printf(" [+] Loaded %d outbound proxies.\n", len(Socks5Ctx.Proxies.Hosts))
+	if len(listener.Proxies) > 0 {
+		if ctx.Proxies.LoadFile(listener.Proxies) {
+			fmt.Printf(" [+] Loaded %d outbound proxies.\n", len(ctx.Proxies.Hosts))
 			fmt.Printf(" [+] IP will be reported from the remote proxy.\n")
+			if ctx.Proxies.Migrated() {
+				fmt.Printf(" [*] Upgrading %s from version %d to %d.\n", listener.Proxies, ctx.Proxies.Version, socks5.PoolVersion)
+				if !ctx.Proxies.SaveFile(listener.Proxies) {
+					fmt.Printf(" [!] Failed to save proxies to: %s\n", listener.Proxies)
+				}
+			}
+		} else {
+			fmt.Printf(" [!] Failed to load proxies from: %s\n", listener.Proxies)
+			if *strictEgressPtr {
+				fmt.Printf(" [*] Refusing connections until outbound proxies are loaded (strict egress).\n")
+			} else {
+				fmt.Printf(" [+] Continuing to run without relay proxies.")
+			}
+		}
+		ctx.StrictEgress = *strictEgressPtr
+	}
+
+	ctx.DrainGrace = *drainPtr
+	ctx.ClientKeepAlive = *keepAlivePtr
+	ctx.RemoteKeepAlive = *upstreamKeepAlivePtr
+
+	// Require clients to authenticate
+	if len(listener.Credentials) > 0 {
+		if ctx.Credentials.LoadFile(listener.Credentials) && ctx.Credentials.Required() {
+			fmt.Printf(" [+] Loaded credentials for %d users.\n", len(ctx.Credentials.Users))
+		} else {
+			fmt.Printf(" [!] Failed to load credentials from: %s\n", listener.Credentials)
+			return false
+		}
+	}
+
+	if len(listener.GSSAPI) > 0 {
+		mechanism, ok := socks5.LookupGSSMechanism(listener.GSSAPI)
+		if !ok {
+			fmt.Printf(" [!] GSS-API mechanism is not available: %s\n", listener.GSSAPI)
+			return false
+		}
+		ctx.GSSAPI = mechanism
+		fmt.Printf(" [+] Using GSS-API mechanism: %s\n", listener.GSSAPI)
+	}
+
+	// Accept clients over TLS
+	if len(listener.TLSCert) == 0 && len(listener.TLSKey) == 0 && certificates != nil {
+		// Certificates obtained and renewed automatically
+		ctx.TLSConfig = &tls.Config{GetCertificate: certificates.GetCertificate, MinVersion: tls.VersionTLS12}
+		fmt.Printf(" [+] Accepting TLS connections with the ACME certificate for: %s\n", strings.Join(certificates.Hosts, ", "))
+	} else if len(listener.TLSCert) > 0 || len(listener.TLSKey) > 0 {
+		certificate, err := tls.LoadX509KeyPair(listener.TLSCert, listener.TLSKey)
+		if err != nil {
+			fmt.Printf(" [!] Failed to load TLS certificate: %s\n", err.Error())
+			return false
+		}
+		ctx.TLSConfig = &tls.Config{Certificates: []tls.Certificate{certificate}, MinVersion: tls.VersionTLS12}
+		fmt.Printf(" [+] Accepting TLS connections with certificate: %s\n", listener.TLSCert)
+	}
+	if len(listener.TLSClientCA) > 0 {
+		if ctx.TLSConfig == nil {
+			fmt.Printf(" [!] Client certificates require a TLS listener (-tls-cert and -tls-key)\n")
+			return false
+		}
+		data, err := os.ReadFile(listener.TLSClientCA)
+		if err != nil {
+			fmt.Printf(" [!] Failed to load client CA: %s\n", err.Error())
+			return false
+		}
+		// Only clients with a certificate signed by the CA are accepted
+		ctx.TLSConfig.ClientCAs = x509.NewCertPool()
+		if !ctx.TLSConfig.ClientCAs.AppendCertsFromPEM(data) {
+			fmt.Printf(" [!] No certificates found in client CA: %s\n", listener.TLSClientCA)
+			return false
+		}
+		ctx.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		fmt.Printf(" [+] Requiring client certificates signed by: %s\n", listener.TLSClientCA)
+	}
+	if ctx.TLSConfig != nil {
+		ctx.TLSConfig.MinVersion, err = socks5.ParseTLSVersion(listener.TLSMinVersion)
+		if err != nil {
+			fmt.Printf(" [!] %s\n", err.Error())
+			return false
+		}
+		if len(listener.TLSCiphers) > 0 {
+			if ctx.TLSConfig.MinVersion == tls.VersionTLS13 {
+				fmt.Printf(" [!] Cipher suites cannot be chosen when only TLS 1.3 is accepted\n")
+				return false
+			}
+			ctx.TLSConfig.CipherSuites, err = socks5.ParseCipherSuites(listener.TLSCiphers)
+			if err != nil {
+				fmt.Printf(" [!] %s\n", err.Error())
+				return false
+			}
+		}
+		ctx.TLSConfig.SessionTicketsDisabled = listener.TLSNoResumption
+		ctx.TicketRotation = *tlsTicketsPtr
+		if len(listener.TLSTickets) > 0 {
+			ctx.TicketRotation, err = time.ParseDuration(listener.TLSTickets)
+			if err != nil || ctx.TicketRotation <= 0 {
+				fmt.Printf(" [!] Invalid TLS ticket rotation: %s\n", listener.TLSTickets)
+				return false
+			}
+		}
+		if listener.TLSNoResumption {
+			fmt.Printf(" [+] TLS from version %s, without session resumption.\n", listener.TLSMinVersion)
+		} else if ctx.TicketRotation > 0 {
+			fmt.Printf(" [+] TLS from version %s, rotating session ticket keys every %v.\n", listener.TLSMinVersion, ctx.TicketRotation)
+		} else {
+			fmt.Printf(" [+] TLS from version %s.\n", listener.TLSMinVersion)
+		}
+	}
+	for _, address := range ctx.Addresses() {
+		if strings.HasPrefix(address, "tls://") && ctx.TLSConfig == nil {
+			fmt.Printf(" [!] TLS listen address without a certificate (-tls-cert and -tls-key): %s\n", address)
+			return false
+		}
+	}
+
+	// Segment size clamping for routes through MTU-constrained links
+	if len(listener.MSS) > 0 {
+		if ctx.MSS.LoadFile(listener.MSS) {
+			fmt.Printf(" [+] Loaded %d MSS clamping routes (default %d, client %d).\n", ctx.MSS.Routes(), ctx.MSS.Default, ctx.MSS.Client)
+		} else {
+			fmt.Printf(" [!] Failed to load MSS clamping from: %s\n", listener.MSS)
+			return false
+		}
+	}
+
+	// Static host aliases (embedders can set any HostRewriter instead)
+	if len(listener.Aliases) > 0 {
+		aliases := &socks5.HostAliases{}
+		if !aliases.LoadFile(listener.Aliases) {
+			fmt.Printf(" [!] Failed to load host aliases from: %s\n", listener.Aliases)
+			return false
+		}
+		fmt.Printf(" [+] Loaded %d host aliases.\n", len(aliases.Aliases))
+		ctx.Rewriter = aliases
+	}
+
+	// Scripted policy rules, evaluated for every request
+	if len(listener.Policy) > 0 {
+		rules := &policy.Policy{}
+		if !rules.LoadFile(listener.Policy) {
+			fmt.Printf(" [!] Failed to load policy from: %s\n", listener.Policy)
+			return false
+		}
+		fmt.Printf(" [+] Loaded %d policy rules.\n", len(rules.Rules))
+		ctx.Policy = rules
+	}
+
+	// Routing table, evaluated for requests the policy doesn't route
+	if len(listener.Routes) > 0 {
+		routes := &socks5.RoutingTable{}
+		if !routes.LoadFile(listener.Routes) {
+			fmt.Printf(" [!] Failed to load routes from: %s\n", listener.Routes)
+			return false
+		}
+		fmt.Printf(" [+] Loaded %d routes.\n", len(routes.Routes))
+		ctx.Routes = routes
+	}
+
+	// Client classes by source network
+	if len(listener.Origins) > 0 {
+		if ctx.Origins.LoadFile(listener.Origins) {
+			fmt.Printf(" [+] Loaded %d client origin classes.\n", len(ctx.Origins.Classes))
 		} else {
-			fmt.Printf(" [!] Failed to load proxies from: %s\n", *proxiesPtr)
-			fmt.Printf(" [+] Continuing to run without relay proxies.")
+			fmt.Printf(" [!] Failed to load client origins from: %s\n", listener.Origins)
+			return false
 		}
 	}
 
+	// Per-destination tunnel limits
+	if len(listener.Destinations) > 0 {
+		if ctx.Destinations.LoadFile(listener.Destinations) {
+			fmt.Printf(" [+] Loaded %d destination limit overrides.\n", len(ctx.Destinations.Overrides))
+		} else {
+			fmt.Printf(" [!] Failed to load destination limits from: %s\n", listener.Destinations)
+			return false
+		}
+	}
+	if *destLimitPtr > 0 {
+		ctx.Destinations.Default = *destLimitPtr
+	}
+
+	// Outbound proxy anonymity requirements
+	ctx.AnonymityJudge = *judgePtr
+	if len(*minAnonymityPtr) > 0 {
+		if len(*judgePtr) == 0 {
+			fmt.Printf(" [!] -minanonymity requires -judge\n")
+			return false
+		}
+		ctx.Proxies.MinAnonymity, err = socks5.ParseAnonymity(*minAnonymityPtr)
+		if err != nil {
+			fmt.Printf(" [!] %s\n", err.Error())
+			return false
+		}
+	}
+
+	// Outbound proxy selection
+	if len(listener.Strategy) == 0 {
+		listener.Strategy = *strategyPtr
+	}
+	if !socks5.ValidStrategy(listener.Strategy) {
+		fmt.Printf(" [!] Unknown selection strategy: %s\n", listener.Strategy)
+		return false
+	}
+	ctx.Proxies.Strategy = listener.Strategy
+	if listener.Strategy == socks5.StrategyRotate {
+		if *rotateEveryPtr <= 0 && *rotateAfterPtr <= 0 {
+			fmt.Printf(" [!] The rotate strategy needs -rotateevery or -rotateafter\n")
+			return false
+		}
+		ctx.Proxies.RotateEvery = *rotateEveryPtr
+		ctx.Proxies.RotateAfter = *rotateAfterPtr
+	}
+	ctx.Proxies.Affinity = *affinityPtr
+
+	// Load allowed time windows
+	if len(listener.Schedule) > 0 {
+		if ctx.Schedule.LoadFile(listener.Schedule) {
+			fmt.Printf(" [+] Loaded time windows for %d users.\n", len(ctx.Schedule.Entries))
+		} else {
+			fmt.Printf(" [!] Failed to load schedule from: %s\n", listener.Schedule)
+			return false
+		}
+		ctx.ScheduleWarning = *scheduleWarnPtr
+	}
+
 	// Initialize the filter (this makes it possible to specify a non-existent file and update)
-	if !Socks5Ctx.DomainFilter.LoadFile(*blacklistPtr) || *updatePtr {
-		// Load some external blacklists to create the initial list
-		ExternalLists := []string{
-			"https://winhelp2002.mvps.org/hosts.txt",
+	loadFilter := func() {
+		domainFilter := filter.Filter{Backups: *blacklistBackupsPtr}
+		var sources []filter.Source
+		start := time.Now()
+		loaded := len(listener.Blacklist) > 0 && domainFilter.LoadFile(listener.Blacklist)
+		// Tenant filters start from their own file only, never from the shared sources
+		shared := len(listener.Tenant) == 0
+		if shared && (!loaded || *updatePtr) {
+			// Load the enabled external blacklists to create the initial list
+			for _, source := range externalLists {
+				if source.Active() {
+					sources = append(sources, filter.Source{Name: source.Name, URL: source.URL, Format: source.Format, Category: source.Category, TTL: source.EntryTTL()})
+				}
+			}
 		}
-		for _, s := range ExternalLists {
-			ok, count := Socks5Ctx.DomainFilter.LoadHTTP(s)
+		if shared && len(*updatefromfilePtr) > 0 {
+			ok, count := domainFilter.LoadListFile(*updatefromfilePtr)
 			if ok {
-				fmt.Printf(" [+] Loaded %d domains from: \"%s\"\n", count, s)
+				fmt.Printf(" [+] Loaded %d domains from: \"%s\"\n", count, *updatefromfilePtr)
 			} else {
-				fmt.Printf(" [!] Error loading blacklist: \"%s\"\n", s)
+				fmt.Printf(" [+] Error loading blacklist: \"%s\"\n", *updatefromfilePtr)
+			}
+		}
+		if shared && len(*updatefromURLPtr) > 0 {
+			for _, url := range strings.Split(*updatefromURLPtr, ",") {
+				sources = append(sources, filter.Source{URL: url})
 			}
 		}
+		// Fetch all lists at once, keeping whichever succeed
+		if len(sources) > 0 {
+			fmt.Printf(" [*] Downloading %d blacklists...\n", len(sources))
+			for _, result := range domainFilter.LoadSources(sources, *updateTimeoutPtr) {
+				if result.Err == nil {
+					fmt.Printf(" [+] Loaded %d domains from: \"%s\"\n", result.Count, result.Source)
+				} else {
+					fmt.Printf(" [!] Error loading blacklist: \"%s\" (%s)\n", result.Source, result.Err.Error())
+				}
+			}
+		}
+		// Always write it back out to save changes (additions, deduplications, etc)
+		if len(listener.Blacklist) > 0 {
+			domainFilter.SaveFile(listener.Blacklist)
+		}
+		ctx.SetFilter(domainFilter)
+		fmt.Printf(" [*] Blacklist %s contains %d domains (active after %v)\n", listener.Blacklist, len(domainFilter.Domains), time.Since(start).Round(time.Millisecond))
 	}
-	if len(*updatefromfilePtr) > 0 {
-		ok, count := Socks5Ctx.DomainFilter.LoadListFile(*updatefromfilePtr)
-		if ok {
-			fmt.Printf(" [+] Loaded %d domains from: \"%s\"\n", count, *updatefromfilePtr)
-		} else {
-			fmt.Printf(" [+] Error loading blacklist: \"%s\"\n", *updatefromfilePtr)
+	switch listener.Interim {
+	case "":
+		loadFilter()
+	case "allow", "deny":
+		// Accept connections right away and switch to the full filter once it loads
+		fmt.Printf(" [*] Loading blacklist in the background (interim policy: %s)\n", listener.Interim)
+		ctx.InterimPolicy = listener.Interim
+		go loadFilter()
+	default:
+		fmt.Printf(" [!] Unknown interim policy: %s\n", listener.Interim)
+		return false
+	}
+	return true
+}
+
+func main() {
+	// Subcommands
+	if len(os.Args) > 2 && os.Args[1] == "filter" && os.Args[2] == "bench" {
+		filterBench(os.Args[3:])
+		return
+	}
+	if len(os.Args) > 2 && os.Args[1] == "blacklist" && os.Args[2] == "update" {
+		blacklistUpdate(os.Args[3:])
+		return
+	}
+	if len(os.Args) > 2 && os.Args[1] == "blacklist" && os.Args[2] == "rollback" {
+		blacklistRollback(os.Args[3:])
+		return
+	}
+	if len(os.Args) > 1 && (os.Args[1] == "resolve" || os.Args[1] == "dial") {
+		debugRequest(os.Args[1], os.Args[2:])
+		return
+	}
+
+	// Process command line arguments
+	flag.Parse()
+
+	// Determine which IP to use
+	var reportIP net.IP
+	var reportHost string
+	if *reportDomainPtr && net.ParseIP(*hostPtr) == nil {
+		// Report the name itself so clients follow DNS changes
+		if len(*hostPtr) > 255 {
+			fmt.Printf(" [!] Host name is too long: %s\n", *hostPtr)
+			return
+		}
+		reportHost = *hostPtr
+		fmt.Printf(" [+] Host to report: %s\n", reportHost)
+	} else {
+		ips, err := net.LookupIP(*hostPtr)
+		if err != nil {
+			fmt.Printf(" [!] Unable to determine IP: %s\n", *hostPtr)
+			return
 		}
+		reportIP = ips[0] // Select the first IP returned
+		fmt.Printf(" [+] IP to report: %s\n", reportIP.String())
 	}
-	if len(*updatefromURLPtr) > 0 {
-		ok, count := Socks5Ctx.DomainFilter.LoadHTTP(*updatefromURLPtr)
-		if ok {
-			fmt.Printf(" [+] Loaded %d domains from: \"%s\"\n", count, *updatefromURLPtr)
+
+	// Create a channel for logging (shared by all listeners)
+	logs := make(chan string, 100)
+
+	// Load webhooks for connection events
+	var hooks *webhook.Webhooks
+	if len(*webhooksPtr) > 0 {
+		hooks = &webhook.Webhooks{}
+		if hooks.LoadFile(*webhooksPtr) {
+			fmt.Printf(" [+] Loaded %d webhooks.\n", len(hooks.Hooks))
 		} else {
-			fmt.Printf(" [+] Error loading blacklist: \"%s\"\n", *updatefromURLPtr)
+			fmt.Printf(" [!] Failed to load webhooks from: %s\n", *webhooksPtr)
+			return
+		}
+		hooks.Logger = logs
+	}
+
+	// Load plugins for connection events (alongside handlers built in)
+	if len(*pluginsPtr) > 0 {
+		for _, file := range strings.Split(*pluginsPtr, ",") {
+			name, err := plugins.Load(file)
+			if err != nil {
+				fmt.Printf(" [!] Failed to load plugin: %s\n", err.Error())
+				return
+			}
+			fmt.Printf(" [+] Loaded plugin: %s\n", name)
+		}
+	}
+	handlers := plugins.Handlers()
+	if len(handlers) > 0 {
+		fmt.Printf(" [+] Event handlers: %s\n", strings.Join(plugins.Names(), ", "))
+	}
+
+	// Count what every listener relays for the summary printed on exit
+	collector := newSummaryCollector()
+
+	// An observer must never hold the admin token
+	if len(*observerTokenPtr) > 0 && *observerTokenPtr == *apiTokenPtr {
+		fmt.Printf(" [!] -observertoken must differ from -apitoken\n")
+		return
+	}
+
+	// Metrics for every listener
+	var sinks metrics.Multi
+	var prometheus *metrics.Prometheus
+	if *prometheusPtr {
+		if len(*apiPtr) == 0 || len(*apiTokenPtr) == 0 {
+			fmt.Printf(" [!] -prometheus requires -api and -apitoken\n")
+			return
+		}
+		prometheus = &metrics.Prometheus{Prefix: "proxy_"}
+		sinks = append(sinks, prometheus)
+	}
+	if len(*statsdPtr) > 0 {
+		statsd, err := metrics.NewStatsD(*statsdPtr, "proxy.")
+		if err != nil {
+			fmt.Printf(" [!] Unable to reach StatsD: %s\n", err.Error())
+			return
+		}
+		fmt.Printf(" [+] Sending metrics to StatsD: %s\n", *statsdPtr)
+		sinks = append(sinks, statsd)
+	}
+
+	if len(*healthTargetPtr) > 0 {
+		_, portText, err := net.SplitHostPort(*healthTargetPtr)
+		port, _ := strconv.Atoi(portText)
+		if err != nil || port <= 0 || port > 0xFFFF {
+			fmt.Printf(" [!] Invalid health check target (host:port): %s\n", *healthTargetPtr)
+			return
+		}
+	}
+
+	if *takeoverPtr && len(*controlPtr) == 0 {
+		fmt.Printf(" [!] -takeover requires -control\n")
+		return
+	}
+
+	// Obtain the TLS listener certificate automatically
+	if len(*acmeHostPtr) > 0 {
+		certificates = &acme.Manager{Hosts: strings.Split(*acmeHostPtr, ","), CacheDir: *acmeCachePtr, Directory: *acmeDirectoryPtr, Email: *acmeEmailPtr, Logger: logs}
+		go func() {
+			err := http.ListenAndServe(*acmeHTTPPtr, certificates)
+			if err != nil {
+				logs <- fmt.Sprintf(" [!] ACME challenge server: %s\n", err.Error())
+			}
+		}()
+		err := certificates.Start()
+		if err != nil {
+			fmt.Printf(" [!] Failed to obtain a certificate: %s\n", err.Error())
+			return
+		}
+	}
+
+	// Listeners come from the config file, or the command line if there is none
+	listeners := []config.Listener{{Address: *addrPtr + ":" + strconv.Itoa(*portPtr)}}
+	if len(*listenPtr) > 0 {
+		listeners[0].Addresses = strings.Split(*listenPtr, ",")
+	}
+	if *httpPortPtr > 0 {
+		listeners[0].Name = "socks"
+		listeners = append(listeners, config.Listener{Name: "http", Address: *addrPtr + ":" + strconv.Itoa(*httpPortPtr), HTTPOnly: true})
+	}
+	if *tproxyPortPtr > 0 {
+		listeners[0].Name = "socks"
+		listeners = append(listeners, config.Listener{Name: "tproxy", Address: *addrPtr + ":" + strconv.Itoa(*tproxyPortPtr), TProxy: true})
+	}
+	if *transparentPortPtr > 0 {
+		listeners[0].Name = "socks"
+		listeners = append(listeners, config.Listener{Name: "transparent", Address: *addrPtr + ":" + strconv.Itoa(*transparentPortPtr), Transparent: true})
+	}
+	sources := config.DefaultSources
+	tenants := make(map[string]*socks5.Tenant)
+	guard := false
+	if len(*configPtr) > 0 {
+		var cfg config.Config
+		if !cfg.LoadFile(*configPtr) || len(cfg.AllListeners()) == 0 {
+			fmt.Printf(" [!] Failed to load config from: %s\n", *configPtr)
+			return
+		}
+		listeners = cfg.AllListeners()
+		for _, tenant := range cfg.Tenants {
+			tenants[tenant.Name] = &socks5.Tenant{Name: tenant.Name, Labels: tenant.Labels, MaxConnections: tenant.MaxConnections, QuotaBytes: tenant.QuotaBytes}
+		}
+		if cfg.Sources != nil {
+			sources = cfg.Sources
+		}
+		guard = cfg.OpenProxyGuard
+	}
+	if len(*sourcesPtr) > 0 {
+		var cfg config.Config
+		if !cfg.LoadFile(*sourcesPtr) {
+			fmt.Printf(" [!] Failed to load blacklist sources from: %s\n", *sourcesPtr)
+			return
+		}
+		sources = cfg.Sources
+	}
+
+	// Sockets passed by systemd are used by the listeners with matching addresses
+	if inherited := socks5.Activated(); inherited > 0 {
+		fmt.Printf(" [+] Inherited %d listening sockets from systemd.\n", inherited)
+	}
+
+	// Socks5 context per listener
+	var contexts []*socks5.Context
+	for _, listener := range listeners {
+		if len(listener.Tenant) > 0 {
+			fmt.Printf(" [*] Listener: %s (%s, tenant %s)\n", listener.Name, listener.Address, listener.Tenant)
+		} else if len(listeners) > 1 {
+			fmt.Printf(" [*] Listener: %s (%s)\n", listener.Name, listener.Address)
+		}
+		Socks5Ctx := &socks5.Context{Logger: logs, ReportIP: reportIP, ReportHost: reportHost, Tenant: tenants[listener.Tenant]}
+		if len(sinks) > 0 {
+			Socks5Ctx.Metrics = sinks
+		}
+		if hooks != nil {
+			Socks5Ctx.EventHandlers = append(Socks5Ctx.EventHandlers, hooks)
+		}
+		Socks5Ctx.EventHandlers = append(Socks5Ctx.EventHandlers, handlers...)
+		Socks5Ctx.EventHandlers = append(Socks5Ctx.EventHandlers, collector)
+		if !setup(Socks5Ctx, listener, sources) {
+			return
+		}
+		contexts = append(contexts, Socks5Ctx)
+	}
+
+	// Anyone on the internet relaying through an unauthenticated listener is rarely intended
+	for i, Socks5Ctx := range contexts {
+		open := Socks5Ctx.OpenAddresses()
+		if len(open) == 0 {
+			continue
+		}
+		if guard && !listeners[i].AllowOpen {
+			fmt.Printf(" [!] Refusing to run an open proxy on: %s (require credentials, bind a private address or set allow_open)\n", strings.Join(open, ", "))
+			return
+		}
+		if guard {
+			fmt.Printf(" [*] Open proxy allowed on: %s\n", strings.Join(open, ", "))
+		}
+	}
+
+	// Replace an instance that is already running
+	if *takeoverPtr {
+		if takeover(*controlPtr, 10*time.Second) {
+			for _, Socks5Ctx := range contexts {
+				// Give the old listeners time to close
+				if Socks5Ctx.ListenRetry < 10*time.Second {
+					Socks5Ctx.ListenRetry = 10 * time.Second
+				}
+			}
 		}
 	}
-	// Always write it back out to save changes (additions, deduplications, etc)
-	Socks5Ctx.DomainFilter.SaveFile(*blacklistPtr)
-	fmt.Printf(" [*] Blacklist contains %d domains\n", len(Socks5Ctx.DomainFilter.Domains))
 
 	// Start a background thread to handle logging
-	go logger(Socks5Ctx)
+	go logger(logs)
 
-	// Start background thread to handle clients
-	go Socks5Ctx.HandleClients()
+	for _, Socks5Ctx := range contexts {
+		// Start background thread to close sessions outside their allowed time
+		if len(Socks5Ctx.Schedule.Entries) > 0 {
+			go Socks5Ctx.EnforceSchedule()
+		}
 
-	// Listen for inbound connections
-	err = Socks5Ctx.Listen()
-	if err != nil {
-		fmt.Printf(" [!] %s\n", err.Error())
+		// Start background thread to skip outbound proxies while they are down
+		if Socks5Ctx.HealthInterval > 0 {
+			go Socks5Ctx.CheckHealth()
+		}
+
+		// Start background thread to replace TLS session ticket keys
+		if Socks5Ctx.TLSConfig != nil && !Socks5Ctx.TLSConfig.SessionTicketsDisabled && Socks5Ctx.TicketRotation > 0 {
+			go Socks5Ctx.RotateTicketKeys()
+		}
+
+		// Start background thread to re-measure idle outbound proxies for the fastest strategy
+		if Socks5Ctx.Proxies.Strategy == socks5.StrategyFastest && Socks5Ctx.LatencyInterval > 0 {
+			go Socks5Ctx.ProbeLatency()
+		}
+
+		// Start background thread to report outbound proxy pool utilization
+		if Socks5Ctx.UsageInterval > 0 {
+			go Socks5Ctx.ReportUtilization()
+		}
+
+		// Start background thread to classify outbound proxies
+		if len(Socks5Ctx.AnonymityJudge) > 0 {
+			go Socks5Ctx.ProbeAnonymity()
+		}
+
+		// Start background thread to handle clients
+		go Socks5Ctx.HandleClients()
+
+		// Start background thread to answer redirected DNS queries
+		if len(Socks5Ctx.DNSIntercept) > 0 {
+			go func(Socks5Ctx *socks5.Context) {
+				err := Socks5Ctx.InterceptDNS()
+				if err != nil {
+					logs <- fmt.Sprintf(" [!] DNS interception stopped: %s\n", err.Error())
+				}
+			}(Socks5Ctx)
+		}
+	}
+
+	// Start background threads to handle signals and control commands
+	commands := make(chan string, 1)
+	go dispatch(commands, contexts, collector)
+	go control.Signals(commands)
+	if len(*controlPtr) > 0 {
+		go func() {
+			err := control.Listen(*controlPtr, commands)
+			if err != nil {
+				logs <- fmt.Sprintf(" [!] Control: %s\n", err.Error())
+			}
+		}()
+	}
+
+	// Start background thread to watch the failover peer
+	var pair *failover.Pair
+	if len(*failoverPtr) > 0 {
+		pair = &failover.Pair{Contexts: contexts, Logger: logs}
+		if !pair.LoadFile(*failoverPtr) {
+			fmt.Printf(" [!] Failed to load failover pairing from: %s\n", *failoverPtr)
+			return
+		}
+		if len(*apiPtr) == 0 || len(*apiTokenPtr) == 0 {
+			// The peer watches this instance through the admin API
+			fmt.Printf(" [!] Failover requires the admin API (-api and -apitoken)\n")
+			return
+		}
+		fmt.Printf(" [+] Paired with failover peer: %s (priority %d)\n", pair.Peer, pair.Priority)
+		go pair.Run()
 	}
+
+	// Start background threads to refresh blacklist sources on their schedules
+	for _, source := range sources {
+		if source.Active() && source.RefreshInterval() > 0 {
+			go refresh(source, contexts, pair, logs)
+		}
+	}
+
+	// Start background threads to report on the listeners and keep the status file current
+	go startupReport(contexts, pair, logs)
+	if len(*statusPtr) > 0 && *statusIntervalPtr > 0 {
+		go statusFile(*statusPtr, *statusIntervalPtr, contexts, pair, logs)
+	}
+
+	// Start background thread to serve the API
+	if len(*apiPtr) > 0 {
+		server := api.Server{Contexts: contexts, ListenAddress: *apiPtr, Token: *apiTokenPtr, ObserverToken: *observerTokenPtr, Journal: *journalPtr, Failover: pair}
+		if len(*apiTokenPtr) > 0 || len(*observerTokenPtr) > 0 {
+			// Only the admin API streams events, so nothing is collected without it
+			server.Events = &api.EventStream{}
+			for _, Socks5Ctx := range contexts {
+				Socks5Ctx.EventHandlers = append(Socks5Ctx.EventHandlers, server.Events)
+			}
+		}
+		if prometheus != nil {
+			server.Metrics = prometheus
+		}
+		server.UpdateBlacklists = func() api.UpdateReport {
+			return updateSources(sources, contexts, logs)
+		}
+		go func() {
+			err := server.Listen()
+			if err != nil {
+				logs <- fmt.Sprintf(" [!] API: %s\n", err.Error())
+			}
+		}()
+	}
+
+	// Listen for inbound connections until every listener has stopped
+	var wait sync.WaitGroup
+	for _, Socks5Ctx := range contexts {
+		wait.Add(1)
+		go func(ctx *socks5.Context) {
+			defer wait.Done()
+			err := ctx.Listen()
+			if err != nil {
+				fmt.Printf(" [!] %s\n", err.Error())
+			}
+		}(Socks5Ctx)
+	}
+	wait.Wait()
+
+	// Shut down through the dispatcher (which exits) so open sessions are given their grace period
+	commands <- control.Exit
+	select {}
 }
@@ -0,0 +1,155 @@
+package schedule
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Window of time during which a user is allowed to connect
+type Window struct {
+	Days  []string `json:"days"`
+	Start string   `json:"start"`
+	End   string   `json:"end"`
+	start int
+	end   int
+}
+
+// Entry containing the allowed windows for a user
+type Entry struct {
+	User    string   `json:"user"`
+	Windows []Window `json:"windows"`
+}
+
+// Schedule struct containing a list of per-user windows
+type Schedule struct {
+	Entries []Entry
+}
+
+// Parse "HH:MM" into minutes past midnight ("24:00" is allowed as an end time)
+func parseClock(clock string) (int, error) {
+	var hour, minute int
+	_, err := fmt.Sscanf(clock, "%d:%d", &hour, &minute)
+	if err != nil {
+		return 0, err
+	}
+	if hour < 0 || minute < 0 || minute > 59 || hour*60+minute > 24*60 {
+		return 0, fmt.Errorf("invalid time: %s", clock)
+	}
+	return hour*60 + minute, nil
+}
+
+// Check whether a window applies to a day of the week (no days means every day)
+func (window *Window) onDay(day time.Weekday) bool {
+	if len(window.Days) == 0 {
+		return true
+	}
+	name := strings.ToLower(day.String()[:3])
+	for _, d := range window.Days {
+		if len(d) >= 3 && strings.ToLower(d[:3]) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Active checks if the window covers the given time and returns when it ends
+func (window *Window) Active(t time.Time) (bool, time.Time) {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	now := t.Hour()*60 + t.Minute()
+	if window.start < window.end {
+		if window.onDay(t.Weekday()) && now >= window.start && now < window.end {
+			return true, midnight.Add(time.Duration(window.end) * time.Minute)
+		}
+		return false, t
+	}
+	// The window wraps past midnight (e.g. 22:00 - 06:00)
+	if window.onDay(t.Weekday()) && now >= window.start {
+		return true, midnight.AddDate(0, 0, 1).Add(time.Duration(window.end) * time.Minute)
+	}
+	if window.onDay(midnight.AddDate(0, 0, -1).Weekday()) && now < window.end {
+		return true, midnight.Add(time.Duration(window.end) * time.Minute)
+	}
+	return false, t
+}
+
+// LoadFile retrieves the schedule from a file
+func (ctx *Schedule) LoadFile(file string) bool {
+	input, err := os.Open(file)
+	if err != nil {
+		return false
+	}
+	defer input.Close()
+	finfo, err := input.Stat()
+	if err != nil {
+		return false
+	}
+	data := make([]byte, finfo.Size())
+	_, err = input.Read(data)
+	if err != nil {
+		return false
+	}
+	var entries []Entry
+	err = json.Unmarshal(data, &entries)
+	if err != nil {
+		return false
+	}
+	for i := range entries {
+		for j := range entries[i].Windows {
+			window := &entries[i].Windows[j]
+			window.start, err = parseClock(window.Start)
+			if err != nil {
+				return false
+			}
+			window.end, err = parseClock(window.End)
+			if err != nil {
+				return false
+			}
+		}
+	}
+	ctx.Entries = entries
+	return true
+}
+
+// Find the entry for a user
+func (ctx *Schedule) find(user string) *Entry {
+	for i, entry := range ctx.Entries {
+		if entry.User == user {
+			return &ctx.Entries[i]
+		}
+	}
+	return nil
+}
+
+// Restricted checks if a user has any schedule at all
+func (ctx *Schedule) Restricted(user string) bool {
+	return ctx.find(user) != nil
+}
+
+// Allowed checks if a user may connect at the given time (users without an entry are unrestricted)
+func (ctx *Schedule) Allowed(user string, t time.Time) bool {
+	allowed, _ := ctx.Remaining(user, t)
+	return allowed
+}
+
+// Remaining returns whether a user is allowed at the given time and how long is left in the window
+func (ctx *Schedule) Remaining(user string, t time.Time) (bool, time.Duration) {
+	entry := ctx.find(user)
+	if entry == nil {
+		return true, 0
+	}
+	allowed := false
+	remaining := time.Duration(0)
+	for i := range entry.Windows {
+		active, end := entry.Windows[i].Active(t)
+		if active {
+			allowed = true
+			if end.Sub(t) > remaining {
+				remaining = end.Sub(t)
+			}
+		}
+	}
+	return allowed, remaining
+}
@@ -0,0 +1,43 @@
+package socks5
+
+import (
+	"net"
+	"sync"
+)
+
+// Listening sockets inherited through systemd socket activation, until a listen address claims them
+var activation struct {
+	once      sync.Once
+	lock      sync.Mutex
+	listeners []net.Listener
+}
+
+// Activated returns the number of inherited sockets not yet claimed by a listen address
+func Activated() int {
+	activation.once.Do(inherit)
+	activation.lock.Lock()
+	defer activation.lock.Unlock()
+	return len(activation.listeners)
+}
+
+// Claim the inherited socket bound to an address (any host matches an unspecified one)
+func activated(address string) net.Listener {
+	activation.once.Do(inherit)
+	want, err := net.ResolveTCPAddr("tcp", address)
+	if err != nil {
+		return nil
+	}
+	activation.lock.Lock()
+	defer activation.lock.Unlock()
+	for i, listener := range activation.listeners {
+		have, ok := listener.Addr().(*net.TCPAddr)
+		if !ok || have.Port != want.Port {
+			continue
+		}
+		if len(want.IP) == 0 || want.IP.IsUnspecified() || want.IP.Equal(have.IP) {
+			activation.listeners = append(activation.listeners[:i], activation.listeners[i+1:]...)
+			return listener
+		}
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+//go:build linux
+
+package socks5
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// First file descriptor passed by systemd (SD_LISTEN_FDS_START)
+const listenFdsStart = 3
+
+// Take the listening sockets passed by systemd (LISTEN_PID and LISTEN_FDS), hiding them from child processes
+func inherit() {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	for fd := listenFdsStart; fd < listenFdsStart+count; fd++ {
+		syscall.CloseOnExec(fd)
+		name := "LISTEN_FD_" + strconv.Itoa(fd)
+		if i := fd - listenFdsStart; i < len(names) && len(names[i]) > 0 {
+			name = names[i]
+		}
+		file := os.NewFile(uintptr(fd), name)
+		// Only stream sockets are of use (datagram and FIFO sockets are left alone)
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err == nil {
+			activation.listeners = append(activation.listeners, listener)
+		}
+	}
+}
@@ -0,0 +1,6 @@
+//go:build !linux
+
+package socks5
+
+// Socket activation is not available on this platform
+func inherit() {}
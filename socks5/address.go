@@ -0,0 +1,110 @@
+package socks5
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Canonical form of a requested host: addresses in their shortest form, names in lower case without the root dot
+func canonicalHost(host string) string {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+	if ip, zone := zonedIP(host); ip != nil {
+		// Zones name local interfaces, which may be case sensitive
+		return ip.String() + "%" + zone
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// Split an IPv6 address with a zone ("fe80::1%eth0") into the address and the zone (nil when the host is not one)
+func zonedIP(host string) (net.IP, string) {
+	address, zone, ok := strings.Cut(host, "%")
+	if !ok || len(zone) == 0 || strings.ContainsAny(zone, "%/[]") {
+		return nil, ""
+	}
+	ip := net.ParseIP(address)
+	if ip == nil || ip.To4() != nil {
+		return nil, ""
+	}
+	return ip, zone
+}
+
+// Address of a host that is an IP address, with or without a zone (nil for names)
+func hostIP(host string) net.IP {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip
+	}
+	ip, _ := zonedIP(host)
+	return ip
+}
+
+// Whether a host is an address on a particular local interface, which only a direct connection can reach
+func zoned(host string) bool {
+	ip, _ := zonedIP(host)
+	return ip != nil
+}
+
+// A link-local IPv6 address on the default zone, when it arrived without one (SOCKS has no way to send a zone)
+func (ctx *Context) defaultZone(host string) string {
+	if len(ctx.LinkLocalZone) == 0 {
+		return host
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil && (ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast()) {
+		return ip.String() + "%" + ctx.LinkLocalZone
+	}
+	return host
+}
+
+// Take a zone out of an address as written in a URI or CONNECT target ("fe80::1%25eth0", RFC 6874)
+func unescapeZone(host string) string {
+	if unescaped := strings.Replace(host, "%25", "%", 1); zoned(unescaped) {
+		return unescaped
+	}
+	return host
+}
+
+// SOCKS5 address type for a host (IPv4, domain name or IPv6)
+func addressType(host string) byte {
+	ip := hostIP(host)
+	switch {
+	case ip == nil:
+		return 0x03
+	case ip.To4() != nil:
+		return 0x01
+	}
+	return 0x04
+}
+
+// Encode a host as a SOCKS5 address (type, then address, any zone is dropped since it only means something here)
+func encodeAddress(host string) ([]byte, error) {
+	switch addressType(host) {
+	case 0x01:
+		return append([]byte{0x01}, hostIP(host).To4()...), nil
+	case 0x04:
+		return append([]byte{0x04}, hostIP(host).To16()...), nil
+	}
+	if len(host) == 0 || len(host) > 255 {
+		return nil, fmt.Errorf("%w: host name of %d bytes", ErrMalformedRequest, len(host))
+	}
+	return append([]byte{0x03, byte(len(host))}, host...), nil
+}
+
+// Destination of a connect request that did not arrive in SOCKS form (the RequestData is only used in replies, so it only has to be well formed)
+func (ctx *ClientCtx) setDestination(host string) {
+	ctx.Command = 0x01
+	if ip, _ := zonedIP(host); ip != nil {
+		ctx.Remote.Host = canonicalHost(host)
+		ctx.RequestData = append([]byte{0x00, 0x04}, ip.To16()...)
+	} else if ip := net.ParseIP(host); ip == nil {
+		ctx.Remote.Host = host
+		ctx.RequestData = append([]byte{0x00, 0x03, byte(len(host))}, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		ctx.Remote.Host = ip4.String()
+		ctx.RequestData = append([]byte{0x00, 0x01}, ip4...)
+	} else {
+		ctx.Remote.Host = ip.String()
+		ctx.RequestData = append([]byte{0x00, 0x04}, ip.To16()...)
+	}
+}
@@ -0,0 +1,75 @@
+package socks5
+
+import (
+	"strings"
+	"time"
+)
+
+// AffinityHosts is how many destination hosts the affinity cache holds, expired entries are dropped to make room
+const AffinityHosts = 10000
+
+// Outbound proxy a destination host was last reached through
+type affinityEntry struct {
+	proxy   ProxyInfo
+	expires time.Time
+}
+
+// Select the outbound proxy a destination host was last reached through while the affinity lasts (so sites see one exit address), or else by the pool's strategy
+func (ctx *ProxyPool) selectFor(host string, preference string, via string, tried map[ProxyInfo]bool) (ProxyInfo, error) {
+	if proxy, ok := ctx.affine(host, preference, via, tried); ok {
+		return proxy, nil
+	}
+	return ctx.selectExcept(preference, via, tried)
+}
+
+// Affine outbound proxy for a destination host, as long as it is still in the pool, eligible, untried and suits the route and preference
+func (ctx *ProxyPool) affine(host string, preference string, via string, tried map[ProxyInfo]bool) (ProxyInfo, bool) {
+	if ctx.Affinity <= 0 {
+		return ProxyInfo{}, false
+	}
+	ctx.RLock()
+	defer ctx.RUnlock()
+	entry, ok := ctx.sticky[strings.ToLower(host)]
+	if !ok || time.Now().After(entry.expires) {
+		return ProxyInfo{}, false
+	}
+	proxy := entry.proxy
+	if tried[proxy] || !ctx.eligible(proxy) || (len(via) > 0 && !proxy.routes(via)) || (len(preference) > 0 && !proxy.exits(preference)) {
+		return ProxyInfo{}, false
+	}
+	for _, member := range ctx.Hosts {
+		if member == proxy {
+			return proxy, true
+		}
+	}
+	return ProxyInfo{}, false
+}
+
+// Remember the outbound proxy a destination host was reached through, for another Affinity from now
+func (ctx *ProxyPool) stick(host string, proxy ProxyInfo) {
+	if ctx.Affinity <= 0 {
+		return
+	}
+	ctx.Lock()
+	defer ctx.Unlock()
+	if ctx.sticky == nil {
+		ctx.sticky = make(map[string]affinityEntry)
+	}
+	host = strings.ToLower(host)
+	if _, ok := ctx.sticky[host]; !ok && len(ctx.sticky) >= AffinityHosts {
+		now := time.Now()
+		for name, entry := range ctx.sticky {
+			if now.After(entry.expires) {
+				delete(ctx.sticky, name)
+			}
+		}
+		if len(ctx.sticky) >= AffinityHosts {
+			// Every entry is live, so an arbitrary one makes way
+			for name := range ctx.sticky {
+				delete(ctx.sticky, name)
+				break
+			}
+		}
+	}
+	ctx.sticky[host] = affinityEntry{proxy: proxy, expires: time.Now().Add(ctx.Affinity)}
+}
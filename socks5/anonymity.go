@@ -0,0 +1,179 @@
+package socks5
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Anonymity class of an outbound proxy
+type Anonymity int
+
+// Anonymity classes, from least to most anonymous
+const (
+	AnonymityUnknown Anonymity = iota
+	AnonymityTransparent
+	AnonymityAnonymous
+	AnonymityElite
+)
+
+var anonymityNames = []string{"unknown", "transparent", "anonymous", "elite"}
+
+func (a Anonymity) String() string {
+	if a < 0 || int(a) >= len(anonymityNames) {
+		return "unknown"
+	}
+	return anonymityNames[a]
+}
+
+// MarshalJSON encodes the class by name
+func (a Anonymity) MarshalJSON() ([]byte, error) {
+	return json.Marshal(a.String())
+}
+
+// ParseAnonymity converts a class name into an Anonymity
+func ParseAnonymity(name string) (Anonymity, error) {
+	for i, n := range anonymityNames {
+		if strings.EqualFold(name, n) {
+			return Anonymity(i), nil
+		}
+	}
+	return AnonymityUnknown, fmt.Errorf("unknown anonymity class: %s", name)
+}
+
+// Headers added by proxies that reveal one is in use
+var revealingHeaders = []string{"via", "x-forwarded-for", "forwarded", "x-real-ip", "proxy-connection", "x-proxy-id", "client-ip"}
+
+var addressPattern = regexp.MustCompile(`[0-9a-fA-F:.]{7,}`)
+
+// Names of the headers a judge echoed back: JSON ({"headers": {...}} or a flat object), "Name: value" lines or CGI style "HTTP_NAME = value" lines
+func echoedHeaders(body string) map[string]bool {
+	names := make(map[string]bool)
+	add := func(name string) {
+		name = strings.ToLower(strings.TrimSpace(name))
+		name = strings.ReplaceAll(strings.TrimPrefix(name, "http_"), "_", "-")
+		if len(name) > 0 {
+			names[name] = true
+		}
+	}
+	var object map[string]json.RawMessage
+	if json.Unmarshal([]byte(body), &object) == nil {
+		var headers map[string]json.RawMessage
+		if raw, ok := object["headers"]; ok && json.Unmarshal(raw, &headers) == nil {
+			object = headers
+		}
+		for name := range object {
+			add(name)
+		}
+		return names
+	}
+	for _, line := range strings.Split(body, "\n") {
+		separator := strings.IndexAny(line, ":=")
+		if separator <= 0 || strings.ContainsAny(strings.TrimSpace(line[:separator]), " \t<>") {
+			// Not a header line (markup or prose around the echoed request)
+			continue
+		}
+		add(line[:separator])
+	}
+	return names
+}
+
+// Find the IP addresses mentioned in a judge response
+func addresses(body string) map[string]bool {
+	found := make(map[string]bool)
+	for _, token := range addressPattern.FindAllString(body, -1) {
+		ip := net.ParseIP(strings.Trim(token, ".:"))
+		if ip != nil {
+			found[ip.String()] = true
+		}
+	}
+	return found
+}
+
+// Fetch the judge URL, optionally through an outbound proxy
+func fetchJudge(judge string, proxy *ProxyInfo, timeout time.Duration) (string, error) {
+	transport := &http.Transport{DisableKeepAlives: true}
+	if proxy != nil {
+		transport.DialContext = func(_ context.Context, network, address string) (net.Conn, error) {
+			host, port, err := net.SplitHostPort(address)
+			if err != nil {
+				return nil, err
+			}
+			portNumber, err := strconv.Atoi(port)
+			if err != nil {
+				return nil, err
+			}
+			return proxy.Dial(host, portNumber, timeout)
+		}
+	}
+	client := http.Client{Transport: transport, Timeout: timeout}
+	resp, err := client.Get(judge)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	return string(body), err
+}
+
+// ProbeTimeout limits each request made while probing outbound proxies
+const ProbeTimeout = 15 * time.Second
+
+// ProbeAnonymity classifies each outbound proxy using a judge URL that echoes back the request it received
+func (ctx *Context) ProbeAnonymity() {
+	judge := ctx.AnonymityJudge
+	timeout := ProbeTimeout
+	direct, err := fetchJudge(judge, nil, timeout)
+	if err != nil {
+		ctx.logError(fmt.Errorf("anonymity judge unavailable: %s (%s)", judge, err.Error()))
+		return
+	}
+	// Addresses in the direct response belong to this host, other than the judge's own
+	own := addresses(direct)
+	if parsed, err := url.Parse(judge); err == nil {
+		judgeIPs, _ := net.LookupIP(parsed.Hostname())
+		for _, ip := range judgeIPs {
+			delete(own, ip.String())
+		}
+	}
+	if ctx.ReportIP != nil && !ctx.ReportIP.IsUnspecified() {
+		own[ctx.ReportIP.String()] = true
+	}
+
+	for _, proxy := range ctx.Proxies.List() {
+		body, err := fetchJudge(judge, &proxy, timeout)
+		if err != nil {
+			ctx.logError(fmt.Errorf("anonymity probe failed: %s (%s)", proxy.Host, err.Error()))
+			continue
+		}
+		anonymity := AnonymityElite
+		echoed := echoedHeaders(body)
+		for _, header := range revealingHeaders {
+			if echoed[header] {
+				anonymity = AnonymityAnonymous
+				break
+			}
+		}
+		for ip := range addresses(body) {
+			if own[ip] {
+				anonymity = AnonymityTransparent
+				break
+			}
+		}
+		ctx.Proxies.updateStatus(proxy, func(status *ProxyStatus) {
+			status.Anonymity = anonymity
+		})
+		if ctx.Logger != nil {
+			ctx.Logger <- fmt.Sprintf(" [*] Proxy anonymity: %s:%d is %s\n", proxy.Host, proxy.Port, anonymity)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package socks5
+
+import (
+	"net"
+	"proxy/metrics"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Limits the combined throughput of every tunnel through one outbound proxy (in both directions, allowing bursts of up to a second's worth)
+type bandwidthLimit struct {
+	lock    sync.Mutex
+	rate    float64
+	tokens  float64
+	updated time.Time
+	relayed uint64
+	metrics metrics.Metrics
+	labels  metrics.Labels
+}
+
+// Bandwidth limit shared by the tunnels through an outbound proxy (nil when it has none)
+func (ctx *Context) bandwidthLimit(proxy ProxyInfo) *bandwidthLimit {
+	if proxy.Bandwidth <= 0 {
+		return nil
+	}
+	ctx.Proxies.Lock()
+	defer ctx.Proxies.Unlock()
+	if ctx.Proxies.limits == nil {
+		ctx.Proxies.limits = make(map[ProxyInfo]*bandwidthLimit)
+	}
+	limit, ok := ctx.Proxies.limits[proxy]
+	if !ok {
+		limit = &bandwidthLimit{
+			rate:    float64(proxy.Bandwidth),
+			tokens:  float64(proxy.Bandwidth),
+			updated: time.Now(),
+			metrics: ctx.metrics(),
+			labels:  ctx.metricLabels("proxy", net.JoinHostPort(proxy.Host, strconv.Itoa(proxy.Port))),
+		}
+		ctx.Proxies.limits[proxy] = limit
+		limit.metrics.Gauge("upstream_bandwidth_limit_bytes", limit.rate, limit.labels)
+	}
+	return limit
+}
+
+// Most a tunnel should relay at once, so one read never takes more than a second's allowance
+func (ctx *bandwidthLimit) chunk(size int) int {
+	if ctx != nil && float64(size) > ctx.rate {
+		return max(int(ctx.rate), 1)
+	}
+	return size
+}
+
+// Take n bytes from the allowance, sleeping for as long as that overdraws it
+func (ctx *bandwidthLimit) wait(n int) {
+	if ctx == nil {
+		return
+	}
+	ctx.lock.Lock()
+	now := time.Now()
+	ctx.tokens += now.Sub(ctx.updated).Seconds() * ctx.rate
+	if ctx.tokens > ctx.rate {
+		ctx.tokens = ctx.rate
+	}
+	ctx.updated = now
+	// Reserving ahead of the sleep queues concurrent tunnels behind each other
+	ctx.tokens -= float64(n)
+	ctx.relayed += uint64(n)
+	delay := time.Duration(-ctx.tokens / ctx.rate * float64(time.Second))
+	ctx.lock.Unlock()
+
+	ctx.metrics.Counter("upstream_bytes_total", int64(n), ctx.labels)
+	if delay > 0 {
+		ctx.metrics.Histogram("upstream_throttle_seconds", delay.Seconds(), ctx.labels)
+		time.Sleep(delay)
+	}
+}
@@ -0,0 +1,145 @@
+package socks5
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// BindTimeout is how long a bind waits for the expected peer to connect
+const BindTimeout = 2 * time.Minute
+
+// processBind waits for the peer named in the request to connect back, replying twice as RFC 1928 requires
+func (ctx *ClientCtx) processBind() error {
+	if len(ctx.Ctx.Proxies.List()) > 0 {
+		// Have the outbound proxy bind, then pass along its second reply
+		err := ctx.processOutbound()
+		if err != nil {
+			return err
+		}
+		err = ctx.forwardReply()
+		if err != nil {
+			ctx.Ctx.logError(err)
+			ctx.Remote.Connection.Close()
+		}
+		return err
+	}
+	if ctx.Ctx.egressBlocked() {
+		return ctx.refuseDirect()
+	}
+
+	// Only the peer the client expects may connect (any peer when the address is unspecified)
+	var expected []net.IP
+	ip := hostIP(ctx.Remote.Host)
+	if ip == nil {
+		var err error
+		expected, err = net.LookupIP(ctx.Remote.Host)
+		if err != nil {
+			ctx.sendFailure(0x01)
+			ctx.Ctx.logError(err)
+			return err
+		}
+	} else if !ip.IsUnspecified() {
+		expected = []net.IP{ip}
+	}
+
+	// Listen on the address the client reached us on
+	local := ctx.Client.Connection.LocalAddr().(*net.TCPAddr)
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: local.IP})
+	if err != nil {
+		ctx.sendFailure(0x01)
+		ctx.Ctx.logError(err)
+		return err
+	}
+	defer listener.Close()
+	atomic.AddInt32(&ctx.sockets, 1)
+	defer atomic.AddInt32(&ctx.sockets, -1)
+	err = ctx.sendAddress(ctx.Ctx.ReportHost, ctx.Ctx.boundIP(local.IP), listener.Addr().(*net.TCPAddr).Port)
+	if err != nil {
+		return err
+	}
+	listener.SetDeadline(time.Now().Add(BindTimeout))
+	for {
+		connection, err := listener.AcceptTCP()
+		if err != nil {
+			ctx.sendFailure(0x01)
+			ctx.Ctx.logError(err)
+			return err
+		}
+		peer := connection.RemoteAddr().(*net.TCPAddr)
+		if len(expected) == 0 || containsIP(expected, peer.IP) {
+			ctx.Remote.Connection = connection
+			break
+		}
+		if ctx.Ctx.Logger != nil {
+			ctx.Ctx.Logger <- fmt.Sprintf(" [!] Unexpected bind peer: %s (expected %s)\n", peer.String(), ctx.Remote.Host)
+		}
+		connection.Close()
+	}
+	ctx.remoteIO()
+
+	// Second reply names the peer that connected
+	peer := ctx.Remote.Connection.RemoteAddr().(*net.TCPAddr)
+	err = ctx.sendAddress("", peer.IP, peer.Port)
+	if err != nil {
+		ctx.Remote.Connection.Close()
+	}
+	return err
+}
+
+// Check whether an IP is in a list
+func containsIP(list []net.IP, ip net.IP) bool {
+	for _, entry := range list {
+		if entry.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Pass the outbound proxy's second bind reply to the client
+func (ctx *ClientCtx) forwardReply() error {
+	ctx.Remote.Connection.SetReadDeadline(time.Now().Add(BindTimeout))
+	defer ctx.Remote.Connection.SetReadDeadline(time.Time{})
+	header := make([]byte, 4)
+	_, err := io.ReadFull(ctx.Remote.Reader, header)
+	if err != nil {
+		ctx.sendFailure(0x01)
+		return err
+	}
+	if header[0] != 0x05 {
+		ctx.sendFailure(0x01)
+		return fmt.Errorf("invalid data(6) from: %s", ctx.Proxy.Host)
+	}
+	length := 0
+	switch header[3] {
+	case 0x01:
+		length = 4
+	case 0x04:
+		length = 16
+	case 0x03:
+		size, err := ctx.Remote.Reader.ReadByte()
+		if err != nil {
+			ctx.sendFailure(0x01)
+			return err
+		}
+		header = append(header, size)
+		length = int(size)
+	default:
+		ctx.sendFailure(0x01)
+		return fmt.Errorf("invalid address type from: %s", ctx.Proxy.Host)
+	}
+	address := make([]byte, length+2)
+	_, err = io.ReadFull(ctx.Remote.Reader, address)
+	if err != nil {
+		ctx.sendFailure(0x01)
+		return err
+	}
+	err = ctx.sendReply(header[1], append(header[2:], address...))
+	if err == nil && header[1] != 0x00 {
+		err = &ErrCommandFailed{Proxy: ctx.Proxy.Host, Code: header[1]}
+	}
+	return err
+}
@@ -0,0 +1,77 @@
+package socks5
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Bypass entries standing for groups of destinations
+const (
+	BypassPrivate = "private" // Private (RFC 1918 and unique local), loopback and link-local addresses
+	BypassLocal   = "<local>" // Host names without a dot
+)
+
+// Bypass lists destinations that are always dialed directly, even with outbound proxies loaded
+type Bypass struct {
+	Entries  []string
+	networks []*net.IPNet
+	domains  []string
+	private  bool
+	local    bool
+}
+
+// ParseBypass reads bypass entries: networks (CIDR), addresses, domains (covering their subdomains), "private" or "<local>"
+func ParseBypass(entries []string) (Bypass, error) {
+	bypass := Bypass{Entries: entries}
+	for _, entry := range entries {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		switch {
+		case entry == BypassPrivate:
+			bypass.private = true
+		case entry == BypassLocal:
+			bypass.local = true
+		case strings.Contains(entry, "/"):
+			_, network, err := net.ParseCIDR(entry)
+			if err != nil {
+				return Bypass{}, fmt.Errorf("invalid bypass network: %s", entry)
+			}
+			bypass.networks = append(bypass.networks, network)
+		case net.ParseIP(strings.Trim(entry, "[]")) != nil:
+			ip := net.ParseIP(strings.Trim(entry, "[]"))
+			bypass.networks = append(bypass.networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+		default:
+			domain := strings.TrimPrefix(strings.TrimPrefix(entry, "*"), ".")
+			if len(domain) == 0 || strings.ContainsAny(domain, "*/ ") {
+				return Bypass{}, fmt.Errorf("invalid bypass domain: %s", entry)
+			}
+			bypass.domains = append(bypass.domains, domain)
+		}
+	}
+	return bypass, nil
+}
+
+// Matches reports whether a destination is dialed directly (names are not resolved, so networks only match addresses)
+func (ctx *Bypass) Matches(host string) bool {
+	if ip := hostIP(host); ip != nil {
+		if ctx.private && (ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast()) {
+			return true
+		}
+		for _, network := range ctx.networks {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if ctx.local && !strings.Contains(host, ".") {
+		return true
+	}
+	for _, domain := range ctx.domains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
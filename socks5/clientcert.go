@@ -0,0 +1,41 @@
+package socks5
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+)
+
+// Identity named by a client certificate (the common name, or the first email or DNS name without one)
+func certificateIdentity(certificate *x509.Certificate) string {
+	switch {
+	case len(certificate.Subject.CommonName) > 0:
+		return certificate.Subject.CommonName
+	case len(certificate.EmailAddresses) > 0:
+		return certificate.EmailAddresses[0]
+	case len(certificate.DNSNames) > 0:
+		return certificate.DNSNames[0]
+	}
+	return ""
+}
+
+// Complete the TLS handshake with a client, taking the user from its certificate when it presented one
+func (ctx *ClientCtx) authenticateCertificate() error {
+	connection, ok := ctx.Client.Connection.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	err := connection.Handshake()
+	if err != nil {
+		return fmt.Errorf("%w: TLS handshake from: %s (%s)", ErrAuthFailed, ctx.Client.Host, err.Error())
+	}
+	certificates := connection.ConnectionState().PeerCertificates
+	if len(certificates) == 0 {
+		return nil
+	}
+	ctx.User = certificateIdentity(certificates[0])
+	if len(ctx.User) > 0 && ctx.Ctx.Logger != nil {
+		ctx.Ctx.Logger <- fmt.Sprintf(" [+] Authenticated: %s from [%s]:%d (client certificate)\n", ctx.User, ctx.Client.Host, ctx.Client.Port)
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package socks5
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Credentials for inbound clients (passwords are plain text or "sha256:" followed by the hex digest)
+type Credentials struct {
+	Users map[string]string `json:"users"`
+	Exits map[string]string `json:"exits"` // Preferred exit country or tag per user
+}
+
+// LoadFile retrieves credentials from a file
+func (ctx *Credentials) LoadFile(file string) bool {
+	input, err := os.Open(file)
+	if err != nil {
+		return false
+	}
+	defer input.Close()
+	finfo, err := input.Stat()
+	if err != nil {
+		return false
+	}
+	data := make([]byte, finfo.Size())
+	_, err = input.Read(data)
+	if err != nil {
+		return false
+	}
+	err = json.Unmarshal(data, ctx)
+	if err != nil {
+		return false
+	}
+	return true
+}
+
+// Required reports whether clients must authenticate
+func (ctx *Credentials) Required() bool {
+	return len(ctx.Users) > 0
+}
+
+// Whether clients must authenticate with some method
+func (ctx *Context) authRequired() bool {
+	return ctx.Credentials.Required() || ctx.GSSAPI != nil
+}
+
+// Pick the method to use from those a client offers (0xFF when none is acceptable)
+func (ctx *Context) selectMethod(methods []byte, required bool) byte {
+	// In order of preference, GSS-API, username/password, then no authentication
+	if ctx.GSSAPI != nil && bytes.IndexByte(methods, 0x01) >= 0 {
+		return 0x01
+	}
+	if ctx.Credentials.Required() && bytes.IndexByte(methods, 0x02) >= 0 {
+		return 0x02
+	}
+	if !required && bytes.IndexByte(methods, 0x00) >= 0 {
+		return 0x00
+	}
+	return 0xFF
+}
+
+// Check a username and password
+func (ctx *Credentials) Check(username string, password string) bool {
+	expected, ok := ctx.Users[username]
+	if !ok {
+		// Compare anyway so unknown users take as long as known ones
+		expected = "sha256:"
+	}
+	if strings.HasPrefix(expected, "sha256:") {
+		digest := sha256.Sum256([]byte(password))
+		password = "sha256:" + hex.EncodeToString(digest[:])
+	}
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1 && ok
+}
+
+// Read a length prefixed field from the sub-negotiation
+func (ctx *ClientCtx) readAuthField() (string, error) {
+	length, err := ctx.Client.Reader.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	field := make([]byte, length)
+	_, err = io.ReadFull(ctx.Client.Reader, field)
+	return string(field), err
+}
+
+// Username/password sub-negotiation with the client (RFC 1929)
+func (ctx *ClientCtx) authenticate() error {
+	version, err := ctx.Client.Reader.ReadByte()
+	if err != nil {
+		return err
+	}
+	if version != 0x01 {
+		return fmt.Errorf("invalid data(auth) from: %s", ctx.Client.Host)
+	}
+	username, err := ctx.readAuthField()
+	if err != nil {
+		return err
+	}
+	password, err := ctx.readAuthField()
+	if err != nil {
+		return err
+	}
+	// Both fields are 1 to 255 bytes, and the request waits for the status
+	if len(username) == 0 || len(password) == 0 {
+		err = ctx.deviate("auth-length", "empty username or password")
+	}
+	if err == nil && ctx.sentAhead() {
+		err = ctx.deviate("negotiation", "request sent before authentication completed")
+	}
+	if err != nil {
+		ctx.Client.Writer.Write([]byte{0x01, 0x01})
+		ctx.Client.Writer.Flush()
+		return err
+	}
+	if !ctx.Ctx.checkPassword(username, password) {
+		ctx.Client.Writer.Write([]byte{0x01, 0x01})
+		ctx.Client.Writer.Flush()
+		return fmt.Errorf("%w: %s from: %s", ErrAuthFailed, username, ctx.Client.Host)
+	}
+	ctx.User = username
+	ctx.Client.Writer.Write([]byte{0x01, 0x00})
+	if ctx.Ctx.Logger != nil {
+		ctx.Ctx.Logger <- fmt.Sprintf(" [+] Authenticated: %s from [%s]:%d\n", username, ctx.Client.Host, ctx.Client.Port)
+	}
+	return ctx.Client.Writer.Flush()
+}
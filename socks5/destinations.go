@@ -0,0 +1,87 @@
+package socks5
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+)
+
+// DestinationLimits caps simultaneous tunnels to a single destination host
+type DestinationLimits struct {
+	Default   int            `json:"default"`
+	Overrides map[string]int `json:"overrides"`
+}
+
+// LoadFile retrieves destination limits from a file
+func (ctx *DestinationLimits) LoadFile(file string) bool {
+	input, err := os.Open(file)
+	if err != nil {
+		return false
+	}
+	defer input.Close()
+	finfo, err := input.Stat()
+	if err != nil {
+		return false
+	}
+	data := make([]byte, finfo.Size())
+	_, err = input.Read(data)
+	if err != nil {
+		return false
+	}
+	var limits DestinationLimits
+	err = json.Unmarshal(data, &limits)
+	if err != nil {
+		return false
+	}
+	// Hosts are matched case-insensitively
+	ctx.Default = limits.Default
+	ctx.Overrides = make(map[string]int)
+	for host, limit := range limits.Overrides {
+		ctx.Overrides[strings.ToLower(host)] = limit
+	}
+	return true
+}
+
+// Limit returns the cap for a host (an override for a domain also covers its subdomains)
+func (ctx *DestinationLimits) Limit(host string) int {
+	host = strings.ToLower(host)
+	for {
+		if limit, ok := ctx.Overrides[host]; ok {
+			return limit
+		}
+		index := strings.Index(host, ".")
+		if index < 0 {
+			return ctx.Default
+		}
+		host = host[index+1:]
+	}
+}
+
+// Reserve a tunnel to a destination host, failing if it is at its limit
+func (ctx *Context) acquireDestination(host string) error {
+	ctx.tuneLock.RLock()
+	limit := ctx.Destinations.Limit(host)
+	ctx.tuneLock.RUnlock()
+	host = strings.ToLower(host)
+	ctx.destinationLock.Lock()
+	defer ctx.destinationLock.Unlock()
+	if ctx.destinations == nil {
+		ctx.destinations = make(map[string]int)
+	}
+	if limit > 0 && ctx.destinations[host] >= limit {
+		return &ErrDestinationBusy{Host: host, Limit: limit}
+	}
+	ctx.destinations[host]++
+	return nil
+}
+
+// Release a tunnel reserved with acquireDestination
+func (ctx *Context) releaseDestination(host string) {
+	host = strings.ToLower(host)
+	ctx.destinationLock.Lock()
+	defer ctx.destinationLock.Unlock()
+	ctx.destinations[host]--
+	if ctx.destinations[host] <= 0 {
+		delete(ctx.destinations, host)
+	}
+}
@@ -0,0 +1,207 @@
+package socks5
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"proxy/policy"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DiagnoseTimeout is how long a diagnostic dial waits for the destination or outbound proxy to answer
+const DiagnoseTimeout = 30 * time.Second
+
+// DiagnosisStep is one decision made for a request, in the order a real request makes it
+type DiagnosisStep struct {
+	Step   string
+	Detail string
+	Failed bool
+}
+
+// Diagnose runs a request for a destination through the schedule, filter, resolver and pool as a client's would be, recording each decision (and connecting when dial is set)
+func (ctx *Context) Diagnose(host string, port int, user string, dial bool) []DiagnosisStep {
+	client := &ClientCtx{Ctx: ctx, User: user, Version: 0x05, Command: 0x01, Started: time.Now()}
+	client.Client.Host = "127.0.0.1"
+	// Replies meant for the client go nowhere
+	client.Client.Writer = bufio.NewWriter(io.Discard)
+	client.setDestination(host)
+	client.Remote.Host = ctx.defaultZone(canonicalHost(client.Remote.Host))
+	client.Remote.Port = port
+	destination := client.Remote.Host
+	if port > 0 {
+		destination = net.JoinHostPort(destination, strconv.Itoa(port))
+	}
+	steps := []DiagnosisStep{{Step: "destination", Detail: fmt.Sprintf("%s (%s) as %s", destination, addressTypeName(addressType(client.Remote.Host)), client.Identity())}}
+
+	if !ctx.Schedule.Allowed(client.Identity(), time.Now()) {
+		return append(steps, DiagnosisStep{Step: "schedule", Detail: "outside the allowed time for " + client.Identity(), Failed: true})
+	}
+	steps = append(steps, DiagnosisStep{Step: "schedule", Detail: "allowed"})
+
+	if ctx.Policy != nil {
+		decision, ok := ctx.Policy.Evaluate(client.policyAttributes())
+		switch {
+		case !ok:
+			steps = append(steps, DiagnosisStep{Step: "policy", Detail: "no rule matched"})
+		case decision.Action == policy.Deny:
+			return append(steps, DiagnosisStep{Step: "policy", Detail: "denied by " + decision.Rule, Failed: true})
+		case decision.Action == policy.Allow:
+			client.exempt = true
+			steps = append(steps, DiagnosisStep{Step: "policy", Detail: "allowed by " + decision.Rule + " (blacklist skipped)"})
+		default:
+			client.route = decision.Route
+			steps = append(steps, DiagnosisStep{Step: "policy", Detail: "routed " + decision.Route + " by " + decision.Rule})
+		}
+	}
+
+	for _, name := range client.filterNames() {
+		if client.exempt {
+			break
+		}
+		if match, ok := ctx.matchDomain(name); ok {
+			return append(steps, DiagnosisStep{Step: "filter", Detail: fmt.Sprintf("blacklisted: %s (%s)", name, explain(match)), Failed: true})
+		}
+	}
+	if !client.exempt {
+		steps = append(steps, DiagnosisStep{Step: "filter", Detail: "not blacklisted"})
+	}
+
+	if ctx.Rewriter != nil {
+		rewrite := DiagnosisStep{Step: "rewrite", Detail: "not rewritten"}
+		if host, port, ok := ctx.Rewriter.Rewrite(client.Remote.Host, client.Remote.Port); ok {
+			client.Remote.Host = canonicalHost(host)
+			if port > 0 {
+				client.Remote.Port = port
+			}
+			rewrite.Detail = "to " + client.Remote.Host
+			if client.Remote.Port > 0 {
+				rewrite.Detail = "to " + net.JoinHostPort(client.Remote.Host, strconv.Itoa(client.Remote.Port))
+			}
+		}
+		steps = append(steps, rewrite)
+	}
+
+	total, eligible := len(ctx.Proxies.List()), ctx.Proxies.Eligible()
+	steps = append(steps, ctx.diagnoseResolve(client.Remote.Host, total > 0))
+	policyRoute := client.route
+	client.applyRoutes()
+	preference := ctx.ExitPreference(client.Identity())
+	if len(client.route) > 0 {
+		preference = client.route
+	}
+	_, sticky := ctx.Proxies.affine(client.Remote.Host, preference, client.via, nil)
+	proxy, err := ctx.Proxies.selectFor(client.Remote.Host, preference, client.via, nil)
+	route := DiagnosisStep{Step: "route"}
+	switch {
+	case ctx.Bypass.Matches(client.Remote.Host):
+		route.Detail = "direct (bypassed)"
+	case policyRoute == policy.Direct:
+		route.Detail = "direct (by policy)"
+	case client.route == policy.Direct:
+		route.Detail = "direct (by the routing table)"
+	case err == errNoProxies && ctx.StrictEgress:
+		route.Detail = "refused (no outbound proxies, strict egress)"
+		route.Failed = true
+	case err == errNoProxies:
+		route.Detail = "direct (no outbound proxies)"
+	case err != nil:
+		route.Detail = fmt.Sprintf("%s (%d of %d proxies eligible)", err.Error(), eligible, total)
+		if len(client.via) > 0 {
+			route.Detail = fmt.Sprintf("%s routed via %s by the routing table (%d of %d proxies eligible)", err.Error(), client.via, eligible, total)
+		}
+		route.Failed = true
+	default:
+		route.Detail = fmt.Sprintf("via %s:%d (%d of %d proxies eligible", proxy.Host, proxy.Port, eligible, total)
+		if len(client.via) > 0 {
+			route.Detail += ", routed via " + client.via + " by the routing table"
+		}
+		if sticky {
+			route.Detail += ", sticky for " + client.Remote.Host
+		}
+		if len(preference) > 0 {
+			if proxy.exits(preference) {
+				route.Detail += ", preferred exit " + preference
+			} else {
+				route.Detail += ", no exit matches the preference " + preference
+			}
+		}
+		route.Detail += ")"
+	}
+	steps = append(steps, route)
+	if !dial || route.Failed {
+		return steps
+	}
+
+	// The dial selects again, so the proxy it uses can differ when several are eligible
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- client.processOutbound()
+	}()
+	select {
+	case err = <-done:
+	case <-time.After(DiagnoseTimeout):
+		// Real requests would wait on, but a stalled handshake is the answer here
+		return append(steps, DiagnosisStep{Step: "dial", Detail: fmt.Sprintf("no answer within %v", DiagnoseTimeout), Failed: true})
+	}
+	if err != nil {
+		detail := err.Error()
+		if len(client.Proxy.Host) > 0 {
+			detail = fmt.Sprintf("%s via %s:%d (%s)", upstreamErrorClass(err), client.Proxy.Host, client.Proxy.Port, err.Error())
+		}
+		return append(steps, DiagnosisStep{Step: "dial", Detail: detail, Failed: true})
+	}
+	defer client.Remote.Connection.Close()
+	via := "direct"
+	if len(client.Proxy.Host) > 0 {
+		via = fmt.Sprintf("via %s:%d", client.Proxy.Host, client.Proxy.Port)
+	}
+	return append(steps, DiagnosisStep{Step: "dial", Detail: fmt.Sprintf("connected %s from %s in %v", via, client.Remote.Connection.LocalAddr().String(), time.Since(start).Round(time.Millisecond))})
+}
+
+// Look up a destination the way a direct connection would
+func (ctx *Context) diagnoseResolve(host string, proxied bool) DiagnosisStep {
+	step := DiagnosisStep{Step: "resolve"}
+	if hostIP(host) != nil {
+		step.Detail = "not needed for an address"
+		return step
+	}
+	lookup, cancel := context.WithTimeout(context.Background(), ResolveTimeout)
+	defer cancel()
+	addresses, err := net.DefaultResolver.LookupIPAddr(lookup, host)
+	switch {
+	case err != nil:
+		step.Detail = err.Error()
+		// The outbound proxy resolves names itself, so a local failure is only fatal for direct connections
+		step.Failed = !proxied
+	default:
+		var list []string
+		for _, address := range addresses {
+			entry := address.IP.String()
+			if ctx.ReachabilityHints && ctx.reach.broken(address.IP.To4() == nil) {
+				entry += " (unreachable family)"
+			}
+			list = append(list, entry)
+		}
+		step.Detail = strings.Join(list, ", ")
+	}
+	if proxied {
+		step.Detail += " (locally, the outbound proxy resolves it again)"
+	}
+	return step
+}
+
+// Name of a SOCKS address type for diagnostics
+func addressTypeName(addressType byte) string {
+	switch addressType {
+	case 0x01:
+		return "IPv4"
+	case 0x04:
+		return "IPv6"
+	}
+	return "domain"
+}
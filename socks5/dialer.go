@@ -0,0 +1,173 @@
+package socks5
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Dial opens a connection to host:port through the outbound proxy (SOCKS5, SOCKS4, HTTP CONNECT, Shadowsocks or a registered transport)
+func (ctx *ProxyInfo) Dial(host string, port int, timeout time.Duration) (net.Conn, error) {
+	connection, err := ctx.connect(&net.Dialer{Timeout: timeout})
+	if err != nil {
+		return nil, err
+	}
+	return ctx.open(connection, host, port, timeout)
+}
+
+// Connect to the outbound proxy itself (over TLS when it uses it)
+func (ctx *ProxyInfo) connect(dialer *net.Dialer) (net.Conn, error) {
+	address := net.JoinHostPort(ctx.Host, strconv.Itoa(ctx.Port))
+	var connection net.Conn
+	var err error
+	if ctx.UseTLS {
+		connection, err = tls.DialWithDialer(dialer, "tcp", address, &tls.Config{})
+	} else {
+		connection, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		return nil, &ErrUpstreamUnreachable{Proxy: ctx.Host, Err: err}
+	}
+	return connection, nil
+}
+
+// Ask the outbound proxy on a connection for a tunnel to host:port (the connection is closed on failure)
+func (ctx *ProxyInfo) open(connection net.Conn, host string, port int, timeout time.Duration) (net.Conn, error) {
+	var err error
+	if timeout > 0 {
+		connection.SetDeadline(time.Now().Add(timeout))
+	}
+	if ctx.httpConnect() {
+		reader := bufio.NewReader(connection)
+		err = ctx.connectHTTP(connection, reader, host, port)
+		if err != nil {
+			connection.Close()
+			return nil, err
+		}
+		connection.SetDeadline(time.Time{})
+		return &bufferedConn{Conn: connection, reader: reader}, nil
+	}
+	if ctx.socks4() {
+		_, err = ctx.connectSOCKS4(connection, connection, host, port)
+		if err != nil {
+			connection.Close()
+			return nil, err
+		}
+		connection.SetDeadline(time.Time{})
+		return connection, nil
+	}
+	if transport, ok := lookupUpstreamTransport(ctx.Type); ok {
+		tunnel, err := transport.Connect(*ctx, connection, host, port)
+		if err != nil {
+			connection.Close()
+			return nil, err
+		}
+		connection.SetDeadline(time.Time{})
+		return tunnel, nil
+	}
+	protected, err := ctx.handshake(connection, host, port)
+	if err != nil {
+		connection.Close()
+		return nil, err
+	}
+	connection.SetDeadline(time.Time{})
+	return protected, nil
+}
+
+// Negotiate authentication and send a connect request to the outbound proxy (the returned connection is protected when GSS-API is used)
+func (ctx *ProxyInfo) handshake(connection net.Conn, host string, port int) (net.Conn, error) {
+	if len(ctx.Username) > 255 || len(ctx.Password) > 255 || len(host) > 255 {
+		return nil, fmt.Errorf("provided username, password, or host is too long: %s", ctx.Host)
+	}
+	method := ctx.method()
+	_, err := connection.Write([]byte{0x05, 0x01, method})
+	if err != nil {
+		return nil, err
+	}
+	reply := make([]byte, 2)
+	_, err = io.ReadFull(connection, reply)
+	if err != nil {
+		return nil, err
+	}
+	if reply[0] != 0x05 || reply[1] != method {
+		return nil, fmt.Errorf("authentication method not supported: %s", ctx.Host)
+	}
+	if method == 0x01 {
+		// Everything after the sub-negotiation is encapsulated
+		connection, err = ctx.initiateGSS(connection, bufio.NewReader(connection))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if method == 0x02 {
+		request := []byte{0x01, byte(len(ctx.Username))}
+		request = append(request, ctx.Username...)
+		request = append(request, byte(len(ctx.Password)))
+		request = append(request, ctx.Password...)
+		_, err = connection.Write(request)
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.ReadFull(connection, reply)
+		if err != nil {
+			return nil, err
+		}
+		if reply[0] != 0x01 || reply[1] != 0x00 {
+			return nil, fmt.Errorf("%w: %s (%d)", ErrAuthFailed, ctx.Host, reply[1])
+		}
+	}
+
+	// Connect command
+	request := []byte{0x05, 0x01, 0x00}
+	ip := hostIP(host)
+	switch {
+	case ip != nil && ip.To4() != nil:
+		request = append(request, 0x01)
+		request = append(request, ip.To4()...)
+	case ip != nil:
+		request = append(request, 0x04)
+		request = append(request, ip.To16()...)
+	default:
+		request = append(request, 0x03, byte(len(host)))
+		request = append(request, host...)
+	}
+	request = append(request, byte((port>>8)&0xFF), byte(port&0xFF))
+	_, err = connection.Write(request)
+	if err != nil {
+		return nil, err
+	}
+
+	// Response header, then the bound address
+	header := make([]byte, 4)
+	_, err = io.ReadFull(connection, header)
+	if err != nil {
+		return nil, err
+	}
+	if header[0] != 0x05 {
+		return nil, fmt.Errorf("invalid data(6) from: %s", ctx.Host)
+	}
+	if header[1] != 0x00 {
+		return nil, &ErrCommandFailed{Proxy: ctx.Host, Code: header[1]}
+	}
+	length := 0
+	switch header[3] {
+	case 0x01:
+		length = 4
+	case 0x04:
+		length = 16
+	case 0x03:
+		_, err = io.ReadFull(connection, reply[:1])
+		if err != nil {
+			return nil, err
+		}
+		length = int(reply[0])
+	default:
+		return nil, fmt.Errorf("invalid address type from: %s", ctx.Host)
+	}
+	_, err = io.ReadFull(connection, make([]byte, length+2))
+	return connection, err
+}
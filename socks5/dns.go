@@ -0,0 +1,171 @@
+package socks5
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// DNSTimeout is how long the resolver has to answer a forwarded query
+const DNSTimeout = 5 * time.Second
+
+// SystemResolver returns the first nameserver in /etc/resolv.conf (empty when there is none)
+func SystemResolver() string {
+	input, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return ""
+	}
+	defer input.Close()
+	scanner := bufio.NewScanner(input)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return net.JoinHostPort(fields[1], "53")
+		}
+	}
+	return ""
+}
+
+// InterceptDNS answers UDP queries redirected from LAN clients, refusing blacklisted names and forwarding the rest to DNSResolver
+func (ctx *Context) InterceptDNS() error {
+	address, err := net.ResolveUDPAddr("udp", ctx.DNSIntercept)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp", address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if ctx.Logger != nil {
+		ctx.Logger <- fmt.Sprintf(" [*] Intercepting DNS on: %s (resolver %s)\n", ctx.DNSIntercept, ctx.DNSResolver)
+	}
+	buffer := make([]byte, 65535)
+	for {
+		n, client, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		// A resolver open to the internet is an amplifier, so only private networks (or origins that allow it) are served
+		origin := ctx.Origins.Classify(client.IP.String())
+		if origin.Deny || (publicIP(client.IP) && origin.Name == internet.Name) {
+			continue
+		}
+		query := append([]byte(nil), buffer[:n]...)
+		go ctx.answerDNS(conn, client, query)
+	}
+}
+
+// Answer one intercepted query
+func (ctx *Context) answerDNS(conn *net.UDPConn, client *net.UDPAddr, query []byte) {
+	name, end, err := dnsQuestion(query)
+	if err != nil {
+		return
+	}
+	// Only the first question is checked, so a query carrying more would slip the others past the filter
+	if binary.BigEndian.Uint16(query[4:6]) != 1 {
+		conn.WriteToUDP(dnsError(query[:12], dnsFormatError), client)
+		return
+	}
+	if match, ok := ctx.matchDomain(name); ok {
+		if ctx.Logger != nil {
+			ctx.Logger <- fmt.Sprintf(" [!] Blacklisted: %s (%s) (dns from %s)\n", name, explain(match), client.IP.String())
+		}
+		ctx.metrics().Counter("blocked_total", 1, ctx.metricLabels("protocol", "dns"))
+		conn.WriteToUDP(dnsError(query[:end], dnsNameError), client)
+		return
+	}
+	reply, err := ctx.resolveDNS(query)
+	if err != nil {
+		ctx.logError(fmt.Errorf("dns %s for %s: %w", name, client.IP.String(), err))
+		return
+	}
+	conn.WriteToUDP(reply, client)
+}
+
+// Pass a query to the resolver and wait for its reply
+func (ctx *Context) resolveDNS(query []byte) ([]byte, error) {
+	resolver, err := net.Dial("udp", ctx.DNSResolver)
+	if err != nil {
+		return nil, err
+	}
+	defer resolver.Close()
+	resolver.SetDeadline(time.Now().Add(DNSTimeout))
+	_, err = resolver.Write(query)
+	if err != nil {
+		return nil, err
+	}
+	reply := make([]byte, 65535)
+	for {
+		n, err := resolver.Read(reply)
+		if err != nil {
+			return nil, err
+		}
+		// Replies for another query ID are stray, keep waiting for ours
+		if n >= 12 && reply[0] == query[0] && reply[1] == query[1] {
+			return reply[:n], nil
+		}
+	}
+}
+
+// Name asked for in the first question of a query, and where the question ends
+func dnsQuestion(query []byte) (string, int, error) {
+	if len(query) < 12 || query[2]&0x80 != 0 || binary.BigEndian.Uint16(query[4:6]) == 0 {
+		return "", 0, errors.New("not a DNS query")
+	}
+	var labels []string
+	offset := 12
+	for {
+		if offset >= len(query) {
+			return "", 0, errors.New("truncated DNS question")
+		}
+		size := int(query[offset])
+		offset++
+		if size == 0 {
+			break
+		}
+		// Questions are never compressed
+		if size > 63 || offset+size > len(query) {
+			return "", 0, errors.New("invalid DNS label")
+		}
+		labels = append(labels, string(query[offset:offset+size]))
+		offset += size
+	}
+	// Type and class
+	offset += 4
+	if offset > len(query) {
+		return "", 0, errors.New("truncated DNS question")
+	}
+	return canonicalHost(strings.Join(labels, ".")), offset, nil
+}
+
+// Response codes for queries answered without the resolver
+const (
+	dnsFormatError = 0x01
+	dnsNameError   = 0x03
+)
+
+// Error reply to a query, echoing its header and first question if given (NXDOMAIN for a blocked name)
+func dnsError(question []byte, code byte) []byte {
+	reply := append([]byte(nil), question...)
+	// Response, keep the opcode and recursion desired, recursion available, response code
+	reply[2] = 0x80 | reply[2]&0x79
+	reply[3] = 0x80 | code
+	questions := uint16(0)
+	if len(reply) > 12 {
+		questions = 1
+	}
+	binary.BigEndian.PutUint16(reply[4:6], questions)
+	binary.BigEndian.PutUint16(reply[6:8], 0)
+	binary.BigEndian.PutUint16(reply[8:10], 0)
+	binary.BigEndian.PutUint16(reply[10:12], 0)
+	return reply
+}
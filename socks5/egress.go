@@ -0,0 +1,19 @@
+package socks5
+
+import (
+	"fmt"
+)
+
+// Whether requests must leave through outbound proxies but none is loaded (strict egress mode)
+func (ctx *Context) egressBlocked() bool {
+	return ctx.StrictEgress && len(ctx.Proxies.List()) == 0
+}
+
+// Refuse a request that would otherwise fall back to a direct connection, so nothing leaks while the outbound proxies are missing
+func (ctx *ClientCtx) refuseDirect() error {
+	// Respond with connection not allowed by ruleset (0x02)
+	ctx.sendFailure(0x02)
+	err := fmt.Errorf("%w: command %d %s -> %s:%d", ErrDirectRefused, ctx.Command, ctx.Identity(), ctx.Remote.Host, ctx.Remote.Port)
+	ctx.Ctx.logError(err)
+	return err
+}
@@ -0,0 +1,107 @@
+package socks5
+
+import (
+	"errors"
+	"fmt"
+	"proxy/filter"
+)
+
+// ErrUnsupportedCommand is returned when a client requests a command the server does not handle
+var ErrUnsupportedCommand = errors.New("unsupported command")
+
+// ErrAuthFailed is returned when credentials are rejected
+var ErrAuthFailed = errors.New("authentication failed")
+
+// ErrOutsideSchedule is returned when a user connects outside their allowed time
+var ErrOutsideSchedule = errors.New("outside allowed time")
+
+// ErrNoEligibleProxy is returned when no outbound proxy meets the selection requirements
+var ErrNoEligibleProxy = errors.New("no eligible outbound proxy")
+
+// ErrProtocolMismatch is returned when a client speaks something other than SOCKS (HTTP or TLS)
+var ErrProtocolMismatch = errors.New("protocol mismatch")
+
+// ErrQuotaExceeded is returned when a tenant has used up its transfer quota
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// ErrMalformedRequest is returned when a client's handshake breaks the protocol's field rules
+var ErrMalformedRequest = errors.New("malformed request")
+
+// ErrDeviation is returned in strict mode when a client departs from RFC 1928 or 1929
+var ErrDeviation = errors.New("RFC deviation")
+
+// ErrPolicyDenied is returned when a policy rule refuses a request
+var ErrPolicyDenied = errors.New("denied by policy")
+
+// ErrDirectRefused is returned in strict egress mode when a request would be connected directly for want of outbound proxies
+var ErrDirectRefused = errors.New("direct connection refused")
+
+// The pool is empty, so connections are made directly
+var errNoProxies = errors.New("no outbound proxies")
+
+// ErrBlocked is returned when a destination matches the domain filter
+type ErrBlocked struct {
+	Domain string
+	Match  filter.Explanation
+}
+
+func (err *ErrBlocked) Error() string {
+	return fmt.Sprintf("blocked: %s (%s)", err.Domain, explain(err.Match))
+}
+
+// Describe the rule that matched, with where it came from
+func explain(match filter.Explanation) string {
+	description := "rule: " + match.Rule
+	if len(match.Source) > 0 {
+		description += ", source: " + match.Source
+	}
+	if len(match.Category) > 0 {
+		description += ", category: " + match.Category
+	}
+	return description
+}
+
+// ErrUpstreamUnreachable is returned when an outbound proxy can't be reached
+type ErrUpstreamUnreachable struct {
+	Proxy string
+	Err   error
+}
+
+func (err *ErrUpstreamUnreachable) Error() string {
+	return fmt.Sprintf("upstream unreachable: %s (%s)", err.Proxy, err.Err.Error())
+}
+
+// Unwrap returns the underlying dial error
+func (err *ErrUpstreamUnreachable) Unwrap() error {
+	return err.Err
+}
+
+// ErrCommandFailed is returned when an outbound proxy answers a request with a failure code
+type ErrCommandFailed struct {
+	Proxy string
+	Code  byte
+}
+
+func (err *ErrCommandFailed) Error() string {
+	return fmt.Sprintf("command failed: %d (%s)", err.Code, err.Proxy)
+}
+
+// ErrDestinationBusy is returned when a destination host already has its limit of tunnels
+type ErrDestinationBusy struct {
+	Host  string
+	Limit int
+}
+
+func (err *ErrDestinationBusy) Error() string {
+	return fmt.Sprintf("destination busy: %s (limit %d)", err.Host, err.Limit)
+}
+
+// ErrUpstreamTampered is returned when an outbound proxy's handshake fails validation
+type ErrUpstreamTampered struct {
+	Proxy  string
+	Reason string
+}
+
+func (err *ErrUpstreamTampered) Error() string {
+	return fmt.Sprintf("upstream failed validation: %s (%s)", err.Proxy, err.Reason)
+}
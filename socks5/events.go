@@ -0,0 +1,75 @@
+package socks5
+
+import (
+	"errors"
+	"proxy/filter"
+	"sync/atomic"
+	"time"
+)
+
+// Event describing a change in a client session
+type Event struct {
+	Type     string              `json:"type"`
+	Time     time.Time           `json:"time"`
+	Client   string              `json:"client"`
+	User     string              `json:"user"`
+	Host     string              `json:"host"`
+	Port     int                 `json:"port"`
+	Proxy    string              `json:"proxy,omitempty"`
+	Sent     uint64              `json:"sent"`
+	Received uint64              `json:"received"`
+	Error    string              `json:"error,omitempty"`
+	Tenant   string              `json:"tenant,omitempty"`
+	Origin   string              `json:"origin,omitempty"`
+	Block    *filter.Explanation `json:"block,omitempty"`
+	Pool     *Utilization        `json:"pool,omitempty"`
+	Labels   map[string]string   `json:"labels,omitempty"`
+	Err      error               `json:"-"`
+}
+
+// EventHandler receives session events (handlers must not block)
+type EventHandler interface {
+	HandleEvent(event Event)
+}
+
+// Pass an event to all registered handlers
+func (ctx *Context) emit(event Event) {
+	for _, handler := range ctx.EventHandlers {
+		handler.HandleEvent(event)
+	}
+}
+
+// Record why a client session failed and report it
+func (ctx *ClientCtx) fail(err error) {
+	ctx.Err = err
+	ctx.Ctx.emit(ctx.event("failed"))
+}
+
+// Build an event from the current state of a client session
+func (ctx *ClientCtx) event(eventType string) Event {
+	event := Event{
+		Type:     eventType,
+		Time:     time.Now(),
+		Client:   ctx.Client.Host,
+		User:     ctx.Identity(),
+		Host:     ctx.Remote.Host,
+		Port:     ctx.Remote.Port,
+		Proxy:    ctx.Proxy.Host,
+		Sent:     atomic.LoadUint64(&ctx.Client.ReadCount),
+		Received: atomic.LoadUint64(&ctx.Remote.ReadCount),
+		Origin:   ctx.OriginName(),
+		Err:      ctx.Err,
+	}
+	if ctx.Err != nil {
+		event.Error = ctx.Err.Error()
+	}
+	var blocked *ErrBlocked
+	if errors.As(ctx.Err, &blocked) {
+		event.Block = &blocked.Match
+	}
+	if ctx.Ctx.Tenant != nil {
+		event.Tenant = ctx.Ctx.Tenant.Name
+		event.Labels = ctx.Ctx.Tenant.Labels
+	}
+	return event
+}
@@ -0,0 +1,48 @@
+//go:build linux
+
+package socks5
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Socket options from linux/tcp.h
+const (
+	tcpFastOpen        = 23
+	tcpFastOpenConnect = 30
+)
+
+// FastOpenSupport reports whether the kernel allows TCP Fast Open for outbound and inbound connections
+func FastOpenSupport() (bool, bool) {
+	data, err := os.ReadFile("/proc/sys/net/ipv4/tcp_fastopen")
+	if err != nil {
+		return false, false
+	}
+	flags, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return false, false
+	}
+	// Bit 1 enables the client side, bit 2 the server side
+	return flags&1 != 0, flags&2 != 0
+}
+
+// Enable Fast Open on a listening socket (with room for 256 pending handshakes)
+func fastOpenListen(network string, address string, conn syscall.RawConn) error {
+	var err error
+	conn.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpFastOpen, 256)
+	})
+	return err
+}
+
+// Enable Fast Open on an outbound socket (the SYN waits for the first write and carries it)
+func fastOpenDial(network string, address string, conn syscall.RawConn) error {
+	var err error
+	conn.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpFastOpenConnect, 1)
+	})
+	return err
+}
@@ -0,0 +1,23 @@
+//go:build !linux
+
+package socks5
+
+import (
+	"syscall"
+)
+
+// FastOpenSupport reports whether the kernel allows TCP Fast Open for outbound and inbound connections
+func FastOpenSupport() (bool, bool) {
+	// Only detected and enabled on Linux so far
+	return false, false
+}
+
+// Fast Open is not available on this platform
+func fastOpenListen(network string, address string, conn syscall.RawConn) error {
+	return nil
+}
+
+// Fast Open is not available on this platform
+func fastOpenDial(network string, address string, conn syscall.RawConn) error {
+	return nil
+}
@@ -0,0 +1,190 @@
+package socks5
+
+import (
+	"fmt"
+	"proxy/filter"
+	"time"
+)
+
+// FilterExpiryInterval is how often expired entries are removed from the domain filter
+const FilterExpiryInterval = time.Minute
+
+// SetFilter atomically replaces the domain filter and ends the interim policy, carrying over the changes made while it loaded
+func (ctx *Context) SetFilter(domainFilter filter.Filter) {
+	ctx.filterLock.Lock()
+	defer ctx.filterLock.Unlock()
+	for _, change := range ctx.filterPending {
+		change(&domainFilter)
+	}
+	if len(ctx.filterPending) > 0 {
+		domainFilter.Save()
+		ctx.filterPending = nil
+	}
+	ctx.DomainFilter = domainFilter
+	ctx.filterReady = true
+	ctx.filterGeneration++
+}
+
+// Remember a change made to the interim filter, to apply it again to the full filter once it loads (the caller holds the filter lock)
+func (ctx *Context) deferChange(change func(*filter.Filter)) {
+	if !ctx.filterReady {
+		ctx.filterPending = append(ctx.filterPending, change)
+	}
+}
+
+// UpdateFilter adds entries to the domain filter and saves it
+func (ctx *Context) UpdateFilter(entries []filter.DomainEntry) {
+	ctx.filterLock.Lock()
+	defer ctx.filterLock.Unlock()
+	ctx.DomainFilter.Add(entries)
+	ctx.DomainFilter.Save()
+	ctx.deferChange(func(domainFilter *filter.Filter) { domainFilter.Add(entries) })
+	ctx.filterGeneration++
+}
+
+// ImportFilter merges a batch of entries into the domain filter and saves it, or only reports the result on a dry run
+func (ctx *Context) ImportFilter(entries []filter.DomainEntry, dryRun bool) filter.MergeResult {
+	ctx.filterLock.Lock()
+	defer ctx.filterLock.Unlock()
+	result := ctx.DomainFilter.Merge(entries, dryRun)
+	if !dryRun {
+		ctx.DomainFilter.Save()
+		ctx.deferChange(func(domainFilter *filter.Filter) { domainFilter.Merge(entries, false) })
+		ctx.filterGeneration++
+	}
+	return result
+}
+
+// RemoveFilter removes entries from the domain filter by name and saves it, returning how many were removed
+func (ctx *Context) RemoveFilter(names []string) int {
+	ctx.filterLock.Lock()
+	defer ctx.filterLock.Unlock()
+	removed := ctx.DomainFilter.Remove(names)
+	// The names may only be in the full filter that is still loading
+	ctx.deferChange(func(domainFilter *filter.Filter) { domainFilter.Remove(names) })
+	if removed > 0 {
+		ctx.DomainFilter.Save()
+		ctx.filterGeneration++
+	}
+	return removed
+}
+
+// ReplaceFilter swaps the domain filter's entries for a new set and saves it
+func (ctx *Context) ReplaceFilter(entries []filter.DomainEntry) {
+	ctx.filterLock.Lock()
+	defer ctx.filterLock.Unlock()
+	ctx.DomainFilter.Replace(entries)
+	ctx.DomainFilter.Save()
+	ctx.deferChange(func(domainFilter *filter.Filter) { domainFilter.Replace(entries) })
+	ctx.filterGeneration++
+}
+
+// SyncFilter takes over a failover peer's domain filter entries, saving them without a backup (the peer made the change and keeps the backups)
+func (ctx *Context) SyncFilter(entries []filter.DomainEntry) {
+	ctx.filterLock.Lock()
+	defer ctx.filterLock.Unlock()
+	ctx.DomainFilter.Replace(entries)
+	backups := ctx.DomainFilter.Backups
+	ctx.DomainFilter.Backups = 0
+	ctx.DomainFilter.Save()
+	ctx.DomainFilter.Backups = backups
+	ctx.deferChange(func(domainFilter *filter.Filter) { domainFilter.Replace(entries) })
+	ctx.filterGeneration++
+}
+
+// FilterReady reports whether the domain filter has been activated
+func (ctx *Context) FilterReady() bool {
+	ctx.filterLock.RLock()
+	defer ctx.filterLock.RUnlock()
+	return ctx.filterReady
+}
+
+// Match a host against the domain filter, applying the interim policy until it is ready
+func (ctx *Context) matchDomain(host string) (filter.Explanation, bool) {
+	// Hit counts are updated atomically, so matches share the lock
+	ctx.filterLock.RLock()
+	defer ctx.filterLock.RUnlock()
+	if !ctx.filterReady && ctx.InterimPolicy == "deny" {
+		return filter.Explanation{Item: host, Rule: "interim deny policy", Source: "interim"}, true
+	}
+	return ctx.DomainFilter.Explain(host)
+}
+
+// SaveFilter writes the domain filter to the file it was loaded from
+func (ctx *Context) SaveFilter() {
+	ctx.filterLock.Lock()
+	defer ctx.filterLock.Unlock()
+	ctx.DomainFilter.Save()
+}
+
+// RollbackFilter restores the domain filter's file from its newest backup and reloads it, returning the backup's name and the entries restored
+func (ctx *Context) RollbackFilter() (string, int, error) {
+	ctx.filterLock.Lock()
+	defer ctx.filterLock.Unlock()
+	if !ctx.filterReady {
+		return "", 0, fmt.Errorf("blacklist is still loading: %s", ctx.ListenAddress)
+	}
+	if len(ctx.DomainFilter.FileName) == 0 {
+		return "", 0, fmt.Errorf("blacklist has no file: %s", ctx.ListenAddress)
+	}
+	backup, err := filter.Rollback(ctx.DomainFilter.FileName)
+	if err != nil {
+		return "", 0, err
+	}
+	return backup, ctx.reloadFilterLocked(), nil
+}
+
+// ReloadFilter reads the domain filter back from its file (after another listener sharing it rolled it back), returning the entries loaded
+func (ctx *Context) ReloadFilter() int {
+	ctx.filterLock.Lock()
+	defer ctx.filterLock.Unlock()
+	return ctx.reloadFilterLocked()
+}
+
+// Replace the domain filter's entries with its file's (the caller holds the filter lock)
+func (ctx *Context) reloadFilterLocked() int {
+	restored := filter.Filter{Backups: ctx.DomainFilter.Backups}
+	if restored.LoadFile(ctx.DomainFilter.FileName) {
+		ctx.DomainFilter = restored
+		ctx.filterGeneration++
+	}
+	return len(ctx.DomainFilter.Domains)
+}
+
+// FilterFile is the file the domain filter is saved to (empty if none)
+func (ctx *Context) FilterFile() string {
+	ctx.filterLock.RLock()
+	defer ctx.filterLock.RUnlock()
+	return ctx.DomainFilter.FileName
+}
+
+// FilterGeneration counts the changes to the domain filter's entries (not its hit counts), so peers can tell when to fetch it again
+func (ctx *Context) FilterGeneration() uint64 {
+	ctx.filterLock.RLock()
+	defer ctx.filterLock.RUnlock()
+	return ctx.filterGeneration
+}
+
+// FilterEntries returns a copy of the domain filter's entries (exclusively, as matches may be counting hits)
+func (ctx *Context) FilterEntries() []filter.DomainEntry {
+	ctx.filterLock.Lock()
+	defer ctx.filterLock.Unlock()
+	return append([]filter.DomainEntry{}, ctx.DomainFilter.Domains...)
+}
+
+// Periodically remove expired entries from the domain filter, saving it when something changed
+func (ctx *Context) expireFilter() {
+	for {
+		time.Sleep(FilterExpiryInterval)
+		ctx.filterLock.Lock()
+		removed := ctx.DomainFilter.Expire(time.Now())
+		if removed > 0 {
+			ctx.DomainFilter.Save()
+			ctx.filterGeneration++
+		}
+		ctx.filterLock.Unlock()
+		if removed > 0 && ctx.Logger != nil {
+			ctx.Logger <- fmt.Sprintf(" [-] Removed %d expired blacklist entries: %s\n", removed, ctx.ListenAddress)
+		}
+	}
+}
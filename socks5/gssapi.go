@@ -0,0 +1,320 @@
+package socks5
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// GSS-API message types (RFC 1961)
+const (
+	gssAuthenticate = 0x01
+	gssProtection   = 0x02
+	gssEncapsulated = 0x03
+	gssAbort        = 0xFF
+)
+
+// Protection levels (RFC 1961)
+const (
+	gssIntegrity       = 0x01
+	gssConfidentiality = 0x02
+	gssSelective       = 0x03
+)
+
+// Largest payload wrapped into one message, leaving room for the mechanism's overhead
+const gssChunk = 16 * 1024
+
+// GSSContext is one side of a GSS-API security context
+type GSSContext interface {
+	// Step consumes the peer's token (nil to start as the initiator) and returns the token to send back, if any
+	Step(token []byte) (output []byte, established bool, err error)
+	// Principal the peer authenticated as (acceptor side)
+	Principal() string
+	// Wrap protects a message for the peer, encrypting it when confidential is set
+	Wrap(message []byte, confidential bool) ([]byte, error)
+	// Unwrap checks and decodes a message from the peer
+	Unwrap(token []byte) ([]byte, error)
+}
+
+// GSSMechanism creates security contexts (Kerberos and similar mechanisms plug in here)
+type GSSMechanism interface {
+	// Acceptor for an inbound client
+	Acceptor() (GSSContext, error)
+	// Initiator for an outbound proxy offering the host based service
+	Initiator(service string) (GSSContext, error)
+}
+
+var gssMechanisms = make(map[string]GSSMechanism)
+var gssLock sync.Mutex
+
+// RegisterGSSMechanism makes a mechanism available by name
+func RegisterGSSMechanism(name string, mechanism GSSMechanism) {
+	gssLock.Lock()
+	defer gssLock.Unlock()
+	gssMechanisms[name] = mechanism
+}
+
+// LookupGSSMechanism finds a registered mechanism
+func LookupGSSMechanism(name string) (GSSMechanism, bool) {
+	gssLock.Lock()
+	defer gssLock.Unlock()
+	mechanism, ok := gssMechanisms[name]
+	return mechanism, ok
+}
+
+// Read one GSS-API message (VER, MTYP, LEN, TOKEN)
+func readGSSMessage(reader *bufio.Reader) (byte, []byte, error) {
+	header := make([]byte, 2)
+	_, err := io.ReadFull(reader, header)
+	if err != nil {
+		return 0, nil, err
+	}
+	if header[0] != 0x01 {
+		return 0, nil, fmt.Errorf("invalid GSS-API message version: %d", header[0])
+	}
+	if header[1] == gssAbort {
+		// Aborts carry no token
+		return gssAbort, nil, nil
+	}
+	length := make([]byte, 2)
+	_, err = io.ReadFull(reader, length)
+	if err != nil {
+		return 0, nil, err
+	}
+	token := make([]byte, binary.BigEndian.Uint16(length))
+	_, err = io.ReadFull(reader, token)
+	return header[1], token, err
+}
+
+// Write one GSS-API message
+func writeGSSMessage(writer io.Writer, kind byte, token []byte) error {
+	if len(token) > 0xFFFF {
+		return errors.New("GSS-API token too long")
+	}
+	message := []byte{0x01, kind, byte(len(token) >> 8), byte(len(token))}
+	_, err := writer.Write(append(message, token...))
+	return err
+}
+
+// gssConn encapsulates traffic in per-message protection once a level has been agreed
+type gssConn struct {
+	net.Conn
+	reader       *bufio.Reader
+	security     GSSContext
+	confidential bool
+	pending      []byte
+	writeLock    sync.Mutex
+}
+
+// Read unwraps the next encapsulated message when the previous one has been consumed
+func (ctx *gssConn) Read(data []byte) (int, error) {
+	for len(ctx.pending) == 0 {
+		kind, token, err := readGSSMessage(ctx.reader)
+		if err != nil {
+			return 0, err
+		}
+		if kind != gssEncapsulated {
+			return 0, fmt.Errorf("unexpected GSS-API message type: %d", kind)
+		}
+		ctx.pending, err = ctx.security.Unwrap(token)
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(data, ctx.pending)
+	ctx.pending = ctx.pending[n:]
+	return n, nil
+}
+
+// Write wraps the data into as many messages as needed
+func (ctx *gssConn) Write(data []byte) (int, error) {
+	ctx.writeLock.Lock()
+	defer ctx.writeLock.Unlock()
+	written := 0
+	for written < len(data) {
+		end := written + gssChunk
+		if end > len(data) {
+			end = len(data)
+		}
+		token, err := ctx.security.Wrap(data[written:end], ctx.confidential)
+		if err == nil {
+			err = writeGSSMessage(ctx.Conn, gssEncapsulated, token)
+		}
+		if err != nil {
+			return written, err
+		}
+		written = end
+	}
+	return written, nil
+}
+
+// CloseWrite passes half-closes through to the underlying connection
+func (ctx *gssConn) CloseWrite() error {
+	if conn, ok := ctx.Conn.(interface{ CloseWrite() error }); ok {
+		return conn.CloseWrite()
+	}
+	return ctx.Conn.Close()
+}
+
+// Accept a client's GSS-API context and protection level, returning the protected connection
+func gssAccept(connection net.Conn, reader *bufio.Reader, security GSSContext) (net.Conn, error) {
+	for {
+		kind, token, err := readGSSMessage(reader)
+		if err != nil {
+			return nil, err
+		}
+		if kind == gssAbort {
+			return nil, errors.New("GSS-API authentication aborted by client")
+		}
+		if kind != gssAuthenticate {
+			return nil, fmt.Errorf("unexpected GSS-API message type: %d", kind)
+		}
+		output, established, err := security.Step(token)
+		if err != nil {
+			connection.Write([]byte{0x01, gssAbort})
+			return nil, err
+		}
+		if len(output) > 0 || !established {
+			err = writeGSSMessage(connection, gssAuthenticate, output)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if established {
+			break
+		}
+	}
+
+	// The client proposes a protection level and the server answers with the one to use
+	kind, token, err := readGSSMessage(reader)
+	if err != nil {
+		return nil, err
+	}
+	if kind != gssProtection {
+		return nil, fmt.Errorf("unexpected GSS-API message type: %d", kind)
+	}
+	level, err := security.Unwrap(token)
+	if err != nil {
+		return nil, err
+	}
+	if len(level) != 1 || level[0] < gssIntegrity || level[0] > gssSelective {
+		connection.Write([]byte{0x01, gssAbort})
+		return nil, errors.New("invalid GSS-API protection level")
+	}
+	if level[0] == gssSelective {
+		// Per-message choice is not supported, so protect everything
+		level[0] = gssConfidentiality
+	}
+	token, err = security.Wrap(level, false)
+	if err == nil {
+		err = writeGSSMessage(connection, gssProtection, token)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &gssConn{Conn: connection, reader: reader, security: security, confidential: level[0] == gssConfidentiality}, nil
+}
+
+// Establish a GSS-API context with an upstream proxy, returning the protected connection
+func gssInitiate(connection net.Conn, reader *bufio.Reader, security GSSContext) (net.Conn, error) {
+	var token []byte
+	for {
+		output, established, err := security.Step(token)
+		if err != nil {
+			connection.Write([]byte{0x01, gssAbort})
+			return nil, err
+		}
+		if len(output) > 0 {
+			err = writeGSSMessage(connection, gssAuthenticate, output)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if established {
+			break
+		}
+		var kind byte
+		kind, token, err = readGSSMessage(reader)
+		if err != nil {
+			return nil, err
+		}
+		if kind == gssAbort {
+			return nil, errors.New("GSS-API authentication rejected by proxy")
+		}
+		if kind != gssAuthenticate {
+			return nil, fmt.Errorf("unexpected GSS-API message type: %d", kind)
+		}
+	}
+
+	// Ask for confidentiality and use whatever the proxy settles on
+	token, err := security.Wrap([]byte{gssConfidentiality}, false)
+	if err == nil {
+		err = writeGSSMessage(connection, gssProtection, token)
+	}
+	if err != nil {
+		return nil, err
+	}
+	kind, token, err := readGSSMessage(reader)
+	if err != nil {
+		return nil, err
+	}
+	if kind != gssProtection {
+		return nil, errors.New("GSS-API protection level rejected by proxy")
+	}
+	level, err := security.Unwrap(token)
+	if err != nil {
+		return nil, err
+	}
+	if len(level) != 1 || (level[0] != gssIntegrity && level[0] != gssConfidentiality) {
+		return nil, errors.New("invalid GSS-API protection level")
+	}
+	return &gssConn{Conn: connection, reader: reader, security: security, confidential: level[0] == gssConfidentiality}, nil
+}
+
+// Run the inbound GSS-API sub-negotiation and switch the client to the protected connection
+func (ctx *ClientCtx) authenticateGSS() error {
+	security, err := ctx.Ctx.GSSAPI.Acceptor()
+	if err != nil {
+		return err
+	}
+	connection, err := gssAccept(ctx.Client.Connection, ctx.Client.Reader, security)
+	if err != nil {
+		return fmt.Errorf("%w: GSS-API from: %s (%v)", ErrAuthFailed, ctx.Client.Host, err)
+	}
+	ctx.User = security.Principal()
+	ctx.Client.Connection = connection
+	ctx.Client.Reader = bufio.NewReader(connection)
+	ctx.Client.Writer = bufio.NewWriter(connection)
+	if ctx.Ctx.Logger != nil {
+		ctx.Ctx.Logger <- fmt.Sprintf(" [+] Authenticated: %s from [%s]:%d (GSS-API)\n", ctx.User, ctx.Client.Host, ctx.Client.Port)
+	}
+	return nil
+}
+
+// Run the outbound GSS-API sub-negotiation and switch to the protected connection
+func (ctx *ProxyInfo) initiateGSS(connection net.Conn, reader *bufio.Reader) (net.Conn, error) {
+	mechanism, ok := LookupGSSMechanism(ctx.GSSAPI)
+	if !ok {
+		return nil, fmt.Errorf("unknown GSS-API mechanism %q for: %s", ctx.GSSAPI, ctx.Host)
+	}
+	// Host based service name, as most SOCKS servers expect
+	security, err := mechanism.Initiator("rcmd@" + ctx.Host)
+	if err != nil {
+		return nil, err
+	}
+	protected, err := gssInitiate(connection, reader, security)
+	if err != nil {
+		return nil, fmt.Errorf("%w: GSS-API with: %s (%v)", ErrAuthFailed, ctx.Host, err)
+	}
+	return protected, nil
+}
+
+// Whether the client's traffic is encapsulated by GSS-API
+func (ctx *ClientCtx) protected() bool {
+	_, ok := ctx.Client.Connection.(*gssConn)
+	return ok
+}
@@ -0,0 +1,130 @@
+package socks5
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// HealthTimeout limits each health probe of an outbound proxy
+const HealthTimeout = 10 * time.Second
+
+// CheckHealth probes every outbound proxy each HealthInterval, skipping one after HealthFailures probes fail in a row until a probe succeeds again
+func (ctx *Context) CheckHealth() {
+	for {
+		time.Sleep(ctx.HealthInterval)
+		var wait sync.WaitGroup
+		for _, proxy := range ctx.Proxies.List() {
+			wait.Add(1)
+			go func(proxy ProxyInfo) {
+				defer wait.Done()
+				ctx.checkProxy(proxy)
+			}(proxy)
+		}
+		wait.Wait()
+	}
+}
+
+// Probe one outbound proxy and mark it down or up when that changes
+func (ctx *Context) checkProxy(proxy ProxyInfo) {
+	connect, handshake, err := ctx.probeProxy(proxy)
+	if err == nil {
+		ctx.Proxies.recordLatency(proxy, connect, handshake)
+	} else {
+		ctx.Proxies.penalizeLatency(proxy)
+	}
+	limit := ctx.HealthFailures
+	if limit < 1 {
+		limit = 1
+	}
+	changed, down := false, false
+	ctx.Proxies.updateStatus(proxy, func(status *ProxyStatus) {
+		status.HealthChecked = time.Now()
+		if err == nil {
+			changed = status.Down
+			status.HealthFailures = 0
+			status.Down = false
+			return
+		}
+		status.HealthFailures++
+		if !status.Down && status.HealthFailures >= limit {
+			status.Down = true
+			changed = true
+		}
+		down = status.Down
+	})
+	if !changed {
+		return
+	}
+	if down {
+		if ctx.Logger != nil {
+			ctx.Logger <- fmt.Sprintf(" [!] Outbound proxy down: %s:%d (%s)\n", proxy.Host, proxy.Port, err.Error())
+		}
+		ctx.Proxies.recordError(proxy, err)
+		ctx.emit(Event{Type: "upstream_down", Time: time.Now(), Proxy: proxy.Host, Port: proxy.Port, Error: err.Error(), Err: err})
+		return
+	}
+	if ctx.Logger != nil {
+		ctx.Logger <- fmt.Sprintf(" [+] Outbound proxy recovered: %s:%d\n", proxy.Host, proxy.Port)
+	}
+	ctx.emit(Event{Type: "upstream_up", Time: time.Now(), Proxy: proxy.Host, Port: proxy.Port})
+}
+
+// Connect through an outbound proxy to HealthTarget when one is set, otherwise only check that it answers a greeting (returning how long connecting and then the greeting took, the greeting unmeasured through a target)
+func (ctx *Context) probeProxy(proxy ProxyInfo) (time.Duration, time.Duration, error) {
+	var host string
+	var port int
+	if len(ctx.HealthTarget) > 0 {
+		var portText string
+		var err error
+		host, portText, err = net.SplitHostPort(ctx.HealthTarget)
+		if err != nil {
+			return 0, 0, err
+		}
+		port, err = strconv.Atoi(portText)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	started := time.Now()
+	dialer := ctx.upstreamDialer(proxy)
+	dialer.Timeout = HealthTimeout
+	connection, err := proxy.connect(dialer)
+	if err != nil {
+		return 0, 0, err
+	}
+	connect := time.Since(started)
+	started = time.Now()
+	if len(host) > 0 {
+		tunnel, err := proxy.open(connection, host, port, HealthTimeout)
+		if err != nil {
+			return 0, 0, err
+		}
+		// Opening the tunnel waits on the target as well, so only the connect time compares with other samples
+		return connect, 0, tunnel.Close()
+	}
+	defer connection.Close()
+	if !proxy.socks5() {
+		// Other protocols have nothing to exchange before a request
+		return connect, 0, nil
+	}
+	connection.SetDeadline(time.Now().Add(HealthTimeout))
+	method := proxy.method()
+	_, err = connection.Write([]byte{0x05, 0x01, method})
+	if err != nil {
+		return 0, 0, err
+	}
+	reply := make([]byte, 2)
+	_, err = io.ReadFull(connection, reply)
+	if err != nil {
+		return 0, 0, err
+	}
+	if reply[0] != 0x05 || reply[1] != method {
+		return 0, 0, fmt.Errorf("unexpected greeting reply from: %s (%d, %d)", proxy.Host, reply[0], reply[1])
+	}
+	return connect, time.Since(started), nil
+}
@@ -0,0 +1,198 @@
+package socks5
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"proxy/httpproxy"
+	"strconv"
+	"strings"
+)
+
+// Version recorded for clients speaking HTTP CONNECT (their replies are HTTP status lines)
+const versionHTTP = 'H'
+
+// processHTTP reads an HTTP CONNECT (or plain forward) request (with its first byte put back) into the same fields as SOCKS5
+func (ctx *ClientCtx) processHTTP() error {
+	ctx.Version = versionHTTP
+	request, err := httpproxy.ReadRequest(ctx.Client.Reader)
+	if err != nil {
+		ctx.sendHTTP(400, "Bad Request")
+		return fmt.Errorf("%w: %s from: %s (http)", ErrMalformedRequest, err.Error(), ctx.Client.Host)
+	}
+
+	// Clients fetch their configuration before they know to authenticate
+	if ctx.Ctx.pacRequest(request.Method, request.Target) {
+		return ctx.servePAC(request.Method, request.Get("Host"))
+	}
+
+	// The SOCKS client inside the tunnel authenticates itself
+	if ctx.websocketRequest(request) {
+		return ctx.acceptWebSocket(request)
+	}
+	if !ctx.Ctx.HTTPConnect && !ctx.Ctx.HTTPOnly {
+		// A WebSocket only listener looks like any other web server
+		ctx.sendHTTP(404, "Not Found")
+		return fmt.Errorf("%w: %s %q is not a WebSocket upgrade from: %s (http)", ErrProtocolMismatch, request.Method, request.Target, ctx.Client.Host)
+	}
+
+	if ctx.authRequired() {
+		username, password, ok := basicCredentials(request.Get("Proxy-Authorization"))
+		if !ok || !ctx.Ctx.checkPassword(username, password) {
+			ctx.sendHTTP(407, "Proxy Authentication Required", `Proxy-Authenticate: Basic realm="proxy"`)
+			return fmt.Errorf("%w: %s from: %s (http)", ErrAuthFailed, username, ctx.Client.Host)
+		}
+		ctx.User = username
+		if ctx.Ctx.Logger != nil {
+			ctx.Ctx.Logger <- fmt.Sprintf(" [+] Authenticated: %s from [%s]:%d (http)\n", username, ctx.Client.Host, ctx.Client.Port)
+		}
+	}
+
+	if request.Method != "CONNECT" {
+		return ctx.processForward(request)
+	}
+	host, port, err := net.SplitHostPort(request.Target)
+	if err == nil {
+		ctx.Remote.Port, err = strconv.Atoi(port)
+	}
+	if err != nil || len(host) == 0 || len(host) > 255 || ctx.Remote.Port <= 0 || ctx.Remote.Port > 0xFFFF {
+		ctx.sendHTTP(400, "Bad Request")
+		return fmt.Errorf("%w: CONNECT target %q from: %s (http)", ErrMalformedRequest, request.Target, ctx.Client.Host)
+	}
+	ctx.setDestination(unescapeZone(host))
+	return nil
+}
+
+// processForward turns a plain HTTP request for an absolute URI into a tunnel that starts with the rewritten request
+func (ctx *ClientCtx) processForward(request *httpproxy.Request) error {
+	target, err := url.Parse(request.Target)
+	if err != nil || target.Scheme != "http" || len(target.Hostname()) == 0 || len(target.Hostname()) > 255 {
+		ctx.sendHTTP(400, "Bad Request")
+		return fmt.Errorf("%w: %s target %q from: %s (http)", ErrMalformedRequest, request.Method, request.Target, ctx.Client.Host)
+	}
+	ctx.Remote.Port = 80
+	if len(target.Port()) > 0 {
+		ctx.Remote.Port, err = strconv.Atoi(target.Port())
+		if err != nil || ctx.Remote.Port <= 0 || ctx.Remote.Port > 0xFFFF {
+			ctx.sendHTTP(400, "Bad Request")
+			return fmt.Errorf("%w: %s target %q from: %s (http)", ErrMalformedRequest, request.Method, request.Target, ctx.Client.Host)
+		}
+	}
+	// Finding the end of a chunked body would mean decoding it, and legacy clients send lengths anyway
+	if request.Chunked {
+		ctx.sendHTTP(411, "Length Required")
+		return fmt.Errorf("%w: chunked %s request from: %s (http)", ErrUnsupportedCommand, request.Method, ctx.Client.Host)
+	}
+	ctx.setDestination(target.Hostname())
+	ctx.initialData = forwardRequest(request, target)
+	ctx.forward = true
+
+	// Only this request's body goes upstream, since the next request on the connection may be for another host
+	body := &forwardBody{reader: ctx.Client.Reader, remaining: request.ContentLength}
+	ctx.Client.Reader = bufio.NewReader(body)
+	return nil
+}
+
+// Headers that only apply to the connection with the proxy
+var hopHeaders = []string{"Connection", "Proxy-Connection", "Keep-Alive", "Proxy-Authorization", "Proxy-Authenticate", "TE", "Trailer", "Upgrade"}
+
+// Rewrite a forward request for the origin server (origin-form target, Host from the URI, one request per connection)
+func forwardRequest(request *httpproxy.Request, target *url.URL) []byte {
+	drop := append([]string{"Host"}, hopHeaders...)
+	for _, name := range strings.Split(request.Get("Connection"), ",") {
+		if name = strings.TrimSpace(name); len(name) > 0 {
+			drop = append(drop, name)
+		}
+	}
+	var head strings.Builder
+	fmt.Fprintf(&head, "%s %s %s\r\n", request.Method, target.RequestURI(), request.Version)
+	// The URI wins over a Host header that disagrees (RFC 7230 5.4), so the filter saw what the server will
+	fmt.Fprintf(&head, "Host: %s\r\n", target.Host)
+	for _, header := range request.Headers {
+		hop := false
+		for _, name := range drop {
+			if strings.EqualFold(header.Name, name) {
+				hop = true
+				break
+			}
+		}
+		if !hop {
+			fmt.Fprintf(&head, "%s: %s\r\n", header.Name, header.Value)
+		}
+	}
+	head.WriteString("Connection: close\r\n\r\n")
+	return []byte(head.String())
+}
+
+// Body of a forward request, after which the client's data is discarded until it closes the connection
+type forwardBody struct {
+	reader    *bufio.Reader
+	remaining int64
+}
+
+// Read the rest of the body, then wait out the client
+func (body *forwardBody) Read(data []byte) (int, error) {
+	if body.remaining > 0 {
+		if int64(len(data)) > body.remaining {
+			data = data[:body.remaining]
+		}
+		n, err := body.reader.Read(data)
+		body.remaining -= int64(n)
+		return n, err
+	}
+	_, err := io.Copy(io.Discard, body.reader)
+	if err == nil {
+		err = io.EOF
+	}
+	return 0, err
+}
+
+// Username and password from a Basic authorization header
+func basicCredentials(header string) (string, string, bool) {
+	scheme, encoded, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(decoded), ":")
+}
+
+// HTTP status for a SOCKS5 reply code
+func httpStatus(code byte) (int, string) {
+	switch code {
+	case 0x00:
+		return 200, "Connection established"
+	case 0x02:
+		return 403, "Forbidden"
+	case 0x06:
+		return 504, "Gateway Timeout"
+	case 0x07:
+		return 501, "Not Implemented"
+	case 0x08:
+		return 400, "Bad Request"
+	}
+	return 502, "Bad Gateway"
+}
+
+// Write an HTTP response head (failures close the connection)
+func (ctx *ClientCtx) sendHTTP(status int, reason string, headers ...string) error {
+	if status == 200 && ctx.forward {
+		// The origin server answers forwarded requests itself
+		return nil
+	}
+	fmt.Fprintf(ctx.Client.Writer, "HTTP/1.1 %d %s\r\n", status, reason)
+	for _, header := range headers {
+		ctx.Client.Writer.WriteString(header + "\r\n")
+	}
+	if status != 200 {
+		ctx.Client.Writer.WriteString("Connection: close\r\nContent-Length: 0\r\n")
+	}
+	ctx.Client.Writer.WriteString("\r\n")
+	return ctx.Client.Writer.Flush()
+}
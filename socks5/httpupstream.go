@@ -0,0 +1,71 @@
+package socks5
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"proxy/httpproxy"
+	"strconv"
+	"strings"
+)
+
+// Whether the outbound proxy is an HTTP proxy tunneling with CONNECT
+func (ctx *ProxyInfo) httpConnect() bool {
+	return strings.EqualFold(ctx.Type, ProxyHTTP)
+}
+
+// Ask an HTTP proxy to open a tunnel, turning refusals into the errors a SOCKS5 proxy's replies would give
+func (ctx *ProxyInfo) connectHTTP(connection net.Conn, reader *bufio.Reader, host string, port int) error {
+	target := net.JoinHostPort(host, strconv.Itoa(port))
+	request := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", target, target)
+	if ctx.method() == 0x02 {
+		request += "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(ctx.Username+":"+ctx.Password)) + "\r\n"
+	}
+	_, err := connection.Write([]byte(request + "\r\n"))
+	if err != nil {
+		return err
+	}
+	response, err := httpproxy.ReadResponse(reader)
+	if err != nil {
+		return fmt.Errorf("invalid response from: %s (%s)", ctx.Host, err.Error())
+	}
+	switch {
+	case response.Status >= 200 && response.Status < 300:
+		return nil
+	case response.Status == 407:
+		return fmt.Errorf("%w: %s (%d)", ErrAuthFailed, ctx.Host, response.Status)
+	case response.Status == 403:
+		// Connection not allowed by ruleset
+		return &ErrCommandFailed{Proxy: ctx.Host, Code: 0x02}
+	case response.Status == 404 || response.Status == 502:
+		// Host unreachable
+		return &ErrCommandFailed{Proxy: ctx.Host, Code: 0x04}
+	case response.Status == 504:
+		// TTL expired
+		return &ErrCommandFailed{Proxy: ctx.Host, Code: 0x06}
+	}
+	return &ErrCommandFailed{Proxy: ctx.Host, Code: 0x01}
+}
+
+// Open the tunnel through an HTTP outbound proxy, answering with an unspecified bound address (HTTP proxies don't report one)
+func (ctx *ClientCtx) negotiateHTTPUpstream() ([]byte, error) {
+	err := ctx.Proxy.connectHTTP(ctx.Remote.Connection, ctx.Remote.Reader, ctx.Remote.Host, ctx.Remote.Port)
+	if err != nil {
+		ctx.Remote.Connection.Close()
+		return nil, err
+	}
+	// Reserved, IPv4, 0.0.0.0 and port 0
+	return []byte{0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}, nil
+}
+
+// Connection whose first bytes were already read into a buffer
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// Read the buffered bytes before the rest of the connection
+func (ctx *bufferedConn) Read(data []byte) (int, error) {
+	return ctx.reader.Read(data)
+}
@@ -0,0 +1,89 @@
+package socks5
+
+import (
+	"sync"
+	"time"
+)
+
+// LatencyWeight is how much each new sample moves an outbound proxy's latency averages
+const LatencyWeight = 0.3
+
+// LatencyPenalty is the connect time a failed tunnel or probe counts as, as slow as a probe that timed out
+const LatencyPenalty = HealthTimeout
+
+// Exponentially weighted moving average of a latency (the first sample starts it)
+func ewma(average time.Duration, sample time.Duration) time.Duration {
+	if average == 0 {
+		return sample
+	}
+	return time.Duration(LatencyWeight*float64(sample) + (1-LatencyWeight)*float64(average))
+}
+
+// Fold a tunnel's or probe's timings into an outbound proxy's averages (zero timings were not measured)
+func (ctx *ProxyPool) recordLatency(proxy ProxyInfo, connect time.Duration, handshake time.Duration) {
+	ctx.updateStatus(proxy, func(status *ProxyStatus) {
+		if connect > 0 {
+			status.ConnectLatency = ewma(status.ConnectLatency, connect)
+		}
+		if handshake > 0 {
+			status.HandshakeLatency = ewma(status.HandshakeLatency, handshake)
+		}
+		status.LatencySampled = time.Now()
+	})
+}
+
+// Count a failure as a slow sample, so an outbound proxy that doesn't answer gets no more than one try as unmeasured
+func (ctx *ProxyPool) penalizeLatency(proxy ProxyInfo) {
+	ctx.recordLatency(proxy, LatencyPenalty, 0)
+}
+
+// Candidates the fastest strategy chooses between: any never measured (so each gets measured), otherwise those with the lowest latency (the pool must be read locked)
+func (ctx *ProxyPool) fastest(candidates []ProxyInfo) []ProxyInfo {
+	var unmeasured, best []ProxyInfo
+	lowest := time.Duration(-1)
+	for _, proxy := range candidates {
+		status, ok := ctx.status[proxy]
+		if !ok || status.LatencySampled.IsZero() {
+			unmeasured = append(unmeasured, proxy)
+			continue
+		}
+		latency := status.ConnectLatency + status.HandshakeLatency
+		if lowest < 0 || latency < lowest {
+			best, lowest = nil, latency
+		}
+		if latency == lowest {
+			best = append(best, proxy)
+		}
+	}
+	if len(unmeasured) > 0 {
+		return unmeasured
+	}
+	return best
+}
+
+// ProbeLatency measures, each LatencyInterval, the outbound proxies no tunnel has measured since the last round, so a slow proxy that speeds up can win back traffic
+func (ctx *Context) ProbeLatency() {
+	for {
+		time.Sleep(ctx.LatencyInterval)
+		stale := time.Now().Add(-ctx.LatencyInterval)
+		var wait sync.WaitGroup
+		for _, proxy := range ctx.Proxies.List() {
+			status := ctx.Proxies.Status(proxy)
+			if status.Down || status.LatencySampled.After(stale) {
+				// Health checks watch proxies that are down, and busy ones are measured by their tunnels
+				continue
+			}
+			wait.Add(1)
+			go func(proxy ProxyInfo) {
+				defer wait.Done()
+				connect, handshake, err := ctx.probeProxy(proxy)
+				if err == nil {
+					ctx.Proxies.recordLatency(proxy, connect, handshake)
+				} else {
+					ctx.Proxies.penalizeLatency(proxy)
+				}
+			}(proxy)
+		}
+		wait.Wait()
+	}
+}
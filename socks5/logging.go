@@ -0,0 +1,154 @@
+package socks5
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"time"
+)
+
+// ErrorLogInterval is how long identical errors are suppressed after being logged
+const ErrorLogInterval = 30 * time.Second
+
+// An error message that was logged recently
+type recentError struct {
+	logged  time.Time
+	repeats int
+}
+
+// Classify an error for the per-class counters
+func errorClass(err error) string {
+	var unreachable *ErrUpstreamUnreachable
+	var tampered *ErrUpstreamTampered
+	var netErr net.Error
+	switch {
+	case errors.As(err, &unreachable):
+		return "upstream unreachable"
+	case errors.As(err, &tampered):
+		return "upstream tampered"
+	case errors.Is(err, ErrAuthFailed):
+		return "auth failed"
+	case errors.Is(err, ErrQuotaExceeded):
+		return "quota exceeded"
+	case errors.Is(err, ErrMalformedRequest):
+		return "malformed"
+	case errors.Is(err, ErrPolicyDenied):
+		return "policy"
+	case errors.Is(err, ErrDeviation):
+		return "deviation"
+	case errors.Is(err, ErrDirectRefused):
+		return "egress"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection refused"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "eof"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	}
+	return "other"
+}
+
+// Classify an error through an outbound proxy, to tell why it is unhealthy
+func upstreamErrorClass(err error) string {
+	var unreachable *ErrUpstreamUnreachable
+	var failed *ErrCommandFailed
+	var tampered *ErrUpstreamTampered
+	var record tls.RecordHeaderError
+	var certificate *tls.CertificateVerificationError
+	var alert tls.AlertError
+	var opErr *net.OpError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, ErrAuthFailed):
+		return "auth failed"
+	case errors.As(err, &failed):
+		return "connect refused"
+	case errors.As(err, &tampered):
+		return "tampered"
+	case errors.As(err, &record), errors.As(err, &certificate), errors.As(err, &alert):
+		return "tls error"
+	case errors.As(err, &unreachable) && !errors.As(err, &opErr):
+		// Connected, then the TLS handshake failed without an alert
+		return "tls error"
+	case errors.As(err, &unreachable) && errors.As(err, &netErr) && netErr.Timeout():
+		return "dial timeout"
+	case errors.As(err, &unreachable) && errors.Is(err, syscall.ECONNREFUSED):
+		return "dial refused"
+	case errors.As(err, &unreachable):
+		return "dial error"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "closed"
+	}
+	return "protocol error"
+}
+
+// Log an error, collapsing identical messages into periodic "repeated" summaries
+func (ctx *Context) logError(err error) {
+	ctx.errorLock.Lock()
+	defer ctx.errorLock.Unlock()
+	if ctx.errorCounts == nil {
+		ctx.errorCounts = make(map[string]uint64)
+		ctx.recentErrors = make(map[string]*recentError)
+	}
+	ctx.errorCounts[errorClass(err)]++
+	ctx.metrics().Counter("errors_total", 1, ctx.metricLabels("class", errorClass(err)))
+	message := err.Error()
+	if recent, ok := ctx.recentErrors[message]; ok && time.Since(recent.logged) < ErrorLogInterval {
+		recent.repeats++
+		return
+	}
+	ctx.recentErrors[message] = &recentError{logged: time.Now()}
+	if ctx.Logger != nil {
+		ctx.Logger <- fmt.Sprintf(" [!] Error: %s\n", message)
+	}
+}
+
+// Periodically report suppressed errors and forget old ones
+func (ctx *Context) flushErrors() {
+	for {
+		time.Sleep(ErrorLogInterval)
+		ctx.errorLock.Lock()
+		for message, recent := range ctx.recentErrors {
+			if time.Since(recent.logged) < ErrorLogInterval {
+				continue
+			}
+			if recent.repeats > 0 && ctx.Logger != nil {
+				ctx.Logger <- fmt.Sprintf(" [!] Error repeated %d times: %s\n", recent.repeats, message)
+			}
+			delete(ctx.recentErrors, message)
+		}
+		ctx.errorLock.Unlock()
+	}
+}
+
+// ErrorCounts returns the number of errors seen per class
+func (ctx *Context) ErrorCounts() map[string]uint64 {
+	ctx.errorLock.Lock()
+	defer ctx.errorLock.Unlock()
+	counts := make(map[string]uint64)
+	for class, count := range ctx.errorCounts {
+		counts[class] = count
+	}
+	return counts
+}
+
+// Dump logs the active sessions and error counts
+func (ctx *Context) Dump() {
+	if ctx.Logger == nil {
+		return
+	}
+	sessions := ctx.Sessions()
+	ctx.Logger <- fmt.Sprintf(" [*] %s: %d active sessions\n", ctx.ListenAddress, len(sessions))
+	for _, client := range sessions {
+		info := client.Info()
+		ctx.Logger <- fmt.Sprintf(" [*]   %s -> %s:%d (%d:%d bytes, %v)\n", info.Client, info.Host, info.Port, info.Sent, info.Received, time.Since(info.Started).Round(time.Second))
+	}
+	for class, count := range ctx.ErrorCounts() {
+		ctx.Logger <- fmt.Sprintf(" [*]   %s errors: %d\n", class, count)
+	}
+}
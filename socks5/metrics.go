@@ -0,0 +1,31 @@
+package socks5
+
+import (
+	"proxy/metrics"
+)
+
+// Where measurements go (dropped when nothing is configured)
+func (ctx *Context) metrics() metrics.Metrics {
+	if ctx.Metrics == nil {
+		return metrics.Noop{}
+	}
+	return ctx.Metrics
+}
+
+// Labels identifying the listener and its tenant, plus any extra key/value pairs
+func (ctx *Context) metricLabels(extra ...string) metrics.Labels {
+	labels := metrics.Labels{"listener": ctx.Name}
+	if len(ctx.Name) == 0 {
+		labels["listener"] = ctx.ListenAddress
+	}
+	if ctx.Tenant != nil {
+		for key, value := range ctx.Tenant.Labels {
+			labels[key] = value
+		}
+		labels["tenant"] = ctx.Tenant.Name
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		labels[extra[i]] = extra[i+1]
+	}
+	return labels
+}
@@ -0,0 +1,49 @@
+package socks5
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Start of the request line for common HTTP methods
+var httpMethods = []string{"GET ", "POST ", "HEAD ", "PUT ", "DELETE ", "OPTIONS ", "PATCH ", "CONNECT ", "TRACE "}
+
+// Response explaining the mistake to HTTP clients
+const httpHint = "HTTP/1.1 400 Bad Request\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"Connection: close\r\n" +
+	"\r\n" +
+	"This port speaks SOCKS (versions 4 and 5), not HTTP. Configure your client to use it as a SOCKS proxy.\r\n"
+
+// Work out what a client that did not start with a SOCKS version byte is speaking
+func (ctx *ClientCtx) detectMismatch(first byte) error {
+	// Only look at what has already arrived so a slow client can't stall this
+	size := ctx.Client.Reader.Buffered()
+	if size > 8 {
+		size = 8
+	}
+	rest, _ := ctx.Client.Reader.Peek(size)
+	greeting := string(append([]byte{first}, rest...))
+	switch {
+	case first == 0x16 && len(rest) > 0 && rest[0] == 0x03:
+		return fmt.Errorf("%w: client sent TLS to SOCKS listener from: %s", ErrProtocolMismatch, ctx.Client.Host)
+	case isHTTP(greeting):
+		if ctx.Ctx.HTTPHint {
+			ctx.Client.Writer.WriteString(httpHint)
+			ctx.Client.Writer.Flush()
+		}
+		method := greeting[:strings.Index(greeting, " ")]
+		return fmt.Errorf("%w: client sent HTTP (%s) to SOCKS listener from: %s", ErrProtocolMismatch, method, ctx.Client.Host)
+	}
+	return fmt.Errorf("invalid data(0) from: %s", ctx.Client.Host)
+}
+
+// Check whether a greeting starts like an HTTP request line
+func isHTTP(greeting string) bool {
+	for _, method := range httpMethods {
+		if strings.HasPrefix(greeting, method) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,108 @@
+package socks5
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// MSSClamp sets the TCP maximum segment size per route, for paths through MTU-constrained links
+type MSSClamp struct {
+	Default   int            `json:"default"`
+	Client    int            `json:"client"`
+	Overrides map[string]int `json:"overrides"`
+	networks  map[*net.IPNet]int
+}
+
+// LoadFile retrieves MSS clamping rules from a file
+func (ctx *MSSClamp) LoadFile(file string) bool {
+	input, err := os.Open(file)
+	if err != nil {
+		return false
+	}
+	defer input.Close()
+	finfo, err := input.Stat()
+	if err != nil {
+		return false
+	}
+	data := make([]byte, finfo.Size())
+	_, err = input.Read(data)
+	if err != nil {
+		return false
+	}
+	var clamp MSSClamp
+	err = json.Unmarshal(data, &clamp)
+	if err != nil {
+		return false
+	}
+	// Routes are either networks (CIDR) or hosts, matched case-insensitively
+	ctx.Default = clamp.Default
+	ctx.Client = clamp.Client
+	ctx.Overrides = make(map[string]int)
+	ctx.networks = make(map[*net.IPNet]int)
+	for route, mss := range clamp.Overrides {
+		if _, network, err := net.ParseCIDR(route); err == nil {
+			ctx.networks[network] = mss
+			continue
+		}
+		ctx.Overrides[strings.ToLower(route)] = mss
+	}
+	return true
+}
+
+// Routes returns the number of overrides
+func (ctx *MSSClamp) Routes() int {
+	return len(ctx.Overrides) + len(ctx.networks)
+}
+
+// MSS for a route to a host (an override for a domain also covers its subdomains, 0 leaves it unclamped)
+func (ctx *MSSClamp) MSS(host string) int {
+	if ip := hostIP(host); ip != nil {
+		// The most specific network wins
+		mss, size := ctx.Default, -1
+		for network, value := range ctx.networks {
+			if ones, _ := network.Mask.Size(); network.Contains(ip) && ones > size {
+				mss, size = value, ones
+			}
+		}
+		if value, ok := ctx.Overrides[ip.String()]; ok {
+			return value
+		}
+		return mss
+	}
+	host = strings.ToLower(host)
+	for {
+		if mss, ok := ctx.Overrides[host]; ok {
+			return mss
+		}
+		index := strings.Index(host, ".")
+		if index < 0 {
+			return ctx.Default
+		}
+		host = host[index+1:]
+	}
+}
+
+// Run several socket controls in order, stopping at the first error
+func socketControls(controls ...func(string, string, syscall.RawConn) error) func(string, string, syscall.RawConn) error {
+	var active []func(string, string, syscall.RawConn) error
+	for _, control := range controls {
+		if control != nil {
+			active = append(active, control)
+		}
+	}
+	if len(active) == 0 {
+		return nil
+	}
+	return func(network string, address string, conn syscall.RawConn) error {
+		for _, control := range active {
+			err := control(network, address, conn)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,21 @@
+//go:build linux
+
+package socks5
+
+import (
+	"syscall"
+)
+
+// Clamp the maximum segment size of a socket (nil when there is nothing to clamp)
+func mssControl(mss int) func(string, string, syscall.RawConn) error {
+	if mss <= 0 {
+		return nil
+	}
+	return func(network string, address string, conn syscall.RawConn) error {
+		var err error
+		conn.Control(func(fd uintptr) {
+			err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_MAXSEG, mss)
+		})
+		return err
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package socks5
+
+import (
+	"syscall"
+)
+
+// MSS clamping is not available on this platform
+func mssControl(mss int) func(string, string, syscall.RawConn) error {
+	return nil
+}
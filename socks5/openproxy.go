@@ -0,0 +1,77 @@
+package socks5
+
+import (
+	"crypto/tls"
+	"net"
+)
+
+// OpenAddresses returns the listen addresses that relay for clients on public networks without authentication
+func (ctx *Context) OpenAddresses() []string {
+	if !ctx.openToPublic() {
+		return nil
+	}
+	var open []string
+	for _, address := range ctx.Addresses() {
+		host, useTLS := ctx.listenTLS(address)
+		// Client certificates are only checked on TLS connections
+		if useTLS && ctx.TLSConfig != nil && ctx.TLSConfig.ClientAuth == tls.RequireAndVerifyClientCert {
+			continue
+		}
+		if publicBind(host) {
+			open = append(open, address)
+		}
+	}
+	return open
+}
+
+// Whether some client from a public network gets through without authenticating (origins may waive or deny it)
+func (ctx *Context) openToPublic() bool {
+	required := ctx.authRequired()
+	fallback := false
+	for _, origin := range ctx.Origins.Classes {
+		if origin.Name == internet.Name {
+			fallback = true
+		}
+		if origin.Deny || (required && !origin.NoAuth) {
+			continue
+		}
+		if origin.Name == internet.Name {
+			return true
+		}
+		for _, network := range origin.networks {
+			if ones, _ := network.Mask.Size(); ones == 0 || publicIP(network.IP) {
+				return true
+			}
+		}
+	}
+	return !fallback && !required
+}
+
+// Whether a listen address accepts connections on a public interface (all interfaces, or a name resolving to a public address)
+func publicBind(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	if len(host) == 0 {
+		return true
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.IsUnspecified() || publicIP(ip)
+	}
+	addresses, err := net.LookupIP(host)
+	if err != nil {
+		return false
+	}
+	for _, ip := range addresses {
+		if publicIP(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether an address is reachable from outside private networks
+func publicIP(ip net.IP) bool {
+	return !ip.IsUnspecified() && !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast()
+}
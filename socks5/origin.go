@@ -0,0 +1,113 @@
+package socks5
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"proxy/metrics"
+)
+
+// Origin is a class of client networks (LAN or VPN, for example) and the policy for clients from them
+type Origin struct {
+	Name     string   `json:"name"`
+	Networks []string `json:"networks"`
+	NoAuth   bool     `json:"no_auth"`
+	Deny     bool     `json:"deny"`
+	networks []*net.IPNet
+}
+
+// Origins classifies clients by the network they connect from (clients outside every class are "internet")
+type Origins struct {
+	Classes []*Origin `json:"classes"`
+}
+
+// Class of clients outside every configured network (unless a class of that name says otherwise)
+var internet = &Origin{Name: "internet"}
+
+// LoadFile retrieves the origin classes from a file
+func (ctx *Origins) LoadFile(file string) bool {
+	input, err := os.Open(file)
+	if err != nil {
+		return false
+	}
+	defer input.Close()
+	finfo, err := input.Stat()
+	if err != nil {
+		return false
+	}
+	data := make([]byte, finfo.Size())
+	_, err = input.Read(data)
+	if err != nil {
+		return false
+	}
+	var origins Origins
+	err = json.Unmarshal(data, &origins)
+	if err != nil {
+		return false
+	}
+	for _, origin := range origins.Classes {
+		if origin == nil || len(origin.Name) == 0 {
+			return false
+		}
+		for _, cidr := range origin.Networks {
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return false
+			}
+			origin.networks = append(origin.networks, network)
+		}
+	}
+	ctx.Classes = origins.Classes
+	return true
+}
+
+// Classify a client address (the most specific network wins)
+func (ctx *Origins) Classify(host string) *Origin {
+	ip := net.ParseIP(host)
+	match, size := (*Origin)(nil), -1
+	for _, origin := range ctx.Classes {
+		for _, network := range origin.networks {
+			if ones, _ := network.Mask.Size(); ip != nil && network.Contains(ip) && ones > size {
+				match, size = origin, ones
+			}
+		}
+	}
+	if match != nil {
+		return match
+	}
+	for _, origin := range ctx.Classes {
+		if origin.Name == internet.Name {
+			return origin
+		}
+	}
+	return internet
+}
+
+// Whether the client must authenticate, given the listener and its origin
+func (ctx *ClientCtx) authRequired() bool {
+	return ctx.Ctx.authRequired() && (ctx.Origin == nil || !ctx.Origin.NoAuth)
+}
+
+// Metric labels for a client, with its origin when origins are configured
+func (ctx *ClientCtx) metricLabels(extra ...string) metrics.Labels {
+	if len(ctx.Ctx.Origins.Classes) > 0 && ctx.Origin != nil {
+		extra = append([]string{"origin", ctx.Origin.Name}, extra...)
+	}
+	return ctx.Ctx.metricLabels(extra...)
+}
+
+// OriginName of the client's network (empty when origins are not configured)
+func (ctx *ClientCtx) OriginName() string {
+	if len(ctx.Ctx.Origins.Classes) == 0 || ctx.Origin == nil {
+		return ""
+	}
+	return ctx.Origin.Name
+}
+
+// Origin of the client for log lines
+func (ctx *ClientCtx) originTag() string {
+	if name := ctx.OriginName(); len(name) > 0 {
+		return " (" + name + ")"
+	}
+	return ""
+}
@@ -0,0 +1,105 @@
+package socks5
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Paths a proxy auto-config file is served at (the second is where WPAD discovery looks)
+var pacPaths = []string{"/proxy.pac", "/wpad.dat"}
+
+// CheckBypass validates the destinations a PAC file sends direct (domains, or IPv4 networks since PAC has no IPv6 test)
+func CheckBypass(entries []string) error {
+	for _, entry := range entries {
+		if _, err := bypassCondition(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PAC expression matching a bypass entry
+func bypassCondition(entry string) (string, error) {
+	if strings.Contains(entry, "/") {
+		ip, network, err := net.ParseCIDR(entry)
+		if err != nil || ip.To4() == nil {
+			return "", fmt.Errorf("invalid bypass network: %s", entry)
+		}
+		return fmt.Sprintf("isInNet(host, %q, %q)", network.IP.String(), net.IP(network.Mask).String()), nil
+	}
+	domain := strings.TrimPrefix(strings.TrimPrefix(entry, "*"), ".")
+	if len(domain) == 0 || strings.ContainsAny(domain, "\"\\*/ ") {
+		return "", fmt.Errorf("invalid bypass domain: %s", entry)
+	}
+	// A domain covers its subdomains, as in the blacklist
+	return fmt.Sprintf("host == %q || dnsDomainIs(host, %q)", domain, "."+domain), nil
+}
+
+// Whether an HTTP request asks for the PAC file (origin form, since the client is not using the proxy yet)
+func (ctx *Context) pacRequest(method string, target string) bool {
+	if !ctx.PAC || (method != "GET" && method != "HEAD") {
+		return false
+	}
+	path, _, _ := strings.Cut(target, "?")
+	for _, pac := range pacPaths {
+		if path == pac {
+			return true
+		}
+	}
+	return false
+}
+
+// servePAC answers with a PAC file pointing at the address the client used to reach this listener
+func (ctx *ClientCtx) servePAC(method string, hostHeader string) error {
+	host, port := pacAddress(hostHeader, ctx.Client.Connection.LocalAddr())
+	directive := "PROXY"
+	if _, tls := ctx.Ctx.listenTLS(ctx.Listener); tls {
+		directive = "HTTPS"
+	}
+	proxy := fmt.Sprintf("%s %s", directive, net.JoinHostPort(host, strconv.Itoa(port)))
+
+	var body strings.Builder
+	body.WriteString("function FindProxyForURL(url, host) {\n")
+	for _, entry := range ctx.Ctx.PACBypass {
+		condition, err := bypassCondition(entry)
+		if err == nil {
+			fmt.Fprintf(&body, "\tif (%s) return \"DIRECT\";\n", condition)
+		}
+	}
+	fmt.Fprintf(&body, "\treturn %q;\n}\n", proxy)
+
+	ctx.served = true
+	err := ctx.sendHTTP(200, "OK", "Content-Type: application/x-ns-proxy-autoconfig", "Content-Length: "+strconv.Itoa(body.Len()), "Connection: close")
+	if err == nil && method != "HEAD" {
+		ctx.Client.Writer.WriteString(body.String())
+		err = ctx.Client.Writer.Flush()
+	}
+	if err == nil && ctx.Ctx.Logger != nil {
+		ctx.Ctx.Logger <- fmt.Sprintf(" [+] Served PAC file to: [%s]:%d (%s)\n", ctx.Client.Host, ctx.Client.Port, proxy)
+	}
+	return err
+}
+
+// Host and port for the PAC file, from the Host header when it is a plain name or address
+func pacAddress(hostHeader string, local net.Addr) (string, int) {
+	port := 0
+	if address, ok := local.(*net.TCPAddr); ok {
+		port = address.Port
+	}
+	host, headerPort, err := net.SplitHostPort(hostHeader)
+	if err != nil {
+		host = strings.TrimSuffix(strings.TrimPrefix(hostHeader, "["), "]")
+	} else if parsed, err := strconv.Atoi(headerPort); err == nil && parsed > 0 && parsed <= 0xFFFF {
+		port = parsed
+	}
+	if len(host) == 0 || strings.Trim(strings.ToLower(host), "abcdefghijklmnopqrstuvwxyz0123456789.-:") != "" {
+		// Only what the client is known to reach goes into a script it will run
+		host = ""
+		if address, ok := local.(*net.TCPAddr); ok {
+			host = address.IP.String()
+		}
+	}
+	return host, port
+}
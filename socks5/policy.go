@@ -0,0 +1,60 @@
+package socks5
+
+import (
+	"fmt"
+	"proxy/policy"
+	"time"
+)
+
+// Name of a request's command for policy rules
+func commandName(command byte) string {
+	switch command {
+	case 0x01:
+		return "connect"
+	case 0x02:
+		return "bind"
+	case 0x03:
+		return "associate"
+	case CommandResolve, CommandResolvePTR:
+		return "resolve"
+	}
+	return "unknown"
+}
+
+// What policy rules can see of a request
+func (ctx *ClientCtx) policyAttributes() policy.Attributes {
+	return policy.Attributes{
+		Client:   ctx.Client.Host,
+		User:     ctx.User,
+		Host:     ctx.Remote.Host,
+		Port:     ctx.Remote.Port,
+		Command:  commandName(ctx.Command),
+		Origin:   ctx.OriginName(),
+		Tenant:   ctx.Ctx.TenantName(),
+		Listener: ctx.Ctx.Name,
+		Time:     time.Now(),
+	}
+}
+
+// Apply the first matching policy rule: deny refuses the request, allow exempts it from the blacklist and route picks its exit
+func (ctx *ClientCtx) applyPolicy() error {
+	if ctx.Ctx.Policy == nil {
+		return nil
+	}
+	decision, ok := ctx.Ctx.Policy.Evaluate(ctx.policyAttributes())
+	if !ok {
+		return nil
+	}
+	switch decision.Action {
+	case policy.Deny:
+		if ctx.Ctx.Logger != nil {
+			ctx.Ctx.Logger <- fmt.Sprintf(" [!] Denied by policy (%s): %s -> %s:%d\n", decision.Rule, ctx.Identity(), ctx.Remote.Host, ctx.Remote.Port)
+		}
+		return fmt.Errorf("%w: %s", ErrPolicyDenied, decision.Rule)
+	case policy.Allow:
+		ctx.exempt = true
+	case policy.Route:
+		ctx.route = decision.Route
+	}
+	return nil
+}
@@ -0,0 +1,657 @@
+package socks5
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PoolVersion is the current schema version of the proxies file
+const PoolVersion = 2
+
+// Types of outbound proxy
+const (
+	ProxySOCKS5      = "socks5"
+	ProxySOCKS4      = "socks4"
+	ProxyHTTP        = "http"
+	ProxyShadowsocks = "shadowsocks"
+)
+
+// ProxyInfo for outbound SOCKS5 (or SOCKS4, HTTP CONNECT, Shadowsocks and registered transport) servers
+type ProxyInfo struct {
+	Type      string `json:"type,omitempty"`
+	Host      string `json:"host"`
+	Port      int    `json:"port"`
+	UseTLS    bool   `json:"usetls"`
+	Username  string `json:"username"`
+	Password  string `json:"password"`
+	GSSAPI    string `json:"gssapi"`
+	Method    string `json:"method,omitempty"`
+	Key       string `json:"key,omitempty"`
+	HostKey   string `json:"hostkey,omitempty"`
+	Pipeline  bool   `json:"pipeline"`
+	MSS       int    `json:"mss"`
+	Country   string `json:"country"`
+	Tag       string `json:"tag"`
+	Bandwidth int64  `json:"bandwidth,omitempty"`
+}
+
+// Check the type of an outbound proxy and the options it allows
+func (ctx *ProxyInfo) validate() error {
+	if ctx.Bandwidth < 0 {
+		return fmt.Errorf("negative bandwidth limit: %s", ctx.Host)
+	}
+	switch strings.ToLower(ctx.Type) {
+	case "", ProxySOCKS5:
+		return nil
+	case ProxySOCKS4:
+		if len(ctx.GSSAPI) > 0 || len(ctx.Password) > 0 {
+			// The username is sent as the user ID, but there is nowhere to send anything else
+			return fmt.Errorf("SOCKS4 has no passwords or GSS-API: %s", ctx.Host)
+		}
+		return nil
+	case ProxyHTTP:
+		if len(ctx.GSSAPI) > 0 {
+			return fmt.Errorf("GSS-API needs a SOCKS5 outbound proxy: %s", ctx.Host)
+		}
+		return nil
+	}
+	if transport, ok := lookupUpstreamTransport(ctx.Type); ok {
+		return transport.Validate(*ctx)
+	}
+	return fmt.Errorf("unknown outbound proxy type %q: %s", ctx.Type, ctx.Host)
+}
+
+// Whether the outbound proxy speaks SOCKS5 (the default), so it can carry every command
+func (ctx *ProxyInfo) socks5() bool {
+	return len(ctx.Type) == 0 || strings.EqualFold(ctx.Type, ProxySOCKS5)
+}
+
+// Authentication method offered to the proxy
+func (ctx *ProxyInfo) method() byte {
+	if len(ctx.GSSAPI) > 0 {
+		// GSS-API auth type
+		return 0x01
+	}
+	if len(ctx.Username) > 0 || len(ctx.Password) > 0 {
+		// User/pass auth type
+		return 0x02
+	}
+	// No authentication
+	return 0x00
+}
+
+// ProxyStatus tracks what has been learned about an outbound proxy while running
+type ProxyStatus struct {
+	Anonymity        Anonymity       `json:"anonymity"`
+	Violations       int             `json:"violations"`
+	QuarantinedUntil time.Time       `json:"quarantineduntil"`
+	NoPipeline       bool            `json:"nopipeline,omitempty"`
+	AuthFailures     int             `json:"authfailures,omitempty"`
+	AuthLocked       bool            `json:"authlocked,omitempty"`
+	Down             bool            `json:"down,omitempty"`
+	HealthFailures   int             `json:"healthfailures,omitempty"`
+	HealthChecked    time.Time       `json:"healthchecked,omitzero"`
+	InFlight         int             `json:"inflight"`
+	Tunnels          uint64          `json:"tunnels"`
+	ConnectLatency   time.Duration   `json:"connectlatency,omitempty"`
+	HandshakeLatency time.Duration   `json:"handshakelatency,omitempty"`
+	LatencySampled   time.Time       `json:"latencysampled,omitzero"`
+	Errors           []UpstreamError `json:"errors,omitempty"`
+}
+
+// ProxyErrorHistory is how many recent errors are kept for each outbound proxy
+const ProxyErrorHistory = 10
+
+// UpstreamError is a failure through an outbound proxy, classified by what went wrong
+type UpstreamError struct {
+	Time    time.Time `json:"time"`
+	Class   string    `json:"class"`
+	Message string    `json:"message"`
+}
+
+// Ways of choosing among the eligible outbound proxies
+const (
+	StrategyRandom           = "random"
+	StrategyRoundRobin       = "round-robin"
+	StrategyLeastConnections = "least-connections"
+	StrategyFastest          = "fastest"
+	StrategyRotate           = "rotate"
+)
+
+// ProxyPool for known outbound SOCKS5 servers
+type ProxyPool struct {
+	sync.RWMutex
+	Hosts        []ProxyInfo
+	FileName     string
+	Version      int
+	MinAnonymity Anonymity
+	Strategy     string
+	Affinity     time.Duration
+	RotateEvery  time.Duration
+	RotateAfter  int
+	status       map[ProxyInfo]*ProxyStatus
+	limits       map[ProxyInfo]*bandwidthLimit
+	sticky       map[string]affinityEntry
+	rotations    map[string]*rotation
+	rotationLock sync.Mutex
+	next         uint64
+}
+
+// ValidStrategy reports whether a selection strategy is known (empty is random)
+func ValidStrategy(strategy string) bool {
+	switch strategy {
+	case "", StrategyRandom, StrategyRoundRobin, StrategyLeastConnections, StrategyFastest, StrategyRotate:
+		return true
+	}
+	return false
+}
+
+// Versioned layout of the proxies file
+type poolFile struct {
+	Version int         `json:"version"`
+	Proxies []ProxyInfo `json:"proxies"`
+}
+
+// Steps upgrading a proxies file from version N to N+1 (indexed by N-1)
+var poolMigrations = []func(data []byte) ([]byte, error){
+	// Version 1 is a bare array of proxies, version 2 wraps it in an object
+	func(data []byte) ([]byte, error) {
+		return json.Marshal(map[string]json.RawMessage{"version": json.RawMessage("2"), "proxies": data})
+	},
+}
+
+// Upgrade the contents of a proxies file to the current schema
+func migratePool(data []byte) (poolFile, int, error) {
+	var pool poolFile
+	data = bytes.TrimSpace(data)
+	version := 1
+	if len(data) == 0 || data[0] != '[' {
+		var header struct {
+			Version int `json:"version"`
+		}
+		err := json.Unmarshal(data, &header)
+		if err != nil {
+			return pool, 0, err
+		}
+		version = header.Version
+	}
+	if version < 1 || version > PoolVersion {
+		return pool, version, fmt.Errorf("unsupported proxies file version: %d", version)
+	}
+	original := version
+	for ; version < PoolVersion; version++ {
+		var err error
+		data, err = poolMigrations[version-1](data)
+		if err != nil {
+			return pool, original, err
+		}
+	}
+	err := json.Unmarshal(data, &pool)
+	return pool, original, err
+}
+
+// LoadFile retrieves a SOCKS5 connection list from a file
+func (ctx *ProxyPool) LoadFile(file string) bool {
+	input, err := os.Open(file)
+	if err != nil {
+		return false
+	}
+	defer input.Close()
+	finfo, err := input.Stat()
+	if err != nil {
+		return false
+	}
+	data := make([]byte, finfo.Size())
+	_, err = input.Read(data)
+	if err != nil {
+		return false
+	}
+	pool, version, err := migratePool(data)
+	if err != nil {
+		return false
+	}
+	for _, proxy := range pool.Proxies {
+		if proxy.validate() != nil {
+			return false
+		}
+	}
+	ctx.Lock()
+	defer ctx.Unlock()
+	ctx.Hosts = pool.Proxies
+	ctx.FileName = file
+	ctx.Version = version
+	return true
+}
+
+// Check whether a proxy meets the selection requirements (caller holds the lock)
+func (ctx *ProxyPool) eligible(proxy ProxyInfo) bool {
+	status, ok := ctx.status[proxy]
+	if ok && (status.AuthLocked || status.Down || time.Now().Before(status.QuarantinedUntil)) {
+		return false
+	}
+	if ctx.MinAnonymity > AnonymityUnknown {
+		if !ok || status.Anonymity < ctx.MinAnonymity {
+			return false
+		}
+	}
+	return true
+}
+
+// Select an outbound proxy by the pool's strategy, among those with the preferred exit when there are any (errNoProxies means the pool is empty)
+func (ctx *ProxyPool) Select(preference string) (ProxyInfo, error) {
+	return ctx.selectExcept(preference, "", nil)
+}
+
+// Select an outbound proxy other than those already tried, one the route names when there is a route (which an empty pool can't satisfy either)
+func (ctx *ProxyPool) selectExcept(preference string, via string, tried map[ProxyInfo]bool) (ProxyInfo, error) {
+	ctx.RLock()
+	defer ctx.RUnlock()
+	if len(ctx.Hosts) == 0 && len(via) == 0 {
+		return ProxyInfo{}, errNoProxies
+	}
+	var candidates []ProxyInfo
+	for _, proxy := range ctx.Hosts {
+		if ctx.eligible(proxy) && !tried[proxy] && (len(via) == 0 || proxy.routes(via)) {
+			candidates = append(candidates, proxy)
+		}
+	}
+	if len(candidates) == 0 {
+		return ProxyInfo{}, ErrNoEligibleProxy
+	}
+	if len(preference) > 0 {
+		var preferred []ProxyInfo
+		for _, proxy := range candidates {
+			if proxy.exits(preference) {
+				preferred = append(preferred, proxy)
+			}
+		}
+		// A preference is not a requirement, so fall back to any exit
+		if len(preferred) > 0 {
+			candidates = preferred
+		}
+	}
+	switch ctx.Strategy {
+	case StrategyRoundRobin:
+		// Selections only hold the read lock, so the position moves atomically
+		return candidates[(atomic.AddUint64(&ctx.next, 1)-1)%uint64(len(candidates))], nil
+	case StrategyLeastConnections:
+		var least []ProxyInfo
+		fewest := -1
+		for _, proxy := range candidates {
+			inflight := 0
+			if status, ok := ctx.status[proxy]; ok {
+				inflight = status.InFlight
+			}
+			if fewest < 0 || inflight < fewest {
+				least, fewest = nil, inflight
+			}
+			if inflight == fewest {
+				least = append(least, proxy)
+			}
+		}
+		// Ties are broken at random so a burst doesn't all land on the first entry
+		candidates = least
+	case StrategyFastest:
+		candidates = ctx.fastest(candidates)
+	case StrategyRotate:
+		// Requests with a different preference or route rotate through their own candidates
+		return ctx.rotate(preference+"\x00"+via, candidates), nil
+	}
+	return candidates[rand.Intn(len(candidates))], nil
+}
+
+// Count a tunnel open through an outbound proxy
+func (ctx *ProxyPool) acquire(proxy ProxyInfo) {
+	ctx.updateStatus(proxy, func(status *ProxyStatus) {
+		status.InFlight++
+		status.Tunnels++
+	})
+}
+
+// Stop counting a tunnel (entries removed from the pool meanwhile are left alone)
+func (ctx *ProxyPool) release(proxy ProxyInfo) {
+	ctx.Lock()
+	defer ctx.Unlock()
+	if status, ok := ctx.status[proxy]; ok && status.InFlight > 0 {
+		status.InFlight--
+	}
+}
+
+// Status returns the runtime status of an outbound proxy
+func (ctx *ProxyPool) Status(proxy ProxyInfo) ProxyStatus {
+	ctx.RLock()
+	defer ctx.RUnlock()
+	if status, ok := ctx.status[proxy]; ok {
+		return *status
+	}
+	return ProxyStatus{}
+}
+
+// Update the runtime status of an outbound proxy
+func (ctx *ProxyPool) updateStatus(proxy ProxyInfo, update func(status *ProxyStatus)) {
+	ctx.Lock()
+	defer ctx.Unlock()
+	if ctx.status == nil {
+		ctx.status = make(map[ProxyInfo]*ProxyStatus)
+	}
+	status, ok := ctx.status[proxy]
+	if !ok {
+		status = &ProxyStatus{}
+		ctx.status[proxy] = status
+	}
+	update(status)
+}
+
+// List returns a snapshot of the outbound proxies
+func (ctx *ProxyPool) List() []ProxyInfo {
+	ctx.RLock()
+	defer ctx.RUnlock()
+	return append([]ProxyInfo(nil), ctx.Hosts...)
+}
+
+// Add outbound proxies that are not already in the pool, returning how many were added
+func (ctx *ProxyPool) Add(hosts []ProxyInfo) int {
+	ctx.Lock()
+	defer ctx.Unlock()
+	added := 0
+	for _, host := range hosts {
+		found := false
+		for _, existing := range ctx.Hosts {
+			if existing == host {
+				found = true
+				break
+			}
+		}
+		if !found {
+			ctx.Hosts = append(ctx.Hosts, host)
+			added++
+		}
+	}
+	return added
+}
+
+// Remove outbound proxies from the pool, returning the entries that were present
+func (ctx *ProxyPool) Remove(hosts []ProxyInfo) []ProxyInfo {
+	ctx.Lock()
+	defer ctx.Unlock()
+	var kept, removed []ProxyInfo
+	for _, existing := range ctx.Hosts {
+		found := false
+		for _, host := range hosts {
+			if existing == host {
+				found = true
+				break
+			}
+		}
+		if found {
+			removed = append(removed, existing)
+			delete(ctx.status, existing)
+			delete(ctx.limits, existing)
+		} else {
+			kept = append(kept, existing)
+		}
+	}
+	ctx.Hosts = kept
+	return removed
+}
+
+// Replace the pool contents, returning the entries that are no longer present
+func (ctx *ProxyPool) Replace(hosts []ProxyInfo) []ProxyInfo {
+	ctx.Lock()
+	defer ctx.Unlock()
+	var removed []ProxyInfo
+	for _, old := range ctx.Hosts {
+		found := false
+		for _, host := range hosts {
+			if old == host {
+				found = true
+				break
+			}
+		}
+		if !found {
+			removed = append(removed, old)
+			delete(ctx.status, old)
+			delete(ctx.limits, old)
+		}
+	}
+	ctx.Hosts = hosts
+	return removed
+}
+
+// Migrated reports whether the loaded file used an older schema version
+func (ctx *ProxyPool) Migrated() bool {
+	return ctx.Version > 0 && ctx.Version < PoolVersion
+}
+
+// SaveFile writes the pool to a file using the current schema version
+func (ctx *ProxyPool) SaveFile(file string) bool {
+	ctx.RLock()
+	data, err := json.MarshalIndent(poolFile{Version: PoolVersion, Proxies: ctx.Hosts}, "", " ")
+	ctx.RUnlock()
+	if err != nil {
+		return false
+	}
+	output, err := os.Create(file)
+	if err != nil {
+		return false
+	}
+	defer output.Close()
+	_, err = output.Write(data)
+	if err != nil {
+		return false
+	}
+	return true
+}
+
+// ReloadProxies re-reads the proxies file and drains tunnels using removed entries
+func (ctx *Context) ReloadProxies() {
+	if len(ctx.Proxies.FileName) == 0 {
+		return
+	}
+	var pool ProxyPool
+	if !pool.LoadFile(ctx.Proxies.FileName) {
+		if ctx.Logger != nil {
+			ctx.Logger <- fmt.Sprintf(" [!] Failed to reload proxies from: %s\n", ctx.Proxies.FileName)
+		}
+		return
+	}
+	removed := ctx.Proxies.Replace(pool.Hosts)
+	// Reloading is how rejected credentials are fixed (or confirmed), so locked entries get another chance
+	ctx.Proxies.unlockAuth()
+	if ctx.Logger != nil {
+		ctx.Logger <- fmt.Sprintf(" [*] Reloaded %d outbound proxies (%d removed)\n", len(pool.Hosts), len(removed))
+	}
+	if grace := ctx.tuned(&ctx.DrainGrace); grace > 0 {
+		for _, proxy := range removed {
+			ctx.DrainProxy(proxy, grace)
+		}
+	}
+	if len(ctx.AnonymityJudge) > 0 {
+		go ctx.ProbeAnonymity()
+	}
+}
+
+// AddProxies puts outbound proxies into the pool until the next reload, returning how many were not there already
+func (ctx *Context) AddProxies(hosts []ProxyInfo) (int, error) {
+	for i := range hosts {
+		err := hosts[i].validate()
+		if err != nil {
+			return 0, err
+		}
+	}
+	added := ctx.Proxies.Add(hosts)
+	if ctx.Logger != nil {
+		ctx.Logger <- fmt.Sprintf(" [*] Added %d outbound proxies: %s\n", added, ctx.ListenAddress)
+	}
+	return added, nil
+}
+
+// RemoveProxies takes outbound proxies (by host and port) out of the pool until the next reload, draining their tunnels as a reload does
+func (ctx *Context) RemoveProxies(hosts []ProxyInfo) []ProxyInfo {
+	var matched []ProxyInfo
+	for _, proxy := range ctx.Proxies.List() {
+		for _, host := range hosts {
+			if proxy.Host == host.Host && proxy.Port == host.Port {
+				matched = append(matched, proxy)
+				break
+			}
+		}
+	}
+	removed := ctx.Proxies.Remove(matched)
+	if ctx.Logger != nil {
+		ctx.Logger <- fmt.Sprintf(" [*] Removed %d outbound proxies: %s\n", len(removed), ctx.ListenAddress)
+	}
+	if grace := ctx.tuned(&ctx.DrainGrace); grace > 0 {
+		for _, proxy := range removed {
+			ctx.DrainProxy(proxy, grace)
+		}
+	}
+	return removed
+}
+
+// Count credentials rejected by an outbound proxy, locking it once AuthFailureLimit is reached (0 never locks)
+func (ctx *Context) authFailed(proxy ProxyInfo, err error) {
+	ctx.metrics().Counter("upstream_auth_failures_total", 1, ctx.metricLabels("proxy", net.JoinHostPort(proxy.Host, strconv.Itoa(proxy.Port))))
+	limit := ctx.tunedInt(&ctx.AuthFailureLimit)
+	failures := 0
+	locked := false
+	ctx.Proxies.updateStatus(proxy, func(status *ProxyStatus) {
+		status.AuthFailures++
+		failures = status.AuthFailures
+		if limit > 0 && failures >= limit && !status.AuthLocked {
+			status.AuthLocked = true
+			locked = true
+		}
+	})
+	if !locked {
+		return
+	}
+	// Retrying could lock the account upstream, so hold the entry until someone looks at it
+	if ctx.Logger != nil {
+		ctx.Logger <- fmt.Sprintf(" [!] ALERT: %s:%d rejected its credentials %d times, skipping it until the proxies are reloaded\n", proxy.Host, proxy.Port, failures)
+	}
+	ctx.emit(Event{Type: "upstream_auth_locked", Time: time.Now(), Proxy: proxy.Host, Port: proxy.Port, Error: err.Error(), Err: err})
+}
+
+// Remember an error through an outbound proxy, dropping the oldest beyond ProxyErrorHistory
+func (ctx *ProxyPool) recordError(proxy ProxyInfo, err error) {
+	entry := UpstreamError{Time: time.Now(), Class: upstreamErrorClass(err), Message: err.Error()}
+	ctx.updateStatus(proxy, func(status *ProxyStatus) {
+		start := 0
+		if len(status.Errors) >= ProxyErrorHistory {
+			start = len(status.Errors) - ProxyErrorHistory + 1
+		}
+		// Status snapshots share the old slice, so always copy
+		status.Errors = append(status.Errors[start:len(status.Errors):len(status.Errors)], entry)
+	})
+}
+
+// Reset the credential failures of an outbound proxy after it accepted them
+func (ctx *ProxyPool) authSucceeded(proxy ProxyInfo) {
+	ctx.RLock()
+	status, ok := ctx.status[proxy]
+	clean := !ok || status.AuthFailures == 0
+	ctx.RUnlock()
+	if !clean {
+		ctx.updateStatus(proxy, func(status *ProxyStatus) {
+			status.AuthFailures = 0
+		})
+	}
+}
+
+// Give every outbound proxy locked for rejected credentials another chance
+func (ctx *ProxyPool) unlockAuth() {
+	ctx.Lock()
+	defer ctx.Unlock()
+	for _, status := range ctx.status {
+		status.AuthFailures = 0
+		status.AuthLocked = false
+	}
+}
+
+// DrainProxy closes tunnels through a proxy after a grace period
+func (ctx *Context) DrainProxy(proxy ProxyInfo, grace time.Duration) {
+	var clients []*ClientCtx
+	for _, client := range ctx.Sessions() {
+		client.Lock()
+		if client.Proxy == proxy && !client.draining {
+			client.draining = true
+			clients = append(clients, client)
+		}
+		client.Unlock()
+	}
+	if len(clients) == 0 {
+		return
+	}
+	if ctx.Logger != nil {
+		ctx.Logger <- fmt.Sprintf(" [*] Draining %d tunnels via: %s (closing in %v)\n", len(clients), proxy.Host, grace)
+	}
+	time.AfterFunc(grace, func() {
+		for _, client := range clients {
+			client.Close()
+		}
+		if ctx.Logger != nil {
+			ctx.Logger <- fmt.Sprintf(" [-] Drained %d tunnels via: %s\n", len(clients), proxy.Host)
+		}
+	})
+}
+
+// Quarantine of an outbound proxy, as shared with a standby instance
+type Quarantine struct {
+	Host  string    `json:"host"`
+	Port  int       `json:"port"`
+	Until time.Time `json:"until"`
+}
+
+// Quarantines returns the outbound proxies currently skipped
+func (ctx *ProxyPool) Quarantines() []Quarantine {
+	ctx.RLock()
+	defer ctx.RUnlock()
+	var quarantines []Quarantine
+	now := time.Now()
+	for proxy, status := range ctx.status {
+		if now.Before(status.QuarantinedUntil) {
+			quarantines = append(quarantines, Quarantine{Host: proxy.Host, Port: proxy.Port, Until: status.QuarantinedUntil})
+		}
+	}
+	return quarantines
+}
+
+// SyncQuarantine skips the matching outbound proxies until a time learned elsewhere (reports whether any changed)
+func (ctx *ProxyPool) SyncQuarantine(quarantine Quarantine) bool {
+	changed := false
+	for _, proxy := range ctx.List() {
+		if proxy.Host != quarantine.Host || proxy.Port != quarantine.Port {
+			continue
+		}
+		ctx.updateStatus(proxy, func(status *ProxyStatus) {
+			if quarantine.Until.After(status.QuarantinedUntil) {
+				status.QuarantinedUntil = quarantine.Until
+				changed = true
+			}
+		})
+	}
+	return changed
+}
+
+// Eligible returns the number of outbound proxies that can currently be selected
+func (ctx *ProxyPool) Eligible() int {
+	ctx.RLock()
+	defer ctx.RUnlock()
+	eligible := 0
+	for _, proxy := range ctx.Hosts {
+		if ctx.eligible(proxy) {
+			eligible++
+		}
+	}
+	return eligible
+}
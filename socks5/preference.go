@@ -0,0 +1,34 @@
+package socks5
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Whether a proxy's exit matches a preferred country or tag (case-insensitive)
+func (ctx *ProxyInfo) exits(preference string) bool {
+	return strings.EqualFold(ctx.Country, preference) || strings.EqualFold(ctx.Tag, preference)
+}
+
+// ExitPreference returns a user's preferred exit (set through the API, else from the users file)
+func (ctx *Context) ExitPreference(user string) string {
+	ctx.preferenceLock.Lock()
+	defer ctx.preferenceLock.Unlock()
+	if exit, ok := ctx.preferences[user]; ok {
+		return exit
+	}
+	return ctx.Credentials.Exits[user]
+}
+
+// SetExitPreference changes a user's preferred exit while running (empty clears it)
+func (ctx *Context) SetExitPreference(user string, exit string) {
+	ctx.preferenceLock.Lock()
+	defer ctx.preferenceLock.Unlock()
+	if ctx.preferences == nil {
+		ctx.preferences = make(map[string]string)
+	}
+	ctx.preferences[user] = exit
+	if ctx.Logger != nil {
+		ctx.Logger <- fmt.Sprintf(" [*] Exit preference for %s set to \"%s\": %s\n", user, exit, ctx.ListenAddress)
+	}
+}
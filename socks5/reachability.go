@@ -0,0 +1,212 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// How long an address family stays unreachable without a ping showing otherwise
+const ReachabilityTTL = 10 * time.Minute
+
+// How long the preferred family has before the other one is tried alongside it
+const FallbackDelay = 300 * time.Millisecond
+
+// How often a family marked unreachable is pinged (where unprivileged ping sockets are permitted)
+const ProbeInterval = time.Minute
+
+// Reachability of each address family, learned from ICMP unreachable errors on direct connections
+type reachability struct {
+	lock        sync.Mutex
+	unreachable [2]time.Time
+	probing     [2]bool
+}
+
+// Whether the family (IPv6 or not) is currently considered unreachable
+func (ctx *reachability) broken(ipv6 bool) bool {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	return time.Now().Before(ctx.unreachable[familyIndex(ipv6)])
+}
+
+// Mark a family unreachable, reporting whether it was reachable before
+func (ctx *reachability) mark(ipv6 bool) bool {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	changed := !time.Now().Before(ctx.unreachable[familyIndex(ipv6)])
+	ctx.unreachable[familyIndex(ipv6)] = time.Now().Add(ReachabilityTTL)
+	return changed
+}
+
+// Mark a family reachable, reporting whether it was unreachable before
+func (ctx *reachability) clear(ipv6 bool) bool {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	changed := time.Now().Before(ctx.unreachable[familyIndex(ipv6)])
+	ctx.unreachable[familyIndex(ipv6)] = time.Time{}
+	return changed
+}
+
+// Whether a dial failed because ICMP (or the routing table) said the network or host is unreachable
+func unreachableError(err error) bool {
+	return errors.Is(err, syscall.ENETUNREACH) || errors.Is(err, syscall.EHOSTUNREACH)
+}
+
+// Name of an address family for logs
+func familyName(ipv6 bool) string {
+	if ipv6 {
+		return "IPv6"
+	}
+	return "IPv4"
+}
+
+// Dial a destination directly, trying the family that is not known to be unreachable first
+func (ctx *Context) dialDirect(dialer *net.Dialer, host string, port int) (net.Conn, error) {
+	if !ctx.ReachabilityHints || zoned(host) {
+		// A link-local address has nothing to learn from, and dialing it by name keeps its zone
+		return dialer.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	}
+	lookup, cancel := context.WithTimeout(context.Background(), ResolveTimeout)
+	defer cancel()
+	addresses, err := net.DefaultResolver.LookupIPAddr(lookup, host)
+	if err != nil {
+		return nil, err
+	}
+	var families [2][]net.IP
+	for _, address := range addresses {
+		ipv6 := address.IP.To4() == nil
+		if ipv6 {
+			families[1] = append(families[1], address.IP)
+		} else {
+			families[0] = append(families[0], address.IP)
+		}
+	}
+	// The resolver's order decides, unless that family is unreachable and the other is not
+	primary := len(addresses) > 0 && addresses[0].IP.To4() == nil
+	if ctx.reach.broken(primary) && !ctx.reach.broken(!primary) && len(families[familyIndex(!primary)]) > 0 {
+		primary = !primary
+	}
+	first, second := families[familyIndex(primary)], families[familyIndex(!primary)]
+	if len(first) == 0 {
+		first, second = second, nil
+	}
+	if len(first) == 0 {
+		return nil, fmt.Errorf("no addresses for: %s", host)
+	}
+
+	type result struct {
+		connection net.Conn
+		err        error
+	}
+	results := make(chan result, 2)
+	dial := func(ips []net.IP) {
+		var err error
+		for _, ip := range ips {
+			var connection net.Conn
+			connection, err = dialer.Dial("tcp", net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+			ctx.learnReachability(ip, err)
+			if err == nil {
+				results <- result{connection, nil}
+				return
+			}
+		}
+		results <- result{nil, err}
+	}
+	go dial(first)
+	pending := 1
+	fallback := time.NewTimer(FallbackDelay)
+	defer fallback.Stop()
+	var firstErr error
+	for pending > 0 {
+		select {
+		case <-fallback.C:
+			if len(second) > 0 {
+				go dial(second)
+				second = nil
+				pending++
+			}
+		case outcome := <-results:
+			pending--
+			if outcome.err == nil {
+				// A slower attempt that still succeeds is not needed
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if late := <-results; late.connection != nil {
+							late.connection.Close()
+						}
+					}
+				}(pending)
+				return outcome.connection, nil
+			}
+			if firstErr == nil {
+				firstErr = outcome.err
+			}
+			if len(second) > 0 {
+				go dial(second)
+				second = nil
+				pending++
+			}
+		}
+	}
+	return nil, firstErr
+}
+
+// Index of an address family in the per-family lists
+func familyIndex(ipv6 bool) int {
+	if ipv6 {
+		return 1
+	}
+	return 0
+}
+
+// Update the family hints from the outcome of a direct dial
+func (ctx *Context) learnReachability(ip net.IP, err error) {
+	ipv6 := ip.To4() == nil
+	if err == nil {
+		if ctx.reach.clear(ipv6) && ctx.Logger != nil {
+			ctx.Logger <- fmt.Sprintf(" [+] %s is reachable again (connected to %s)\n", familyName(ipv6), ip.String())
+		}
+		return
+	}
+	if !unreachableError(err) || !ctx.reach.mark(ipv6) {
+		return
+	}
+	if ctx.Logger != nil {
+		ctx.Logger <- fmt.Sprintf(" [*] %s looks unreachable (%s), preferring %s for direct connections\n", familyName(ipv6), err.Error(), familyName(!ipv6))
+	}
+	go ctx.probeReachability(ip)
+}
+
+// Ping an address of a family marked unreachable until it answers or the hint expires
+func (ctx *Context) probeReachability(ip net.IP) {
+	ipv6 := ip.To4() == nil
+	ctx.reach.lock.Lock()
+	if ctx.reach.probing[familyIndex(ipv6)] {
+		ctx.reach.lock.Unlock()
+		return
+	}
+	ctx.reach.probing[familyIndex(ipv6)] = true
+	ctx.reach.lock.Unlock()
+	defer func() {
+		ctx.reach.lock.Lock()
+		ctx.reach.probing[familyIndex(ipv6)] = false
+		ctx.reach.lock.Unlock()
+	}()
+
+	for ctx.reach.broken(ipv6) {
+		time.Sleep(ProbeInterval)
+		err := ping(ip, 5*time.Second)
+		if errors.Is(err, errPingUnavailable) {
+			// Without ping sockets the hint just expires
+			return
+		}
+		if err == nil && ctx.reach.clear(ipv6) && ctx.Logger != nil {
+			ctx.Logger <- fmt.Sprintf(" [+] %s is reachable again (%s answered a ping)\n", familyName(ipv6), ip.String())
+		}
+	}
+}
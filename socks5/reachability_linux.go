@@ -0,0 +1,50 @@
+//go:build linux
+
+package socks5
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// Ping sockets need net.ipv4.ping_group_range to include the process's group
+var errPingUnavailable = errors.New("unprivileged ping sockets are not permitted")
+
+// Send an ICMP echo request over an unprivileged ping socket and wait for the reply
+func ping(ip net.IP, timeout time.Duration) error {
+	family, protocol, request, reply := syscall.AF_INET, syscall.IPPROTO_ICMP, byte(8), byte(0)
+	if ip.To4() == nil {
+		family, protocol, request, reply = syscall.AF_INET6, syscall.IPPROTO_ICMPV6, 128, 129
+	}
+	fd, err := syscall.Socket(family, syscall.SOCK_DGRAM, protocol)
+	if err != nil {
+		return errPingUnavailable
+	}
+	file := os.NewFile(uintptr(fd), "ping")
+	conn, err := net.FilePacketConn(file)
+	file.Close()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	// The kernel fills in the identifier and checksum
+	_, err = conn.WriteTo([]byte{request, 0, 0, 0, 0, 0, 0, 1}, &net.UDPAddr{IP: ip})
+	if err != nil {
+		return err
+	}
+	buffer := make([]byte, 1500)
+	for {
+		n, _, err := conn.ReadFrom(buffer)
+		if err != nil {
+			return err
+		}
+		if n > 0 && buffer[0] == reply {
+			return nil
+		}
+	}
+}
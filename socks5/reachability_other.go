@@ -0,0 +1,17 @@
+//go:build !linux
+
+package socks5
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// Only Linux offers ping sockets without privileges
+var errPingUnavailable = errors.New("unprivileged ping sockets are not supported on this platform")
+
+// Ping is not available, so reachability hints only expire
+func ping(ip net.IP, timeout time.Duration) error {
+	return errPingUnavailable
+}
@@ -0,0 +1,137 @@
+package socks5
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// Reply code for a failed connection attempt (RFC 1928), general failure (0x01) unless the reason is known
+func replyCode(err error) byte {
+	var failed *ErrCommandFailed
+	if errors.As(err, &failed) {
+		// Only reachability codes are passed on from an outbound proxy
+		if failed.Code >= 0x03 && failed.Code <= 0x06 {
+			return failed.Code
+		}
+		return 0x01
+	}
+	var opErr *net.OpError
+	var unreachable *ErrUpstreamUnreachable
+	if errors.As(err, &unreachable) || !errors.As(err, &opErr) || opErr.Op != "dial" {
+		// Failures reaching or talking to an outbound proxy say nothing about the destination
+		return 0x01
+	}
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, syscall.ENETUNREACH):
+		// Network unreachable
+		return 0x03
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnsErr):
+		// Host unreachable
+		return 0x04
+	case errors.Is(err, syscall.ECONNREFUSED):
+		// Connection refused
+		return 0x05
+	case opErr.Timeout():
+		// TTL expired
+		return 0x06
+	}
+	return 0x01
+}
+
+// Respond with a failure code (the local port is undefined)
+func (ctx *ClientCtx) sendFailure(code byte) error {
+	if ctx.Version == versionTransparent {
+		return nil
+	}
+	if ctx.Version == versionHTTP {
+		return ctx.sendHTTP(httpStatus(code))
+	}
+	if ctx.Version == 0x04 {
+		// Request rejected or failed (91)
+		ctx.Client.Writer.Write([]byte{0x00, 0x5B, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+		return ctx.Client.Writer.Flush()
+	}
+	if ctx.Version == 0x06 {
+		return ctx.sendSocks6(code, "", nil, 0)
+	}
+	ctx.Client.Writer.Write([]byte{0x05, code})
+	ctx.Client.Writer.Write(ctx.RequestData)
+	ctx.Client.Writer.Write([]byte{0x00, 0x00})
+	return ctx.Client.Writer.Flush()
+}
+
+// Reply with success and an address (a host name takes precedence over the IP)
+func (ctx *ClientCtx) sendAddress(host string, ip net.IP, port int) error {
+	if ctx.Version == versionTransparent {
+		return nil
+	}
+	if ctx.Version == versionHTTP {
+		return ctx.sendHTTP(httpStatus(0x00))
+	}
+	if ctx.Version == 0x04 {
+		// SOCKS4 replies only carry IPv4 addresses
+		return ctx.sendSocks4(0x00, ip.To4(), port)
+	}
+	if ctx.Version == 0x06 {
+		return ctx.sendSocks6(0x00, host, ip, port)
+	}
+	ctx.Client.Writer.Write([]byte{0x05, 0x00, 0x00})
+	if len(host) > 0 {
+		// Type domain name
+		ctx.Client.Writer.Write([]byte{0x03, byte(len(host))})
+		ctx.Client.Writer.Write([]byte(host))
+	} else if ip4 := ip.To4(); ip4 != nil {
+		// Type IPv4
+		ctx.Client.Writer.Write([]byte{0x01})
+		ctx.Client.Writer.Write(ip4)
+	} else {
+		// Type IPv6
+		ctx.Client.Writer.Write([]byte{0x04})
+		ctx.Client.Writer.Write(ip.To16())
+	}
+	ctx.Client.Writer.Write([]byte{byte((port >> 8) & 0xFF), byte(port & 0xFF)})
+	return ctx.Client.Writer.Flush()
+}
+
+// Pass along a reply from an outbound proxy (result code, then reserved, address type, address and port)
+func (ctx *ClientCtx) sendReply(code byte, response []byte) error {
+	if ctx.Version == versionTransparent {
+		return nil
+	}
+	if ctx.Version == versionHTTP {
+		return ctx.sendHTTP(httpStatus(code))
+	}
+	if ctx.Version == 0x04 {
+		var ip net.IP
+		if len(response) >= 8 && response[1] == 0x01 {
+			ip = net.IP(response[2:6])
+		}
+		port := 0
+		if len(response) >= 2 {
+			port = int(response[len(response)-2])<<8 | int(response[len(response)-1])
+		}
+		return ctx.sendSocks4(code, ip, port)
+	}
+	if ctx.Version == 0x06 {
+		return ctx.sendSocks6Reply(code, response)
+	}
+	ctx.Client.Writer.Write([]byte{0x05, code})
+	ctx.Client.Writer.Write(response)
+	return ctx.Client.Writer.Flush()
+}
+
+// Write a SOCKS4 reply (granted for a zero code, rejected otherwise)
+func (ctx *ClientCtx) sendSocks4(code byte, ip net.IP, port int) error {
+	status := byte(0x5A)
+	if code != 0x00 {
+		status = 0x5B
+	}
+	ctx.Client.Writer.Write([]byte{0x00, status, byte((port >> 8) & 0xFF), byte(port & 0xFF)})
+	if ip == nil {
+		ip = net.IPv4zero.To4()
+	}
+	ctx.Client.Writer.Write(ip)
+	return ctx.Client.Writer.Flush()
+}
@@ -0,0 +1,94 @@
+package socks5
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Tor extension commands for DNS lookups through the proxy
+const (
+	CommandResolve    = 0xF0
+	CommandResolvePTR = 0xF1
+)
+
+// ResolveTimeout is how long a lookup may take before the client is told the host is unreachable
+const ResolveTimeout = 30 * time.Second
+
+// processResolve answers a RESOLVE (address for a name) or RESOLVE_PTR (name for an address) request
+func (ctx *ClientCtx) processResolve() error {
+	if ctx.Command == CommandResolvePTR && addressType(ctx.Remote.Host) == 0x03 {
+		// Respond with address type not supported (0x08)
+		ctx.sendFailure(0x08)
+		return fmt.Errorf("invalid address type(resolve_ptr) from: %s", ctx.Client.Host)
+	}
+	if len(ctx.Ctx.Proxies.List()) > 0 {
+		// Have the outbound proxy look it up, passing along its reply
+		err := ctx.processOutbound()
+		if err == nil {
+			ctx.Remote.Connection.Close()
+		}
+		return err
+	}
+	if ctx.Ctx.egressBlocked() {
+		return ctx.refuseDirect()
+	}
+
+	lookup, cancel := context.WithTimeout(context.Background(), ResolveTimeout)
+	defer cancel()
+	var result string
+	var err error
+	if ctx.Command == CommandResolve {
+		var ip net.IP
+		ip, err = lookupIP(lookup, ctx.Remote.Host)
+		if err == nil {
+			result = ip.String()
+			err = ctx.sendAddress("", ip, 0)
+		}
+	} else {
+		var names []string
+		names, err = net.DefaultResolver.LookupAddr(lookup, ctx.Remote.Host)
+		if err == nil && len(names) == 0 {
+			err = fmt.Errorf("no names for: %s", ctx.Remote.Host)
+		}
+		if err == nil {
+			result = strings.TrimSuffix(names[0], ".")
+			if len(result) > 255 {
+				result = result[:255]
+			}
+			err = ctx.sendAddress(result, nil, 0)
+		}
+	}
+	if err != nil {
+		// Respond with host unreachable (0x04), as Tor does for failed lookups
+		ctx.sendFailure(0x04)
+		ctx.Ctx.logError(err)
+		return err
+	}
+	if ctx.Ctx.Logger != nil {
+		ctx.Ctx.Logger <- fmt.Sprintf(" [+] Resolved: [%s]:%d %s -> %s\n", ctx.Client.Host, ctx.Client.Port, ctx.Remote.Host, result)
+	}
+	return nil
+}
+
+// Look up a host's address, preferring IPv4 (an address is returned as is)
+func lookupIP(lookup context.Context, host string) (net.IP, error) {
+	if ip := hostIP(host); ip != nil {
+		return ip, nil
+	}
+	addresses, err := net.DefaultResolver.LookupIPAddr(lookup, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, address := range addresses {
+		if address.IP.To4() != nil {
+			return address.IP, nil
+		}
+	}
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("no addresses for: %s", host)
+	}
+	return addresses[0].IP, nil
+}
@@ -0,0 +1,47 @@
+package socks5
+
+import (
+	"runtime"
+	"sync/atomic"
+)
+
+// Resources a session holds, approximately (the buffers it allocated and the descriptors of its sockets)
+type Resources struct {
+	Memory      int64 `json:"memory"`
+	Descriptors int   `json:"descriptors"`
+}
+
+// ProcessResources of the whole process, to compare with its limits (-1 descriptors and a limit of 0 are unknown)
+type ProcessResources struct {
+	Memory          uint64 `json:"memory"`
+	Descriptors     int    `json:"descriptors"`
+	DescriptorLimit uint64 `json:"descriptor_limit,omitempty"`
+}
+
+// Resources returns what an active session holds: the client and remote sockets with their buffers, the relay buffers and any UDP relay or BIND listener
+func (ctx *ClientCtx) Resources() Resources {
+	var resources Resources
+	for _, connection := range []*Connection{&ctx.Client, &ctx.Remote} {
+		if connection.Connection != nil {
+			resources.Descriptors++
+		}
+		if connection.Reader != nil {
+			resources.Memory += int64(connection.Reader.Size())
+		}
+		if connection.Writer != nil {
+			resources.Memory += int64(connection.Writer.Size())
+		}
+		resources.Memory += atomic.LoadInt64(&connection.relaying)
+	}
+	resources.Descriptors += int(atomic.LoadInt32(&ctx.sockets))
+	return resources
+}
+
+// Process returns the memory the process has from the system and the descriptors it has open
+func Process() ProcessResources {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	process := ProcessResources{Memory: stats.Sys}
+	process.Descriptors, process.DescriptorLimit = descriptors()
+	return process
+}
@@ -0,0 +1,22 @@
+//go:build linux
+
+package socks5
+
+import (
+	"os"
+	"syscall"
+)
+
+// Descriptors the process has open, and its soft limit on them
+func descriptors() (int, uint64) {
+	open := -1
+	if entries, err := os.ReadDir("/proc/self/fd"); err == nil {
+		// Reading the directory holds one more descriptor
+		open = len(entries) - 1
+	}
+	var limit syscall.Rlimit
+	if syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit) != nil {
+		return open, 0
+	}
+	return open, limit.Cur
+}
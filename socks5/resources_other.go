@@ -0,0 +1,8 @@
+//go:build !linux
+
+package socks5
+
+// Only counted on Linux so far
+func descriptors() (int, uint64) {
+	return -1, 0
+}
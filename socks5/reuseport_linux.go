@@ -0,0 +1,21 @@
+//go:build linux
+
+package socks5
+
+import (
+	"syscall"
+)
+
+// Socket option from asm-generic/socket.h
+const soReusePort = 15
+
+// Let several sockets listen on one port, with the kernel spreading new connections between them
+func reusePortControl() func(string, string, syscall.RawConn) error {
+	return func(network string, address string, conn syscall.RawConn) error {
+		var err error
+		conn.Control(func(fd uintptr) {
+			err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+		})
+		return err
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package socks5
+
+import (
+	"syscall"
+)
+
+// Sharing a port between accept workers is not available on this platform
+func reusePortControl() func(string, string, syscall.RawConn) error {
+	return nil
+}
@@ -0,0 +1,105 @@
+package socks5
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// HostRewriter maps a requested destination to the one actually connected to (service discovery, blue/green switching), consulted as each tunnel opens
+type HostRewriter interface {
+	// Rewrite returns the destination to connect to, or false to connect as requested (implementations must not block for long)
+	Rewrite(host string, port int) (string, int, bool)
+}
+
+// HostAliases is a static HostRewriter, mapping "host" or "host:port" to "target" or "target:port"
+type HostAliases struct {
+	Aliases map[string]string `json:"aliases"`
+}
+
+// LoadFile retrieves host aliases from a file
+func (ctx *HostAliases) LoadFile(file string) bool {
+	input, err := os.Open(file)
+	if err != nil {
+		return false
+	}
+	defer input.Close()
+	finfo, err := input.Stat()
+	if err != nil {
+		return false
+	}
+	data := make([]byte, finfo.Size())
+	_, err = input.Read(data)
+	if err != nil {
+		return false
+	}
+	var aliases HostAliases
+	err = json.Unmarshal(data, &aliases)
+	if err != nil {
+		return false
+	}
+	// Names are matched case-insensitively, and every target must be usable
+	ctx.Aliases = make(map[string]string)
+	for alias, target := range aliases.Aliases {
+		if _, _, err := splitTarget(target, 0); err != nil || len(alias) == 0 {
+			return false
+		}
+		ctx.Aliases[strings.ToLower(alias)] = target
+	}
+	return true
+}
+
+// Rewrite a destination with an alias for the host and port, or failing that the host alone
+func (ctx *HostAliases) Rewrite(host string, port int) (string, int, bool) {
+	host = strings.ToLower(host)
+	target, ok := ctx.Aliases[net.JoinHostPort(host, strconv.Itoa(port))]
+	if !ok {
+		target, ok = ctx.Aliases[host]
+	}
+	if !ok {
+		return "", 0, false
+	}
+	host, port, err := splitTarget(target, port)
+	return host, port, err == nil
+}
+
+// Split a target into its host and port, keeping the requested port when it has none
+func splitTarget(target string, port int) (string, int, error) {
+	host, portText, err := net.SplitHostPort(target)
+	if err != nil {
+		// A bare host (or IPv6 address)
+		host = strings.Trim(target, "[]")
+		if len(host) == 0 {
+			return "", 0, fmt.Errorf("invalid alias target: %s", target)
+		}
+		return host, port, nil
+	}
+	port, err = strconv.Atoi(portText)
+	if err != nil || port <= 0 || port > 0xFFFF || len(host) == 0 {
+		return "", 0, fmt.Errorf("invalid alias target: %s", target)
+	}
+	return host, port, nil
+}
+
+// Point a tunnel at the destination the rewriter maps it to (policy has already been applied to the requested destination)
+func (ctx *ClientCtx) rewriteDestination() {
+	if ctx.Ctx.Rewriter == nil {
+		return
+	}
+	host, port, ok := ctx.Ctx.Rewriter.Rewrite(ctx.Remote.Host, ctx.Remote.Port)
+	if !ok || len(host) == 0 || port <= 0 || port > 0xFFFF {
+		return
+	}
+	host = canonicalHost(host)
+	if host == ctx.Remote.Host && port == ctx.Remote.Port {
+		return
+	}
+	if ctx.Ctx.Logger != nil {
+		ctx.Ctx.Logger <- fmt.Sprintf(" [*] Rewrote: %s -> %s\n", net.JoinHostPort(ctx.Remote.Host, strconv.Itoa(ctx.Remote.Port)), net.JoinHostPort(host, strconv.Itoa(port)))
+	}
+	ctx.Remote.Host = host
+	ctx.Remote.Port = port
+}
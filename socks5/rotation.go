@@ -0,0 +1,52 @@
+package socks5
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Outbound proxy the rotate strategy keeps using, since when and for how many connections
+type rotation struct {
+	proxy       ProxyInfo
+	since       time.Time
+	connections int
+}
+
+// Whether a rotation has used its proxy for RotateEvery or RotateAfter (caller holds the rotation lock)
+func (ctx *ProxyPool) rotationDue(current *rotation) bool {
+	if ctx.RotateEvery > 0 && time.Since(current.since) >= ctx.RotateEvery {
+		return true
+	}
+	return ctx.RotateAfter > 0 && current.connections >= ctx.RotateAfter
+}
+
+// Keep choosing one outbound proxy until its rotation is due (or it drops out of the candidates), then move on to another at random
+func (ctx *ProxyPool) rotate(key string, candidates []ProxyInfo) ProxyInfo {
+	ctx.rotationLock.Lock()
+	defer ctx.rotationLock.Unlock()
+	if ctx.rotations == nil {
+		ctx.rotations = make(map[string]*rotation)
+	}
+	current, ok := ctx.rotations[key]
+	if ok && !ctx.rotationDue(current) {
+		for _, proxy := range candidates {
+			if proxy == current.proxy {
+				current.connections++
+				return proxy
+			}
+		}
+	}
+	var others []ProxyInfo
+	for _, proxy := range candidates {
+		if !ok || proxy != current.proxy {
+			others = append(others, proxy)
+		}
+	}
+	if len(others) == 0 {
+		// The only candidate starts another rotation
+		others = candidates
+	}
+	proxy := others[rand.Intn(len(others))]
+	ctx.rotations[key] = &rotation{proxy: proxy, since: time.Now(), connections: 1}
+	return proxy
+}
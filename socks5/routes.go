@@ -0,0 +1,115 @@
+package socks5
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"proxy/policy"
+	"strconv"
+	"strings"
+)
+
+// Route sends destinations matching a domain suffix, network or port through a specific outbound proxy ("host:port"), a group of them (country or tag) or "direct"
+type Route struct {
+	Destination string `json:"destination"`
+	Port        int    `json:"port"`
+	Via         string `json:"via"`
+	network     *net.IPNet
+}
+
+// RoutingTable of routes, the first that matches a destination wins
+type RoutingTable struct {
+	Routes []Route `json:"routes"`
+}
+
+// LoadFile retrieves routes from a file
+func (ctx *RoutingTable) LoadFile(file string) bool {
+	input, err := os.Open(file)
+	if err != nil {
+		return false
+	}
+	defer input.Close()
+	finfo, err := input.Stat()
+	if err != nil {
+		return false
+	}
+	data := make([]byte, finfo.Size())
+	_, err = input.Read(data)
+	if err != nil {
+		return false
+	}
+	var table RoutingTable
+	err = json.Unmarshal(data, &table)
+	if err != nil {
+		return false
+	}
+	// Destinations are networks (CIDR), addresses or domains (matched case-insensitively), every route needs somewhere to go and something to match
+	for i := range table.Routes {
+		route := &table.Routes[i]
+		route.Destination = strings.ToLower(strings.TrimSpace(route.Destination))
+		route.Via = strings.TrimSpace(route.Via)
+		if len(route.Via) == 0 || route.Port < 0 || route.Port > 0xFFFF {
+			return false
+		}
+		if (len(route.Destination) == 0 || route.Destination == "*") && route.Port == 0 {
+			return false
+		}
+		if _, network, err := net.ParseCIDR(route.Destination); err == nil {
+			route.network = network
+		} else if ip := net.ParseIP(strings.Trim(route.Destination, "[]")); ip != nil {
+			route.network = &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}
+		}
+	}
+	ctx.Routes = table.Routes
+	return true
+}
+
+// Whether a destination matches the route (a domain also covers its subdomains, "*.domain" only its subdomains)
+func (ctx *Route) matches(host string, port int) bool {
+	if ctx.Port > 0 && ctx.Port != port {
+		return false
+	}
+	if ctx.network != nil {
+		ip := hostIP(host)
+		return ip != nil && ctx.network.Contains(ip)
+	}
+	host = strings.ToLower(host)
+	switch {
+	case len(ctx.Destination) == 0 || ctx.Destination == "*":
+		return true
+	case strings.HasPrefix(ctx.Destination, "*."):
+		return strings.HasSuffix(host, ctx.Destination[1:])
+	}
+	return host == ctx.Destination || strings.HasSuffix(host, "."+ctx.Destination)
+}
+
+// Lookup where the first matching route sends a destination
+func (ctx *RoutingTable) Lookup(host string, port int) (string, bool) {
+	for i := range ctx.Routes {
+		if ctx.Routes[i].matches(host, port) {
+			return ctx.Routes[i].Via, true
+		}
+	}
+	return "", false
+}
+
+// Whether a route's target names this outbound proxy, by address or by its country or tag
+func (ctx *ProxyInfo) routes(via string) bool {
+	return strings.EqualFold(via, net.JoinHostPort(ctx.Host, strconv.Itoa(ctx.Port))) || ctx.exits(via)
+}
+
+// Route a tunnel the policy hasn't by the routing table ("direct" skips the outbound proxies, any other target is required rather than preferred)
+func (ctx *ClientCtx) applyRoutes() {
+	if ctx.Ctx.Routes == nil || len(ctx.route) > 0 {
+		return
+	}
+	via, ok := ctx.Ctx.Routes.Lookup(ctx.Remote.Host, ctx.Remote.Port)
+	if !ok {
+		return
+	}
+	if strings.EqualFold(via, policy.Direct) {
+		ctx.route = policy.Direct
+		return
+	}
+	ctx.via = via
+}
@@ -0,0 +1,179 @@
+package socks5
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// DrainTimeout bounds how long a shutdown waits for relays to finish once the remotes are half-closed
+const DrainTimeout = time.Second
+
+// Register an active client session
+func (ctx *Context) addSession(client *ClientCtx) {
+	ctx.sessionLock.Lock()
+	defer ctx.sessionLock.Unlock()
+	if ctx.sessions == nil {
+		ctx.sessions = make(map[*ClientCtx]bool)
+	}
+	ctx.sessions[client] = true
+	ctx.metrics().Gauge("sessions_active", float64(len(ctx.sessions)), ctx.metricLabels())
+}
+
+// Remove a client session once it has closed and record its usage
+func (ctx *Context) removeSession(client *ClientCtx) {
+	ctx.sessionLock.Lock()
+	defer ctx.sessionLock.Unlock()
+	delete(ctx.sessions, client)
+	ctx.addUsage(client)
+	sent, received := atomic.LoadUint64(&client.Client.ReadCount), atomic.LoadUint64(&client.Remote.ReadCount)
+	ctx.metrics().Gauge("sessions_active", float64(len(ctx.sessions)), ctx.metricLabels())
+	labels := client.metricLabels()
+	ctx.metrics().Counter("bytes_sent_total", int64(sent), labels)
+	ctx.metrics().Counter("bytes_received_total", int64(received), labels)
+	ctx.metrics().Histogram("session_duration_seconds", time.Since(client.Started).Seconds(), labels)
+}
+
+// Sessions returns a snapshot of the active client sessions
+func (ctx *Context) Sessions() []*ClientCtx {
+	ctx.sessionLock.Lock()
+	defer ctx.sessionLock.Unlock()
+	var list []*ClientCtx
+	for client := range ctx.sessions {
+		list = append(list, client)
+	}
+	return list
+}
+
+// EnforceSchedule closes active sessions once their user's allowed window ends
+func (ctx *Context) EnforceSchedule() {
+	for {
+		time.Sleep(15 * time.Second)
+		now := time.Now()
+		for _, client := range ctx.Sessions() {
+			user := client.Identity()
+			if !ctx.Schedule.Restricted(user) {
+				continue
+			}
+			allowed, remaining := ctx.Schedule.Remaining(user, now)
+			if !allowed {
+				if ctx.Logger != nil {
+					ctx.Logger <- fmt.Sprintf(" [!] Allowed time ended for: %s (closing %s:%d)\n", user, client.Remote.Host, client.Remote.Port)
+				}
+				ctx.emit(client.event("schedule_ended"))
+				client.Close()
+				continue
+			}
+			if remaining <= ctx.tuned(&ctx.ScheduleWarning) && !client.warned {
+				client.warned = true
+				if ctx.Logger != nil {
+					ctx.Logger <- fmt.Sprintf(" [*] Allowed time for %s ends in %v (%s:%d)\n", user, remaining.Round(time.Minute), client.Remote.Host, client.Remote.Port)
+				}
+				ctx.emit(client.event("schedule_warning"))
+			}
+		}
+	}
+}
+
+// Close terminates both sides of a client session
+func (ctx *ClientCtx) Close() {
+	ctx.Lock()
+	defer ctx.Unlock()
+	if ctx.Client.Connection != nil {
+		ctx.Client.Connection.Close()
+	}
+	if ctx.Remote.Connection != nil {
+		ctx.Remote.Connection.Close()
+	}
+}
+
+// Half-close the remote side of a client session, leaving the relay to deliver the rest of its reply and then end the client's stream
+func (ctx *ClientCtx) closeWrite() {
+	ctx.Lock()
+	defer ctx.Unlock()
+	if conn, ok := ctx.Remote.Connection.(interface{ CloseWrite() error }); ok {
+		conn.CloseWrite()
+	}
+}
+
+// Shutdown stops accepting clients and gives active sessions a grace period to finish
+func (ctx *Context) Shutdown(grace time.Duration) {
+	ctx.listenerLock.Lock()
+	for _, listener := range ctx.listeners {
+		listener.Close()
+	}
+	ctx.listenerLock.Unlock()
+	deadline := time.Now().Add(grace)
+	for len(ctx.Sessions()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	sessions := ctx.Sessions()
+	if len(sessions) == 0 {
+		return
+	}
+	if ctx.Logger != nil {
+		ctx.Logger <- fmt.Sprintf(" [-] Closing %d sessions on: %s\n", len(sessions), ctx.ListenAddress)
+	}
+	// Let the relays deliver what they already have before the sockets close
+	for _, client := range sessions {
+		client.closeWrite()
+	}
+	deadline = time.Now().Add(DrainTimeout)
+	for len(ctx.Sessions()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	// Whatever is still running after that is cut off
+	for _, client := range ctx.Sessions() {
+		client.Close()
+	}
+}
+
+// Identity used for per-user policies and accounting
+func (ctx *ClientCtx) Identity() string {
+	if len(ctx.User) > 0 {
+		return ctx.User
+	}
+	return ctx.Client.Host
+}
+
+// SessionQuery for searching active sessions (empty fields match everything)
+type SessionQuery struct {
+	Client      string
+	Destination string
+	Upstream    string
+	MinAge      time.Duration
+}
+
+// Matches checks a session against the query (destinations accept glob patterns like "*.example.com")
+func (query *SessionQuery) Matches(client *ClientCtx, now time.Time) bool {
+	if len(query.Client) > 0 && query.Client != client.Client.Host && query.Client != client.Identity() {
+		return false
+	}
+	if len(query.Destination) > 0 {
+		ok, err := path.Match(strings.ToLower(query.Destination), strings.ToLower(client.Remote.Host))
+		if err != nil || !ok {
+			return false
+		}
+	}
+	if len(query.Upstream) > 0 && query.Upstream != client.Proxy.Host {
+		return false
+	}
+	if query.MinAge > 0 && now.Sub(client.Started) < query.MinAge {
+		return false
+	}
+	return true
+}
+
+// FindSessions returns the active sessions matching a query
+func (ctx *Context) FindSessions(query SessionQuery) []*ClientCtx {
+	var list []*ClientCtx
+	now := time.Now()
+	for _, client := range ctx.Sessions() {
+		if query.Matches(client, now) {
+			list = append(list, client)
+		}
+	}
+	return list
+}
@@ -0,0 +1,194 @@
+package socks5
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Shadowsocks AEAD methods the standard library can provide, with their key sizes
+var shadowsocksMethods = map[string]int{
+	"aes-128-gcm": 16,
+	"aes-256-gcm": 32,
+}
+
+// Largest payload in one Shadowsocks chunk
+const shadowsocksChunk = 0x3FFF
+
+func init() {
+	RegisterUpstreamTransport(ProxyShadowsocks, shadowsocksTransport{})
+}
+
+// Tunnels through Shadowsocks servers (AEAD ciphers only, the stream ciphers are broken)
+type shadowsocksTransport struct{}
+
+// Validate requires a supported method and a password
+func (shadowsocksTransport) Validate(proxy ProxyInfo) error {
+	if _, ok := shadowsocksMethods[strings.ToLower(proxy.Method)]; !ok {
+		return fmt.Errorf("unsupported Shadowsocks method %q (aes-128-gcm or aes-256-gcm): %s", proxy.Method, proxy.Host)
+	}
+	if len(proxy.Password) == 0 {
+		return fmt.Errorf("Shadowsocks needs a password: %s", proxy.Host)
+	}
+	if len(proxy.Username) > 0 || len(proxy.GSSAPI) > 0 {
+		return fmt.Errorf("Shadowsocks has no usernames or GSS-API: %s", proxy.Host)
+	}
+	return nil
+}
+
+// Connect sends the destination as the first chunk (the server never answers it, so failures show up as the tunnel closing)
+func (shadowsocksTransport) Connect(proxy ProxyInfo, connection net.Conn, host string, port int) (net.Conn, error) {
+	address, err := encodeAddress(host)
+	if err != nil {
+		return nil, err
+	}
+	address = append(address, byte((port>>8)&0xFF), byte(port&0xFF))
+	tunnel := &shadowsocksConn{Conn: connection, proxy: proxy.Host, key: shadowsocksKey(proxy.Password, shadowsocksMethods[strings.ToLower(proxy.Method)])}
+	_, err = tunnel.Write(address)
+	if err != nil {
+		return nil, err
+	}
+	return tunnel, nil
+}
+
+// Derive the master key from a password (OpenSSL's EVP_BytesToKey with MD5, as every Shadowsocks implementation does)
+func shadowsocksKey(password string, size int) []byte {
+	var key, previous []byte
+	for len(key) < size {
+		digest := md5.Sum(append(previous, password...))
+		previous = digest[:]
+		key = append(key, previous...)
+	}
+	return key[:size]
+}
+
+// Cipher for one direction of a session, keyed by that direction's salt
+func shadowsocksCipher(key []byte, salt []byte) (cipher.AEAD, error) {
+	subkey, err := hkdf.Key(sha1.New, key, salt, "ss-subkey", len(key))
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(subkey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Nonces count chunks, little endian
+func incrementNonce(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+// Connection carrying a byte stream in Shadowsocks AEAD chunks
+type shadowsocksConn struct {
+	net.Conn
+	proxy      string
+	key        []byte
+	writer     cipher.AEAD
+	writeNonce []byte
+	writeLock  sync.Mutex
+	reader     cipher.AEAD
+	readNonce  []byte
+	pending    []byte
+}
+
+// Write data as sealed chunks, preceded by the salt the first time
+func (ss *shadowsocksConn) Write(data []byte) (int, error) {
+	ss.writeLock.Lock()
+	defer ss.writeLock.Unlock()
+	var buffer []byte
+	if ss.writer == nil {
+		salt := make([]byte, len(ss.key))
+		_, err := rand.Read(salt)
+		if err != nil {
+			return 0, err
+		}
+		ss.writer, err = shadowsocksCipher(ss.key, salt)
+		if err != nil {
+			return 0, err
+		}
+		ss.writeNonce = make([]byte, ss.writer.NonceSize())
+		buffer = salt
+	}
+	for remaining := data; len(remaining) > 0; {
+		chunk := remaining
+		if len(chunk) > shadowsocksChunk {
+			chunk = chunk[:shadowsocksChunk]
+		}
+		remaining = remaining[len(chunk):]
+		buffer = ss.writer.Seal(buffer, ss.writeNonce, []byte{byte(len(chunk) >> 8), byte(len(chunk))}, nil)
+		incrementNonce(ss.writeNonce)
+		buffer = ss.writer.Seal(buffer, ss.writeNonce, chunk, nil)
+		incrementNonce(ss.writeNonce)
+	}
+	_, err := ss.Conn.Write(buffer)
+	if err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// Read payload bytes, opening chunks as needed
+func (ss *shadowsocksConn) Read(data []byte) (int, error) {
+	for len(ss.pending) == 0 {
+		err := ss.readChunk()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(data, ss.pending)
+	ss.pending = ss.pending[n:]
+	return n, nil
+}
+
+// Open the next chunk (after the server's salt the first time), any forgery fails the session
+func (ss *shadowsocksConn) readChunk() error {
+	if ss.reader == nil {
+		salt := make([]byte, len(ss.key))
+		_, err := io.ReadFull(ss.Conn, salt)
+		if err != nil {
+			return err
+		}
+		ss.reader, err = shadowsocksCipher(ss.key, salt)
+		if err != nil {
+			return err
+		}
+		ss.readNonce = make([]byte, ss.reader.NonceSize())
+	}
+	header := make([]byte, 2+ss.reader.Overhead())
+	_, err := io.ReadFull(ss.Conn, header)
+	if err != nil {
+		return err
+	}
+	length, err := ss.reader.Open(header[:0], ss.readNonce, header, nil)
+	if err != nil {
+		return &ErrUpstreamTampered{Proxy: ss.proxy, Reason: "Shadowsocks chunk failed authentication"}
+	}
+	incrementNonce(ss.readNonce)
+	size := (int(length[0])<<8 | int(length[1])) & shadowsocksChunk
+	payload := make([]byte, size+ss.reader.Overhead())
+	_, err = io.ReadFull(ss.Conn, payload)
+	if err != nil {
+		return err
+	}
+	ss.pending, err = ss.reader.Open(payload[:0], ss.readNonce, payload, nil)
+	if err != nil {
+		return &ErrUpstreamTampered{Proxy: ss.proxy, Reason: "Shadowsocks chunk failed authentication"}
+	}
+	incrementNonce(ss.readNonce)
+	return nil
+}
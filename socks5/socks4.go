@@ -0,0 +1,68 @@
+package socks5
+
+import (
+	"fmt"
+	"io"
+	"net"
+)
+
+// Read a null terminated SOCKS4 string (user ID or SOCKS4a host name)
+func (ctx *ClientCtx) readSocks4String() (string, error) {
+	var value []byte
+	for {
+		data, err := ctx.Client.Reader.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if data == 0x00 {
+			return string(value), nil
+		}
+		if len(value) >= 255 {
+			return "", fmt.Errorf("invalid data(socks4) from: %s", ctx.Client.Host)
+		}
+		value = append(value, data)
+	}
+}
+
+// processSocks4 reads a SOCKS4 or SOCKS4a request (after the version byte) into the same fields as SOCKS5
+func (ctx *ClientCtx) processSocks4() error {
+	ctx.Version = 0x04
+	request := make([]byte, 7)
+	_, err := io.ReadFull(ctx.Client.Reader, request)
+	if err != nil {
+		return err
+	}
+	// Connect or bind command
+	if request[0] != 0x01 && request[0] != 0x02 {
+		if !ctx.Ctx.DropUnsupported {
+			ctx.sendFailure(0x07)
+		}
+		return fmt.Errorf("%w (%d) from: %s", ErrUnsupportedCommand, request[0], ctx.Client.Host)
+	}
+	ctx.Command = request[0]
+	ctx.Remote.Port = int(request[1])<<8 | int(request[2])
+	ip := net.IP(request[3:7])
+
+	// The user ID is not used for anything yet
+	_, err = ctx.readSocks4String()
+	if err != nil {
+		return err
+	}
+
+	// SOCKS4a sends 0.0.0.x (x != 0) followed by the host name
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		host, err := ctx.readSocks4String()
+		if err != nil {
+			return err
+		}
+		if len(host) == 0 {
+			return fmt.Errorf("invalid data(socks4a) from: %s", ctx.Client.Host)
+		}
+		ctx.Remote.Host = host
+		ctx.RequestData = append([]byte{0x00, 0x03, byte(len(host))}, host...)
+		return nil
+	}
+	ctx.Remote.Host = ip.String()
+	ctx.RequestData = append([]byte{0x00, 0x01}, ip...)
+	return nil
+}
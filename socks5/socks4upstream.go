@@ -0,0 +1,69 @@
+package socks5
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+// Whether the outbound proxy only speaks SOCKS4 (and 4a)
+func (ctx *ProxyInfo) socks4() bool {
+	return strings.EqualFold(ctx.Type, ProxySOCKS4)
+}
+
+// Send a SOCKS4 connect request (4a for names) and read the reply, returning the bound address as a SOCKS5 reply address
+func (ctx *ProxyInfo) connectSOCKS4(connection net.Conn, reader io.Reader, host string, port int) ([]byte, error) {
+	request := []byte{0x04, 0x01, byte((port >> 8) & 0xFF), byte(port & 0xFF)}
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		// SOCKS4a: an invalid address (0.0.0.x) says the name follows the user ID
+		request = append(request, 0x00, 0x00, 0x00, 0x01)
+		request = append(request, ctx.Username...)
+		request = append(request, 0x00)
+		request = append(request, host...)
+	case ip.To4() != nil:
+		request = append(request, ip.To4()...)
+		request = append(request, ctx.Username...)
+	default:
+		// Address type not supported
+		return nil, &ErrCommandFailed{Proxy: ctx.Host, Code: 0x08}
+	}
+	_, err := connection.Write(append(request, 0x00))
+	if err != nil {
+		return nil, err
+	}
+
+	// Version 0, result, then the bound port and address
+	reply := make([]byte, 8)
+	_, err = io.ReadFull(reader, reply)
+	if err != nil {
+		return nil, err
+	}
+	if reply[0] != 0x00 {
+		return nil, fmt.Errorf("invalid data(socks4) from: %s", ctx.Host)
+	}
+	switch reply[1] {
+	case 90:
+		// Granted
+	case 92, 93:
+		// The proxy could not confirm the user ID with identd
+		return nil, fmt.Errorf("%w: %s (%d)", ErrAuthFailed, ctx.Host, reply[1])
+	default:
+		// Rejected or failed, without saying why
+		return nil, &ErrCommandFailed{Proxy: ctx.Host, Code: 0x01}
+	}
+	response := append([]byte{0x00, 0x01}, reply[4:8]...)
+	return append(response, reply[2:4]...), nil
+}
+
+// Open the tunnel through a SOCKS4 outbound proxy
+func (ctx *ClientCtx) negotiateSOCKS4Upstream() ([]byte, error) {
+	response, err := ctx.Proxy.connectSOCKS4(ctx.Remote.Connection, ctx.Remote.Reader, ctx.Remote.Host, ctx.Remote.Port)
+	if err != nil {
+		ctx.Remote.Connection.Close()
+		return nil, err
+	}
+	return response, nil
+}
@@ -2,68 +2,310 @@ package socks5
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
-	"encoding/hex"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"math/rand"
 	"net"
-	"os"
-	"os/signal"
 	"proxy/filter"
+	"proxy/metrics"
+	"proxy/policy"
+	"proxy/schedule"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 )
 
 // Context for Socks5 server
 type Context struct {
+	Name              string
 	Logger            chan string
-	ClientConnections chan ClientCtx
+	ClientConnections chan *ClientCtx
 	DomainFilter      filter.Filter
 	ListenAddress     string
+	ListenAddresses   []string
 	Proxies           ProxyPool
 	ReportIP          net.IP
+	ReportHost        string
+	Schedule          schedule.Schedule
+	ScheduleWarning   time.Duration
+	EventHandlers     []EventHandler
+	DrainGrace        time.Duration
+	errorLock         sync.Mutex
+	errorCounts       map[string]uint64
+	recentErrors      map[string]*recentError
+	InterimPolicy     string
+	AnonymityJudge    string
+	ClientKeepAlive   time.Duration
+	RemoteKeepAlive   time.Duration
+	MaxConnections    int
+	VerifyUpstream    bool
+	ListenRetry       time.Duration
+	AcceptWorkers     int
+	UDPIdleTimeout    time.Duration
+	HTTPHint          bool
+	ReachabilityHints bool
+	LinkLocalZone     string
+	Socks6            bool
+	HTTPConnect       bool
+	HTTPOnly          bool
+	WebSocket         string
+	Transparent       bool
+	TProxy            bool
+	PreserveSource    bool
+	DNSIntercept      string
+	DNSResolver       string
+	FastOpen          bool
+	MSS               MSSClamp
+	Rewriter          HostRewriter
+	Policy            *policy.Policy
+	Routes            *RoutingTable
+	HandshakeTimeout  time.Duration
+	TLSConfig         *tls.Config
+	TicketRotation    time.Duration
+	Origins           Origins
+	MaxMethods        int
+	DropUnsupported   bool
+	Strict            bool
+	StrictEgress      bool
+	PAC               bool
+	PACBypass         []string
+	Bypass            Bypass
+	Credentials       Credentials
+	SessionTokenTTL   time.Duration
+	GSSAPI            GSSMechanism
+	Tenant            *Tenant
+	Metrics           metrics.Metrics
+	TraceDir          string
+	listeners         []net.Listener
+	tuneLock          sync.RWMutex
+	Destinations      DestinationLimits
+	destinations      map[string]int
+	destinationLock   sync.Mutex
+	listenerLock      sync.Mutex
+	traces            map[string]bool
+	traceLock         sync.Mutex
+	reach             reachability
+	QuarantineTime    time.Duration
+	HealthInterval    time.Duration
+	HealthFailures    int
+	HealthTarget      string
+	LatencyInterval   time.Duration
+	UsageInterval     time.Duration
+	UpstreamRetries   int
+	AuthFailureLimit  int
+	clients           int64
+	filterLock        sync.RWMutex
+	filterReady       bool
+	filterGeneration  uint64
+	filterPending     []func(*filter.Filter)
+	sessions          map[*ClientCtx]bool
+	sessionLock       sync.Mutex
+	usage             map[string]*Usage
+	preferences       map[string]string
+	preferenceLock    sync.Mutex
+	tokens            map[string]sessionToken
+	tokenLock         sync.Mutex
 }
 
-func (ctx *Context) catchExit() {
-	c := make(chan os.Signal)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	go func() {
-		<-c
-		ctx.Logger <- "\r [!] ctrl-c detected, exiting\n"
-		ctx.DomainFilter.Save()
-		os.Exit(0)
-	}()
+// Listen for inbound Socks5 connections on every address
+func (ctx *Context) Listen() error {
+	go ctx.flushErrors()
+	go ctx.expireFilter()
+	if ctx.Tenant != nil {
+		ctx.Tenant.attach(ctx)
+	}
+	defer close(ctx.ClientConnections)
+	addresses := ctx.Addresses()
+	var listeners []net.Listener
+	var bound []string
+	for _, address := range addresses {
+		workers, err := ctx.bind(address)
+		if err != nil {
+			for _, listener := range listeners {
+				listener.Close()
+			}
+			return err
+		}
+		for _, listener := range workers {
+			listeners = append(listeners, listener)
+			bound = append(bound, address)
+		}
+	}
+	ctx.listenerLock.Lock()
+	ctx.listeners = listeners
+	ctx.listenerLock.Unlock()
+	// All listeners feed the same clients channel, which closes once every one has stopped
+	var wait sync.WaitGroup
+	for i, listener := range listeners {
+		wait.Add(1)
+		go func(listener net.Listener, address string) {
+			defer wait.Done()
+			ctx.accept(listener, address)
+		}(listener, bound[i])
+	}
+	wait.Wait()
+	return nil
 }
 
-func (ctx *Context) logError(err error) {
-	if ctx.Logger != nil {
-		ctx.Logger <- fmt.Sprintf(" [!] Error: %s\n", err.Error())
+// Addresses the context accepts clients on (the listen address, then any additional ones)
+func (ctx *Context) Addresses() []string {
+	addresses := []string{ctx.ListenAddress}
+	for _, address := range ctx.ListenAddresses {
+		if address != ctx.ListenAddress {
+			addresses = append(addresses, address)
+		}
 	}
+	return addresses
 }
 
-// Listen for inbound Socks5 connections
-func (ctx *Context) Listen() error {
-	// Listen does not exit, so setup a handler for ctrl-c
-	go ctx.catchExit()
-	defer close(ctx.ClientConnections)
-	listener, err := net.Listen("tcp", ctx.ListenAddress)
-	if err != nil {
-		return err
+// Split a listen address into its host:port and whether clients use TLS on it
+// (tls:// and tcp:// override the default, which is TLS whenever a certificate is configured)
+func (ctx *Context) listenTLS(address string) (string, bool) {
+	switch {
+	case strings.HasPrefix(address, "tls://"):
+		return strings.TrimPrefix(address, "tls://"), true
+	case strings.HasPrefix(address, "tcp://"):
+		return strings.TrimPrefix(address, "tcp://"), false
+	}
+	return address, ctx.TLSConfig != nil
+}
+
+// Bind one listen address, with a socket per accept worker where the kernel can share the port between them
+func (ctx *Context) bind(address string) ([]net.Listener, error) {
+	host, useTLS := ctx.listenTLS(address)
+	if useTLS && ctx.TLSConfig == nil {
+		return nil, fmt.Errorf("no TLS certificate for: %s", address)
+	}
+	// A socket passed by systemd is used as is (its unit file sets the socket options)
+	var listeners []net.Listener
+	inherited := activated(host)
+	if inherited != nil {
+		listeners = append(listeners, inherited)
+	} else {
+		workers, reusePort := ctx.AcceptWorkers, reusePortControl()
+		if workers < 1 || reusePort == nil {
+			workers = 1
+		}
+		for len(listeners) < workers {
+			var control func(string, string, syscall.RawConn) error
+			if workers > 1 {
+				control = reusePort
+			}
+			listener, err := ctx.listen(host, control)
+			if err != nil {
+				for _, listener := range listeners {
+					listener.Close()
+				}
+				return nil, err
+			}
+			if len(listeners) == 0 {
+				// The others join the first one's port (which the kernel picks for port 0)
+				host = listener.Addr().String()
+			}
+			listeners = append(listeners, listener)
+		}
+	}
+	if useTLS {
+		// Clients reach the proxy over an encrypted channel (the handshake happens on the first read)
+		for i := range listeners {
+			listeners[i] = tls.NewListener(listeners[i], ctx.TLSConfig)
+		}
 	}
 	if ctx.Logger != nil {
-		ctx.Logger <- fmt.Sprintf(" [*] Bound to: %s\n", ctx.ListenAddress)
+		bound := address
+		if inherited != nil {
+			bound += " (from systemd)"
+		} else if len(listeners) > 1 {
+			bound += fmt.Sprintf(" (%d accept workers)", len(listeners))
+		}
+		if len(ctx.Name) > 0 {
+			ctx.Logger <- fmt.Sprintf(" [*] Bound to: %s (%s)\n", bound, ctx.Name)
+		} else {
+			ctx.Logger <- fmt.Sprintf(" [*] Bound to: %s\n", bound)
+		}
+	}
+	return listeners, nil
+}
+
+// Open a listening socket
+func (ctx *Context) listen(host string, reusePort func(string, string, syscall.RawConn) error) (net.Listener, error) {
+	var fastOpen func(string, string, syscall.RawConn) error
+	if _, server := FastOpenSupport(); ctx.FastOpen && server {
+		fastOpen = fastOpenListen
+	}
+	// Accepted connections inherit the clamped segment size
+	var tproxy func(string, string, syscall.RawConn) error
+	if ctx.TProxy {
+		tproxy = transparentControl
 	}
+	config := net.ListenConfig{KeepAlive: ctx.ClientKeepAlive, Control: socketControls(reusePort, fastOpen, tproxy, mssControl(ctx.MSS.Client))}
+	listener, err := config.Listen(context.Background(), "tcp", host)
+	// Keep trying while the address is held (by a previous instance shutting down, for example)
+	deadline := time.Now().Add(ctx.ListenRetry)
+	for err != nil && errors.Is(err, syscall.EADDRINUSE) && time.Now().Before(deadline) {
+		if ctx.Logger != nil {
+			ctx.Logger <- fmt.Sprintf(" [*] Address in use, retrying: %s\n", host)
+		}
+		time.Sleep(time.Second)
+		listener, err = config.Listen(context.Background(), "tcp", host)
+	}
+	return listener, err
+}
+
+// Accept clients on one listener until it is closed
+func (ctx *Context) accept(listener net.Listener, address string) {
 	for {
 		connection, err := listener.Accept()
 		if err != nil {
-			break
+			if !errors.Is(err, net.ErrClosed) && ctx.Logger != nil {
+				ctx.Logger <- fmt.Sprintf(" [!] Stopped accepting on %s: %s\n", address, err.Error())
+			}
+			return
+		}
+		ctx.metrics().Counter("connections_total", 1, ctx.metricLabels())
+		// Refuse clients beyond the connection limit
+		if limit := ctx.tunedInt(&ctx.MaxConnections); limit > 0 && atomic.LoadInt64(&ctx.clients) >= int64(limit) {
+			if ctx.Logger != nil {
+				ctx.Logger <- fmt.Sprintf(" [!] Connection limit reached on %s, refusing: %s\n", address, connection.RemoteAddr().String())
+			}
+			ctx.metrics().Counter("connections_refused_total", 1, ctx.metricLabels("reason", "listener"))
+			connection.Close()
+			continue
+		}
+		if ctx.Tenant != nil && ctx.Tenant.full() {
+			if ctx.Logger != nil {
+				ctx.Logger <- fmt.Sprintf(" [!] Tenant connection limit reached (%s) on %s, refusing: %s\n", ctx.Tenant.Name, address, connection.RemoteAddr().String())
+			}
+			ctx.metrics().Counter("connections_refused_total", 1, ctx.metricLabels("reason", "tenant"))
+			connection.Close()
+			continue
 		}
-		ctx.ClientConnections <- ClientCtx{Ctx: *ctx, Client: Connection{Connection: connection}}
+		ctx.countClient(1)
+		ctx.ClientConnections <- &ClientCtx{Ctx: ctx, Client: Connection{Connection: connection}, Listener: address}
 	}
-	return err
+}
+
+// Dialer for outbound connections to a host (clamped to the route's MSS)
+func (ctx *Context) dialer(host string) *net.Dialer {
+	return &net.Dialer{KeepAlive: ctx.RemoteKeepAlive, Control: mssControl(ctx.MSS.MSS(host))}
+}
+
+// Dialer for outbound proxies, which are always written to first, so Fast Open can save a round trip
+func (ctx *Context) upstreamDialer(proxy ProxyInfo) *net.Dialer {
+	dialer := ctx.dialer(proxy.Host)
+	if proxy.MSS > 0 {
+		// The proxy's own setting takes precedence over the routes
+		dialer.Control = mssControl(proxy.MSS)
+	}
+	if client, _ := FastOpenSupport(); ctx.FastOpen && client {
+		dialer.Control = socketControls(fastOpenDial, dialer.Control)
+	}
+	return dialer
 }
 
 // HandleClients waits for client connections via the specified channel
@@ -74,55 +316,20 @@ func (ctx *Context) HandleClients() {
 			return
 		}
 		host, port, err := net.SplitHostPort(client.Client.Connection.RemoteAddr().String())
-		if err != nil {
-			return
+		if err == nil {
+			client.Client.Host = host
+			client.Client.Port, err = strconv.Atoi(port)
+			client.Origin = ctx.Origins.Classify(host)
 		}
-		client.Client.Host = host
-		client.Client.Port, err = strconv.Atoi(port)
 		if err != nil {
-			return
+			client.Client.Connection.Close()
+			ctx.countClient(-1)
+			continue
 		}
 		go client.processClient()
 	}
 }
 
-// ProxyInfo for outbound SOCKS5 servers
-type ProxyInfo struct {
-	Host     string `json:"host"`
-	Port     int    `json:"port"`
-	UseTLS   bool   `json:"usetls"`
-	Username string `json:"username"`
-	Password string `json:"password"`
-}
-
-// ProxyPool for known outbound SOCKS5 servers
-type ProxyPool struct {
-	Hosts []ProxyInfo
-}
-
-// LoadFile retrieves a SOCKS5 connection list from a file
-func (ctx *ProxyPool) LoadFile(file string) bool {
-	input, err := os.Open(file)
-	if err != nil {
-		return false
-	}
-	defer input.Close()
-	finfo, err := input.Stat()
-	if err != nil {
-		return false
-	}
-	data := make([]byte, finfo.Size())
-	_, err = input.Read(data)
-	if err != nil {
-		return false
-	}
-	err = json.Unmarshal(data, &ctx.Hosts)
-	if err != nil {
-		return false
-	}
-	return true
-}
-
 // Connection information
 type Connection struct {
 	Host       string
@@ -131,28 +338,92 @@ type Connection struct {
 	Reader     *bufio.Reader
 	Writer     *bufio.Writer
 	ReadCount  uint64
+	limit      *bandwidthLimit
+	relaying   int64 // Size of the buffer relaying from this side
+	tenant     *Tenant
+}
+
+// Count bytes read from this side, reporting whether the tenant's quota is used up
+func (ctx *Connection) count(bytes int) bool {
+	atomic.AddUint64(&ctx.ReadCount, uint64(bytes))
+	return ctx.tenant.transfer(uint64(bytes))
 }
 
 // CopyData between connections
 func (ctx *Connection) CopyData(other *Connection, wait *sync.WaitGroup) {
 	defer wait.Done()
+	// Copy in chunks so the byte counts are current while the session is active
+	limit := ctx.limit
+	if limit == nil {
+		limit = other.limit
+	}
+	buffer := make([]byte, limit.chunk(32*1024))
+	atomic.StoreInt64(&other.relaying, int64(len(buffer)))
+	defer atomic.StoreInt64(&other.relaying, 0)
 	for {
-		n, err := io.Copy(ctx.Writer, other.Reader)
-		if err != nil || n <= 0 {
+		n, err := other.Reader.Read(buffer)
+		if n > 0 {
+			exhausted := other.count(n)
+			limit.wait(n)
+			_, werr := ctx.Writer.Write(buffer[:n])
+			if werr == nil {
+				werr = ctx.Writer.Flush()
+			}
+			if werr != nil {
+				err = werr
+			}
+			if exhausted && err == nil {
+				// The tenant's quota ran out with this chunk
+				err = ErrQuotaExceeded
+			}
+		}
+		if err == io.EOF && ctx.Writer.Flush() == nil {
+			// Pass the half-close along once everything buffered is out, so the other peer sees the end of the stream
+			if conn, ok := ctx.Connection.(interface{ CloseWrite() error }); ok {
+				conn.CloseWrite()
+				return
+			}
+		}
+		if err != nil {
+			// A peer vanished (reset, keepalive timeout), so tear down both sides
+			ctx.Connection.Close()
+			other.Connection.Close()
 			return
 		}
-		other.ReadCount += uint64(n)
 	}
 }
 
 // ClientCtx for client connections
 type ClientCtx struct {
 	sync.Mutex
-	Ctx         Context
+	Ctx         *Context
 	Client      Connection
 	Remote      Connection
+	User        string
+	Version     byte
+	Command     byte
 	RequestData []byte
 	Proxy       ProxyInfo
+	Started     time.Time
+	Err         error
+	warned      bool
+	draining    bool
+	trace       *tracer
+	initialData []byte
+	forward     bool
+	served      bool
+	serverName  string
+	tunneled    bool
+	exempt      bool
+	route       string
+	via         string
+	deviations  map[string]bool
+	sockets     int32
+	dialTime    time.Duration
+	connected   time.Time
+	greeted     time.Duration
+	Origin      *Origin
+	Listener    string
 }
 
 // processInbound connections
@@ -161,6 +432,12 @@ func (ctx *ClientCtx) processInbound() (err error) {
 	state := 0
 	store := 0
 	data := byte(0)
+	var methods []byte
+
+	// Redirected clients never send a request
+	if ctx.Ctx.Transparent {
+		return ctx.processTransparent()
+	}
 
 	// Execute state machine
 	for state < 13 {
@@ -172,15 +449,51 @@ func (ctx *ClientCtx) processInbound() (err error) {
 
 		switch state {
 		case 0:
+			// A dedicated HTTP listener takes every client as an HTTP proxy request
+			if ctx.Ctx.HTTPOnly && !ctx.tunneled {
+				if data < 'A' || data > 'Z' {
+					// Not a request line, so there is no point waiting for one to end
+					ctx.Version = versionHTTP
+					ctx.sendHTTP(400, "Bad Request")
+					return fmt.Errorf("%w: client sent %#x to HTTP listener from: %s", ErrProtocolMismatch, data, ctx.Client.Host)
+				}
+				ctx.Client.Reader.UnreadByte()
+				return ctx.processHTTP()
+			}
 			// Version 5
 			if data == 0x05 {
+				ctx.Version = data
 				state = 1
 				break
 			}
-			err = fmt.Errorf("invalid data(0) from: %s", ctx.Client.Host)
+			// Version 4 (and 4a) has its own request format
+			if data == 0x04 {
+				if ctx.authRequired() {
+					// SOCKS4 has no way to authenticate
+					ctx.Version = data
+					ctx.sendFailure(0x02)
+					return fmt.Errorf("%w: SOCKS4 client from: %s", ErrAuthFailed, ctx.Client.Host)
+				}
+				return ctx.processSocks4()
+			}
+			// HTTP proxy requests and WebSocket upgrades, from the first letter of the method (only when enabled for the listener)
+			if data >= 'A' && data <= 'Z' && (ctx.Ctx.HTTPConnect || len(ctx.Ctx.WebSocket) > 0) && !ctx.tunneled {
+				ctx.Client.Reader.UnreadByte()
+				return ctx.processHTTP()
+			}
+			// Version 6 (experimental, only when enabled for the listener)
+			if data == 0x06 && ctx.Ctx.Socks6 {
+				return ctx.processSocks6()
+			}
+			err = ctx.detectMismatch(data)
 			state = 13
 		case 1:
 			// Number of supported authentication methods
+			if limit := ctx.Ctx.tunedInt(&ctx.Ctx.MaxMethods); limit > 0 && int(data) > limit {
+				err = fmt.Errorf("%w: %d methods offered (limit %d) from: %s", ErrMalformedRequest, data, limit, ctx.Client.Host)
+				state = 13
+				break
+			}
 			if data > 0 {
 				store = int(data)
 				state = 2
@@ -189,20 +502,42 @@ func (ctx *ClientCtx) processInbound() (err error) {
 			err = fmt.Errorf("invalid data(1) from: %s", ctx.Client.Host)
 			state = 13
 		case 2:
-			// Authentication methods (ignored for now)
+			// Authentication methods
+			methods = append(methods, data)
 			store--
 			if store > 0 {
 				break
 			}
 			fallthrough
 		case 3:
-			// Respond with no authenticaiton required
-			_, err = ctx.Client.Writer.Write([]byte{0x05, 0x00})
+			// Orderly negotiation waits for the method before sending anything more
+			if ctx.sentAhead() {
+				err = ctx.deviate("negotiation", "data sent before a method was selected")
+				if err != nil {
+					ctx.Client.Writer.Write([]byte{0x05, 0xFF})
+					ctx.Client.Writer.Flush()
+					state = 13
+					break
+				}
+			}
+			// Reply only once the whole list has been read, with the best method both sides support
+			method := ctx.Ctx.selectMethod(methods, ctx.authRequired())
+			_, err = ctx.Client.Writer.Write([]byte{0x05, method})
+			if err == nil {
+				err = ctx.Client.Writer.Flush()
+			}
 			if err != nil {
 				state = 13
 				break
 			}
-			err = ctx.Client.Writer.Flush()
+			switch method {
+			case 0xFF:
+				err = fmt.Errorf("%w: no acceptable method offered from: %s", ErrAuthFailed, ctx.Client.Host)
+			case 0x01:
+				err = ctx.authenticateGSS()
+			case 0x02:
+				err = ctx.authenticate()
+			}
 			if err != nil {
 				state = 13
 				break
@@ -217,16 +552,25 @@ func (ctx *ClientCtx) processInbound() (err error) {
 			err = fmt.Errorf("invalid data(4) from: %s", ctx.Client.Host)
 			state = 13
 		case 5:
-			// Connect command
-			if data == 0x01 {
-				state = 6
+			// Connect, bind, UDP associate or Tor resolve command
+			if !supportedCommand(data) && ctx.Ctx.DropUnsupported {
+				// Give nothing away to clients probing for commands
+				err = fmt.Errorf("%w (%d) from: %s", ErrUnsupportedCommand, data, ctx.Client.Host)
+				state = 13
 				break
 			}
-			// Ignore other commands
-			err = fmt.Errorf("invalid data(5) from: %s", ctx.Client.Host)
-			state = 13
+			// Other commands are refused once the whole request has been read
+			ctx.Command = data
+			state = 6
 		case 6:
-			// Reserved
+			// Reserved (must be zero)
+			if data != 0x00 {
+				err = ctx.deviate("reserved", fmt.Sprintf("reserved byte is %d", data))
+				if err != nil {
+					state = 13
+					break
+				}
+			}
 			ctx.RequestData = append(ctx.RequestData, data)
 			state = 7
 		case 7:
@@ -246,6 +590,13 @@ func (ctx *ClientCtx) processInbound() (err error) {
 				store = 16
 				state = 11
 			}
+			if state == 7 {
+				// Respond with address type not supported (0x08), with an empty IPv4 address in place of the unknown one
+				ctx.RequestData = []byte{0x00, 0x01, 0x00, 0x00, 0x00, 0x00}
+				ctx.sendFailure(0x08)
+				err = fmt.Errorf("%w: address type %d from: %s", ErrMalformedRequest, data, ctx.Client.Host)
+				state = 13
+			}
 		case 8:
 			// IPv4
 			ctx.RequestData = append(ctx.RequestData, data)
@@ -259,11 +610,30 @@ func (ctx *ClientCtx) processInbound() (err error) {
 			}
 		case 9:
 			// Domain name length
+			if data == 0 {
+				err = ctx.deviate("domain-length", "empty domain name")
+				if err != nil {
+					state = 13
+					break
+				}
+			}
 			ctx.RequestData = append(ctx.RequestData, data)
 			store = int(data)
 			state = 10
+			if store == 0 {
+				// Nothing to read, the port follows
+				store = 2
+				state = 12
+			}
 		case 10:
-			// Domain name
+			// Domain name (no spaces or control characters)
+			if data <= 0x20 || data == 0x7F {
+				err = ctx.deviate("domain-name", fmt.Sprintf("character %#x in domain name", data))
+				if err != nil {
+					state = 13
+					break
+				}
+			}
 			ctx.RequestData = append(ctx.RequestData, data)
 			store--
 			ctx.Remote.Host += string([]byte{data})
@@ -272,14 +642,11 @@ func (ctx *ClientCtx) processInbound() (err error) {
 				state = 12
 			}
 		case 11:
-			// IPv6
+			// IPv6 (formatted once complete, the wire form has no zone)
 			ctx.RequestData = append(ctx.RequestData, data)
 			store--
-			ctx.Remote.Host += hex.EncodeToString([]byte{data})
-			if store > 0 && store%2 == 0 {
-				ctx.Remote.Host += ":"
-			}
 			if store == 0 {
+				ctx.Remote.Host = net.IP(ctx.RequestData[len(ctx.RequestData)-16:]).String()
 				store = 2
 				state = 12
 			}
@@ -293,118 +660,115 @@ func (ctx *ClientCtx) processInbound() (err error) {
 			}
 		}
 	}
+	if err == nil && !supportedCommand(ctx.Command) {
+		// Respond with command not supported (0x07), echoing the requested address
+		ctx.sendFailure(0x07)
+		err = fmt.Errorf("%w (%d) from: %s", ErrUnsupportedCommand, ctx.Command, ctx.Client.Host)
+	}
 	return err
 }
 
-// processOutbound connection
-func (ctx *ClientCtx) processOutbound() (err error) {
-	// State machine variables
-	state := 0
-	store := 0
-	data := byte(0)
-	proxyport := uint16(0)
-	var response []byte
+// Whether a SOCKS5 command is handled (connect, bind, UDP associate or Tor resolve)
+func supportedCommand(command byte) bool {
+	switch command {
+	case 0x01, 0x02, 0x03, CommandResolve, CommandResolvePTR:
+		return true
+	}
+	return false
+}
 
-	// If no proxy list is available, connect to the destination directly and return
-	if len(ctx.Ctx.Proxies.Hosts) == 0 {
-		ctx.Remote.Connection, err = net.Dial("tcp", net.JoinHostPort(ctx.Remote.Host, strconv.Itoa(ctx.Remote.Port)))
-		if err == nil {
-			ctx.Remote.Reader = bufio.NewReader(ctx.Remote.Connection)
-			ctx.Remote.Writer = bufio.NewWriter(ctx.Remote.Connection)
-			// Get local port
-			proxyport = uint16(ctx.Remote.Connection.LocalAddr().(*net.TCPAddr).Port)
-			// Respond with success (version = 0x05, result = 0x00, reserved = 0x00)
-			ctx.Client.Writer.Write([]byte{0x05, 0x00, 0x00})
-			// Add the proxy IP
-			reportIP := ctx.Ctx.ReportIP.To4()
-			if reportIP != nil {
-				// Type IPv4
-				ctx.Client.Writer.Write([]byte{0x01})
-				ctx.Client.Writer.Write(reportIP)
-			} else {
-				// Type IPv6
-				ctx.Client.Writer.Write([]byte{0x04})
-				ctx.Client.Writer.Write(ctx.Ctx.ReportIP)
-			}
-			// Local port
-			ctx.Client.Writer.Write([]byte{byte((proxyport >> 8) & 0xFF), byte(proxyport & 0xFF)})
-			ctx.Client.Writer.Flush()
-		} else {
-			// Respond with general error (0x01)
-			ctx.Client.Writer.Write([]byte{0x05, 0x01})
-			ctx.Client.Writer.Write(ctx.RequestData)
-			// Local port is undefined
-			ctx.Client.Writer.Write([]byte{0x00, 0x00})
-			ctx.Client.Writer.Flush()
-			ctx.Ctx.logError(err)
-		}
+// Send the request (connect, bind or resolve) to the outbound proxy
+func (ctx *ClientCtx) sendConnect() (err error) {
+	// Built from the parsed request, so nothing the client sent is forwarded as is
+	address, err := encodeAddress(ctx.Remote.Host)
+	if err != nil {
+		return err
+	}
+	request := append([]byte{0x05, ctx.Command, 0x00}, address...)
+	request = append(request, byte((ctx.Remote.Port>>8)&0xFF), byte(ctx.Remote.Port&0xFF))
+	_, err = ctx.Remote.Writer.Write(request)
+	if err != nil {
 		return err
 	}
+	return ctx.Remote.Writer.Flush()
+}
 
-	// Select an outbound proxy at random
-	ctx.Proxy = ctx.Ctx.Proxies.Hosts[rand.Intn(len(ctx.Ctx.Proxies.Hosts))]
-	if len(ctx.Proxy.Username) > 255 || len(ctx.Proxy.Password) > 255 {
-		// Respond with general error (0x01)
-		ctx.Client.Writer.Write([]byte{0x05, 0x01})
-		ctx.Client.Writer.Write(ctx.RequestData)
-		// Local port is undefined
-		ctx.Client.Writer.Write([]byte{0x00, 0x00})
-		ctx.Client.Writer.Flush()
-		ctx.Ctx.logError(err)
-		return fmt.Errorf("provided username or password is too long: %s", ctx.Proxy.Host)
+// Send username and password to the outbound proxy (sub-negotiation is version 0x01)
+func (ctx *ClientCtx) sendCredentials() (err error) {
+	_, err = ctx.Remote.Writer.Write([]byte{0x01, byte(len(ctx.Proxy.Username))})
+	if err != nil {
+		return err
 	}
+	_, err = ctx.Remote.Writer.Write([]byte(ctx.Proxy.Username))
+	if err != nil {
+		return err
+	}
+	_, err = ctx.Remote.Writer.Write([]byte{byte(len(ctx.Proxy.Password))})
+	if err != nil {
+		return err
+	}
+	_, err = ctx.Remote.Writer.Write([]byte(ctx.Proxy.Password))
+	return err
+}
+
+// Whether a pipelined handshake failed in a way that waiting for each reply might avoid
+func pipelineFailure(err error) bool {
+	var unreachable *ErrUpstreamUnreachable
+	var failed *ErrCommandFailed
+	return !errors.As(err, &unreachable) && !errors.As(err, &failed) && !errors.Is(err, ErrAuthFailed)
+}
+
+// Connect to the selected outbound proxy and negotiate the request, returning the proxy's reply
+func (ctx *ClientCtx) negotiateUpstream(pipeline bool) (response []byte, err error) {
+	// State machine variables
+	state := 0
+	store := 0
+	data := byte(0)
 
 	// Connect to proxy
+	started := time.Now()
 	if ctx.Proxy.UseTLS {
-		ctx.Remote.Connection, err = tls.Dial("tcp", net.JoinHostPort(ctx.Proxy.Host, strconv.Itoa(ctx.Proxy.Port)), &tls.Config{
+		ctx.Remote.Connection, err = tls.DialWithDialer(ctx.Ctx.upstreamDialer(ctx.Proxy), "tcp", net.JoinHostPort(ctx.Proxy.Host, strconv.Itoa(ctx.Proxy.Port)), &tls.Config{
 			//InsecureSkipVerify: true,
 		})
 	} else {
-		ctx.Remote.Connection, err = net.Dial("tcp", net.JoinHostPort(ctx.Proxy.Host, strconv.Itoa(ctx.Proxy.Port)))
+		ctx.Remote.Connection, err = ctx.Ctx.upstreamDialer(ctx.Proxy).Dial("tcp", net.JoinHostPort(ctx.Proxy.Host, strconv.Itoa(ctx.Proxy.Port)))
 	}
 	if err != nil {
-		// Respond with general error (0x01)
-		ctx.Client.Writer.Write([]byte{0x05, 0x01})
-		ctx.Client.Writer.Write(ctx.RequestData)
-		// Local port is undefined
-		ctx.Client.Writer.Write([]byte{0x00, 0x00})
-		ctx.Client.Writer.Flush()
-		ctx.Ctx.logError(err)
-		return err
+		return nil, &ErrUpstreamUnreachable{Proxy: ctx.Proxy.Host, Err: err}
 	}
+	ctx.dialTime, ctx.connected, ctx.greeted = time.Since(started), time.Now(), 0
 
 	// Setup reader/writer
-	ctx.Remote.Reader = bufio.NewReader(ctx.Remote.Connection)
-	ctx.Remote.Writer = bufio.NewWriter(ctx.Remote.Connection)
+	ctx.remoteIO()
+	if ctx.Proxy.httpConnect() {
+		return ctx.negotiateHTTPUpstream()
+	}
+	if ctx.Proxy.socks4() {
+		return ctx.negotiateSOCKS4Upstream()
+	}
+	if transport, ok := lookupUpstreamTransport(ctx.Proxy.Type); ok {
+		return ctx.negotiateTransport(transport)
+	}
 
 	// Send initial SOCK5 request
-	authType := byte(0) // No authentication
-	if len(ctx.Proxy.Username) > 0 || len(ctx.Proxy.Password) > 0 {
-		authType = byte(2) // User/pass auth type
-	}
+	authType := ctx.Proxy.method()
 	_, err = ctx.Remote.Writer.Write([]byte{0x05, 0x01, authType})
-	if err != nil {
-		// Respond with general error (0x01)
-		ctx.Client.Writer.Write([]byte{0x05, 0x01})
-		ctx.Client.Writer.Write(ctx.RequestData)
-		// Local port is undefined
-		ctx.Client.Writer.Write([]byte{0x00, 0x00})
-		ctx.Client.Writer.Flush()
-		ctx.Ctx.logError(err)
-		ctx.Remote.Connection.Close()
-		return err
+	if err == nil && pipeline {
+		// Send the sub-negotiation and the request without waiting for the replies
+		if authType == 0x02 {
+			err = ctx.sendCredentials()
+		}
+		if err == nil {
+			err = ctx.sendConnect()
+		}
+	}
+	if err == nil {
+		err = ctx.Remote.Writer.Flush()
 	}
-	err = ctx.Remote.Writer.Flush()
 	if err != nil {
-		// Respond with general error (0x01)
-		ctx.Client.Writer.Write([]byte{0x05, 0x01})
-		ctx.Client.Writer.Write(ctx.RequestData)
-		// Local port is undefined
-		ctx.Client.Writer.Write([]byte{0x00, 0x00})
-		ctx.Client.Writer.Flush()
-		ctx.Ctx.logError(err)
 		ctx.Remote.Connection.Close()
-		return err
+		return nil, err
 	}
 
 	// Execute state machine
@@ -426,41 +790,50 @@ func (ctx *ClientCtx) processOutbound() (err error) {
 			err = fmt.Errorf("invalid data(0) from: %s", ctx.Proxy.Host)
 			state = 15
 		case 1:
-			// Authentication method
-			if data == authType {
-				state = 2
-			} else {
+			// Authentication method, timed as the probes time it (the rest of the handshake waits on the destination)
+			ctx.greeted = time.Since(ctx.connected)
+			if data != authType {
 				err = fmt.Errorf("authentication method not supported: %s", ctx.Proxy.Host)
 				state = 15
 				break
 			}
-			fallthrough
-		case 2:
-			// Send username and password (sub-negotiation is version 0x01)
-			_, err = ctx.Remote.Writer.Write([]byte{0x01, byte(len(ctx.Proxy.Username))})
-			if err != nil {
-				state = 15
-				break
-			}
-			_, err = ctx.Remote.Writer.Write([]byte(ctx.Proxy.Username))
-			if err != nil {
-				state = 15
-				break
-			}
-			_, err = ctx.Remote.Writer.Write([]byte{byte(len(ctx.Proxy.Password))})
-			if err != nil {
-				state = 15
-				break
+			if authType == 0x01 {
+				// GSS-API sub-negotiation, after which everything is encapsulated
+				var protected net.Conn
+				protected, err = ctx.Proxy.initiateGSS(ctx.Remote.Connection, ctx.Remote.Reader)
+				if err != nil {
+					state = 15
+					break
+				}
+				ctx.Remote.Connection = protected
+				ctx.Remote.Reader = bufio.NewReader(protected)
+				ctx.Remote.Writer = bufio.NewWriter(protected)
 			}
-			_, err = ctx.Remote.Writer.Write([]byte(ctx.Proxy.Password))
-			if err != nil {
-				state = 15
+			if authType != 0x02 {
+				// No further sub-negotiation, go straight to the connect command
+				if !pipeline {
+					err = ctx.sendConnect()
+				}
+				if err != nil {
+					state = 15
+					break
+				}
+				state = 6
 				break
 			}
-			err = ctx.Remote.Writer.Flush()
-			if err != nil {
-				state = 15
-				break
+			state = 2
+			fallthrough
+		case 2:
+			// Send username and password (unless already sent)
+			if !pipeline {
+				err = ctx.sendCredentials()
+				if err == nil {
+					err = ctx.Remote.Writer.Flush()
+				}
+				if err != nil {
+					state = 15
+					break
+				}
 			}
 			state = 3
 		case 3:
@@ -476,34 +849,19 @@ func (ctx *ClientCtx) processOutbound() (err error) {
 			if data == 0x00 {
 				state = 5
 			} else {
-				err = fmt.Errorf("authentication failed: %s (%d)", ctx.Proxy.Host, data)
+				err = fmt.Errorf("%w: %s (%d)", ErrAuthFailed, ctx.Proxy.Host, data)
 				state = 15
 				break
 			}
 			fallthrough
 		case 5:
-			// Send connect command
-			_, err = ctx.Remote.Writer.Write([]byte{0x05, 0x01})
-			if err != nil {
-				state = 15
-				break
-			}
-			// Resend the original request info, but without the port
-			_, err = ctx.Remote.Writer.Write(ctx.RequestData)
-			if err != nil {
-				state = 15
-				break
-			}
-			// Add the port
-			_, err = ctx.Remote.Writer.Write([]byte{byte((ctx.Remote.Port >> 8) & 0xFF), byte(ctx.Remote.Port & 0xFF)})
-			if err != nil {
-				state = 15
-				break
-			}
-			err = ctx.Remote.Writer.Flush()
-			if err != nil {
-				state = 15
-				break
+			// Send connect command (unless already sent)
+			if !pipeline {
+				err = ctx.sendConnect()
+				if err != nil {
+					state = 15
+					break
+				}
 			}
 			state = 6
 		case 6:
@@ -520,7 +878,7 @@ func (ctx *ClientCtx) processOutbound() (err error) {
 				state = 8
 				break
 			}
-			err = fmt.Errorf("command failed: %d", data)
+			err = &ErrCommandFailed{Proxy: ctx.Proxy.Host, Code: data}
 			state = 15
 		case 8:
 			// Reserved
@@ -543,6 +901,10 @@ func (ctx *ClientCtx) processOutbound() (err error) {
 				store = 16
 				state = 13
 			}
+			if state == 9 {
+				err = fmt.Errorf("invalid address type from: %s", ctx.Proxy.Host)
+				state = 15
+			}
 		case 10:
 			// IPv4
 			response = append(response, data)
@@ -581,63 +943,311 @@ func (ctx *ClientCtx) processOutbound() (err error) {
 			}
 		}
 	}
-	if err == nil {
-		// Respond with success (0x00)
-		ctx.Client.Writer.Write([]byte{0x05, 0x00})
-		// Send response from remote proxy
-		ctx.Client.Writer.Write(response)
-		ctx.Client.Writer.Flush()
-	} else {
-		// This hides the error from the remote proxy (by design)
-		// Respond with general error (0x01)
-		ctx.Client.Writer.Write([]byte{0x05, 0x01})
-		ctx.Client.Writer.Write(ctx.RequestData)
-		// Local port is undefined
-		ctx.Client.Writer.Write([]byte{0x00, 0x00})
-		ctx.Client.Writer.Flush()
-		ctx.Ctx.logError(err)
+	if err != nil {
 		ctx.Remote.Connection.Close()
 	}
-	return err
+	return response, err
+}
+
+// processOutbound connection
+func (ctx *ClientCtx) processOutbound() (err error) {
+	proxyport := uint16(0)
+
+	// Select an outbound proxy at random, honoring the policy's route or else the user's preferred exit (within the routing table's route)
+	ctx.applyRoutes()
+	preference := ctx.Ctx.ExitPreference(ctx.Identity())
+	if len(ctx.route) > 0 {
+		preference = ctx.route
+	}
+	// Proxies that failed this request, which is retried through others while the budget lasts
+	tried := make(map[ProxyInfo]bool)
+	var failure error
+	// Direct routes and bypassed destinations are connected directly by design, even in strict egress mode
+	direct := ctx.route == policy.Direct || ctx.Ctx.Bypass.Matches(ctx.Remote.Host)
+	for {
+		proxy, err := ProxyInfo{}, errNoProxies
+		// A zone names an interface on this host, which no outbound proxy can use
+		if !direct && !zoned(ctx.Remote.Host) {
+			proxy, err = ctx.Ctx.Proxies.selectFor(ctx.Remote.Host, preference, ctx.via, tried)
+		}
+		if err != nil && failure != nil {
+			// No other proxy to retry through
+			break
+		}
+		if err != nil && err != errNoProxies {
+			if len(ctx.via) > 0 {
+				err = fmt.Errorf("%w routed via %s: %s -> %s:%d", err, ctx.via, ctx.Identity(), ctx.Remote.Host, ctx.Remote.Port)
+			}
+			// Respond with general error (0x01)
+			ctx.sendFailure(0x01)
+			ctx.Ctx.logError(err)
+			return err
+		}
+
+		if err == errNoProxies && !direct && ctx.Ctx.StrictEgress {
+			return ctx.refuseDirect()
+		}
+
+		// If no proxy list is available, connect to the destination directly and return
+		if err == errNoProxies {
+			ctx.Remote.Connection, err = ctx.Ctx.dialDirect(ctx.directDialer(), ctx.Remote.Host, ctx.Remote.Port)
+			if err == nil {
+				ctx.remoteIO()
+				// Get local port
+				proxyport = uint16(ctx.Remote.Connection.LocalAddr().(*net.TCPAddr).Port)
+				// Respond with success and the proxy address
+				ctx.sendAddress(ctx.Ctx.ReportHost, ctx.Ctx.ReportIP, int(proxyport))
+			} else {
+				// Respond with the reason the destination could not be reached
+				ctx.sendFailure(replyCode(err))
+				ctx.Ctx.logError(err)
+			}
+			return err
+		}
+
+		if failure != nil && ctx.Ctx.Logger != nil {
+			ctx.Ctx.Logger <- fmt.Sprintf(" [*] Retrying through %s:%d (%d of %d): %s -> %s:%d\n", proxy.Host, proxy.Port, len(tried), ctx.Ctx.UpstreamRetries, ctx.Identity(), ctx.Remote.Host, ctx.Remote.Port)
+		}
+		ctx.Proxy = proxy
+		if len(ctx.Proxy.Username) > 255 || len(ctx.Proxy.Password) > 255 {
+			// Respond with general error (0x01)
+			ctx.sendFailure(0x01)
+			err = fmt.Errorf("provided username or password is too long: %s", ctx.Proxy.Host)
+			ctx.Ctx.logError(err)
+			return err
+		}
+		if !ctx.Proxy.socks5() && ctx.Command != 0x01 {
+			// Other types of proxy are only used for tunnels, not to bind or resolve
+			// Respond with command not supported (0x07)
+			ctx.sendFailure(0x07)
+			err = fmt.Errorf("%w: command %d through %s proxy %s from: %s", ErrUnsupportedCommand, ctx.Command, strings.ToLower(ctx.Proxy.Type), ctx.Proxy.Host, ctx.Client.Host)
+			ctx.Ctx.logError(err)
+			return err
+		}
+		if ctx.Proxy.socks4() && addressType(ctx.Remote.Host) == 0x04 {
+			// Respond with address type not supported (0x08)
+			ctx.sendFailure(0x08)
+			err = fmt.Errorf("%w: IPv6 destination through SOCKS4 proxy %s from: %s", ErrUnsupportedCommand, ctx.Proxy.Host, ctx.Client.Host)
+			ctx.Ctx.logError(err)
+			return err
+		}
+
+		response, err := ctx.connectUpstream()
+		if err == nil {
+			ctx.Ctx.Proxies.recordLatency(ctx.Proxy, ctx.dialTime, ctx.greeted)
+			ctx.Ctx.Proxies.stick(ctx.Remote.Host, ctx.Proxy)
+			// Respond with success (0x00) and the response from the remote proxy
+			ctx.sendReply(0x00, response)
+			return nil
+		}
+		ctx.Ctx.Proxies.recordError(ctx.Proxy, err)
+		if replyCode(err) == 0x01 {
+			ctx.Ctx.Proxies.penalizeLatency(ctx.Proxy)
+		}
+		ctx.Ctx.logError(err)
+		failure = err
+		tried[proxy] = true
+		// Only failures of the proxy itself are worth retrying, the destination refusing would likely refuse again
+		if replyCode(err) != 0x01 || len(tried) > ctx.Ctx.UpstreamRetries {
+			break
+		}
+	}
+	// This hides the error from the remote proxy (by design), except for why the destination was unreachable
+	ctx.sendFailure(replyCode(failure))
+	return failure
+}
+
+// Negotiate a tunnel with the selected outbound proxy, pipelining the handshake with proxies that tolerate it and falling back to waiting for each reply
+func (ctx *ClientCtx) connectUpstream() ([]byte, error) {
+	pipeline := ctx.Proxy.Pipeline && ctx.Proxy.method() != 0x01 && ctx.Proxy.socks5() && !ctx.Ctx.Proxies.Status(ctx.Proxy).NoPipeline
+	response, err := ctx.negotiateUpstream(pipeline)
+	if err != nil && pipeline && pipelineFailure(err) {
+		ctx.Ctx.Proxies.updateStatus(ctx.Proxy, func(status *ProxyStatus) {
+			status.NoPipeline = true
+		})
+		if ctx.Ctx.Logger != nil {
+			ctx.Ctx.Logger <- fmt.Sprintf(" [*] Pipelining failed with %s:%d, no longer pipelining (%s)\n", ctx.Proxy.Host, ctx.Proxy.Port, err.Error())
+		}
+		response, err = ctx.negotiateUpstream(false)
+	}
+	// Rejected credentials are counted apart from connectivity failures, which say nothing about the account
+	if errors.Is(err, ErrAuthFailed) {
+		ctx.Ctx.authFailed(ctx.Proxy, err)
+	} else if err == nil {
+		ctx.Ctx.Proxies.authSucceeded(ctx.Proxy)
+	}
+	if err == nil && ctx.Ctx.VerifyUpstream {
+		err = ctx.verifyReply(response)
+		if err != nil {
+			ctx.Remote.Connection.Close()
+		}
+	}
+	return response, err
 }
 
 // Background thread to process a client connection
 func (ctx *ClientCtx) processClient() {
+	defer ctx.Ctx.countClient(-1)
 	defer ctx.Client.Connection.Close()
+	ctx.startTrace()
+	defer ctx.endTrace()
+	if ctx.Origin.Deny {
+		if ctx.Ctx.Logger != nil {
+			ctx.Ctx.Logger <- fmt.Sprintf(" [!] Refusing client from %s network: %s\n", ctx.Origin.Name, ctx.Client.Connection.RemoteAddr().String())
+		}
+		ctx.Ctx.metrics().Counter("connections_refused_total", 1, ctx.metricLabels("reason", "origin"))
+		return
+	}
 	// Client IO
 	ctx.Client.Reader = bufio.NewReader(ctx.Client.Connection)
 	ctx.Client.Writer = bufio.NewWriter(ctx.Client.Connection)
 
-	// Process client request
-	err := ctx.processInbound()
+	// Process client request (a partial handshake may only hold the connection for so long)
+	if timeout := ctx.Ctx.tuned(&ctx.Ctx.HandshakeTimeout); timeout > 0 {
+		ctx.Client.Connection.SetDeadline(time.Now().Add(timeout))
+	}
+	err := ctx.authenticateCertificate()
+	if err == nil {
+		err = ctx.processInbound()
+	}
 	if err != nil {
 		if ctx.Ctx.Logger != nil {
-			ctx.Ctx.Logger <- fmt.Sprintf(" [!] Invalid request from: %s (%s)\n", ctx.Client.Connection.RemoteAddr().String(), err.Error())
+			if class := errorClass(err); class == "malformed" || class == "timeout" {
+				ctx.Ctx.Logger <- fmt.Sprintf(" [!] Closing abusive client: %s (%s)\n", ctx.Client.Connection.RemoteAddr().String(), err.Error())
+			} else {
+				ctx.Ctx.Logger <- fmt.Sprintf(" [!] Invalid request from: %s (%s)\n", ctx.Client.Connection.RemoteAddr().String(), err.Error())
+			}
 		}
+		ctx.Ctx.metrics().Counter("handshake_failures_total", 1, ctx.metricLabels("class", errorClass(err)))
+		ctx.fail(err)
+		return
+	}
+	if ctx.served {
+		// Answered without a tunnel (a PAC file)
 		return
 	}
-	if ctx.Ctx.DomainFilter.Matches(ctx.Remote.Host) {
+	ctx.Client.Connection.SetDeadline(time.Time{})
+	// Policy, logs and the upstream request all see one spelling of the destination
+	ctx.Remote.Host = ctx.Ctx.defaultZone(canonicalHost(ctx.Remote.Host))
+	if !ctx.Ctx.Schedule.Allowed(ctx.Identity(), time.Now()) {
 		if ctx.Ctx.Logger != nil {
-			ctx.Ctx.Logger <- fmt.Sprintf(" [!] Blacklisted: %s\n", ctx.Remote.Host)
+			ctx.Ctx.Logger <- fmt.Sprintf(" [!] Outside allowed time: %s -> %s\n", ctx.Identity(), ctx.Remote.Host)
+		}
+		ctx.fail(ErrOutsideSchedule)
+		return
+	}
+	if ctx.Ctx.Tenant != nil {
+		err = ctx.Ctx.Tenant.checkQuota()
+		if err != nil {
+			if ctx.Ctx.Logger != nil {
+				ctx.Ctx.Logger <- fmt.Sprintf(" [!] Transfer quota exhausted (%s): %s -> %s\n", ctx.Ctx.Tenant.Name, ctx.Identity(), ctx.Remote.Host)
+			}
+			// Respond with connection not allowed by ruleset (0x02)
+			ctx.sendFailure(0x02)
+			ctx.fail(err)
+			return
+		}
+	}
+	err = ctx.applyPolicy()
+	if err != nil {
+		// Respond with connection not allowed by ruleset (0x02)
+		ctx.sendFailure(0x02)
+		ctx.fail(err)
+		return
+	}
+	if ctx.Command == 0x03 {
+		// Destinations are filtered per datagram
+		err = ctx.processAssociate()
+		if err != nil {
+			ctx.fail(err)
 		}
 		return
 	}
+	for _, name := range ctx.filterNames() {
+		if ctx.exempt {
+			// Allowed by policy
+			break
+		}
+		if match, ok := ctx.Ctx.matchDomain(name); ok {
+			if ctx.Ctx.Logger != nil {
+				ctx.Ctx.Logger <- fmt.Sprintf(" [!] Blacklisted: %s (%s)\n", name, explain(match))
+			}
+			ctx.Ctx.metrics().Counter("blocked_total", 1, ctx.metricLabels())
+			ctx.fail(&ErrBlocked{Domain: name, Match: match})
+			return
+		}
+	}
+
+	if ctx.Command == CommandResolve || ctx.Command == CommandResolvePTR {
+		// Lookups have no tunnel to track
+		err = ctx.processResolve()
+		if err != nil {
+			ctx.fail(err)
+		}
+		return
+	}
+
+	if ctx.Command == 0x01 {
+		ctx.rewriteDestination()
+		err = ctx.Ctx.acquireDestination(ctx.Remote.Host)
+		if err != nil {
+			if ctx.Ctx.Logger != nil {
+				ctx.Ctx.Logger <- fmt.Sprintf(" [!] Destination limit reached: %s\n", ctx.Remote.Host)
+			}
+			// Respond with connection not allowed by ruleset (0x02)
+			ctx.sendFailure(0x02)
+			ctx.fail(err)
+			return
+		}
+		defer ctx.Ctx.releaseDestination(ctx.Remote.Host)
+	}
 
 	// Open a connection
-	err = ctx.processOutbound()
+	if ctx.Command == 0x02 {
+		err = ctx.processBind()
+	} else {
+		connecting := time.Now()
+		err = ctx.processOutbound()
+		if err == nil {
+			ctx.Ctx.metrics().Histogram("connect_seconds", time.Since(connecting).Seconds(), ctx.metricLabels())
+		}
+	}
 	if err != nil {
+		ctx.fail(err)
 		return
 	}
 	defer ctx.Remote.Connection.Close()
+	if len(ctx.Proxy.Host) > 0 {
+		ctx.Ctx.Proxies.acquire(ctx.Proxy)
+		defer ctx.Ctx.Proxies.release(ctx.Proxy)
+		ctx.Remote.limit = ctx.Ctx.bandwidthLimit(ctx.Proxy)
+	}
+	ctx.endTrace()
+	ctx.Client.tenant, ctx.Remote.tenant = ctx.Ctx.Tenant, ctx.Ctx.Tenant
+
+	// Data a SOCKS6 client sent along with its request
+	if len(ctx.initialData) > 0 {
+		_, err = ctx.Remote.Connection.Write(ctx.initialData)
+		if err != nil {
+			ctx.fail(err)
+			return
+		}
+		ctx.Client.count(len(ctx.initialData))
+	}
+
+	// Track the session so it can be closed from elsewhere
+	ctx.Started = time.Now()
+	ctx.Ctx.addSession(ctx)
 
 	// Create buffered IO reader/writers
 	if ctx.Ctx.Logger != nil {
 		if len(ctx.Proxy.Host) > 0 {
-			ctx.Ctx.Logger <- fmt.Sprintf(" [+] Opened: [%s]:%d -> [%s]%s:%d\n", ctx.Client.Host, ctx.Client.Port, ctx.Proxy.Host, ctx.Remote.Host, ctx.Remote.Port)
+			ctx.Ctx.Logger <- fmt.Sprintf(" [+] Opened: [%s]:%d%s -> [%s]%s:%d\n", ctx.Client.Host, ctx.Client.Port, ctx.originTag(), ctx.Proxy.Host, ctx.Remote.Host, ctx.Remote.Port)
 		} else {
-			ctx.Ctx.Logger <- fmt.Sprintf(" [+] Opened: [%s]:%d -> %s:%d\n", ctx.Client.Host, ctx.Client.Port, ctx.Remote.Host, ctx.Remote.Port)
+			ctx.Ctx.Logger <- fmt.Sprintf(" [+] Opened: [%s]:%d%s -> %s:%d\n", ctx.Client.Host, ctx.Client.Port, ctx.originTag(), ctx.Remote.Host, ctx.Remote.Port)
 		}
 	}
+	ctx.Ctx.emit(ctx.event("open"))
 
 	// Start threads to receive data from the client and remote connections
 	var wait sync.WaitGroup
@@ -647,12 +1257,15 @@ func (ctx *ClientCtx) processClient() {
 
 	// Wait for threads to finish
 	wait.Wait()
+	// Removed before the close event, so a listed session's bytes are never counted twice
+	ctx.Ctx.removeSession(ctx)
 
 	if ctx.Ctx.Logger != nil {
 		if len(ctx.Proxy.Host) > 0 {
-			ctx.Ctx.Logger <- fmt.Sprintf(" [-] Closed: [%s]:%d -> [%s]%s:%d (%v:%v bytes)\n", ctx.Client.Host, ctx.Client.Port, ctx.Proxy.Host, ctx.Remote.Host, ctx.Remote.Port, ctx.Client.ReadCount, ctx.Remote.ReadCount)
+			ctx.Ctx.Logger <- fmt.Sprintf(" [-] Closed: [%s]:%d%s -> [%s]%s:%d (%v:%v bytes)\n", ctx.Client.Host, ctx.Client.Port, ctx.originTag(), ctx.Proxy.Host, ctx.Remote.Host, ctx.Remote.Port, ctx.Client.ReadCount, ctx.Remote.ReadCount)
 		} else {
-			ctx.Ctx.Logger <- fmt.Sprintf(" [-] Closed: [%s]:%d -> %s:%d (%v:%v bytes)\n", ctx.Client.Host, ctx.Client.Port, ctx.Remote.Host, ctx.Remote.Port, ctx.Client.ReadCount, ctx.Remote.ReadCount)
+			ctx.Ctx.Logger <- fmt.Sprintf(" [-] Closed: [%s]:%d%s -> %s:%d (%v:%v bytes)\n", ctx.Client.Host, ctx.Client.Port, ctx.originTag(), ctx.Remote.Host, ctx.Remote.Port, ctx.Client.ReadCount, ctx.Remote.ReadCount)
 		}
 	}
+	ctx.Ctx.emit(ctx.event("close"))
 }
@@ -0,0 +1,222 @@
+package socks5
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// Experimental SOCKS6 support following draft-olteanu-intarea-socks-6-11 (CONNECT only)
+
+// SOCKS6 option kinds
+const (
+	socks6AuthAdvertisement = 0x02
+	socks6AuthSelection     = 0x03
+	socks6AuthData          = 0x04
+)
+
+// Largest initial data accepted with a request
+const socks6MaxInitialData = 16 * 1024
+
+// Zeros needed to pad a length to a multiple of 4
+func socks6Padding(length int) int {
+	return (4 - length%4) % 4
+}
+
+// Read a SOCKS6 address (port, padding, type and address) into the remote fields
+func (ctx *ClientCtx) readSocks6Address() error {
+	header := make([]byte, 4)
+	_, err := io.ReadFull(ctx.Client.Reader, header)
+	if err != nil {
+		return err
+	}
+	ctx.Remote.Port = int(binary.BigEndian.Uint16(header[0:2]))
+	switch header[3] {
+	case 0x01, 0x04:
+		ip := make(net.IP, 4)
+		if header[3] == 0x04 {
+			ip = make(net.IP, 16)
+		}
+		_, err = io.ReadFull(ctx.Client.Reader, ip)
+		if err != nil {
+			return err
+		}
+		ctx.Remote.Host = ip.String()
+		ctx.RequestData = append([]byte{0x00, header[3]}, ip...)
+	case 0x03:
+		// Length prefixed and padded to a multiple of 4
+		length, err := ctx.Client.Reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		name := make([]byte, int(length)+socks6Padding(int(length)+1))
+		_, err = io.ReadFull(ctx.Client.Reader, name)
+		if err != nil {
+			return err
+		}
+		ctx.Remote.Host = string(name[:length])
+		ctx.RequestData = append([]byte{0x00, 0x03, length}, name[:length]...)
+	default:
+		ctx.sendFailure(0x08)
+		return fmt.Errorf("invalid address type(socks6) %d from: %s", header[3], ctx.Client.Host)
+	}
+	return nil
+}
+
+// Username and password from a SOCKS6 authentication data option (RFC 1929 layout)
+func socks6Credentials(data []byte) (string, string, bool) {
+	if len(data) < 3 || data[0] != 0x01 {
+		return "", "", false
+	}
+	userLength := int(data[1])
+	if len(data) < 3+userLength {
+		return "", "", false
+	}
+	passLength := int(data[2+userLength])
+	if len(data) < 3+userLength+passLength {
+		return "", "", false
+	}
+	return string(data[2 : 2+userLength]), string(data[3+userLength : 3+userLength+passLength]), true
+}
+
+// Write a SOCKS6 authentication reply (success, with the method used when there was one)
+func (ctx *ClientCtx) sendSocks6Auth(success bool, method byte) error {
+	reply := []byte{0x06, 0x00, 0x00, 0x00}
+	if !success {
+		reply[1] = 0x01
+	}
+	if method != 0x00 {
+		// Authentication method selection option (kind, length, method and padding)
+		reply[3] = 8
+		reply = append(reply, 0x00, socks6AuthSelection, 0x00, 0x08, method, 0x00, 0x00, 0x00)
+	}
+	_, err := ctx.Client.Writer.Write(reply)
+	if err != nil {
+		return err
+	}
+	return ctx.Client.Writer.Flush()
+}
+
+// processSocks6 reads a SOCKS6 request (after the version byte), authenticates it and keeps any initial data
+func (ctx *ClientCtx) processSocks6() error {
+	ctx.Version = 0x06
+	header := make([]byte, 3)
+	_, err := io.ReadFull(ctx.Client.Reader, header)
+	if err != nil {
+		return err
+	}
+	ctx.Command = header[0]
+	optionsLength := int(binary.BigEndian.Uint16(header[1:3]))
+	err = ctx.readSocks6Address()
+	if err != nil {
+		return err
+	}
+
+	// Options (kind, length including the header, then data)
+	options := make([]byte, optionsLength)
+	_, err = io.ReadFull(ctx.Client.Reader, options)
+	if err != nil {
+		return err
+	}
+	initialData := 0
+	username, password, hasCredentials := "", "", false
+	for len(options) >= 4 {
+		kind := binary.BigEndian.Uint16(options[0:2])
+		length := int(binary.BigEndian.Uint16(options[2:4]))
+		if length < 4 || length > len(options) {
+			return fmt.Errorf("invalid option(socks6) from: %s", ctx.Client.Host)
+		}
+		data := options[4:length]
+		switch kind {
+		case socks6AuthAdvertisement:
+			if len(data) >= 2 {
+				initialData = int(binary.BigEndian.Uint16(data[0:2]))
+			}
+		case socks6AuthData:
+			if len(data) >= 1 && data[0] == 0x02 {
+				username, password, hasCredentials = socks6Credentials(data[1:])
+			}
+		}
+		options = options[length:]
+	}
+
+	// Initial data is sent right after the request (before any reply)
+	if initialData > socks6MaxInitialData {
+		return fmt.Errorf("initial data too long(socks6) from: %s", ctx.Client.Host)
+	}
+	if initialData > 0 {
+		ctx.initialData = make([]byte, initialData)
+		_, err = io.ReadFull(ctx.Client.Reader, ctx.initialData)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Authentication happens within the request
+	method := byte(0x00)
+	if ctx.authRequired() {
+		if !hasCredentials || !ctx.Ctx.checkPassword(username, password) {
+			ctx.sendSocks6Auth(false, 0x00)
+			return fmt.Errorf("%w: %s from: %s (socks6)", ErrAuthFailed, username, ctx.Client.Host)
+		}
+		ctx.User = username
+		method = 0x02
+		if ctx.Ctx.Logger != nil {
+			ctx.Ctx.Logger <- fmt.Sprintf(" [+] Authenticated: %s from [%s]:%d\n", username, ctx.Client.Host, ctx.Client.Port)
+		}
+	}
+	err = ctx.sendSocks6Auth(true, method)
+	if err != nil {
+		return err
+	}
+	if ctx.Command != 0x01 {
+		if !ctx.Ctx.DropUnsupported {
+			ctx.sendFailure(0x07)
+		}
+		return fmt.Errorf("%w (%d) from: %s (socks6)", ErrUnsupportedCommand, ctx.Command, ctx.Client.Host)
+	}
+	return nil
+}
+
+// Write a SOCKS6 operation reply
+func (ctx *ClientCtx) sendSocks6(code byte, host string, ip net.IP, port int) error {
+	reply := []byte{0x06, code, 0x00, 0x00, byte((port >> 8) & 0xFF), byte(port & 0xFF), 0x00}
+	if len(host) > 0 {
+		reply = append(reply, 0x03, byte(len(host)))
+		reply = append(reply, host...)
+		reply = append(reply, make([]byte, socks6Padding(len(host)+1))...)
+	} else if ip4 := ip.To4(); ip4 != nil || ip == nil {
+		if ip == nil {
+			ip4 = net.IPv4zero.To4()
+		}
+		reply = append(reply, 0x01)
+		reply = append(reply, ip4...)
+	} else {
+		reply = append(reply, 0x04)
+		reply = append(reply, ip.To16()...)
+	}
+	_, err := ctx.Client.Writer.Write(reply)
+	if err != nil {
+		return err
+	}
+	return ctx.Client.Writer.Flush()
+}
+
+// Convert a SOCKS5 style reply address (reserved, type, address and port) for a SOCKS6 reply
+func (ctx *ClientCtx) sendSocks6Reply(code byte, response []byte) error {
+	host, ip, port := "", net.IP(nil), 0
+	if len(response) >= 4 {
+		port = int(response[len(response)-2])<<8 | int(response[len(response)-1])
+		address := response[2 : len(response)-2]
+		switch response[1] {
+		case 0x01, 0x04:
+			ip = net.IP(address)
+		case 0x03:
+			if len(address) > 0 {
+				host = string(address[1:])
+			}
+		}
+	}
+	return ctx.sendSocks6(code, host, ip, port)
+}
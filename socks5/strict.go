@@ -0,0 +1,31 @@
+package socks5
+
+import (
+	"fmt"
+)
+
+// Note a client's departure from RFC 1928 or 1929 (logged once per session), which fails the request only in strict mode
+func (ctx *ClientCtx) deviate(rule string, detail string) error {
+	mode := "lenient"
+	if ctx.Ctx.Strict {
+		mode = "strict"
+	}
+	ctx.Ctx.metrics().Counter("protocol_deviations_total", 1, ctx.metricLabels("rule", rule, "mode", mode))
+	if ctx.Ctx.Strict {
+		// Logged with the rest of the failed handshakes
+		return fmt.Errorf("%w (%s): %s from: %s", ErrDeviation, rule, detail, ctx.Client.Host)
+	}
+	if ctx.deviations == nil {
+		ctx.deviations = make(map[string]bool)
+	}
+	if !ctx.deviations[rule] && ctx.Ctx.Logger != nil {
+		ctx.Ctx.Logger <- fmt.Sprintf(" [*] RFC deviation allowed (%s): %s from: %s\n", rule, detail, ctx.Client.Host)
+	}
+	ctx.deviations[rule] = true
+	return nil
+}
+
+// Whether the client sent more before its last message was answered (orderly negotiation waits for each reply)
+func (ctx *ClientCtx) sentAhead() bool {
+	return ctx.Client.Reader.Buffered() > 0
+}
@@ -0,0 +1,121 @@
+package socks5
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// Tenant groups the listeners of one customer, sharing connection and transfer limits between them
+type Tenant struct {
+	Name           string
+	Labels         map[string]string
+	MaxConnections int
+	QuotaBytes     uint64
+	clients        int64
+	transferred    uint64
+	listeners      []*Context
+	listenerLock   sync.Mutex
+}
+
+// TenantStatus describing a tenant's current use of its limits
+type TenantStatus struct {
+	Name           string            `json:"name"`
+	Labels         map[string]string `json:"labels,omitempty"`
+	Connections    int64             `json:"connections"`
+	MaxConnections int               `json:"max_connections"`
+	Transferred    uint64            `json:"transferred"`
+	QuotaBytes     uint64            `json:"quota_bytes"`
+}
+
+// Status returns a snapshot of the tenant's usage
+func (ctx *Tenant) Status() TenantStatus {
+	return TenantStatus{
+		Name:           ctx.Name,
+		Labels:         ctx.Labels,
+		Connections:    atomic.LoadInt64(&ctx.clients),
+		MaxConnections: ctx.MaxConnections,
+		Transferred:    atomic.LoadUint64(&ctx.transferred),
+		QuotaBytes:     ctx.QuotaBytes,
+	}
+}
+
+// Whether another connection would exceed the tenant's limit
+func (ctx *Tenant) full() bool {
+	return ctx.MaxConnections > 0 && atomic.LoadInt64(&ctx.clients) >= int64(ctx.MaxConnections)
+}
+
+// Check the tenant's transfer quota before opening a tunnel
+func (ctx *Tenant) checkQuota() error {
+	if ctx.QuotaBytes > 0 && atomic.LoadUint64(&ctx.transferred) >= ctx.QuotaBytes {
+		return fmt.Errorf("%w: %s (%d bytes)", ErrQuotaExceeded, ctx.Name, ctx.QuotaBytes)
+	}
+	return nil
+}
+
+// Count bytes relayed for the tenant as they pass, reporting whether its quota is used up (closing its sessions the moment it is)
+func (ctx *Tenant) transfer(bytes uint64) bool {
+	if ctx == nil || ctx.QuotaBytes == 0 {
+		return false
+	}
+	transferred := atomic.AddUint64(&ctx.transferred, bytes)
+	if transferred < ctx.QuotaBytes {
+		return false
+	}
+	if transferred-bytes < ctx.QuotaBytes {
+		go ctx.closeSessions()
+	}
+	return true
+}
+
+// Register a listener belonging to the tenant, so its sessions can be closed when the quota runs out
+func (ctx *Tenant) attach(listener *Context) {
+	ctx.listenerLock.Lock()
+	defer ctx.listenerLock.Unlock()
+	ctx.listeners = append(ctx.listeners, listener)
+}
+
+// Close the sessions of every listener of the tenant, its quota being used up
+func (ctx *Tenant) closeSessions() {
+	ctx.listenerLock.Lock()
+	listeners := append([]*Context(nil), ctx.listeners...)
+	ctx.listenerLock.Unlock()
+	for _, listener := range listeners {
+		sessions := listener.Sessions()
+		if len(sessions) > 0 && listener.Logger != nil {
+			listener.Logger <- fmt.Sprintf(" [!] Quota of tenant %s used up (%d bytes), closing %d sessions on: %s\n", ctx.Name, ctx.QuotaBytes, len(sessions), listener.ListenAddress)
+		}
+		for _, client := range sessions {
+			client.Close()
+		}
+	}
+}
+
+// SyncTransferred raises the tenant's transfer count to one learned elsewhere (reports whether it changed)
+func (ctx *Tenant) SyncTransferred(bytes uint64) bool {
+	for {
+		current := atomic.LoadUint64(&ctx.transferred)
+		if current >= bytes {
+			return false
+		}
+		if atomic.CompareAndSwapUint64(&ctx.transferred, current, bytes) {
+			return true
+		}
+	}
+}
+
+// Count a client against its listener and tenant (negative to release)
+func (ctx *Context) countClient(delta int64) {
+	atomic.AddInt64(&ctx.clients, delta)
+	if ctx.Tenant != nil {
+		atomic.AddInt64(&ctx.Tenant.clients, delta)
+	}
+}
+
+// TenantName of the tenant a listener belongs to (empty for shared listeners)
+func (ctx *Context) TenantName() string {
+	if ctx.Tenant == nil {
+		return ""
+	}
+	return ctx.Tenant.Name
+}
@@ -0,0 +1,68 @@
+package socks5
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TLS versions a listener can be limited to, by the names used in settings
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseTLSVersion of a minimum version setting ("1.0" to "1.3")
+func ParseTLSVersion(name string) (uint16, error) {
+	version, ok := tlsVersions[strings.TrimPrefix(strings.ToLower(name), "tls")]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version: %s (1.0, 1.1, 1.2 or 1.3)", name)
+	}
+	return version, nil
+}
+
+// ParseCipherSuites from a comma separated list of Go's names for them (TLS 1.3 suites are fixed, and insecure ones are refused)
+func ParseCipherSuites(names string) ([]uint16, error) {
+	known := make(map[string]*tls.CipherSuite)
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite
+	}
+	var suites []uint16
+	for _, name := range strings.Split(names, ",") {
+		name = strings.ToUpper(strings.TrimSpace(name))
+		if len(name) == 0 {
+			continue
+		}
+		suite, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite: %s", name)
+		}
+		if len(suite.SupportedVersions) == 1 && suite.SupportedVersions[0] == tls.VersionTLS13 {
+			return nil, fmt.Errorf("TLS 1.3 cipher suites cannot be chosen: %s", name)
+		}
+		suites = append(suites, suite.ID)
+	}
+	if len(suites) == 0 {
+		return nil, fmt.Errorf("no cipher suites in: %s", names)
+	}
+	return suites, nil
+}
+
+// RotateTicketKeys replaces the TLS session ticket key each TicketRotation, still accepting tickets issued under the previous key for one more period
+func (ctx *Context) RotateTicketKeys() {
+	var keys [][32]byte
+	for {
+		var key [32]byte
+		rand.Read(key[:])
+		keys = append([][32]byte{key}, keys...)
+		if len(keys) > 2 {
+			keys = keys[:2]
+		}
+		ctx.TLSConfig.SetSessionTicketKeys(keys)
+		time.Sleep(ctx.TicketRotation)
+	}
+}
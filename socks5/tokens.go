@@ -0,0 +1,77 @@
+package socks5
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+)
+
+// A session token a user may present as their password until it expires
+type sessionToken struct {
+	user    string
+	expires time.Time
+}
+
+// NewSessionToken returns a random token to hand to a user (the same token can be accepted by several listeners)
+func NewSessionToken() (string, error) {
+	data := make([]byte, 24)
+	_, err := rand.Read(data)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(data), nil
+}
+
+// Tokens are kept by digest, so a memory dump doesn't hand out live passwords
+func tokenDigest(token string) string {
+	digest := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(digest[:])
+}
+
+// AcceptToken lets a user authenticate with a token for SessionTokenTTL, returning when it expires (false when tokens are disabled)
+func (ctx *Context) AcceptToken(user string, token string) (time.Time, bool) {
+	ttl := ctx.tuned(&ctx.SessionTokenTTL)
+	if ttl <= 0 {
+		return time.Time{}, false
+	}
+	ctx.tokenLock.Lock()
+	defer ctx.tokenLock.Unlock()
+	now := time.Now()
+	if ctx.tokens == nil {
+		ctx.tokens = make(map[string]sessionToken)
+	}
+	for digest, issued := range ctx.tokens {
+		if now.After(issued.expires) {
+			delete(ctx.tokens, digest)
+		}
+	}
+	expires := now.Add(ttl)
+	ctx.tokens[tokenDigest(token)] = sessionToken{user: user, expires: expires}
+	return expires, true
+}
+
+// RevokeTokens drops every token issued to a user, returning how many there were
+func (ctx *Context) RevokeTokens(user string) int {
+	ctx.tokenLock.Lock()
+	defer ctx.tokenLock.Unlock()
+	revoked := 0
+	for digest, issued := range ctx.tokens {
+		if issued.user == user {
+			delete(ctx.tokens, digest)
+			revoked++
+		}
+	}
+	return revoked
+}
+
+// Check a client's username and password, which may be a session token issued to that user
+func (ctx *Context) checkPassword(username string, password string) bool {
+	if ctx.Credentials.Check(username, password) {
+		return true
+	}
+	ctx.tokenLock.Lock()
+	defer ctx.tokenLock.Unlock()
+	issued, ok := ctx.tokens[tokenDigest(password)]
+	return ok && issued.user == username && time.Now().Before(issued.expires)
+}
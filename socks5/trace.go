@@ -0,0 +1,129 @@
+package socks5
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Negotiation trace written to a file
+type tracer struct {
+	sync.Mutex
+	file  *os.File
+	start time.Time
+}
+
+// Record data passing through a traced connection
+func (ctx *tracer) record(direction string, data []byte, err error) {
+	ctx.Lock()
+	defer ctx.Unlock()
+	if ctx.file == nil {
+		return
+	}
+	elapsed := time.Since(ctx.start)
+	if len(data) > 0 {
+		fmt.Fprintf(ctx.file, "+%v %s (%d bytes)\n%s", elapsed, direction, len(data), hex.Dump(data))
+	}
+	if err != nil {
+		fmt.Fprintf(ctx.file, "+%v %s error: %s\n", elapsed, direction, err.Error())
+	}
+}
+
+// Stop tracing (the connections keep working untraced)
+func (ctx *tracer) close() {
+	ctx.Lock()
+	defer ctx.Unlock()
+	if ctx.file == nil {
+		return
+	}
+	fmt.Fprintf(ctx.file, "+%v end of negotiation\n", time.Since(ctx.start))
+	ctx.file.Close()
+	ctx.file = nil
+}
+
+// Connection wrapper that records reads and writes
+type tracedConn struct {
+	net.Conn
+	trace *tracer
+	read  string
+	write string
+}
+
+func (ctx *tracedConn) Read(b []byte) (int, error) {
+	n, err := ctx.Conn.Read(b)
+	ctx.trace.record(ctx.read, b[:n], err)
+	return n, err
+}
+
+func (ctx *tracedConn) Write(b []byte) (int, error) {
+	n, err := ctx.Conn.Write(b)
+	ctx.trace.record(ctx.write, b[:n], err)
+	return n, err
+}
+
+// CloseWrite passes half-closes through to the underlying connection
+func (ctx *tracedConn) CloseWrite() error {
+	if conn, ok := ctx.Conn.(interface{ CloseWrite() error }); ok {
+		return conn.CloseWrite()
+	}
+	return ctx.Conn.Close()
+}
+
+// TraceNext arms a negotiation trace for the next connection from a client IP
+func (ctx *Context) TraceNext(client string) {
+	ctx.traceLock.Lock()
+	defer ctx.traceLock.Unlock()
+	if ctx.traces == nil {
+		ctx.traces = make(map[string]bool)
+	}
+	ctx.traces[client] = true
+}
+
+// Start tracing a client connection if a trace was requested for it
+func (ctx *ClientCtx) startTrace() {
+	ctx.Ctx.traceLock.Lock()
+	armed := ctx.Ctx.traces[ctx.Client.Host]
+	delete(ctx.Ctx.traces, ctx.Client.Host)
+	ctx.Ctx.traceLock.Unlock()
+	if !armed {
+		return
+	}
+	dir := ctx.Ctx.TraceDir
+	if len(dir) == 0 {
+		dir = os.TempDir()
+	}
+	name := fmt.Sprintf("trace-%s-%d-%s.log", strings.ReplaceAll(ctx.Client.Host, ":", "_"), ctx.Client.Port, time.Now().Format("20060102-150405"))
+	file, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		ctx.Ctx.logError(err)
+		return
+	}
+	fmt.Fprintf(file, "Trace of [%s]:%d on %s started %s\n", ctx.Client.Host, ctx.Client.Port, ctx.Listener, time.Now().Format(time.RFC3339Nano))
+	ctx.trace = &tracer{file: file, start: time.Now()}
+	ctx.Client.Connection = &tracedConn{Conn: ctx.Client.Connection, trace: ctx.trace, read: "client -> proxy", write: "proxy -> client"}
+	if ctx.Ctx.Logger != nil {
+		ctx.Ctx.Logger <- fmt.Sprintf(" [*] Tracing [%s]:%d to: %s\n", ctx.Client.Host, ctx.Client.Port, file.Name())
+	}
+}
+
+// Setup IO for the remote connection, tracing it along with the client
+func (ctx *ClientCtx) remoteIO() {
+	if ctx.trace != nil {
+		ctx.Remote.Connection = &tracedConn{Conn: ctx.Remote.Connection, trace: ctx.trace, read: "remote -> proxy", write: "proxy -> remote"}
+	}
+	ctx.Remote.Reader = bufio.NewReader(ctx.Remote.Connection)
+	ctx.Remote.Writer = bufio.NewWriter(ctx.Remote.Connection)
+}
+
+// Finish the negotiation trace, if any
+func (ctx *ClientCtx) endTrace() {
+	if ctx.trace != nil {
+		ctx.trace.close()
+	}
+}
@@ -0,0 +1,181 @@
+package socks5
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Version recorded for redirected clients (they get no replies, failures just close the connection)
+const versionTransparent = 'T'
+
+// SniffTimeout is how long a redirected client has to send enough of its first message to name the destination
+const SniffTimeout = 2 * time.Second
+
+// SniffPorts are the destination ports of HTTP and TLS, where the client speaks first (server-first protocols like SSH or SMTP would stall waiting)
+var SniffPorts = map[int]bool{80: true, 443: true, 8080: true, 8443: true}
+
+// processTransparent takes the destination of a redirected connection from the firewall instead of a request
+func (ctx *ClientCtx) processTransparent() error {
+	ctx.Version = versionTransparent
+	if ctx.authRequired() {
+		// A client that does not know about the proxy cannot authenticate to it
+		return fmt.Errorf("%w: transparent client from: %s", ErrAuthFailed, ctx.Client.Host)
+	}
+	var ip net.IP
+	var port int
+	var err error
+	local, _ := ctx.Client.Connection.LocalAddr().(*net.TCPAddr)
+	if ctx.Ctx.TProxy && local != nil {
+		// TPROXY leaves the destination alone, so the socket's local address is where the client was going
+		ip, port = local.IP, local.Port
+		if _, listenPort, _ := net.SplitHostPort(ctx.Listener); listenPort == strconv.Itoa(port) {
+			return fmt.Errorf("%w: connection to the transparent listener itself from: %s", ErrMalformedRequest, ctx.Client.Host)
+		}
+	} else {
+		ip, port, err = originalDestination(ctx.Client.Connection)
+		if err != nil {
+			return fmt.Errorf("no original destination for: %s (%s)", ctx.Client.Host, err.Error())
+		}
+		if local != nil && local.IP.Equal(ip) && local.Port == port {
+			// Connecting to the listener itself, rather than being redirected to it, would loop
+			return fmt.Errorf("%w: connection to the transparent listener itself from: %s", ErrMalformedRequest, ctx.Client.Host)
+		}
+	}
+	ctx.setDestination(ip.String())
+	ctx.Remote.Port = port
+	ctx.serverName = ctx.sniffServerName()
+	return nil
+}
+
+// Dialer for a direct connection, from the client's own address when TPROXY flows keep their source
+func (ctx *ClientCtx) directDialer() *net.Dialer {
+	dialer := ctx.Ctx.dialer(ctx.Remote.Host)
+	if ctx.Ctx.TProxy && ctx.Ctx.PreserveSource {
+		dialer.LocalAddr = &net.TCPAddr{IP: net.ParseIP(ctx.Client.Host)}
+		dialer.Control = socketControls(dialer.Control, transparentControl)
+	}
+	return dialer
+}
+
+// Names the domain filter checks for a request (a redirected connection also has the name its client asked for)
+func (ctx *ClientCtx) filterNames() []string {
+	names := []string{ctx.Remote.Host}
+	if ip, _ := zonedIP(ctx.Remote.Host); ip != nil {
+		// Entries for an address cover it on every interface
+		names = append(names, ip.String())
+	}
+	if len(ctx.serverName) > 0 && ctx.serverName != ctx.Remote.Host {
+		names = append(names, ctx.serverName)
+	}
+	return names
+}
+
+// Name of the server a redirected client wants, from the TLS SNI or the HTTP Host header (empty when neither arrives in time)
+func (ctx *ClientCtx) sniffServerName() string {
+	if !SniffPorts[ctx.Remote.Port] && ctx.Client.Reader.Buffered() == 0 {
+		return ""
+	}
+	ctx.Client.Connection.SetReadDeadline(time.Now().Add(SniffTimeout))
+	defer ctx.Client.Connection.SetReadDeadline(time.Time{})
+	first, err := ctx.Client.Reader.Peek(1)
+	if err != nil {
+		return ""
+	}
+	var name string
+	if first[0] == 0x16 {
+		name = ctx.sniffTLS()
+	} else {
+		name = ctx.sniffHTTP()
+	}
+	name = canonicalHost(name)
+	// The name only feeds the filter and the logs, so anything that is not a plain host name is ignored
+	if len(name) > 255 || strings.Trim(name, "abcdefghijklmnopqrstuvwxyz0123456789.-_:") != "" {
+		return ""
+	}
+	return name
+}
+
+// Server name from a TLS ClientHello (the record is only peeked, so it still reaches the server untouched)
+func (ctx *ClientCtx) sniffTLS() string {
+	header, err := ctx.Client.Reader.Peek(5)
+	if err != nil || header[1] != 0x03 {
+		return ""
+	}
+	length := int(binary.BigEndian.Uint16(header[3:5]))
+	if length > ctx.Client.Reader.Size()-5 {
+		length = ctx.Client.Reader.Size() - 5
+	}
+	record, _ := ctx.Client.Reader.Peek(5 + length)
+	return serverNameIndication(record[5:])
+}
+
+// Find the server_name extension in the start of a handshake message
+func serverNameIndication(data []byte) string {
+	// Handshake type (client_hello), length, version and random
+	if len(data) < 38 || data[0] != 0x01 {
+		return ""
+	}
+	data = data[38:]
+	// Session ID, cipher suites and compression methods
+	for _, size := range []int{1, 2, 1} {
+		if len(data) < size {
+			return ""
+		}
+		skip := int(data[0])
+		if size == 2 {
+			skip = int(binary.BigEndian.Uint16(data))
+		}
+		if len(data) < size+skip {
+			return ""
+		}
+		data = data[size+skip:]
+	}
+	if len(data) < 2 {
+		return ""
+	}
+	data = data[2:]
+	for len(data) >= 4 {
+		extension, size := binary.BigEndian.Uint16(data), int(binary.BigEndian.Uint16(data[2:]))
+		data = data[4:]
+		if len(data) < size {
+			return ""
+		}
+		// server_name: list length, then entries of type, length and name
+		if extension == 0x0000 && size >= 5 && data[2] == 0x00 {
+			nameLength := int(binary.BigEndian.Uint16(data[3:]))
+			if 5+nameLength <= size {
+				return string(data[5 : 5+nameLength])
+			}
+			return ""
+		}
+		data = data[size:]
+	}
+	return ""
+}
+
+// Host header of a plain HTTP request (looking only at what has arrived)
+func (ctx *ClientCtx) sniffHTTP() string {
+	prefix, _ := ctx.Client.Reader.Peek(ctx.Client.Reader.Buffered())
+	if !isHTTP(string(prefix)) {
+		return ""
+	}
+	head := string(prefix)
+	if end := strings.Index(head, "\r\n\r\n"); end >= 0 {
+		head = head[:end]
+	}
+	for _, line := range strings.Split(head, "\r\n")[1:] {
+		name, value, ok := strings.Cut(line, ":")
+		if ok && strings.EqualFold(name, "Host") {
+			host := strings.TrimSpace(value)
+			if stripped, _, err := net.SplitHostPort(host); err == nil {
+				host = stripped
+			}
+			return host
+		}
+	}
+	return ""
+}
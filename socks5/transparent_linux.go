@@ -0,0 +1,82 @@
+//go:build linux
+
+package socks5
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// Socket option from linux/netfilter_ipv4.h (and IP6T_SO_ORIGINAL_DST, which has the same value)
+const soOriginalDst = 80
+
+// Destination a connection had before netfilter redirected it to the listener
+func originalDestination(connection net.Conn) (net.IP, int, error) {
+	tcp, ok := connection.(*net.TCPConn)
+	if !ok {
+		return nil, 0, fmt.Errorf("not a TCP connection")
+	}
+	raw, err := tcp.SyscallConn()
+	if err != nil {
+		return nil, 0, err
+	}
+	local, _ := tcp.LocalAddr().(*net.TCPAddr)
+	var ip net.IP
+	var port int
+	control := raw.Control(func(fd uintptr) {
+		if local != nil && local.IP.To4() == nil {
+			// The sockaddr_in6 fits in the start of this structure, which saves going through unsafe
+			var info *syscall.IPv6MTUInfo
+			info, err = syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, soOriginalDst)
+			if err == nil {
+				var raw [2]byte
+				binary.NativeEndian.PutUint16(raw[:], info.Addr.Port)
+				ip, port = net.IP(info.Addr.Addr[:]), int(binary.BigEndian.Uint16(raw[:]))
+			}
+			return
+		}
+		// Likewise for the sockaddr_in
+		var mreq *syscall.IPv6Mreq
+		mreq, err = syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst)
+		if err == nil {
+			ip, port = net.IPv4(mreq.Multiaddr[4], mreq.Multiaddr[5], mreq.Multiaddr[6], mreq.Multiaddr[7]), int(binary.BigEndian.Uint16(mreq.Multiaddr[2:4]))
+		}
+	})
+	if control != nil {
+		return nil, 0, control
+	}
+	return ip, port, err
+}
+
+// Socket options from linux/in.h and linux/in6.h
+const (
+	ipTransparent   = 19
+	ipv6Transparent = 75
+)
+
+// Let a socket accept connections for (or connect from) addresses that are not local, as TPROXY needs
+func transparentControl(network string, address string, conn syscall.RawConn) error {
+	var err error
+	control := conn.Control(func(fd uintptr) {
+		if network == "tcp6" {
+			err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, ipv6Transparent, 1)
+			if err != nil {
+				return
+			}
+		}
+		// Dual-stack sockets carry IPv4 flows too
+		err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, ipTransparent, 1)
+		if err != nil && network == "tcp6" {
+			err = nil
+		}
+	})
+	if control != nil {
+		return control
+	}
+	if err != nil {
+		return fmt.Errorf("IP_TRANSPARENT (needs CAP_NET_ADMIN): %w", err)
+	}
+	return nil
+}
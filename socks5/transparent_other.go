@@ -0,0 +1,19 @@
+//go:build !linux
+
+package socks5
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// Redirected connections only carry their original destination on Linux
+func originalDestination(connection net.Conn) (net.IP, int, error) {
+	return nil, 0, fmt.Errorf("transparent mode requires Linux")
+}
+
+// TPROXY interception only exists on Linux
+func transparentControl(network string, address string, conn syscall.RawConn) error {
+	return fmt.Errorf("TPROXY requires Linux")
+}
@@ -0,0 +1,46 @@
+package socks5
+
+import (
+	"net"
+	"strings"
+	"sync"
+)
+
+// UpstreamTransport tunnels through a type of outbound proxy compiled in from outside this package
+type UpstreamTransport interface {
+	// Validate checks an entry of the transport's type when the proxies file is loaded
+	Validate(proxy ProxyInfo) error
+	// Connect opens a tunnel to host:port over an established connection to the proxy (closing the tunnel closes the connection)
+	Connect(proxy ProxyInfo, connection net.Conn, host string, port int) (net.Conn, error)
+}
+
+var upstreamTransports = make(map[string]UpstreamTransport)
+var transportLock sync.Mutex
+
+// RegisterUpstreamTransport makes an outbound proxy type available by name
+func RegisterUpstreamTransport(name string, transport UpstreamTransport) {
+	transportLock.Lock()
+	defer transportLock.Unlock()
+	upstreamTransports[strings.ToLower(name)] = transport
+}
+
+// Find the transport registered for an outbound proxy's type
+func lookupUpstreamTransport(name string) (UpstreamTransport, bool) {
+	transportLock.Lock()
+	defer transportLock.Unlock()
+	transport, ok := upstreamTransports[strings.ToLower(name)]
+	return transport, ok
+}
+
+// Open the tunnel through an outbound proxy of a registered type, answering with an unspecified bound address
+func (ctx *ClientCtx) negotiateTransport(transport UpstreamTransport) ([]byte, error) {
+	tunnel, err := transport.Connect(ctx.Proxy, ctx.Remote.Connection, ctx.Remote.Host, ctx.Remote.Port)
+	if err != nil {
+		ctx.Remote.Connection.Close()
+		return nil, err
+	}
+	ctx.Remote.Connection = tunnel
+	ctx.remoteIO()
+	// Reserved, IPv4, 0.0.0.0 and port 0
+	return []byte{0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}, nil
+}
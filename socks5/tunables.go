@@ -0,0 +1,100 @@
+package socks5
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Tunable is a limit that can be changed while the server is running
+type Tunable struct {
+	Listener    string `json:"listener,omitempty"`
+	Name        string `json:"name"`
+	Value       string `json:"value"`
+	Description string `json:"description"`
+}
+
+// Limits that may be changed at runtime (an *int or *time.Duration field of the context)
+var tunables = map[string]struct {
+	description string
+	field       func(ctx *Context) interface{}
+}{
+	"max_connections":    {"Simultaneous clients allowed (0 is unlimited)", func(ctx *Context) interface{} { return &ctx.MaxConnections }},
+	"udp_idle_timeout":   {"Idle time before a UDP association closes (0 disables)", func(ctx *Context) interface{} { return &ctx.UDPIdleTimeout }},
+	"quarantine_time":    {"How long a proxy that failed validation is skipped", func(ctx *Context) interface{} { return &ctx.QuarantineTime }},
+	"destination_limit":  {"Default simultaneous tunnels per destination host (0 is unlimited)", func(ctx *Context) interface{} { return &ctx.Destinations.Default }},
+	"drain_grace":        {"Grace before closing tunnels through removed proxies (0 keeps them open)", func(ctx *Context) interface{} { return &ctx.DrainGrace }},
+	"schedule_warning":   {"How long before a window ends to warn about closing sessions", func(ctx *Context) interface{} { return &ctx.ScheduleWarning }},
+	"handshake_timeout":  {"How long a client may take to complete its request (0 disables)", func(ctx *Context) interface{} { return &ctx.HandshakeTimeout }},
+	"max_methods":        {"Authentication methods a client may offer (0 is unlimited)", func(ctx *Context) interface{} { return &ctx.MaxMethods }},
+	"auth_failure_limit": {"Credentials rejections before an outbound proxy is skipped until reload (0 never skips)", func(ctx *Context) interface{} { return &ctx.AuthFailureLimit }},
+	"session_token_ttl":  {"How long newly issued session tokens are accepted as passwords (0 stops issuing them)", func(ctx *Context) interface{} { return &ctx.SessionTokenTTL }},
+}
+
+// Read a tunable integer
+func (ctx *Context) tunedInt(value *int) int {
+	ctx.tuneLock.RLock()
+	defer ctx.tuneLock.RUnlock()
+	return *value
+}
+
+// Read a tunable duration
+func (ctx *Context) tuned(value *time.Duration) time.Duration {
+	ctx.tuneLock.RLock()
+	defer ctx.tuneLock.RUnlock()
+	return *value
+}
+
+// Format a tunable field (caller holds the lock)
+func formatTunable(field interface{}) string {
+	switch value := field.(type) {
+	case *int:
+		return strconv.Itoa(*value)
+	case *time.Duration:
+		return value.String()
+	}
+	return ""
+}
+
+// Tunables returns the current value of every runtime limit
+func (ctx *Context) Tunables() []Tunable {
+	ctx.tuneLock.RLock()
+	defer ctx.tuneLock.RUnlock()
+	var list []Tunable
+	for name, tunable := range tunables {
+		list = append(list, Tunable{Listener: ctx.Name, Name: name, Value: formatTunable(tunable.field(ctx)), Description: tunable.description})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// SetTunable changes a runtime limit, returning its previous value
+func (ctx *Context) SetTunable(name string, value string) (string, error) {
+	tunable, ok := tunables[name]
+	if !ok {
+		return "", fmt.Errorf("unknown tunable: %s", name)
+	}
+	ctx.tuneLock.Lock()
+	defer ctx.tuneLock.Unlock()
+	field := tunable.field(ctx)
+	old := formatTunable(field)
+	switch field := field.(type) {
+	case *int:
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			return old, fmt.Errorf("invalid value for %s: %s", name, value)
+		}
+		*field = parsed
+	case *time.Duration:
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed < 0 {
+			return old, fmt.Errorf("invalid value for %s: %s", name, value)
+		}
+		*field = parsed
+	}
+	if ctx.Logger != nil {
+		ctx.Logger <- fmt.Sprintf(" [*] %s changed from %s to %s on: %s\n", name, old, value, ctx.ListenAddress)
+	}
+	return old, nil
+}
@@ -0,0 +1,225 @@
+package socks5
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Split a UDP request header (RSV, FRAG, ATYP, DST.ADDR, DST.PORT) from the payload
+func parseDatagram(data []byte) (string, int, []byte, error) {
+	if len(data) < 4 {
+		return "", 0, nil, errors.New("short UDP header")
+	}
+	if data[2] != 0x00 {
+		// Fragmentation is optional and not supported, so fragments are dropped
+		return "", 0, nil, errors.New("fragmented UDP datagram")
+	}
+	host := ""
+	offset := 4
+	switch data[3] {
+	case 0x01:
+		offset += 4
+		if len(data) < offset+2 {
+			return "", 0, nil, errors.New("short UDP header")
+		}
+		host = net.IP(data[4:offset]).String()
+	case 0x03:
+		if len(data) < 5 {
+			return "", 0, nil, errors.New("short UDP header")
+		}
+		offset += 1 + int(data[4])
+		if len(data) < offset+2 {
+			return "", 0, nil, errors.New("short UDP header")
+		}
+		host = string(data[5:offset])
+	case 0x04:
+		offset += 16
+		if len(data) < offset+2 {
+			return "", 0, nil, errors.New("short UDP header")
+		}
+		host = net.IP(data[4:offset]).String()
+	default:
+		return "", 0, nil, fmt.Errorf("invalid UDP address type: %d", data[3])
+	}
+	port := int(binary.BigEndian.Uint16(data[offset : offset+2]))
+	return host, port, data[offset+2:], nil
+}
+
+// Prefix a payload with a UDP header describing where it came from
+func encapsulate(from *net.UDPAddr, payload []byte) []byte {
+	datagram := []byte{0x00, 0x00, 0x00}
+	if ip := from.IP.To4(); ip != nil {
+		datagram = append(datagram, 0x01)
+		datagram = append(datagram, ip...)
+	} else {
+		datagram = append(datagram, 0x04)
+		datagram = append(datagram, from.IP.To16()...)
+	}
+	datagram = append(datagram, byte((from.Port>>8)&0xFF), byte(from.Port&0xFF))
+	return append(datagram, payload...)
+}
+
+// Send a client datagram's payload on to its destination
+func (ctx *ClientCtx) forwardDatagram(relay *net.UDPConn, data []byte, peers map[string]bool) error {
+	if len(data) >= 2 && (data[0] != 0x00 || data[1] != 0x00) {
+		// Reserved bytes must be zero
+		err := ctx.deviate("udp-reserved", fmt.Sprintf("reserved UDP header bytes are %#x", data[:2]))
+		if err != nil {
+			return err
+		}
+	}
+	host, port, payload, err := parseDatagram(data)
+	if err != nil {
+		return err
+	}
+	if match, ok := ctx.Ctx.matchDomain(host); ok {
+		return &ErrBlocked{Domain: host, Match: match}
+	}
+	destination, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return err
+	}
+	// Only destinations the client has sent to may send datagrams back
+	peers[destination.String()] = true
+	_, err = relay.WriteToUDP(payload, destination)
+	if err == nil {
+		ctx.Client.count(len(payload))
+	}
+	return err
+}
+
+// Address to report for a socket opened on the client's behalf
+func (ctx *Context) boundIP(local net.IP) net.IP {
+	if ctx.ReportIP == nil || ctx.ReportIP.IsUnspecified() {
+		return local
+	}
+	return ctx.ReportIP
+}
+
+// processAssociate relays UDP datagrams for the client until the control connection closes
+func (ctx *ClientCtx) processAssociate() error {
+	if len(ctx.Ctx.Proxies.List()) > 0 {
+		// Datagrams would bypass the outbound proxies, so refuse instead of leaking them
+		// Respond with command not supported (0x07)
+		ctx.sendFailure(0x07)
+		err := fmt.Errorf("%w: UDP associate with outbound proxies from: %s", ErrUnsupportedCommand, ctx.Client.Host)
+		ctx.Ctx.logError(err)
+		return err
+	}
+	if ctx.Ctx.egressBlocked() {
+		return ctx.refuseDirect()
+	}
+
+	if ctx.protected() {
+		// Datagrams would have to be encapsulated too, which is not supported
+		// Respond with command not supported (0x07)
+		ctx.sendFailure(0x07)
+		err := fmt.Errorf("%w: UDP associate with GSS-API protection from: %s", ErrUnsupportedCommand, ctx.Client.Host)
+		ctx.Ctx.logError(err)
+		return err
+	}
+
+	// Open the relay on the address the client reached us on
+	local := ctx.Client.Connection.LocalAddr().(*net.TCPAddr)
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP})
+	if err != nil {
+		// Respond with general error (0x01)
+		ctx.sendFailure(0x01)
+		ctx.Ctx.logError(err)
+		return err
+	}
+	defer relay.Close()
+	atomic.AddInt32(&ctx.sockets, 1)
+	defer atomic.AddInt32(&ctx.sockets, -1)
+	relayPort := relay.LocalAddr().(*net.UDPAddr).Port
+	err = ctx.sendAddress(ctx.Ctx.ReportHost, ctx.Ctx.boundIP(local.IP), relayPort)
+	if err != nil {
+		return err
+	}
+	ctx.endTrace()
+	ctx.Client.tenant, ctx.Remote.tenant = ctx.Ctx.Tenant, ctx.Ctx.Tenant
+
+	// The request names the address the client will send from (zeros when unknown)
+	expectedPort := ctx.Remote.Port
+	clientIP := net.ParseIP(ctx.Client.Host)
+	ctx.Lock()
+	ctx.Remote.Host = "udp"
+	ctx.Remote.Port = relayPort
+	ctx.Remote.Connection = relay
+	ctx.Unlock()
+
+	// Track the association like any other session
+	ctx.Started = time.Now()
+	ctx.Ctx.addSession(ctx)
+	if ctx.Ctx.Logger != nil {
+		ctx.Ctx.Logger <- fmt.Sprintf(" [+] UDP associate: [%s]:%d -> relay :%d\n", ctx.Client.Host, ctx.Client.Port, relayPort)
+	}
+	ctx.Ctx.emit(ctx.event("open"))
+
+	// The association ends when the control connection closes
+	go func() {
+		io.Copy(io.Discard, ctx.Client.Reader)
+		relay.Close()
+	}()
+
+	var client *net.UDPAddr
+	peers := make(map[string]bool)
+	sent, received := 0, 0
+	buffer := make([]byte, 65535)
+	lastActive := time.Now()
+	for {
+		idle := ctx.Ctx.tuned(&ctx.Ctx.UDPIdleTimeout)
+		if idle > 0 {
+			relay.SetReadDeadline(lastActive.Add(idle))
+		} else {
+			relay.SetReadDeadline(time.Time{})
+		}
+		n, from, err := relay.ReadFromUDP(buffer)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() && ctx.Ctx.Logger != nil {
+				ctx.Ctx.Logger <- fmt.Sprintf(" [*] UDP association idle for %v: [%s]:%d\n", idle, ctx.Client.Host, ctx.Client.Port)
+			}
+			break
+		}
+		switch {
+		case client == nil && from.IP.Equal(clientIP) && (expectedPort == 0 || expectedPort == from.Port),
+			client != nil && from.IP.Equal(client.IP) && from.Port == client.Port:
+			// From the client (its first datagram fixes the source port)
+			client = from
+			err = ctx.forwardDatagram(relay, buffer[:n], peers)
+			if err != nil {
+				ctx.Ctx.logError(err)
+				continue
+			}
+			sent++
+			lastActive = time.Now()
+		case client != nil && peers[from.String()]:
+			// From a destination, back to the client
+			_, err = relay.WriteToUDP(encapsulate(from, buffer[:n]), client)
+			if err != nil {
+				ctx.Ctx.logError(err)
+				continue
+			}
+			ctx.Remote.count(n)
+			received++
+			lastActive = time.Now()
+		}
+	}
+
+	// Closing the control connection ends the watcher
+	ctx.Client.Connection.Close()
+	// Removed before the close event, so a listed session's bytes are never counted twice
+	ctx.Ctx.removeSession(ctx)
+	if ctx.Ctx.Logger != nil {
+		ctx.Ctx.Logger <- fmt.Sprintf(" [-] UDP closed: [%s]:%d (%v:%v bytes, %d:%d datagrams)\n", ctx.Client.Host, ctx.Client.Port, atomic.LoadUint64(&ctx.Client.ReadCount), atomic.LoadUint64(&ctx.Remote.ReadCount), sent, received)
+	}
+	ctx.Ctx.emit(ctx.event("close"))
+	return nil
+}
@@ -0,0 +1,86 @@
+package socks5
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Usage totals for a user
+type Usage struct {
+	Connections uint64 `json:"connections"`
+	Sent        uint64 `json:"sent"`
+	Received    uint64 `json:"received"`
+}
+
+// SessionInfo describing an active client session
+type SessionInfo struct {
+	Client     string    `json:"client"`
+	ClientPort int       `json:"clientport"`
+	User       string    `json:"user"`
+	Host       string    `json:"host"`
+	Port       int       `json:"port"`
+	Proxy      string    `json:"proxy,omitempty"`
+	Started    time.Time `json:"started"`
+	Sent       uint64    `json:"sent"`
+	Received   uint64    `json:"received"`
+	Tenant     string    `json:"tenant,omitempty"`
+	Origin     string    `json:"origin,omitempty"`
+	Listener   string    `json:"listener,omitempty"`
+	Resources  Resources `json:"resources"`
+}
+
+// Info returns a snapshot of an active client session
+func (ctx *ClientCtx) Info() SessionInfo {
+	return SessionInfo{
+		Client:     ctx.Client.Host,
+		ClientPort: ctx.Client.Port,
+		User:       ctx.Identity(),
+		Host:       ctx.Remote.Host,
+		Port:       ctx.Remote.Port,
+		Proxy:      ctx.Proxy.Host,
+		Started:    ctx.Started,
+		Sent:       atomic.LoadUint64(&ctx.Client.ReadCount),
+		Received:   atomic.LoadUint64(&ctx.Remote.ReadCount),
+		Tenant:     ctx.Ctx.TenantName(),
+		Origin:     ctx.OriginName(),
+		Listener:   ctx.Listener,
+		Resources:  ctx.Resources(),
+	}
+}
+
+// Add the totals of a closed session to its user (caller holds sessionLock)
+func (ctx *Context) addUsage(client *ClientCtx) {
+	if ctx.usage == nil {
+		ctx.usage = make(map[string]*Usage)
+	}
+	usage, ok := ctx.usage[client.Identity()]
+	if !ok {
+		usage = &Usage{}
+		ctx.usage[client.Identity()] = usage
+	}
+	usage.Connections++
+	usage.Sent += atomic.LoadUint64(&client.Client.ReadCount)
+	usage.Received += atomic.LoadUint64(&client.Remote.ReadCount)
+}
+
+// UserUsage returns the totals for a user (including active sessions) and their active sessions
+func (ctx *Context) UserUsage(user string) (Usage, []SessionInfo) {
+	var usage Usage
+	var active []SessionInfo
+	ctx.sessionLock.Lock()
+	defer ctx.sessionLock.Unlock()
+	if total, ok := ctx.usage[user]; ok {
+		usage = *total
+	}
+	for client := range ctx.sessions {
+		if client.Identity() != user {
+			continue
+		}
+		info := client.Info()
+		usage.Connections++
+		usage.Sent += info.Sent
+		usage.Received += info.Received
+		active = append(active, info)
+	}
+	return usage, active
+}
@@ -0,0 +1,146 @@
+package socks5
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// UtilizationSaturated is the share of its bandwidth cap an outbound proxy relays over an interval to count as saturated
+const UtilizationSaturated = 0.9
+
+// States of the outbound proxy pool, reported as they change
+const (
+	PoolIdle      = "idle"
+	PoolBusy      = "busy"
+	PoolSaturated = "saturated"
+)
+
+// UpstreamUtilization of one outbound proxy over an interval
+type UpstreamUtilization struct {
+	Proxy      string  `json:"proxy"`
+	Country    string  `json:"country,omitempty"`
+	Tag        string  `json:"tag,omitempty"`
+	Available  bool    `json:"available"`
+	Active     int     `json:"active"`
+	Opened     uint64  `json:"opened"`
+	Bandwidth  int64   `json:"bandwidth,omitempty"`
+	Relayed    uint64  `json:"relayed,omitempty"`
+	Saturation float64 `json:"saturation,omitempty"`
+}
+
+// Utilization of the outbound proxy pool over an interval, for automation scaling the exits to demand
+type Utilization struct {
+	State     string                `json:"state"`
+	Interval  string                `json:"interval"`
+	Active    int                   `json:"active"`
+	Opened    uint64                `json:"opened"`
+	Available int                   `json:"available"`
+	Idle      int                   `json:"idle"`
+	Saturated int                   `json:"saturated"`
+	Upstreams []UpstreamUtilization `json:"upstreams"`
+}
+
+// Counters of an outbound proxy at the last report
+type utilizationSample struct {
+	tunnels uint64
+	relayed uint64
+}
+
+// ReportUtilization emits pool_utilization each UsageInterval, and pool_idle, pool_busy or pool_saturated as the pool moves between those states
+func (ctx *Context) ReportUtilization() {
+	state := ""
+	samples := make(map[ProxyInfo]utilizationSample)
+	started := time.Now()
+	for {
+		time.Sleep(ctx.UsageInterval)
+		var utilization Utilization
+		utilization, samples = ctx.Proxies.utilization(samples, time.Since(started))
+		started = time.Now()
+		ctx.emitUtilization("pool_utilization", utilization)
+		if utilization.State == state {
+			continue
+		}
+		state = utilization.State
+		if ctx.Logger != nil {
+			ctx.Logger <- fmt.Sprintf(" [*] Outbound proxy pool %s: %d tunnels through %d of %d proxies (%d idle, %d saturated)\n", state, utilization.Active, utilization.Available, len(utilization.Upstreams), utilization.Idle, utilization.Saturated)
+		}
+		ctx.emitUtilization("pool_"+state, utilization)
+	}
+}
+
+// Report the pool's utilization to the event handlers
+func (ctx *Context) emitUtilization(eventType string, utilization Utilization) {
+	event := Event{Type: eventType, Time: time.Now(), Pool: &utilization}
+	if ctx.Tenant != nil {
+		event.Tenant = ctx.Tenant.Name
+		event.Labels = ctx.Tenant.Labels
+	}
+	ctx.emit(event)
+}
+
+// Measure each outbound proxy since the previous samples, returning the samples to measure the next interval from
+func (ctx *ProxyPool) utilization(previous map[ProxyInfo]utilizationSample, interval time.Duration) (Utilization, map[ProxyInfo]utilizationSample) {
+	ctx.RLock()
+	defer ctx.RUnlock()
+	report := Utilization{Interval: interval.Round(time.Second).String(), Upstreams: []UpstreamUtilization{}}
+	samples := make(map[ProxyInfo]utilizationSample)
+	for _, proxy := range ctx.Hosts {
+		upstream := UpstreamUtilization{
+			Proxy:     net.JoinHostPort(proxy.Host, strconv.Itoa(proxy.Port)),
+			Country:   proxy.Country,
+			Tag:       proxy.Tag,
+			Available: ctx.eligible(proxy),
+			Bandwidth: proxy.Bandwidth,
+		}
+		var sample utilizationSample
+		if status, ok := ctx.status[proxy]; ok {
+			upstream.Active = status.InFlight
+			sample.tunnels = status.Tunnels
+		}
+		if limit, ok := ctx.limits[proxy]; ok {
+			limit.lock.Lock()
+			sample.relayed = limit.relayed
+			limit.lock.Unlock()
+		}
+		samples[proxy] = sample
+		upstream.Opened = counted(sample.tunnels, previous[proxy].tunnels)
+		upstream.Relayed = counted(sample.relayed, previous[proxy].relayed)
+		if proxy.Bandwidth > 0 && interval > 0 {
+			upstream.Saturation = float64(upstream.Relayed) / (float64(proxy.Bandwidth) * interval.Seconds())
+		}
+
+		report.Active += upstream.Active
+		report.Opened += upstream.Opened
+		if upstream.Available {
+			report.Available++
+			if upstream.Active == 0 && upstream.Opened == 0 {
+				report.Idle++
+			}
+			if upstream.Saturation >= UtilizationSaturated {
+				report.Saturated++
+			}
+		}
+		report.Upstreams = append(report.Upstreams, upstream)
+	}
+
+	// Only caps saturate, so a pool with headroom on any available proxy is busy at most
+	switch {
+	case report.Active == 0 && report.Opened == 0:
+		report.State = PoolIdle
+	case report.Available > 0 && report.Saturated == report.Available:
+		report.State = PoolSaturated
+	default:
+		report.State = PoolBusy
+	}
+	return report, samples
+}
+
+// Growth of a counter since a sample (counters that started over, like the limits of a replaced proxy, count from zero)
+func counted(current uint64, previous uint64) uint64 {
+	if current < previous {
+		return current
+	}
+	return current - previous
+}
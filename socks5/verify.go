@@ -0,0 +1,39 @@
+package socks5
+
+import (
+	"fmt"
+	"time"
+)
+
+// Check the outbound proxy's connect reply against the request, quarantining the proxy if it fails
+func (ctx *ClientCtx) verifyReply(response []byte) error {
+	reason := ""
+	switch {
+	case response[0] != 0x00:
+		reason = fmt.Sprintf("reserved byte is %d", response[0])
+	case ctx.Command == 0x01 && addressType(ctx.Remote.Host) != 0x03 && response[1] != 0x03 && addressType(ctx.Remote.Host) != response[1]:
+		// An IPv4 request should not be bound to an IPv6 address or the other way around
+		reason = fmt.Sprintf("bound address type %d does not match request type %d", response[1], addressType(ctx.Remote.Host))
+	case ctx.Command == 0x01 && ctx.Remote.Reader.Buffered() > 0:
+		// Nothing has been sent to the destination yet, so any data here came from the proxy
+		// (a bind's second reply may legitimately follow right away)
+		reason = fmt.Sprintf("%d bytes injected after the reply", ctx.Remote.Reader.Buffered())
+	default:
+		return nil
+	}
+	ctx.Ctx.quarantine(ctx.Proxy, reason)
+	return &ErrUpstreamTampered{Proxy: ctx.Proxy.Host, Reason: reason}
+}
+
+// Skip an outbound proxy for QuarantineTime after it misbehaves
+func (ctx *Context) quarantine(proxy ProxyInfo, reason string) {
+	duration := ctx.tuned(&ctx.QuarantineTime)
+	until := time.Now().Add(duration)
+	ctx.Proxies.updateStatus(proxy, func(status *ProxyStatus) {
+		status.Violations++
+		status.QuarantinedUntil = until
+	})
+	if ctx.Logger != nil {
+		ctx.Logger <- fmt.Sprintf(" [!] Quarantined %s:%d for %v: %s\n", proxy.Host, proxy.Port, duration, reason)
+	}
+}
@@ -0,0 +1,184 @@
+package socks5
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"proxy/httpproxy"
+	"strings"
+	"sync"
+)
+
+// Appended to the client's key to prove the server speaks WebSocket (RFC 6455)
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Whether an HTTP request asks to open the listener's WebSocket tunnel
+func (ctx *ClientCtx) websocketRequest(request *httpproxy.Request) bool {
+	if len(ctx.Ctx.WebSocket) == 0 || ctx.tunneled {
+		return false
+	}
+	path, _, _ := strings.Cut(request.Target, "?")
+	return path == ctx.Ctx.WebSocket && strings.EqualFold(request.Get("Upgrade"), "websocket")
+}
+
+// acceptWebSocket completes the upgrade, then reads a SOCKS request from inside the tunnel
+func (ctx *ClientCtx) acceptWebSocket(request *httpproxy.Request) error {
+	key := request.Get("Sec-WebSocket-Key")
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	if request.Method != "GET" || err != nil || len(decoded) != 16 || !headerHasToken(request.Get("Connection"), "upgrade") {
+		ctx.sendHTTP(400, "Bad Request")
+		return fmt.Errorf("%w: invalid WebSocket upgrade from: %s", ErrMalformedRequest, ctx.Client.Host)
+	}
+	if request.Get("Sec-WebSocket-Version") != "13" {
+		ctx.sendHTTP(426, "Upgrade Required", "Sec-WebSocket-Version: 13")
+		return fmt.Errorf("%w: WebSocket version %q from: %s", ErrMalformedRequest, request.Get("Sec-WebSocket-Version"), ctx.Client.Host)
+	}
+	digest := sha1.Sum([]byte(key + websocketGUID))
+	fmt.Fprintf(ctx.Client.Writer, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", base64.StdEncoding.EncodeToString(digest[:]))
+	err = ctx.Client.Writer.Flush()
+	if err != nil {
+		return err
+	}
+
+	// Everything from here on is a SOCKS client, just framed
+	tunnel := &websocketConn{Conn: ctx.Client.Connection, reader: ctx.Client.Reader}
+	ctx.Client.Connection = tunnel
+	ctx.Client.Reader = bufio.NewReader(tunnel)
+	ctx.Client.Writer = bufio.NewWriter(tunnel)
+	ctx.Version = 0
+	ctx.tunneled = true
+	return ctx.processInbound()
+}
+
+// Whether a comma separated header lists a token
+func headerHasToken(header string, token string) bool {
+	for _, item := range strings.Split(header, ",") {
+		if strings.EqualFold(strings.TrimSpace(item), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// Connection carrying a byte stream in binary WebSocket messages
+type websocketConn struct {
+	net.Conn
+	reader    *bufio.Reader
+	remaining uint64
+	mask      [4]byte
+	masked    int
+	writeLock sync.Mutex
+}
+
+// Read payload bytes, handling control frames along the way
+func (ws *websocketConn) Read(data []byte) (int, error) {
+	for ws.remaining == 0 {
+		err := ws.nextFrame()
+		if err != nil {
+			return 0, err
+		}
+	}
+	if uint64(len(data)) > ws.remaining {
+		data = data[:ws.remaining]
+	}
+	n, err := ws.reader.Read(data)
+	for i := 0; i < n; i++ {
+		data[i] ^= ws.mask[ws.masked%4]
+		ws.masked++
+	}
+	ws.remaining -= uint64(n)
+	return n, err
+}
+
+// Read frame headers until a data frame starts (pings are answered, a close ends the stream)
+func (ws *websocketConn) nextFrame() error {
+	header := make([]byte, 2)
+	_, err := io.ReadFull(ws.reader, header)
+	if err != nil {
+		return err
+	}
+	opcode := header[0] & 0x0F
+	if header[1]&0x80 == 0 {
+		// Clients must mask every frame
+		return errors.New("unmasked WebSocket frame")
+	}
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		extended := make([]byte, 2)
+		_, err = io.ReadFull(ws.reader, extended)
+		length = uint64(binary.BigEndian.Uint16(extended))
+	case 127:
+		extended := make([]byte, 8)
+		_, err = io.ReadFull(ws.reader, extended)
+		length = binary.BigEndian.Uint64(extended)
+	}
+	if err == nil {
+		_, err = io.ReadFull(ws.reader, ws.mask[:])
+	}
+	if err != nil {
+		return err
+	}
+	ws.masked = 0
+
+	switch opcode {
+	case 0x0, 0x1, 0x2:
+		// Continuation, text and binary frames all carry the stream
+		ws.remaining = length
+		return nil
+	case 0x8, 0x9, 0xA:
+		if length > 125 {
+			return errors.New("oversized WebSocket control frame")
+		}
+		payload := make([]byte, length)
+		_, err = io.ReadFull(ws.reader, payload)
+		if err != nil {
+			return err
+		}
+		for i := range payload {
+			payload[i] ^= ws.mask[i%4]
+		}
+		if opcode == 0x8 {
+			ws.writeFrame(0x8, payload)
+			return io.EOF
+		}
+		if opcode == 0x9 {
+			return ws.writeFrame(0xA, payload)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown WebSocket opcode: %d", opcode)
+}
+
+// Write data as one binary message
+func (ws *websocketConn) Write(data []byte) (int, error) {
+	err := ws.writeFrame(0x2, data)
+	if err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// Send a single unmasked frame (servers never mask)
+func (ws *websocketConn) writeFrame(opcode byte, payload []byte) error {
+	frame := []byte{0x80 | opcode}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		frame = append(frame, 126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(len(payload)))
+	default:
+		frame = append(frame, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(len(payload)))
+	}
+	ws.writeLock.Lock()
+	defer ws.writeLock.Unlock()
+	_, err := ws.Conn.Write(append(frame, payload...))
+	return err
+}
@@ -0,0 +1,6 @@
+//go:build ssh
+
+package main
+
+// Built with -tags ssh, outbound proxies can be SSH servers (needs golang.org/x/crypto in GOPATH)
+import _ "proxy/sshupstream"
@@ -0,0 +1,136 @@
+//go:build ssh
+
+// Package sshupstream adds outbound proxies of type "ssh", tunneling through direct-tcpip channels
+package sshupstream
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"proxy/socks5"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func init() {
+	socks5.RegisterUpstreamTransport("ssh", transport{})
+}
+
+type transport struct{}
+
+// Private keys are parsed once per file
+var signers = make(map[string]ssh.Signer)
+var signerLock sync.Mutex
+
+// Validate requires a user, a key or password and the server's host key fingerprint
+func (transport) Validate(proxy socks5.ProxyInfo) error {
+	if len(proxy.Username) == 0 {
+		return fmt.Errorf("ssh proxy without a username: %s", proxy.Host)
+	}
+	if len(proxy.Key) == 0 && len(proxy.Password) == 0 {
+		return fmt.Errorf("ssh proxy without a key or password: %s", proxy.Host)
+	}
+	if !strings.HasPrefix(proxy.HostKey, "SHA256:") {
+		// Without a pinned host key anyone in the path could read the tunnel
+		return fmt.Errorf("ssh proxy without a SHA256 host key fingerprint: %s", proxy.Host)
+	}
+	if len(proxy.Key) > 0 {
+		_, err := signer(proxy.Key)
+		if err != nil {
+			return fmt.Errorf("ssh proxy key for %s: %s", proxy.Host, err.Error())
+		}
+	}
+	return nil
+}
+
+// Connect logs in over the connection and opens a direct-tcpip channel to host:port
+func (transport) Connect(proxy socks5.ProxyInfo, connection net.Conn, host string, port int) (net.Conn, error) {
+	config := &ssh.ClientConfig{User: proxy.Username, HostKeyCallback: hostKey(proxy.HostKey)}
+	if len(proxy.Key) > 0 {
+		key, err := signer(proxy.Key)
+		if err != nil {
+			return nil, err
+		}
+		config.Auth = append(config.Auth, ssh.PublicKeys(key))
+	}
+	if len(proxy.Password) > 0 {
+		config.Auth = append(config.Auth, ssh.Password(proxy.Password))
+	}
+	client, channels, requests, err := ssh.NewClientConn(connection, net.JoinHostPort(proxy.Host, strconv.Itoa(proxy.Port)), config)
+	if err != nil {
+		var tampered *socks5.ErrUpstreamTampered
+		if errors.As(err, &tampered) {
+			return nil, tampered
+		}
+		// The ssh package only says so in the message
+		if strings.Contains(err.Error(), "unable to authenticate") {
+			return nil, fmt.Errorf("%w: %s (%s)", socks5.ErrAuthFailed, proxy.Host, err.Error())
+		}
+		return nil, err
+	}
+	tunnel := ssh.NewClient(client, channels, requests)
+	channel, err := tunnel.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		tunnel.Close()
+		var refused *ssh.OpenChannelError
+		if errors.As(err, &refused) {
+			switch refused.Reason {
+			case ssh.Prohibited:
+				// Connection not allowed by ruleset
+				return nil, &socks5.ErrCommandFailed{Proxy: proxy.Host, Code: 0x02}
+			case ssh.ConnectionFailed:
+				// Connection refused
+				return nil, &socks5.ErrCommandFailed{Proxy: proxy.Host, Code: 0x05}
+			}
+			return nil, &socks5.ErrCommandFailed{Proxy: proxy.Host, Code: 0x01}
+		}
+		return nil, err
+	}
+	return &channelConn{Conn: channel, client: tunnel}, nil
+}
+
+// Parse a private key file, or return the one parsed before
+func signer(file string) (ssh.Signer, error) {
+	signerLock.Lock()
+	defer signerLock.Unlock()
+	if key, ok := signers[file]; ok {
+		return key, nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		return nil, err
+	}
+	signers[file] = key
+	return key, nil
+}
+
+// Accept only the server key with the configured fingerprint
+func hostKey(fingerprint string) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if ssh.FingerprintSHA256(key) != fingerprint {
+			return &socks5.ErrUpstreamTampered{Proxy: hostname, Reason: "host key " + ssh.FingerprintSHA256(key)}
+		}
+		return nil
+	}
+}
+
+// Channel to the destination that closes the SSH connection along with it
+type channelConn struct {
+	net.Conn
+	client *ssh.Client
+}
+
+// Close the channel and the SSH connection under it
+func (ctx *channelConn) Close() error {
+	err := ctx.Conn.Close()
+	ctx.client.Close()
+	return err
+}
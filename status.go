@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"proxy/failover"
+	"proxy/plugins"
+	"proxy/socks5"
+	"runtime"
+	"time"
+)
+
+// Version of the build (set with -ldflags "-X main.version=...")
+var version = "dev"
+
+// Status of the instance written for orchestration tooling
+type Status struct {
+	Version     string           `json:"version"`
+	GoVersion   string           `json:"go_version"`
+	PoolVersion int              `json:"pool_version"`
+	PID         int              `json:"pid"`
+	Started     time.Time        `json:"started"`
+	Updated     time.Time        `json:"updated"`
+	Failover    string           `json:"failover,omitempty"`
+	Plugins     []string         `json:"plugins,omitempty"`
+	Listeners   []ListenerStatus `json:"listeners"`
+}
+
+// ListenerStatus summarizing how a listener is configured and what it has loaded
+type ListenerStatus struct {
+	Name          string         `json:"name,omitempty"`
+	Tenant        string         `json:"tenant,omitempty"`
+	Addresses     []string       `json:"addresses"`
+	Protocols     []string       `json:"protocols"`
+	TLS           bool           `json:"tls"`
+	Credentials   int            `json:"credentials"`
+	Origins       int            `json:"origins"`
+	FilterReady   bool           `json:"filter_ready"`
+	FilterDomains int            `json:"filter_domains"`
+	Categories    map[string]int `json:"categories,omitempty"`
+	Proxies       int            `json:"proxies"`
+	Eligible      int            `json:"eligible"`
+	Quarantined   int            `json:"quarantined"`
+	Sessions      int            `json:"sessions"`
+}
+
+// Take a snapshot of the instance
+func status(contexts []*socks5.Context, pair *failover.Pair, started time.Time) Status {
+	report := Status{
+		Version:     version,
+		GoVersion:   runtime.Version(),
+		PoolVersion: socks5.PoolVersion,
+		PID:         os.Getpid(),
+		Started:     started,
+		Updated:     time.Now(),
+		Plugins:     plugins.Names(),
+		Listeners:   []ListenerStatus{},
+	}
+	if pair != nil {
+		report.Failover = "standby"
+		if pair.Active() {
+			report.Failover = "active"
+		}
+	}
+	for _, ctx := range contexts {
+		listener := ListenerStatus{
+			Name:        ctx.Name,
+			Tenant:      ctx.TenantName(),
+			Addresses:   ctx.Addresses(),
+			Protocols:   protocols(ctx),
+			TLS:         ctx.TLSConfig != nil,
+			Credentials: len(ctx.Credentials.Users),
+			Origins:     len(ctx.Origins.Classes),
+			FilterReady: ctx.FilterReady(),
+			Categories:  make(map[string]int),
+			Proxies:     len(ctx.Proxies.List()),
+			Eligible:    ctx.Proxies.Eligible(),
+			Quarantined: len(ctx.Proxies.Quarantines()),
+			Sessions:    len(ctx.Sessions()),
+		}
+		for _, entry := range ctx.FilterEntries() {
+			listener.FilterDomains++
+			if len(entry.Category) > 0 {
+				listener.Categories[entry.Category]++
+			}
+		}
+		report.Listeners = append(report.Listeners, listener)
+	}
+	return report
+}
+
+// Protocols a listener accepts clients with
+func protocols(ctx *socks5.Context) []string {
+	if ctx.TProxy {
+		return []string{"tproxy"}
+	}
+	if ctx.Transparent {
+		return []string{"transparent"}
+	}
+	accepted := []string{"http"}
+	if !ctx.HTTPOnly {
+		accepted = []string{"socks4", "socks5"}
+		if ctx.Socks6 {
+			accepted = append(accepted, "socks6")
+		}
+		if ctx.HTTPConnect {
+			accepted = append(accepted, "http")
+		}
+	}
+	if len(ctx.WebSocket) > 0 {
+		accepted = append(accepted, "websocket")
+	}
+	return accepted
+}
+
+// Write the status file, replacing it in one step so readers never see a partial file
+func writeStatus(file string, report Status) error {
+	data, err := json.MarshalIndent(report, "", " ")
+	if err != nil {
+		return err
+	}
+	temp, err := os.CreateTemp(filepath.Dir(file), ".status-*")
+	if err != nil {
+		return err
+	}
+	_, err = temp.Write(data)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), file)
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+	}
+	return err
+}
+
+// Print what each listener has loaded once the blacklists are active (or a minute has passed)
+func startupReport(contexts []*socks5.Context, pair *failover.Pair, logs chan string) {
+	deadline := time.Now().Add(time.Minute)
+	for time.Now().Before(deadline) {
+		ready := true
+		for _, ctx := range contexts {
+			ready = ready && ctx.FilterReady()
+		}
+		if ready {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	report := status(contexts, pair, time.Now())
+	for _, listener := range report.Listeners {
+		name := listener.Name
+		if len(name) == 0 {
+			name = listener.Addresses[0]
+		}
+		logs <- fmt.Sprintf(" [*] Listener %s: %d addresses, %d blacklist entries, %d/%d outbound proxies eligible, %d users\n", name, len(listener.Addresses), listener.FilterDomains, listener.Eligible, listener.Proxies, listener.Credentials)
+	}
+}
+
+// Keep the status file current
+func statusFile(file string, interval time.Duration, contexts []*socks5.Context, pair *failover.Pair, logs chan string) {
+	started := time.Now()
+	for {
+		err := writeStatus(file, status(contexts, pair, started))
+		if err != nil {
+			logs <- fmt.Sprintf(" [!] Failed to write status: %s\n", err.Error())
+		}
+		time.Sleep(interval)
+	}
+}
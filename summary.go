@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"proxy/socks5"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Distinct destinations counted individually, the rest are summed under "(other)" so long runs stay bounded
+const summaryHosts = 10000
+
+// Usage counts for a destination or an outbound proxy
+type Usage struct {
+	Name        string `json:"name"`
+	Connections int    `json:"connections"`
+	Sent        uint64 `json:"sent"`
+	Received    uint64 `json:"received"`
+}
+
+// Summary of a run, written when the proxy exits
+type Summary struct {
+	Started      time.Time `json:"started"`
+	Stopped      time.Time `json:"stopped"`
+	Uptime       string    `json:"uptime"`
+	Connections  int       `json:"connections"`
+	Failed       int       `json:"failed"`
+	Blocked      int       `json:"blocked"`
+	Sent         uint64    `json:"sent"`
+	Received     uint64    `json:"received"`
+	Destinations []Usage   `json:"top_destinations"`
+	Upstreams    []Usage   `json:"upstreams"`
+}
+
+// Collects session events from every listener into a summary
+type summaryCollector struct {
+	lock         sync.Mutex
+	summary      Summary
+	destinations map[string]*Usage
+	upstreams    map[string]*Usage
+}
+
+// Start counting now
+func newSummaryCollector() *summaryCollector {
+	return &summaryCollector{
+		summary:      Summary{Started: time.Now()},
+		destinations: make(map[string]*Usage),
+		upstreams:    make(map[string]*Usage),
+	}
+}
+
+// Find or create the usage entry for a name
+func usage(entries map[string]*Usage, name string, limit int) *Usage {
+	entry, ok := entries[name]
+	if ok {
+		return entry
+	}
+	if limit > 0 && len(entries) >= limit {
+		name = "(other)"
+		if entry, ok = entries[name]; ok {
+			return entry
+		}
+	}
+	entry = &Usage{Name: name}
+	entries[name] = entry
+	return entry
+}
+
+// HandleEvent counts opened sessions, failures and the bytes relayed once sessions close
+func (ctx *summaryCollector) HandleEvent(event socks5.Event) {
+	proxy := event.Proxy
+	if len(proxy) == 0 {
+		proxy = "direct"
+	}
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	switch event.Type {
+	case "open":
+		ctx.summary.Connections++
+		usage(ctx.destinations, event.Host, summaryHosts).Connections++
+		usage(ctx.upstreams, proxy, 0).Connections++
+	case "close":
+		ctx.summary.Sent += event.Sent
+		ctx.summary.Received += event.Received
+		for _, entry := range []*Usage{usage(ctx.destinations, event.Host, summaryHosts), usage(ctx.upstreams, proxy, 0)} {
+			entry.Sent += event.Sent
+			entry.Received += event.Received
+		}
+	case "failed":
+		ctx.summary.Failed++
+		if event.Block != nil {
+			ctx.summary.Blocked++
+		}
+	}
+}
+
+// Sort usage by connections (then bytes), keeping at most top entries (0 keeps all)
+func ranked(entries map[string]*Usage, top int) []Usage {
+	list := make([]Usage, 0, len(entries))
+	for _, entry := range entries {
+		list = append(list, *entry)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Connections != list[j].Connections {
+			return list[i].Connections > list[j].Connections
+		}
+		return list[i].Sent+list[i].Received > list[j].Sent+list[j].Received
+	})
+	if top > 0 && len(list) > top {
+		list = list[:top]
+	}
+	return list
+}
+
+// Finish the summary with the busiest destinations and every outbound proxy used, counting the bytes of sessions still open
+func (ctx *summaryCollector) finish(top int, contexts []*socks5.Context) Summary {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	for _, server := range contexts {
+		// Sessions leave the list before their close event, so none is counted twice
+		for _, client := range server.Sessions() {
+			proxy := client.Proxy.Host
+			if len(proxy) == 0 {
+				proxy = "direct"
+			}
+			sent, received := atomic.LoadUint64(&client.Client.ReadCount), atomic.LoadUint64(&client.Remote.ReadCount)
+			ctx.summary.Sent += sent
+			ctx.summary.Received += received
+			for _, entry := range []*Usage{usage(ctx.destinations, client.Remote.Host, summaryHosts), usage(ctx.upstreams, proxy, 0)} {
+				entry.Sent += sent
+				entry.Received += received
+			}
+		}
+	}
+	summary := ctx.summary
+	summary.Stopped = time.Now()
+	summary.Uptime = summary.Stopped.Sub(summary.Started).Round(time.Second).String()
+	summary.Destinations = ranked(ctx.destinations, top)
+	summary.Upstreams = ranked(ctx.upstreams, 0)
+	return summary
+}
+
+// Human readable byte count
+func byteCount(count uint64) string {
+	const unit = 1024
+	if count < unit {
+		return fmt.Sprintf("%d B", count)
+	}
+	value, prefix := float64(count)/unit, 0
+	for value >= unit && prefix < 4 {
+		value /= unit
+		prefix++
+	}
+	return fmt.Sprintf("%.1f %ciB", value, "KMGTP"[prefix])
+}
+
+// Print the summary (the logger may not get to run again before exit, so this prints directly)
+func printSummary(summary Summary) {
+	fmt.Printf(" [*] Summary: up %s, %d connections (%d failed, %d blocked), %s sent, %s received\n", summary.Uptime, summary.Connections, summary.Failed, summary.Blocked, byteCount(summary.Sent), byteCount(summary.Received))
+	for _, destination := range summary.Destinations {
+		fmt.Printf(" [*] Destination: %s (%d connections, %s)\n", destination.Name, destination.Connections, byteCount(destination.Sent+destination.Received))
+	}
+	for _, upstream := range summary.Upstreams {
+		fmt.Printf(" [*] Upstream: %s (%d connections, %s)\n", upstream.Name, upstream.Connections, byteCount(upstream.Sent+upstream.Received))
+	}
+}
+
+// Write the summary as a JSON report
+func writeSummary(file string, summary Summary) error {
+	data, err := json.MarshalIndent(summary, "", " ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, data, 0644)
+}
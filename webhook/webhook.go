@@ -0,0 +1,114 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"proxy/socks5"
+	"strings"
+	"time"
+)
+
+// Hook describing where to send events and which events to send
+type Hook struct {
+	URL      string   `json:"url"`
+	Events   []string `json:"events"`
+	Domains  []string `json:"domains"`
+	Users    []string `json:"users"`
+	MinBytes uint64   `json:"min_bytes"`
+}
+
+// Matches an event against the criteria of a hook (empty criteria match everything)
+func (hook *Hook) Matches(event socks5.Event) bool {
+	if len(hook.Events) > 0 && !contains(hook.Events, event.Type) {
+		return false
+	}
+	if len(hook.Users) > 0 && !contains(hook.Users, event.User) {
+		return false
+	}
+	if event.Sent+event.Received < hook.MinBytes {
+		return false
+	}
+	if len(hook.Domains) > 0 {
+		// A domain matches itself and its subdomains, never names merely ending in it
+		host := strings.TrimSuffix(strings.ToLower(event.Host), ".")
+		for _, domain := range hook.Domains {
+			domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+			if host == domain || strings.HasSuffix(host, "."+domain) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func contains(list []string, item string) bool {
+	for _, s := range list {
+		if s == item {
+			return true
+		}
+	}
+	return false
+}
+
+// Webhooks struct containing the configured hooks
+type Webhooks struct {
+	Hooks  []Hook
+	Logger chan string
+	client http.Client
+}
+
+// LoadFile retrieves the webhook list from a file
+func (ctx *Webhooks) LoadFile(file string) bool {
+	input, err := os.Open(file)
+	if err != nil {
+		return false
+	}
+	defer input.Close()
+	finfo, err := input.Stat()
+	if err != nil {
+		return false
+	}
+	data := make([]byte, finfo.Size())
+	_, err = input.Read(data)
+	if err != nil {
+		return false
+	}
+	err = json.Unmarshal(data, &ctx.Hooks)
+	if err != nil {
+		return false
+	}
+	ctx.client.Timeout = 10 * time.Second
+	return true
+}
+
+// HandleEvent posts the event to every matching hook in the background
+func (ctx *Webhooks) HandleEvent(event socks5.Event) {
+	for i := range ctx.Hooks {
+		if ctx.Hooks[i].Matches(event) {
+			go ctx.post(ctx.Hooks[i].URL, event)
+		}
+	}
+}
+
+// Send an event to a URL as JSON
+func (ctx *Webhooks) post(url string, event socks5.Event) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	resp, err := ctx.client.Post(url, "application/json", bytes.NewReader(body))
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode < 300 {
+			return
+		}
+		err = fmt.Errorf("status %d", resp.StatusCode)
+	}
+	if ctx.Logger != nil {
+		ctx.Logger <- fmt.Sprintf(" [!] Webhook failed: %s (%s)\n", url, err.Error())
+	}
+}